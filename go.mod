@@ -1,4 +1,4 @@
-module mysql-auto-db-proxy
+module github.com/Ibmurai/mysql-auto-db-proxy
 
 go 1.21.0
 
@@ -7,6 +7,7 @@ toolchain go1.24.2
 require (
 	github.com/go-sql-driver/mysql v1.9.3
 	github.com/sirupsen/logrus v1.9.3
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Ibmurai/mysql-auto-db-proxy/proxy"
+	"github.com/sirupsen/logrus"
+)
+
+// logFile is the file LOG_OUTPUT names, reopened after rotation tools moved
+// it away
+type logFile struct {
+	path string
+	file *os.File
+}
+
+// openLogFile opens a log file for appending, creating it if needed
+func openLogFile(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	return file, nil
+}
+
+// Reopen switches logging to a new file at the same path and closes the old
+// one. If the new file cannot be opened, logging carries on to the old one.
+func (l *logFile) Reopen() error {
+	file, err := openLogFile(l.path)
+	if err != nil {
+		return err
+	}
+	logrus.SetOutput(file)
+	old := l.file
+	l.file = file
+	return old.Close()
+}
+
+// setupLogging configures logrus from the log level, format and output. It
+// returns the log file when LOG_OUTPUT names one, nil otherwise.
+func setupLogging(config proxy.Config) (*logFile, error) {
+	logrus.SetLevel(parseLogLevel(config.LogLevel))
+
+	if strings.ToLower(config.LogFormat) == "text" {
+		// Colored when the output is a terminal
+		logrus.SetFormatter(&logrus.TextFormatter{
+			FullTimestamp:   true,
+			TimestampFormat: time.RFC3339,
+		})
+	} else {
+		// Set JSON formatter for structured logging
+		logrus.SetFormatter(&logrus.JSONFormatter{
+			TimestampFormat: time.RFC3339,
+		})
+	}
+
+	switch config.LogOutput {
+	case "", "stderr":
+		logrus.SetOutput(os.Stderr)
+	case "stdout":
+		logrus.SetOutput(os.Stdout)
+	default:
+		file, err := openLogFile(config.LogOutput)
+		if err != nil {
+			return nil, err
+		}
+		logrus.SetOutput(file)
+		return &logFile{path: config.LogOutput, file: file}, nil
+	}
+	return nil, nil
+}
+
+// parseLogLevel returns the logrus level LOG_LEVEL names, info if unknown
+func parseLogLevel(level string) logrus.Level {
+	switch strings.ToLower(level) {
+	case "debug":
+		return logrus.DebugLevel
+	case "info":
+		return logrus.InfoLevel
+	case "warn", "warning":
+		return logrus.WarnLevel
+	case "error":
+		return logrus.ErrorLevel
+	case "fatal":
+		return logrus.FatalLevel
+	case "panic":
+		return logrus.PanicLevel
+	default:
+		return logrus.InfoLevel
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Ibmurai/mysql-auto-db-proxy/proxy"
+	"github.com/sirupsen/logrus"
+)
+
+// restoreLogging puts the standard logger back as it was when the test ends
+func restoreLogging(t *testing.T) {
+	logger := logrus.StandardLogger()
+	formatter, out, level := logger.Formatter, logger.Out, logger.Level
+	t.Cleanup(func() {
+		logrus.SetFormatter(formatter)
+		logrus.SetOutput(out)
+		logrus.SetLevel(level)
+	})
+}
+
+func TestSetupLoggingFormat(t *testing.T) {
+	restoreLogging(t)
+	for format, want := range map[string]string{"": "json", "json": "json", "TEXT": "text"} {
+		config := proxy.DefaultConfig()
+		config.LogFormat = format
+		if _, err := setupLogging(config); err != nil {
+			t.Fatalf("setupLogging: %v", err)
+		}
+		var got string
+		switch logrus.StandardLogger().Formatter.(type) {
+		case *logrus.JSONFormatter:
+			got = "json"
+		case *logrus.TextFormatter:
+			got = "text"
+		}
+		if got != want {
+			t.Errorf("LOG_FORMAT %q gives a %s formatter, want %s", format, got, want)
+		}
+	}
+}
+
+func TestSetupLoggingOutput(t *testing.T) {
+	restoreLogging(t)
+	for output, want := range map[string]*os.File{"": os.Stderr, "stderr": os.Stderr, "stdout": os.Stdout} {
+		config := proxy.DefaultConfig()
+		config.LogOutput = output
+		if logs, err := setupLogging(config); err != nil || logs != nil {
+			t.Fatalf("setupLogging = %v, %v", logs, err)
+		}
+		if logrus.StandardLogger().Out != want {
+			t.Errorf("LOG_OUTPUT %q logs to %v", output, logrus.StandardLogger().Out)
+		}
+	}
+
+	// A file is created, and appended to
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	if err := os.WriteFile(path, []byte("earlier\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config := proxy.DefaultConfig()
+	config.LogOutput = path
+	logs, err := setupLogging(config)
+	if err != nil || logs == nil {
+		t.Fatalf("setupLogging = %v, %v", logs, err)
+	}
+	logrus.Info("before rotation")
+
+	// and reopened once a rotation tool moved it away
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := logs.Reopen(); err != nil {
+		t.Fatalf("Reopen: %v", err)
+	}
+	logrus.Info("after rotation")
+	logs.file.Close()
+
+	rotated, _ := os.ReadFile(path + ".1")
+	if !strings.HasPrefix(string(rotated), "earlier\n") || !strings.Contains(string(rotated), `"msg":"before rotation"`) {
+		t.Fatalf("rotated file holds %q", rotated)
+	}
+	current, _ := os.ReadFile(path)
+	if !strings.Contains(string(current), `"msg":"after rotation"`) || strings.Contains(string(current), "before rotation") {
+		t.Fatalf("new file holds %q", current)
+	}
+
+	config.LogOutput = filepath.Join(t.TempDir(), "missing", "proxy.log")
+	if _, err := setupLogging(config); err == nil {
+		t.Fatal("logged to a file in a missing directory")
+	}
+}
+
+func TestParseLogLevel(t *testing.T) {
+	for level, want := range map[string]logrus.Level{
+		"debug":   logrus.DebugLevel,
+		"WARNING": logrus.WarnLevel,
+		"error":   logrus.ErrorLevel,
+		"":        logrus.InfoLevel,
+		"verbose": logrus.InfoLevel,
+	} {
+		if got := parseLogLevel(level); got != want {
+			t.Errorf("parseLogLevel(%q) = %s, want %s", level, got, want)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// adminHandler returns the HTTP handler for the admin API
+func (p *Proxy) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pause", p.handlePause)
+	mux.HandleFunc("/resume", p.handleResume)
+	mux.HandleFunc("/status", p.handleStatus)
+	mux.HandleFunc("/stats", p.handleStats)
+	mux.HandleFunc("/databases", p.handleDatabases)
+	mux.HandleFunc("/databases/", p.handleDatabase)
+	return mux
+}
+
+// serveAdmin runs the admin HTTP server until Shutdown stops it or it fails
+func (p *Proxy) serveAdmin(addr string) {
+	server := newHTTPServer(addr, p.adminHandler())
+	if !p.trackServer(server) {
+		return
+	}
+
+	p.log.WithField("admin_addr", addr).Info("Admin API listening")
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		p.log.WithError(err).Error("Admin API stopped")
+	}
+}
+
+// handlePause stops new connections from proceeding to the handshake
+func (p *Proxy) handlePause(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p.pause.Pause()
+	p.log.Info("Proxy paused, holding new connections")
+	p.handleStatus(w, r)
+}
+
+// handleResume releases held connections and resumes normal operation
+func (p *Proxy) handleResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p.pause.Resume()
+	p.log.Info("Proxy resumed")
+	p.handleStatus(w, r)
+}
+
+// handleStatus reports the proxy's runtime state
+func (p *Proxy) handleStatus(w http.ResponseWriter, r *http.Request) {
+	paused, queued := p.pause.State()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"paused":             paused,
+		"queued_connections": queued,
+		"recent_rejections":  p.rejections.recent(),
+		"dry_run":            p.config.DryRun,
+	})
+}
+
+// handleStats reports the proxy's activity and its connected clients
+func (p *Proxy) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"stats":       p.stats(),
+		"connections": p.connectionStats(),
+	})
+}
+
+// handleDatabases lists the databases the proxy has created
+func (p *Proxy) handleDatabases(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"databases": p.created.list(),
+	})
+}
+
+// handleDatabase shows or drops one database. Only databases the proxy
+// created may be dropped, unless force=1 is given; with several backends,
+// backend=host:port then says which one to drop the database from.
+func (p *Proxy) handleDatabase(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/databases/")
+	if err := validateDatabaseName(name, p.config.StrictDBNames); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	database, created := p.created.get(name)
+	backend := r.URL.Query().Get("backend")
+	if created && backend != "" && backend != database.Backend {
+		created = false
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !created {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "database was not created by the proxy"})
+			return
+		}
+		writeJSON(w, http.StatusOK, database)
+	case http.MethodDelete:
+		if !created && r.URL.Query().Get("force") != "1" {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "database was not created by the proxy, use force=1 to drop it anyway"})
+			return
+		}
+		if !created {
+			addr, err := p.forcedDropBackend(backend)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			database = createdDatabase{Name: name, Backend: addr}
+		}
+		if err := p.dropDatabase(r.Context(), database); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		p.log.WithFields(logrus.Fields{
+			"database": name,
+			"backend":  database.Backend,
+			"forced":   !created,
+		}).Info("Database dropped through the admin API")
+		if p.audit != nil && !database.DryRun {
+			p.audit.RecordDrop(dropAuditEvent{
+				Database:   name,
+				Backend:    database.Backend,
+				Reason:     "admin_api",
+				Timestamp:  time.Now().UTC(),
+				LastUsedAt: database.LastUsedAt.UTC(),
+			})
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"dropped": name})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// forcedDropBackend returns the backend a database the proxy did not create
+// is dropped from: the one given, which must be configured, or else the only
+// one. The registry cannot tell which of several backends has the database.
+func (p *Proxy) forcedDropBackend(backend string) (string, error) {
+	if backend == "" {
+		if len(p.backendEnsurers) > 1 {
+			return "", errors.New("several backends are configured, give backend=host:port with force=1")
+		}
+		return p.backendAddr(), nil
+	}
+	if _, ok := p.backendEnsurers[backend]; !ok {
+		return "", fmt.Errorf("backend %s is not configured", backend)
+	}
+	return backend, nil
+}
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// adminRequest sends a request to the admin API of p, returning the status
+// and the body
+func adminRequest(p *Proxy, method, path string) (int, string) {
+	recorder := httptest.NewRecorder()
+	p.adminHandler().ServeHTTP(recorder, httptest.NewRequest(method, path, nil))
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestAdminDatabases(t *testing.T) {
+	backend, legacy := startFakeMySQL(t), startFakeMySQL(t)
+	config := testConfig(backend)
+	config.Backends = []string{"legacy=mysql://" + legacy.addr()}
+	config.DatabaseRoutes = []string{"legacy_=legacy"}
+	p, addr := startProxy(t, config)
+	mustConnect(t, addr, testHandshake{user: "root", database: "orders"})
+	routed := testHandshake{user: "root", auth: []byte("scrambled"), database: "legacy_orders"}
+	c, _ := connect(t, addr, routed)
+	if response := c.send(3, routed.auth); response == nil || response.Payload[0] != 0x00 {
+		t.Fatalf("routed handshake answered with %s", describePacket(response))
+	}
+
+	// The databases the proxy created are listed with their backend
+	status, body := adminRequest(p, http.MethodGet, "/databases")
+	var listed struct{ Databases []createdDatabase }
+	if err := json.Unmarshal([]byte(body), &listed); status != http.StatusOK || err != nil || len(listed.Databases) != 2 {
+		t.Fatalf("/databases answered %d %s", status, body)
+	}
+	backends := map[string]string{}
+	for _, database := range listed.Databases {
+		backends[database.Name] = database.Backend
+	}
+	if backends["orders"] != backend.addr() || backends["legacy_orders"] != legacy.addr() {
+		t.Fatalf("listed %v", backends)
+	}
+	if status, body := adminRequest(p, http.MethodGet, "/databases/legacy_orders"); status != http.StatusOK || !strings.Contains(body, legacy.addr()) {
+		t.Fatalf("/databases/legacy_orders answered %d %s", status, body)
+	}
+	if status, _ := adminRequest(p, http.MethodGet, "/databases/stray"); status != http.StatusNotFound {
+		t.Fatalf("a database the proxy did not create answered %d", status)
+	}
+	if status, _ := adminRequest(p, http.MethodPost, "/databases"); status != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /databases answered %d", status)
+	}
+
+	// A created database is dropped from the backend it was created on
+	backend.create("legacy_orders")
+	if status, body := adminRequest(p, http.MethodDelete, "/databases/legacy_orders"); status != http.StatusOK {
+		t.Fatalf("drop answered %d %s", status, body)
+	}
+	if legacy.hasDatabase("legacy_orders") || !backend.hasDatabase("legacy_orders") {
+		t.Fatal("the database was not dropped from its own backend")
+	}
+	if _, ok := p.created.get("legacy_orders"); ok {
+		t.Fatal("the dropped database is still listed")
+	}
+
+	// Others only with force=1, which must say which backend they are on
+	backend.create("stray")
+	legacy.create("stray")
+	if status, body := adminRequest(p, http.MethodDelete, "/databases/stray"); status != http.StatusNotFound || !strings.Contains(body, "use force=1") {
+		t.Fatalf("drop without force answered %d %s", status, body)
+	}
+	if status, body := adminRequest(p, http.MethodDelete, "/databases/stray?force=1"); status != http.StatusBadRequest || !strings.Contains(body, "give backend=host:port") {
+		t.Fatalf("forced drop without a backend answered %d %s", status, body)
+	}
+	if status, body := adminRequest(p, http.MethodDelete, "/databases/stray?force=1&backend=127.0.0.1:1"); status != http.StatusBadRequest || !strings.Contains(body, "is not configured") {
+		t.Fatalf("forced drop from an unknown backend answered %d %s", status, body)
+	}
+	if !backend.hasDatabase("stray") || !legacy.hasDatabase("stray") {
+		t.Fatal("a refused drop dropped the database")
+	}
+	if status, body := adminRequest(p, http.MethodDelete, "/databases/stray?force=1&backend="+legacy.addr()); status != http.StatusOK {
+		t.Fatalf("forced drop answered %d %s", status, body)
+	}
+	if legacy.hasDatabase("stray") || !backend.hasDatabase("stray") {
+		t.Fatal("the forced drop did not drop from the backend given")
+	}
+
+	// A database created on one backend is not dropped from another as if
+	// it had been created there, and stays listed
+	legacy.create("orders")
+	if status, _ := adminRequest(p, http.MethodDelete, "/databases/orders?backend="+legacy.addr()); status != http.StatusNotFound {
+		t.Fatalf("drop from another backend answered %d", status)
+	}
+	if status, _ := adminRequest(p, http.MethodDelete, "/databases/orders?force=1&backend="+legacy.addr()); status != http.StatusOK {
+		t.Fatalf("forced drop from another backend answered %d", status)
+	}
+	if legacy.hasDatabase("orders") || !backend.hasDatabase("orders") {
+		t.Fatal("the forced drop did not drop from the backend given")
+	}
+	if database, ok := p.created.get("orders"); !ok || database.Backend != backend.addr() {
+		t.Fatal("the database created on the default backend is no longer listed")
+	}
+}
+
+func TestAdminForcedDropSingleBackend(t *testing.T) {
+	backend := startFakeMySQL(t)
+	p, _ := startProxy(t, testConfig(backend))
+	backend.create("stray")
+
+	if status, body := adminRequest(p, http.MethodDelete, "/databases/stray?force=1"); status != http.StatusOK || !strings.Contains(body, `"dropped":"stray"`) {
+		t.Fatalf("forced drop answered %d %s", status, body)
+	}
+	if backend.hasDatabase("stray") {
+		t.Fatal("the forced drop left the database")
+	}
+	if status, _ := adminRequest(p, http.MethodDelete, "/databases/mysql?force=1"); status != http.StatusBadRequest {
+		t.Fatalf("dropping a system schema answered %d", status)
+	}
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"bytes"
+	"database/sql"
+
+	"github.com/sirupsen/logrus"
+)
+
+// adminCredentials are the account the proxy creates a connection's databases
+// with, when it is not the configured MYSQL_USER
+type adminCredentials struct {
+	user     string
+	password string
+}
+
+// passthroughCredentials returns the client's own credentials for creating
+// its databases when ADMIN_CREDENTIALS is "passthrough", or nil when they
+// cannot be reused and the configured admin account must be. The path taken
+// is logged.
+//
+// Only mysql_clear_password sends the password itself, and the proxy only
+// reuses it when it terminated the client's TLS, so that it never travelled
+// in the clear. mysql_native_password, caching_sha2_password and
+// sha256_password send a scramble of the password bound to the nonce of the
+// greeting the client saw, which MySQL will not accept on another connection,
+// so clients using them fall back to the admin account.
+func passthroughCredentials(handshake *handshakeResponse, overTLS bool, logger *logrus.Entry) *adminCredentials {
+	plugin := handshake.authPlugin()
+	logger = logger.WithField("auth_plugin", plugin)
+	switch {
+	case plugin != "mysql_clear_password":
+		logger.Debug("Auth plugin does not reveal the password, creating databases with the configured admin account")
+		return nil
+	case !overTLS:
+		logger.Debug("Cleartext password was not sent over TLS, creating databases with the configured admin account")
+		return nil
+	}
+	logger.Debug("Creating databases with the client's credentials")
+	return &adminCredentials{
+		user:     handshake.Username,
+		password: string(bytes.TrimRight(handshake.AuthResponse, "\x00")),
+	}
+}
+
+// adminDB returns the pool used to check for and create the connection's
+// databases, and the function that releases it: the shared admin pool, or a
+// single connection made with the client's own credentials
+func (e *sqlEnsurer) adminDB(cc *ConnContext) (*sql.DB, func(), error) {
+	if cc.credentials == nil {
+		return e.db, func() {}, nil
+	}
+	config := e.config
+	config.MySQLUser, config.MySQLPassword = cc.credentials.user, cc.credentials.password
+	dsn, err := adminDSN(config)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return db, func() { db.Close() }, nil
+}
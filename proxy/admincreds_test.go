@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"testing"
+)
+
+func TestPassthroughCredentials(t *testing.T) {
+	for name, tc := range map[string]struct {
+		plugin  string
+		auth    string
+		overTLS bool
+		want    *adminCredentials
+		logged  string
+	}{
+		"cleartext over TLS": {
+			plugin: "mysql_clear_password", auth: "s3cret\x00", overTLS: true,
+			want:   &adminCredentials{user: "app", password: "s3cret"},
+			logged: "Creating databases with the client's credentials",
+		},
+		"cleartext in the clear": {
+			plugin: "mysql_clear_password", auth: "s3cret\x00",
+			logged: "Cleartext password was not sent over TLS, creating databases with the configured admin account",
+		},
+		"scrambled over TLS": {
+			plugin: "mysql_native_password", auth: "\x8f\x1b\x02scramble", overTLS: true,
+			logged: "Auth plugin does not reveal the password, creating databases with the configured admin account",
+		},
+		"caching_sha2_password": {
+			plugin: "caching_sha2_password", auth: "scramble", overTLS: true,
+			logged: "Auth plugin does not reveal the password, creating databases with the configured admin account",
+		},
+	} {
+		handshake, err := parseHandshakeResponse(testHandshake{user: "app", auth: []byte(tc.auth), plugin: tc.plugin}.payload())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		logger, hook := testLogger()
+		got := passthroughCredentials(handshake, tc.overTLS, logger.WithField("conn_id", 1))
+		if (got == nil) != (tc.want == nil) || got != nil && *got != *tc.want {
+			t.Errorf("%s: credentials %+v, want %+v", name, got, tc.want)
+		}
+		if entry := findEntry(hook, tc.logged); entry == nil || entry.Data["auth_plugin"] != tc.plugin {
+			t.Errorf("%s: logged %v", name, hook.AllEntries())
+		}
+	}
+}
+
+func TestPassthroughCredentialsForCreation(t *testing.T) {
+	cert, certPEM := testCertificate(t)
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.MySQLUser = "admin"
+	config.AdminCredentials = "passthrough"
+	config.ProxyTLSCert, config.ProxyTLSKey = writeCertificate(t, cert, certPEM)
+	_, addr := startProxy(t, config)
+
+	// creators returns the users whose admin connections reached MySQL,
+	// which unlike the relayed handshakes select no database
+	creators := func() map[string]int {
+		users := map[string]int{}
+		for _, received := range backend.receivedHandshakes() {
+			if hr, err := parseHandshakeResponse(received); err == nil && hr.Database == "" {
+				users[hr.Username]++
+			}
+		}
+		return users
+	}
+	before := creators()
+
+	connectTLS := func(handshake testHandshake) {
+		c := dialTestClient(t, addr)
+		sslRequest := testHandshake{capabilities: testClientCapabilities | clientSSL}.payload()[:32]
+		if err := writePacket(c.conn, newPacket(1, sslRequest)); err != nil {
+			t.Fatalf("write SSLRequest: %v", err)
+		}
+		tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatalf("TLS handshake: %v", err)
+		}
+		c = &testClient{t: t, conn: tlsConn, greeting: c.greeting}
+		handshake.capabilities = testClientCapabilities | clientSSL
+		if response := c.send(2, handshake.payload()); response == nil || response.Payload[0] != 0x00 {
+			t.Fatalf("handshake answered with %s", describePacket(response))
+		}
+	}
+
+	// A cleartext password sent over the proxy's TLS creates the database
+	// as the client
+	handshake := testHandshake{user: "app", auth: []byte("s3cret\x00"), plugin: "mysql_clear_password", database: "secure"}
+	connectTLS(handshake)
+	if after := creators(); !backend.hasDatabase("secure") || after["app"] != before["app"]+1 || after["admin"] != before["admin"] {
+		t.Fatalf("admin connections made by %v, before %v", after, before)
+	}
+
+	// The same password in the clear falls back to the configured account
+	handshake.database = "plaintext"
+	before = creators()
+	mustConnect(t, addr, handshake)
+	if after := creators(); !backend.hasDatabase("plaintext") || after["app"] != before["app"] {
+		t.Fatalf("admin connections made by %v, before %v", after, before)
+	}
+
+	// as does a scrambled password over TLS
+	handshake.auth, handshake.plugin, handshake.database = []byte("scrambled"), "mysql_native_password", "scrambled"
+	before = creators()
+	connectTLS(handshake)
+	if after := creators(); !backend.hasDatabase("scrambled") || after["app"] != before["app"] {
+		t.Fatalf("admin connections made by %v, before %v", after, before)
+	}
+}
@@ -0,0 +1,324 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// auditLog appends a JSON line per created or dropped database to a file,
+// from which the registry of created databases is restored when the proxy
+// restarts. The file can be reopened at its configured path, so that
+// logrotate can move it away and signal the proxy with SIGHUP, or rotated by
+// the proxy itself once it reaches maxBytes.
+type auditLog struct {
+	path string
+	log  logrus.FieldLogger
+
+	// maxBytes rotates the file once it is this large (0 never does), keeping
+	// backups rotated files
+	maxBytes int64
+	backups  int
+
+	// fsync syncs the file after every line
+	fsync bool
+
+	// carryOver returns the databases still known, which are repeated at the
+	// start of a rotated file so that it alone restores the registry
+	carryOver func() []CreationEvent
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+// carriedOverEvent repeats a creation from before a rotation
+type carriedOverEvent struct {
+	Event string `json:"event"`
+	CreationEvent
+}
+
+// openAuditLog opens, creating if needed, the configured audit log
+func openAuditLog(config Config, log logrus.FieldLogger) (*auditLog, error) {
+	a := &auditLog{
+		path:     config.AuditLogPath,
+		log:      log,
+		maxBytes: int64(config.AuditLogMaxBytes),
+		backups:  config.AuditLogBackups,
+		fsync:    config.AuditLogFsync,
+	}
+	if err := a.Reopen(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reopen opens the configured path again and swaps it in for the current
+// file, which is closed once no write is using it. A new, empty file starts
+// with the databases still known carried over, as after a rotation.
+func (a *auditLog) Reopen() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	var size int64
+	if info, err := file.Stat(); err == nil {
+		size = info.Size()
+	}
+
+	a.mu.Lock()
+	old := a.file
+	a.file, a.size = file, size
+	if size == 0 {
+		a.writeCarriedOver()
+	}
+	a.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// dropAuditEvent records a dropped database and why it was dropped
+type dropAuditEvent struct {
+	Event      string    `json:"event"`
+	Database   string    `json:"database"`
+	Backend    string    `json:"backend"`
+	Reason     string    `json:"reason"`
+	Timestamp  time.Time `json:"timestamp"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// Record appends a creation event to the audit log
+func (a *auditLog) Record(event CreationEvent) {
+	a.write(event.Database, event)
+}
+
+// RecordDrop appends a line for a database the proxy dropped on its own
+func (a *auditLog) RecordDrop(event dropAuditEvent) {
+	event.Event = "dropped"
+	a.write(event.Database, event)
+}
+
+// write appends an event about a database as a JSON line
+func (a *auditLog) write(database string, event interface{}) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		a.log.WithError(err).Error("Failed to encode audit event")
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		a.log.WithField("database", database).Warn("Audit log closed, dropping audit event")
+		return
+	}
+	n, err := a.file.Write(line)
+	a.size += int64(n)
+	if err == nil && a.fsync {
+		err = a.file.Sync()
+	}
+	if err != nil {
+		a.log.WithError(err).WithField("database", database).Error("Failed to write audit event")
+	}
+	if a.maxBytes > 0 && a.size >= a.maxBytes {
+		a.rotate()
+	}
+}
+
+// rotate renames the file to path.1, shifting older backups up and removing
+// the one beyond the limit, and starts a new file with the databases still
+// known carried over. If the new file cannot be created, writing goes on to
+// the renamed one. The caller holds a.mu.
+func (a *auditLog) rotate() {
+	if a.backups > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", a.path, a.backups))
+	}
+	for i := a.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", a.path, i), fmt.Sprintf("%s.%d", a.path, i+1))
+	}
+	if a.backups > 0 {
+		if err := os.Rename(a.path, a.path+".1"); err != nil {
+			a.log.WithError(err).Error("Failed to rotate audit log")
+			return
+		}
+	}
+
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0o640)
+	if err != nil {
+		a.log.WithError(err).Error("Failed to open rotated audit log, writing to the previous file")
+		return
+	}
+	a.file.Close()
+	a.file, a.size = file, 0
+	a.log.WithField("carried_over", a.writeCarriedOver()).Info("Rotated audit log")
+}
+
+// writeCarriedOver writes the databases still known to the start of a new
+// file, returning how many it wrote. The caller holds a.mu.
+func (a *auditLog) writeCarriedOver() int {
+	if a.carryOver == nil {
+		return 0
+	}
+	carried := 0
+	for _, event := range a.carryOver() {
+		line, err := json.Marshal(carriedOverEvent{Event: "carried_over", CreationEvent: event})
+		if err != nil {
+			continue
+		}
+		n, err := a.file.Write(append(line, '\n'))
+		a.size += int64(n)
+		if err != nil {
+			a.log.WithError(err).Error("Failed to carry databases over to the new audit log")
+			break
+		}
+		carried++
+	}
+	if a.fsync {
+		a.file.Sync()
+	}
+	return carried
+}
+
+// auditLine is any line of the audit log: a creation, carried over or not,
+// or a drop, whose fields are those of a creation
+type auditLine struct {
+	Event string `json:"event"`
+	CreationEvent
+}
+
+// readAuditLog replays the audit log at path, returning the databases created
+// and not dropped since, oldest first, and the number of lines that could not
+// be read. A missing file has no databases.
+func readAuditLog(path string) ([]CreationEvent, int, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer file.Close()
+
+	var order []string
+	created := make(map[string]CreationEvent)
+	malformed := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var line auditLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil || line.Database == "" {
+			malformed++
+			continue
+		}
+		switch line.Event {
+		case "", "carried_over":
+			if _, ok := created[line.Database]; !ok {
+				order = append(order, line.Database)
+			}
+			created[line.Database] = line.CreationEvent
+		case "dropped":
+			// A forced drop from another backend leaves the database created
+			if event, ok := created[line.Database]; ok && (line.Backend == "" || event.Backend == line.Backend) {
+				delete(created, line.Database)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, malformed, fmt.Errorf("failed to read audit log: %w", err)
+	}
+
+	events := make([]CreationEvent, 0, len(created))
+	for _, name := range order {
+		if event, ok := created[name]; ok {
+			events = append(events, event)
+			delete(created, name)
+		}
+	}
+	return events, malformed, nil
+}
+
+// Close syncs and closes the audit log
+func (a *auditLog) Close(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Sync()
+	if closeErr := a.file.Close(); err == nil {
+		err = closeErr
+	}
+	a.file = nil
+	return err
+}
+
+// reconcileRestored removes from the registry the databases restored from the
+// audit log or the state file that no longer exist on their backend,
+// recording them as dropped so that the next restart does not restore them
+// either. Backends that cannot be listed keep their databases; databases the
+// registry does not know are never added to it.
+func (p *Proxy) reconcileRestored(ctx context.Context) {
+	byBackend := make(map[string][]createdDatabase)
+	for _, database := range p.created.list() {
+		if database.Restored {
+			byBackend[database.Backend] = append(byBackend[database.Backend], database)
+		}
+	}
+
+	for backend, databases := range byBackend {
+		logger := p.log.WithField("backend", backend)
+		ensurer, ok := p.backendEnsurers[backend]
+		if !ok {
+			logger.WithField("databases", len(databases)).Warn("Restored databases belong to a backend that is not configured, keeping them")
+			continue
+		}
+		existing, err := ensurer.existingDatabases(ctx)
+		if err != nil {
+			logger.WithError(err).Warn("Cannot check the restored databases against MySQL, keeping them")
+			continue
+		}
+
+		stale := 0
+		for _, database := range databases {
+			if existing[ensurer.databaseKey(database.Name)] {
+				continue
+			}
+			current, ok := p.created.get(database.Name)
+			if !ok || !current.Restored {
+				// Dropped or created again since it was restored
+				continue
+			}
+			stale++
+			p.created.remove(database.Name)
+			if p.audit != nil {
+				p.audit.RecordDrop(dropAuditEvent{
+					Database:   database.Name,
+					Backend:    backend,
+					Reason:     "missing",
+					Timestamp:  time.Now().UTC(),
+					LastUsedAt: database.LastUsedAt.UTC(),
+				})
+			}
+			logger.WithField("database", database.Name).Info("Restored database no longer exists, forgetting it")
+		}
+		logger.WithFields(logrus.Fields{
+			"restored": len(databases),
+			"stale":    stale,
+		}).Info("Checked restored databases against MySQL")
+	}
+}
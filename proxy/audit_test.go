@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// auditDatabases returns "event:database" for each line of the audit log at path
+func auditDatabases(t *testing.T, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read audit log: %v", err)
+	}
+	var databases []string
+	for _, line := range strings.Fields(string(data)) {
+		var event auditLine
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("malformed audit line %q: %v", line, err)
+		}
+		databases = append(databases, event.Event+":"+event.Database)
+	}
+	return databases
+}
+
+func TestAuditLogReopenAfterRename(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.AuditLogPath = filepath.Join(t.TempDir(), "audit.log")
+	p, addr := startProxy(t, config)
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("USE before")
+
+	// logrotate moves the file away, then signals the proxy
+	if err := os.Rename(config.AuditLogPath, config.AuditLogPath+".1"); err != nil {
+		t.Fatal(err)
+	}
+	p.ReopenLogs()
+	c.mustQuery("USE after")
+
+	if got := auditDatabases(t, config.AuditLogPath+".1"); !equalStrings(got, []string{":before"}) {
+		t.Fatalf("rotated file holds %q", got)
+	}
+	// The fresh file alone restores what the proxy created
+	if got := auditDatabases(t, config.AuditLogPath); !equalStrings(got, []string{"carried_over:before", ":after"}) {
+		t.Fatalf("new file holds %q", got)
+	}
+}
+
+func TestAuditLogReopenDuringWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	config := DefaultConfig()
+	config.AuditLogPath = path
+	logger, _ := testLogger()
+	audit, err := openAuditLog(config, logger)
+	if err != nil {
+		t.Fatalf("openAuditLog: %v", err)
+	}
+	defer audit.Close(context.Background())
+
+	var wg sync.WaitGroup
+	for writer := 0; writer < 4; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				audit.Record(CreationEvent{Database: fmt.Sprintf("db_%d_%d", writer, i)})
+			}
+		}(writer)
+	}
+	for i := 1; i <= 5; i++ {
+		os.Rename(path, fmt.Sprintf("%s.%d", path, i))
+		if err := audit.Reopen(); err != nil {
+			t.Fatalf("Reopen: %v", err)
+		}
+	}
+	wg.Wait()
+
+	// Every event is written whole to one of the files
+	lines := 0
+	for _, name := range []string{path, path + ".1", path + ".2", path + ".3", path + ".4", path + ".5"} {
+		if _, err := os.Stat(name); err == nil {
+			lines += len(auditDatabases(t, name))
+		}
+	}
+	if lines != 200 {
+		t.Fatalf("%d events written, want 200", lines)
+	}
+}
+
+func TestReadAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if events, malformed, err := readAuditLog(path); err != nil || len(events) != 0 || malformed != 0 {
+		t.Fatalf("readAuditLog of a missing file = %v, %d, %v", events, malformed, err)
+	}
+
+	lines := strings.Join([]string{
+		`{"event":"carried_over","database":"orders","username":"app","trigger":"handshake"}`,
+		`{"database":"billing","trigger":"use"}`,
+		`not json`,
+		`{"database":"stock","backend":"db1:3306"}`,
+		`{"event":"dropped","database":"billing","reason":"ttl"}`,
+		`{"event":"dropped","database":"stock","backend":"db2:3306","reason":"admin_api"}`,
+		`{"event":"carried_over"}`,
+		`{"database":"orders","username":"admin","trigger":"use"}`,
+	}, "\n")
+	if err := os.WriteFile(path, []byte(lines+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	events, malformed, err := readAuditLog(path)
+	if err != nil {
+		t.Fatalf("readAuditLog: %v", err)
+	}
+	if malformed != 2 {
+		t.Fatalf("%d malformed lines, want 2", malformed)
+	}
+	// A database created again is known by its latest creation, in the
+	// order it was first seen, and one dropped from another backend is kept
+	if len(events) != 2 || events[0].Database != "orders" || events[0].Username != "admin" || events[1].Database != "stock" {
+		t.Fatalf("replayed %+v", events)
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	dir := t.TempDir()
+	config := DefaultConfig()
+	config.AuditLogPath = filepath.Join(dir, "audit.log")
+	config.AuditLogMaxBytes = 200
+	config.AuditLogBackups = 2
+	logger, _ := testLogger()
+	audit, err := openAuditLog(config, logger)
+	if err != nil {
+		t.Fatalf("openAuditLog: %v", err)
+	}
+	audit.carryOver = func() []CreationEvent { return []CreationEvent{{Database: "kept"}} }
+
+	for i := 0; i < 20; i++ {
+		audit.Record(CreationEvent{Database: fmt.Sprintf("db_%02d", i)})
+	}
+	audit.Close(context.Background())
+
+	// Only the configured backups are kept
+	entries, _ := os.ReadDir(dir)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if !equalStrings(names, []string{"audit.log", "audit.log.1", "audit.log.2"}) {
+		t.Fatalf("audit log rotated into %q", names)
+	}
+
+	// and each rotated file starts with the databases still known
+	for _, name := range []string{"audit.log", "audit.log.1"} {
+		if got := auditDatabases(t, filepath.Join(dir, name)); len(got) == 0 || got[0] != "carried_over:kept" {
+			t.Fatalf("%s holds %q", name, got)
+		}
+	}
+	if got := auditDatabases(t, config.AuditLogPath); got[len(got)-1] != ":db_19" {
+		t.Fatalf("the latest file ends with %q", got[len(got)-1])
+	}
+}
+
+func TestRegistrySurvivesRestart(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.AuditLogPath = filepath.Join(t.TempDir(), "audit.log")
+
+	p, addr := startProxy(t, config)
+	c := mustConnect(t, addr, testHandshake{user: "app", database: "orders"})
+	c.mustQuery("USE billing")
+	c.conn.Close()
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	// billing is dropped while the proxy is not running
+	backend.mu.Lock()
+	delete(backend.databases, "billing")
+	backend.mu.Unlock()
+
+	p, _ = startProxy(t, config)
+	for name, trigger := range map[string]string{"orders": "handshake", "billing": "use"} {
+		database, ok := p.created.get(name)
+		if !ok || !database.Restored || database.Trigger != trigger || database.Username != "app" || database.Backend != backend.addr() {
+			t.Fatalf("restored %s as %+v, %v", name, database, ok)
+		}
+	}
+
+	// Checked against MySQL, the dropped database is forgotten
+	p.reconcileRestored(context.Background())
+	if _, ok := p.created.get("billing"); ok {
+		t.Fatal("the dropped database is still registered")
+	}
+	if _, ok := p.created.get("orders"); !ok {
+		t.Fatal("an existing database was forgotten")
+	}
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	want := []string{":orders", ":billing", "dropped:billing"}
+	if got := auditDatabases(t, config.AuditLogPath); !equalStrings(got, want) {
+		t.Fatalf("audit log holds %q, want %q", got, want)
+	}
+
+	// so that the next restart does not restore it either
+	p, _ = startProxy(t, config)
+	if _, ok := p.created.get("billing"); ok {
+		t.Fatal("the dropped database was restored")
+	}
+}
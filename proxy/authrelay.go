@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+// cachingSHA2FastAuthOK is the packet with which caching_sha2_password tells
+// the client that its cached password matched; MySQL's OK follows without a
+// client reply
+var cachingSHA2FastAuthOK = []byte{0x01, 0x03}
+
+// errUnknownDatabaseHeld reports that MySQL refused the handshake's database
+// as unknown before the client saw any of its answers. The ERR is returned
+// unforwarded, so the handshake can be replayed once the database exists.
+var errUnknownDatabaseHeld = errors.New("MySQL reported the handshake's database unknown")
+
+// relayAuth relays the authentication exchange that follows the client's
+// handshake response until MySQL accepts or refuses the client with OK or
+// ERR. Depending on the plugin there are several round trips: an auth switch,
+// caching_sha2_password's fast or full authentication, a request for the
+// server's public key. seqOffset is how far MySQL's numbering is ahead of the
+// client's; the packets exchanged with the client are recorded in sequence.
+//
+// It returns MySQL's final packet, numbered for the client and already
+// forwarded to it. An auth switch to a plugin that is not allowed is returned
+// unforwarded, with a proxyError the client should be rejected with. With
+// holdUnknownDatabase set, an ERR 1049 that is MySQL's first answer, or that
+// only follows a fast auth OK, is returned unforwarded with
+// errUnknownDatabaseHeld.
+func (p *Proxy) relayAuth(clientConn, mysqlConn net.Conn, sequence *exchangeSequence, seqOffset int, holdUnknownDatabase bool, logger *logrus.Entry) (*MySQLPacket, error) {
+	// held is a fast auth OK not yet forwarded, while the client has seen
+	// nothing from MySQL
+	var held *MySQLPacket
+	for {
+		response, err := readPacketWithTimeout(mysqlConn, p.config.HandshakeTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MySQL authentication response: %w", err)
+		}
+		if seqOffset != 0 {
+			response = newPacket(response.SequenceID-seqOffset, response.Payload)
+		}
+
+		// The server may ask the client to switch to another auth plugin
+		if plugin, ok := parseAuthSwitchRequest(response.Payload); ok && !p.authPluginAllowed(plugin) {
+			return response, newProxyError(errCategoryAccessDenied, "authentication plugin '%s' is not allowed", plugin)
+		}
+
+		if holdUnknownDatabase {
+			if len(response.Payload) > 0 && response.Payload[0] == 0xff && errPacketCode(response.Payload) == erBadDBError {
+				return response, errUnknownDatabaseHeld
+			}
+			if string(response.Payload) == string(cachingSHA2FastAuthOK) {
+				held = response
+				continue
+			}
+			holdUnknownDatabase = false
+			if held != nil {
+				if err := sequence.write(clientConn, held); err != nil {
+					return nil, fmt.Errorf("failed to forward MySQL authentication response: %w", err)
+				}
+			}
+		}
+
+		if err := sequence.write(clientConn, response); err != nil {
+			return nil, fmt.Errorf("failed to forward MySQL authentication response: %w", err)
+		}
+		p.withPacketDump(logger.WithField("response_length", len(response.Payload)), response.Payload, redactAuthExchange).
+			Debug("Forwarded server response to client")
+
+		if isOKOrErr(response.Payload) {
+			return response, nil
+		}
+		if string(response.Payload) == string(cachingSHA2FastAuthOK) {
+			continue
+		}
+
+		reply, err := readPacketWithTimeout(clientConn, p.config.HandshakeTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client authentication reply: %w", err)
+		}
+		sequence.readFrom(reply)
+		if seqOffset != 0 {
+			reply = newPacket(reply.SequenceID+seqOffset, reply.Payload)
+		}
+		if err := writePacket(mysqlConn, reply); err != nil {
+			return nil, fmt.Errorf("failed to forward client authentication reply: %w", err)
+		}
+		p.withPacketDump(logger.WithField("reply_length", len(reply.Payload)), reply.Payload, redactAll).
+			Debug("Forwarded client authentication reply to MySQL")
+	}
+}
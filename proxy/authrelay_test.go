@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAuthSwitchRequest(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		plugin  string
+		ok      bool
+	}{
+		{"switch", append([]byte("\xfecaching_sha2_password\x00"), "saltsaltsaltsaltsalt\x00"...), "caching_sha2_password", true},
+		{"old password", []byte{0xfe}, "mysql_old_password", true},
+		{"unterminated", []byte("\xfemysql_native_password"), "", false},
+		{"ok", []byte{0x00, 0x00, 0x00, 0x02, 0x00}, "", false},
+		{"empty", nil, "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if plugin, ok := parseAuthSwitchRequest(tc.payload); plugin != tc.plugin || ok != tc.ok {
+				t.Fatalf("parsed %q, %v; want %q, %v", plugin, ok, tc.plugin, tc.ok)
+			}
+		})
+	}
+}
+
+func TestAllowedAuthPlugins(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.AllowedAuthPlugins = []string{"caching_sha2_password", "mysql_native_password"}
+	_, addr := startProxy(t, config)
+
+	mustConnect(t, addr, testHandshake{user: "root", plugin: "caching_sha2_password"})
+	mustConnect(t, addr, testHandshake{user: "root"})
+	before := len(backend.receivedHandshakes())
+
+	for _, handshake := range []testHandshake{
+		{user: "root", plugin: "mysql_clear_password"},
+		// Without CLIENT_PLUGIN_AUTH or CLIENT_SECURE_CONNECTION the client
+		// uses the pre-4.1 password hash
+		{user: "root", capabilities: clientProtocol41},
+	} {
+		_, response := connect(t, addr, handshake)
+		expectErr(t, response, 1045)
+		if message := errPacketMessage(response.Payload); !strings.Contains(message, "is not allowed") {
+			t.Fatalf("refused with %q", message)
+		}
+	}
+	if got := len(backend.receivedHandshakes()); got != before {
+		t.Fatalf("a forbidden plugin's handshake was forwarded to MySQL")
+	}
+}
+
+func TestAuthSwitchToForbiddenPlugin(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.switchAuth("mysql_old_password")
+	config := testConfig(backend)
+	config.AllowedAuthPlugins = []string{"mysql_native_password"}
+	_, addr := startProxy(t, config)
+
+	_, response := connect(t, addr, testHandshake{user: "root"})
+	expectErr(t, response, 1045)
+	if message := errPacketMessage(response.Payload); !strings.Contains(message, "'mysql_old_password' is not allowed") {
+		t.Fatalf("refused with %q", message)
+	}
+
+	// A switch to an allowed plugin is relayed to the client
+	backend.switchAuth("mysql_native_password")
+	c, response := connect(t, addr, testHandshake{user: "root"})
+	if plugin, ok := parseAuthSwitchRequest(response.Payload); !ok || plugin != "mysql_native_password" {
+		t.Fatalf("auth switch relayed as %s", describePacket(response))
+	}
+	if response = c.send(3, []byte("scrambled-password-20")); response == nil || response.Payload[0] != 0x00 {
+		t.Fatalf("auth switch reply answered with %s", describePacket(response))
+	}
+}
+
+func TestRelayAuth(t *testing.T) {
+	// Each step is a packet from MySQL or the client, which the relay must
+	// pass on to the other side with the same sequence ID
+	type step struct {
+		fromMySQL bool
+		payload   string
+	}
+	for _, tc := range []struct {
+		name  string
+		steps []step
+	}{
+		{"ok", []step{{true, "\x00\x00\x00\x02\x00\x00\x00"}}},
+		{"refused", []step{{true, "\xff\x15\x04#28000Access denied"}}},
+		{"auth switch", []step{
+			{true, "\xfemysql_native_password\x00abcdefghijklmnopqrst\x00"},
+			{false, "scrambled-again-xxxx"},
+			{true, "\x00\x00\x00\x02\x00\x00\x00"},
+		}},
+		{"caching_sha2_password fast auth", []step{
+			{true, "\x01\x03"},
+			{true, "\x00\x00\x00\x02\x00\x00\x00"},
+		}},
+		{"caching_sha2_password full auth with public key", []step{
+			{true, "\x01\x04"},
+			{false, "\x02"},
+			{true, "\x01-----BEGIN PUBLIC KEY-----"},
+			{false, "rsa-encrypted password"},
+			{true, "\x00\x00\x00\x02\x00\x00\x00"},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p, _ := startProxy(t, DefaultConfig(), WithEnsurer(&recordingEnsurer{}))
+			client, clientPeer := net.Pipe()
+			mysql, mysqlPeer := net.Pipe()
+			defer clientPeer.Close()
+			defer mysqlPeer.Close()
+
+			sequence := newExchangeSequence(p.log.WithField("test", tc.name))
+			sequence.readFrom(newPacket(1, nil))
+			type result struct {
+				packet *MySQLPacket
+				err    error
+			}
+			done := make(chan result, 1)
+			go func() {
+				packet, err := p.relayAuth(client, mysql, sequence, 0, false, p.log.WithField("test", tc.name))
+				done <- result{packet, err}
+			}()
+
+			for i, step := range tc.steps {
+				from, to := clientPeer, mysqlPeer
+				if step.fromMySQL {
+					from, to = mysqlPeer, clientPeer
+				}
+				if err := writePacket(from, newPacket(2+i, []byte(step.payload))); err != nil {
+					t.Fatalf("step %d: write: %v", i, err)
+				}
+				packet, err := readPacket(to)
+				if err != nil {
+					t.Fatalf("step %d: read: %v", i, err)
+				}
+				if string(packet.Payload) != step.payload || packet.SequenceID != 2+i {
+					t.Fatalf("step %d: relayed %q numbered %d", i, packet.Payload, packet.SequenceID)
+				}
+			}
+			r := <-done
+			last := tc.steps[len(tc.steps)-1].payload
+			if r.err != nil || string(r.packet.Payload) != last {
+				t.Fatalf("relayAuth returned %v, %v", r.packet, r.err)
+			}
+		})
+	}
+}
+
+func TestRelayAuthTimeout(t *testing.T) {
+	config := DefaultConfig()
+	config.HandshakeTimeout = 50 * time.Millisecond
+	p, _ := startProxy(t, config, WithEnsurer(&recordingEnsurer{}))
+	client, clientPeer := net.Pipe()
+	mysql, mysqlPeer := net.Pipe()
+	defer clientPeer.Close()
+	defer mysqlPeer.Close()
+
+	// MySQL asks for another round, and the client never answers it
+	go writePacket(mysqlPeer, newPacket(2, []byte("\x01\x04")))
+	go readPacket(clientPeer)
+	sequence := newExchangeSequence(p.log.WithField("test", "timeout"))
+	sequence.readFrom(newPacket(1, nil))
+	if _, err := p.relayAuth(client, mysql, sequence, 0, false, p.log.WithField("test", "timeout")); err == nil {
+		t.Fatal("relayAuth succeeded without an answer from the client")
+	}
+
+	// Nothing, not even a made-up OK, is sent to either side
+	mysqlPeer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if packet, err := readPacket(mysqlPeer); err == nil {
+		t.Fatalf("MySQL received %q", packet.Payload)
+	}
+}
+
+func TestAuthSwitchIsRelayed(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.switchAuth("caching_sha2_password")
+	ensurer := &recordingEnsurer{backend: backend}
+	_, addr := startProxy(t, testConfig(backend), WithEnsurer(ensurer))
+
+	c, authSwitch := connect(t, addr, testHandshake{user: "root", database: "switched"})
+	if authSwitch == nil || string(authSwitch.Payload) != "\xfecaching_sha2_password\x00" || authSwitch.SequenceID != 2 {
+		t.Fatalf("handshake answered with %s", describePacket(authSwitch))
+	}
+	if response := c.send(3, []byte("scrambled")); response == nil || response.Payload[0] != 0x00 || response.SequenceID != 4 {
+		t.Fatalf("auth switch response answered with %s", describePacket(response))
+	}
+	c.mustQuery("USE after_switch")
+	if !equalStrings(ensurer.requested(), []string{"switched", "after_switch"}) {
+		t.Fatalf("ensurer asked for %q", ensurer.requested())
+	}
+}
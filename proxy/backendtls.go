@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// clientSSL is the capability flag for switching the connection to TLS
+const clientSSL = 0x00000800
+
+// withCapability returns a copy of a handshake response payload with
+// additional capability flags set
+func withCapability(payload []byte, flags uint32) []byte {
+	rewritten := append([]byte(nil), payload...)
+	rewritten[0] |= byte(flags)
+	rewritten[1] |= byte(flags >> 8)
+	rewritten[2] |= byte(flags >> 16)
+	rewritten[3] |= byte(flags >> 24)
+	return rewritten
+}
+
+// withoutCapability returns a copy of a handshake response payload with
+// capability flags cleared
+func withoutCapability(payload []byte, flags uint32) []byte {
+	rewritten := append([]byte(nil), payload...)
+	rewritten[0] &^= byte(flags)
+	rewritten[1] &^= byte(flags >> 8)
+	rewritten[2] &^= byte(flags >> 16)
+	rewritten[3] &^= byte(flags >> 24)
+	return rewritten
+}
+
+// upgradeBackendTLS switches the connection to MySQL to TLS on behalf of a
+// client that did not request it. It sends the backend an SSLRequest built
+// from the client's handshake response and performs the TLS handshake,
+// returning the TLS connection and the client's handshake response rewritten
+// to follow the SSLRequest. The backend's packets are then numbered one ahead
+// of what the client expects until authentication completes.
+//
+// A nil connection is returned, without error, when the backend does not
+// support TLS and the backend's BackendTLS is "preferred".
+func (p *Proxy) upgradeBackendTLS(mysqlConn net.Conn, mysqlAddr string, greeting, clientHandshake *MySQLPacket) (net.Conn, *MySQLPacket, error) {
+	capabilities, err := parseGreetingCapabilities(greeting.Payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read backend capabilities: %w", err)
+	}
+	config := p.backendConfig(mysqlAddr)
+	if capabilities&clientSSL == 0 {
+		if config.BackendTLS == "required" {
+			return nil, nil, fmt.Errorf("backend does not support TLS")
+		}
+		return nil, nil, nil
+	}
+	if len(clientHandshake.Payload) < 32 {
+		return nil, nil, errTruncatedHandshake
+	}
+
+	sslRequest := newPacket(clientHandshake.SequenceID, withCapability(clientHandshake.Payload[:32], clientSSL))
+	if err := writePacket(mysqlConn, sslRequest); err != nil {
+		return nil, nil, fmt.Errorf("failed to send SSLRequest: %w", err)
+	}
+
+	tlsConfig, err := backendTLSConfig(config, mysqlAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConn := tls.Client(mysqlConn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, nil, fmt.Errorf("TLS handshake with backend failed: %w", err)
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	response := newPacket(clientHandshake.SequenceID+1, withCapability(clientHandshake.Payload, clientSSL))
+	return tlsConn, response, nil
+}
+
+// backendTLSConfig returns the TLS configuration for connections to the
+// MySQL server at addr
+func backendTLSConfig(config Config, addr string) (*tls.Config, error) {
+	serverName, _, _ := net.SplitHostPort(addr)
+	tlsConfig := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: config.BackendTLSSkipVerify,
+	}
+	if config.BackendTLSCA != "" {
+		bundle, err := os.ReadFile(config.BackendTLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MySQL CA bundle: %w", err)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates found in MySQL CA bundle %s", config.BackendTLSCA)
+		}
+	}
+	return tlsConfig, nil
+}
+
+// adminTLSParams returns the DSN parameters that make the proxy's own
+// connections to the MySQL server at addr use TLS, registering the TLS
+// configuration with the driver
+func adminTLSParams(config Config, addr string) (string, error) {
+	if config.BackendTLS == "off" {
+		return "", nil
+	}
+	tlsConfig, err := backendTLSConfig(config, addr)
+	if err != nil {
+		return "", err
+	}
+	name := "backend-" + addr
+	if err := mysql.RegisterTLSConfig(name, tlsConfig); err != nil {
+		return "", err
+	}
+	params := "&tls=" + url.QueryEscape(name)
+	if config.BackendTLS == "preferred" {
+		params += "&allowFallbackToPlaintext=true"
+	}
+	return params, nil
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"math/rand"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	chaosDelays = newCounterVec("mysql_autodb_chaos_delays_total",
+		"Artificial delays injected for chaos testing, by injection point", "point")
+	chaosCreateFailures = newCounter("mysql_autodb_chaos_create_failures_total",
+		"Database creations failed on purpose for chaos testing")
+)
+
+// Points at which ChaosLatency may be injected
+const (
+	chaosPointAccept   = "accept"
+	chaosPointGreeting = "greeting"
+	chaosPointResponse = "response"
+)
+
+// chaosEnabled reports whether latency is injected at the given point
+func (p *Proxy) chaosEnabled(point string) bool {
+	if p.config.ChaosLatency <= 0 || p.config.ChaosLatencyProbability <= 0 {
+		return false
+	}
+	for _, enabled := range p.config.ChaosLatencyPoints {
+		if enabled == point {
+			return true
+		}
+	}
+	return false
+}
+
+// chaosDelay sleeps for ChaosLatency at the given point with probability
+// ChaosLatencyProbability, returning early once ctx is done so that an
+// injected delay never holds up shutdown
+func (p *Proxy) chaosDelay(ctx context.Context, point string, logger *logrus.Entry) {
+	if !p.chaosEnabled(point) || rand.Float64() >= p.config.ChaosLatencyProbability {
+		return
+	}
+	chaosDelays.Inc(point)
+	logger.WithFields(logrus.Fields{
+		"point": point,
+		"delay": p.config.ChaosLatency.String(),
+	}).Debug("Injecting chaos latency")
+
+	timer := time.NewTimer(p.config.ChaosLatency)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// chaosEnsurer fails database creations on purpose, before they reach the
+// real ensurer, for testing how failed creations are reported. Names matching
+// one of patterns always fail; others fail with probability rate.
+type chaosEnsurer struct {
+	DatabaseEnsurer
+	rate     float64
+	patterns []string
+}
+
+// EnsureExists fails with ErrBackendUnreachable when chaos selects the
+// creation, and otherwise passes it on to the wrapped ensurer
+func (c *chaosEnsurer) EnsureExists(ctx context.Context, name string) error {
+	if c.matches(name) || (c.rate > 0 && rand.Float64() < c.rate) {
+		chaosCreateFailures.Inc()
+		connContextFrom(ctx).Logger().WithField("database", name).Warn("Injecting chaos database creation failure")
+		return ErrBackendUnreachable
+	}
+	return c.DatabaseEnsurer.EnsureExists(ctx, name)
+}
+
+// matches reports whether a database name matches one of the failure patterns
+func (c *chaosEnsurer) matches(name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range c.patterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), name); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestChaosLatency(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.ChaosLatency = 100 * time.Millisecond
+	config.ChaosLatencyPoints = []string{chaosPointResponse}
+	_, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	accepts, responses := chaosDelays.Value(chaosPointAccept), chaosDelays.Value(chaosPointResponse)
+	start := time.Now()
+	c.mustQuery("SELECT 1")
+	if elapsed := time.Since(start); elapsed < config.ChaosLatency {
+		t.Fatalf("query answered in %v, before the injected latency", elapsed)
+	}
+	if chaosDelays.Value(chaosPointResponse) <= responses || chaosDelays.Value(chaosPointAccept) != accepts {
+		t.Fatal("latency was not injected at the configured point only")
+	}
+
+	// Latency is never injected with a probability of 0
+	config.ChaosLatencyProbability = 0
+	_, addr = startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+	c = mustConnect(t, addr, testHandshake{user: "root"})
+	responses = chaosDelays.Value(chaosPointResponse)
+	c.mustQuery("SELECT 1")
+	if chaosDelays.Value(chaosPointResponse) != responses {
+		t.Fatal("latency was injected with a probability of 0")
+	}
+}
+
+func TestChaosLatencyDoesNotHoldUpShutdown(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.ChaosLatency = time.Hour
+	config.ChaosLatencyPoints = []string{chaosPointAccept}
+	p, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{}))
+
+	accepts := chaosDelays.Value(chaosPointAccept)
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+	eventually(t, "the delay to be injected", func() bool { return chaosDelays.Value(chaosPointAccept) > accepts })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	p.Shutdown(ctx)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("shutdown took %v behind the injected delay", elapsed)
+	}
+
+	// The delay ended with the shutdown, rather than leaving the connection
+	// asleep for an hour
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := readPacket(conn); err != nil {
+		t.Fatalf("read greeting: %v", err)
+	}
+	conn.Close()
+	eventually(t, "the delayed connection to end", func() bool { return p.connsOpen.Load() == 0 })
+}
+
+func TestChaosEnsurer(t *testing.T) {
+	inner := &recordingEnsurer{}
+	chaos := &chaosEnsurer{DatabaseEnsurer: inner, patterns: []string{"flaky_*"}}
+	ctx := withConnContext(context.Background(), &ConnContext{})
+
+	failures := chaosCreateFailures.Value()
+	if err := chaos.EnsureExists(ctx, "Flaky_orders"); !errors.Is(err, ErrBackendUnreachable) {
+		t.Fatalf("EnsureExists: %v", err)
+	}
+	if err := chaos.EnsureExists(ctx, "orders"); err != nil {
+		t.Fatalf("EnsureExists: %v", err)
+	}
+	chaos.rate = 1
+	if err := chaos.EnsureExists(ctx, "billing"); !errors.Is(err, ErrBackendUnreachable) {
+		t.Fatalf("EnsureExists: %v", err)
+	}
+
+	// Failed creations never reach the wrapped ensurer
+	if !equalStrings(inner.requested(), []string{"orders"}) {
+		t.Fatalf("wrapped ensurer asked for %q", inner.requested())
+	}
+	if got := chaosCreateFailures.Value() - failures; got != 2 {
+		t.Fatalf("%d failures counted, want 2", got)
+	}
+}
+
+func TestChaosCreateFailuresReachClients(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.ChaosCreateFailurePatterns = []string{"flaky_*"}
+	ensurer := &recordingEnsurer{backend: backend}
+	_, addr := startProxy(t, config, WithEnsurer(ensurer))
+
+	_, response := connect(t, addr, testHandshake{user: "root", database: "flaky_handshake"})
+	expectErr(t, response, 1053)
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	expectErr(t, c.query("USE flaky_use"), 1053)
+	c.mustQuery("USE steady")
+	if !equalStrings(ensurer.requested(), []string{"steady"}) {
+		t.Fatalf("ensurer asked for %q", ensurer.requested())
+	}
+}
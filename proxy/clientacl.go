@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// parseClientPrefixes parses ALLOWED_CLIENTS entries, CIDRs or single
+// addresses, into prefixes. IPv4-mapped IPv6 entries are converted to IPv4,
+// so that they match the IPv4 addresses clients are compared as.
+func parseClientPrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		var prefix netip.Prefix
+		if strings.Contains(entry, "/") {
+			parsed, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q: %w", entry, err)
+			}
+			prefix = parsed
+		} else {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid address %q: %w", entry, err)
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		if prefix.Addr().Zone() != "" {
+			return nil, fmt.Errorf("invalid CIDR %q: zones are not supported", entry)
+		}
+		if prefix.Addr().Is4In6() {
+			if prefix.Bits() < 96 {
+				return nil, fmt.Errorf("invalid CIDR %q: IPv4-mapped prefixes must be at least /96", entry)
+			}
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// clientPrefixes validates ALLOWED_CLIENTS
+func clientPrefixes(value interface{}) error {
+	_, err := parseClientPrefixes(value.([]string))
+	return err
+}
+
+// clientAllowed reports whether a client at addr may connect, and the
+// address it was checked as. Every client is allowed when ALLOWED_CLIENTS is
+// empty, as are clients of the Unix socket, which have no IP address.
+func (p *Proxy) clientAllowed(addr net.Addr) (bool, netip.Addr) {
+	if len(p.allowedClients) == 0 {
+		return true, netip.Addr{}
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true, netip.Addr{}
+	}
+	ip, ok := netip.AddrFromSlice(tcpAddr.IP)
+	if !ok {
+		return false, ip
+	}
+	// Clients of a dual-stack listener arrive as IPv4-mapped IPv6 addresses
+	ip = ip.Unmap()
+	for _, prefix := range p.allowedClients {
+		if prefix.Contains(ip) {
+			return true, ip
+		}
+	}
+	return false, ip
+}
+
+// admitClient refuses the connection, reporting whether it may continue, if
+// its client is not allowed by ALLOWED_CLIENTS
+func (p *Proxy) admitClient(conn net.Conn, logger *logrus.Entry) bool {
+	allowed, ip := p.clientAllowed(conn.RemoteAddr())
+	if !allowed {
+		p.rejectConnection(conn, logger, "client_not_allowed", 0, errCategoryHostNotAllowed,
+			fmt.Sprintf("host '%s' is not allowed to connect to this proxy", ip))
+	}
+	return allowed
+}
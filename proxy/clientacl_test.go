@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseClientPrefixes(t *testing.T) {
+	prefixes, err := parseClientPrefixes([]string{"127.0.0.0/8", "10.1.2.3", "::1/128", "2001:db8::/32", "::ffff:192.168.1.0/120", "192.168.7.9/24"})
+	if err != nil {
+		t.Fatalf("parseClientPrefixes: %v", err)
+	}
+	want := []string{"127.0.0.0/8", "10.1.2.3/32", "::1/128", "2001:db8::/32", "192.168.1.0/24", "192.168.7.0/24"}
+	for i, prefix := range prefixes {
+		if prefix.String() != want[i] {
+			t.Errorf("parsed %s, want %s", prefix, want[i])
+		}
+	}
+
+	for _, entry := range []string{"10.0.0.0/33", "10.0.0/8", "localhost", "fe80::1%eth0/64", "::ffff:0:0/95", ""} {
+		if _, err := parseClientPrefixes([]string{entry}); err == nil {
+			t.Errorf("accepted %q", entry)
+		}
+	}
+
+	// Malformed entries stop the proxy from starting
+	config := DefaultConfig()
+	config.AllowedClients = []string{"10.0.0.0/8", "10.0.0.300/8"}
+	if _, err := New(config); err == nil || !strings.Contains(err.Error(), "10.0.0.300/8") {
+		t.Fatalf("New: %v", err)
+	}
+}
+
+func TestClientAllowed(t *testing.T) {
+	prefixes, err := parseClientPrefixes([]string{"192.168.1.0/24", "2001:db8:1::/48"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Proxy{allowedClients: prefixes}
+	for _, tc := range []struct {
+		ip      string
+		allowed bool
+	}{
+		{"192.168.1.0", true},
+		{"192.168.1.1", true},
+		{"192.168.1.255", true},
+		{"192.168.0.255", false},
+		{"192.168.2.0", false},
+		{"::ffff:192.168.1.42", true},
+		{"::ffff:192.168.2.1", false},
+		{"2001:db8:1::", true},
+		{"2001:db8:1:ffff:ffff:ffff:ffff:ffff", true},
+		{"2001:db8:0:ffff:ffff:ffff:ffff:ffff", false},
+		{"2001:db8:2::", false},
+		{"127.0.0.1", false},
+	} {
+		addr := &net.TCPAddr{IP: net.ParseIP(tc.ip), Port: 50000}
+		if allowed, _ := p.clientAllowed(addr); allowed != tc.allowed {
+			t.Errorf("clientAllowed(%s) = %v", tc.ip, allowed)
+		}
+	}
+
+	// Mapped addresses are checked as the IPv4 address they carry
+	if _, ip := p.clientAllowed(&net.TCPAddr{IP: net.ParseIP("::ffff:192.168.1.42")}); ip != netip.MustParseAddr("192.168.1.42") {
+		t.Fatalf("checked as %s", ip)
+	}
+
+	// Unix socket clients have no address to check
+	if allowed, _ := p.clientAllowed(socketPeer("/tmp/proxy.sock#1")); !allowed {
+		t.Fatal("refused a Unix socket client")
+	}
+	if allowed, _ := (&Proxy{}).clientAllowed(&net.TCPAddr{IP: net.ParseIP("203.0.113.1")}); !allowed {
+		t.Fatal("refused a client with ALLOWED_CLIENTS empty")
+	}
+}
+
+func TestDisallowedClientsNeverReachMySQL(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.AllowedClients = []string{"10.0.0.0/8"}
+	logger, hook := testLogger()
+	_, addr := startProxy(t, config, WithLogger(logger))
+
+	sessions := backend.sessionCount()
+	expectErr(t, readRejection(t, addr), 1130)
+	if backend.sessionCount() != sessions {
+		t.Fatal("a refused client was relayed to MySQL")
+	}
+	entry := findEntry(hook, "Rejected connection: host '127.0.0.1' is not allowed to connect to this proxy")
+	if entry == nil || !strings.HasPrefix(entry.Data["client_addr"].(string), "127.0.0.1:") {
+		t.Fatalf("logged %v", entry)
+	}
+
+	// Allowed clients connect as usual
+	config.AllowedClients = []string{"192.0.2.0/24", "127.0.0.1"}
+	_, addr = startProxy(t, config)
+	mustConnect(t, addr, testHandshake{user: "root"}).mustQuery("SELECT 1")
+}
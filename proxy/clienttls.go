@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var tlsPassthroughConnections = newCounter("mysql_autodb_tls_passthrough_connections_total",
+	"Client connections relayed to MySQL as opaque TLS sessions")
+
+// isSSLRequest reports whether a client's reply to the greeting is an
+// SSLRequest, the truncated handshake response a client sends before
+// switching to TLS, rather than the handshake response itself
+func isSSLRequest(payload []byte) bool {
+	if len(payload) != 32 {
+		return false
+	}
+	capabilities := uint32(payload[0]) | uint32(payload[1])<<8 | uint32(payload[2])<<16 | uint32(payload[3])<<24
+	return capabilities&clientSSL != 0
+}
+
+// loadClientTLS loads the certificate and key with which the proxy
+// terminates client TLS
+func loadClientTLS(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("PROXY_TLS_CERT and PROXY_TLS_KEY must both be set")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// acceptClientTLS completes the TLS handshake a client asked for with its
+// SSLRequest and reads the handshake response it then sends encrypted. The
+// response is returned without CLIENT_SSL, as MySQL sees it in plaintext.
+func (p *Proxy) acceptClientTLS(clientConn net.Conn) (net.Conn, *MySQLPacket, error) {
+	tlsConn := tls.Server(clientConn, p.clientTLS)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, nil, fmt.Errorf("TLS handshake with client failed: %w", err)
+	}
+
+	response, err := readPacket(tlsConn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read client handshake: %w", err)
+	}
+	if len(response.Payload) < 32 {
+		return nil, nil, errTruncatedHandshake
+	}
+	return tlsConn, newPacket(response.SequenceID, withoutCapability(response.Payload, clientSSL)), nil
+}
+
+// relayTLS forwards a client's SSLRequest to MySQL, which then negotiates TLS
+// with the client directly, and relays the encrypted session in both
+// directions without looking at it. The proxy cannot see the handshake
+// response or the commands, so no database is created for the connection.
+func (p *Proxy) relayTLS(clientConn, mysqlConn net.Conn, mysqlAddr string, cc *ConnContext, sslRequest *MySQLPacket, logger *logrus.Entry) {
+	if err := writePacket(mysqlConn, sslRequest); err != nil {
+		logger.WithError(err).Error("Failed to forward SSLRequest to MySQL")
+		return
+	}
+	logger.Warn("Client switched to TLS, relaying it untouched: databases are not created automatically for this connection")
+	tlsPassthroughConnections.Inc()
+	p.relayUntouched(clientConn, mysqlConn, mysqlAddr, cc, logger)
+}
+
+// relayUntouched copies bytes between the client and MySQL until either side
+// closes, for sessions the proxy cannot read packets from
+func (p *Proxy) relayUntouched(clientConn, mysqlConn net.Conn, mysqlAddr string, cc *ConnContext, logger *logrus.Entry) {
+	clientConn.SetDeadline(time.Time{})
+	mysqlConn.SetDeadline(time.Time{})
+
+	state := newRelayState(p.config.WriteTimeout)
+	active := &activeConn{cc: cc, clientConn: clientConn, mysqlConn: mysqlConn, backend: mysqlAddr,
+		state: state, opaque: true}
+	p.conns.add(active)
+	defer p.conns.remove(active)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		n, err := io.Copy(mysqlConn, clientConn)
+		bytesForwarded.Add(uint64(n), "client_to_server")
+		state.clientBytes.Add(uint64(n))
+		state.end(copyEndReason("client", err))
+		closeRelayed(mysqlConn)
+	}()
+	n, err := io.Copy(clientConn, mysqlConn)
+	bytesForwarded.Add(uint64(n), "server_to_client")
+	state.serverBytes.Add(uint64(n))
+	state.end(copyEndReason("mysql", err))
+	closeRelayed(clientConn)
+
+	<-done
+	logger.WithFields(logrus.Fields{
+		"reason":            state.reason(),
+		"bytes_from_client": state.clientBytes.Load(),
+		"bytes_from_server": state.serverBytes.Load(),
+	}).Info("Connection closed")
+}
+
+// copyEndReason returns why copying the bytes sent by from ("client" or
+// "mysql") stopped
+func copyEndReason(from string, err error) string {
+	switch {
+	case err == nil:
+		return from + "_closed"
+	case errors.Is(err, net.ErrClosed):
+		return "closed"
+	default:
+		return "relay_failed"
+	}
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestIsSSLRequest(t *testing.T) {
+	sslRequest := testHandshake{capabilities: testClientCapabilities | clientSSL}.payload()[:32]
+	if !isSSLRequest(sslRequest) {
+		t.Fatal("SSLRequest not recognized")
+	}
+	if isSSLRequest(testHandshake{capabilities: testClientCapabilities}.payload()[:32]) {
+		t.Fatal("a truncated response without CLIENT_SSL taken for an SSLRequest")
+	}
+	if isSSLRequest(testHandshake{capabilities: testClientCapabilities | clientSSL, user: "root"}.payload()) {
+		t.Fatal("a whole handshake response taken for an SSLRequest")
+	}
+}
+
+// startTLS sends an SSLRequest on c and returns a client speaking TLS on its
+// connection
+func startTLS(t *testing.T, c *testClient) *testClient {
+	t.Helper()
+	sslRequest := testHandshake{capabilities: testClientCapabilities | clientSSL}.payload()[:32]
+	if err := writePacket(c.conn, newPacket(1, sslRequest)); err != nil {
+		t.Fatalf("write SSLRequest: %v", err)
+	}
+	tlsConn := tls.Client(c.conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake: %v", err)
+	}
+	return &testClient{t: t, conn: tlsConn, greeting: c.greeting}
+}
+
+func TestTLSPassthrough(t *testing.T) {
+	cert, _ := testCertificate(t)
+	backend := startFakeMySQL(t)
+	backend.enableTLS(cert, false)
+	ensurer := &recordingEnsurer{backend: backend}
+	_, addr := startProxy(t, testConfig(backend), WithEnsurer(ensurer))
+
+	// Clients that do not switch to TLS are relayed as usual
+	mustConnect(t, addr, testHandshake{user: "root", database: "plaintext"})
+	if !equalStrings(ensurer.requested(), []string{"plaintext"}) {
+		t.Fatalf("ensurer asked for %q", ensurer.requested())
+	}
+
+	passthrough := tlsPassthroughConnections.Value()
+	c := dialTestClient(t, addr)
+	if capabilities, _ := parseGreetingCapabilities(c.greeting.Payload); capabilities&clientSSL == 0 {
+		t.Fatal("MySQL's TLS support was hidden from the client")
+	}
+
+	// The session is negotiated with MySQL, and the proxy cannot see the
+	// commands it carries
+	c = startTLS(t, c)
+	handshake := testHandshake{capabilities: testClientCapabilities | clientSSL, user: "root"}
+	if response := c.send(2, handshake.payload()); response == nil || response.Payload[0] != 0x00 {
+		t.Fatalf("handshake answered with %s", describePacket(response))
+	}
+	expectErr(t, c.query("USE encrypted"), 1049)
+	if backend.tlsSessionCount() != 1 || tlsPassthroughConnections.Value() != passthrough+1 {
+		t.Fatal("the TLS session was not relayed to MySQL")
+	}
+	if len(ensurer.requested()) != 1 {
+		t.Fatalf("ensurer asked for %q", ensurer.requested())
+	}
+}
+
+func TestTLSModeReject(t *testing.T) {
+	cert, _ := testCertificate(t)
+	backend := startFakeMySQL(t)
+	backend.enableTLS(cert, false)
+	config := testConfig(backend)
+	config.TLSMode = "reject"
+	_, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	// TLS is hidden so that clients preferring it fall back to plaintext
+	c := dialTestClient(t, addr)
+	if capabilities, _ := parseGreetingCapabilities(c.greeting.Payload); capabilities&clientSSL != 0 {
+		t.Fatal("greeting offers TLS")
+	}
+	mustConnect(t, addr, testHandshake{user: "root"})
+
+	// and those that insist are refused
+	sslRequest := testHandshake{capabilities: testClientCapabilities | clientSSL}.payload()[:32]
+	response := c.send(1, sslRequest)
+	expectErr(t, response, 1045)
+	if message := errPacketMessage(response.Payload); !strings.Contains(message, "TLS connections are not accepted") {
+		t.Fatalf("refused with %q", message)
+	}
+	if backend.tlsSessionCount() != 0 {
+		t.Fatal("a TLS session reached MySQL")
+	}
+}
+
+// writeCertificate writes cert and its key as PEM files for PROXY_TLS_CERT
+// and PROXY_TLS_KEY
+func writeCertificate(t *testing.T, cert tls.Certificate, certPEM []byte) (string, string) {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "proxy.crt"), filepath.Join(dir, "proxy.key")
+	if err := os.WriteFile(certFile, certPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestClientTLSTermination(t *testing.T) {
+	cert, certPEM := testCertificate(t)
+	backend := startFakeMySQL(t)
+	ensurer := &recordingEnsurer{backend: backend}
+	config := testConfig(backend)
+	config.ProxyTLSCert, config.ProxyTLSKey = writeCertificate(t, cert, certPEM)
+	config.ProxyTLSRequired = true
+	_, addr := startProxy(t, config, WithEnsurer(ensurer))
+
+	// The proxy offers TLS although MySQL does not
+	c := dialTestClient(t, addr)
+	if capabilities, _ := parseGreetingCapabilities(c.greeting.Payload); capabilities&clientSSL == 0 {
+		t.Fatal("greeting does not offer TLS")
+	}
+
+	// and clients verifying its certificate complete the handshake with it
+	sslRequest := testHandshake{capabilities: testClientCapabilities | clientSSL}.payload()[:32]
+	if err := writePacket(c.conn, newPacket(1, sslRequest)); err != nil {
+		t.Fatalf("write SSLRequest: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	tlsConn := tls.Client(c.conn, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatalf("TLS handshake: %v", err)
+	}
+	c = &testClient{t: t, conn: tlsConn, greeting: c.greeting}
+
+	// Databases are created for the encrypted session, which MySQL sees in
+	// plaintext
+	handshake := testHandshake{capabilities: testClientCapabilities | clientSSL, user: "root", database: "secure"}
+	if response := c.send(2, handshake.payload()); response == nil || response.Payload[0] != 0x00 {
+		t.Fatalf("handshake answered with %s", describePacket(response))
+	}
+	c.mustQuery("USE reports")
+	if !equalStrings(ensurer.requested(), []string{"secure", "reports"}) {
+		t.Fatalf("ensurer asked for %q", ensurer.requested())
+	}
+	if !backend.hasDatabase("secure") || !backend.hasDatabase("reports") || backend.tlsSessionCount() != 0 {
+		t.Fatal("the terminated session did not reach MySQL in plaintext")
+	}
+	handshakes := backend.receivedHandshakes()
+	if hr, err := parseHandshakeResponse(handshakes[len(handshakes)-1]); err != nil || hr.CapabilityFlags&clientSSL != 0 || hr.Database != "secure" {
+		t.Fatalf("MySQL received %+v, %v", hr, err)
+	}
+
+	// With PROXY_TLS_REQUIRED plaintext clients are refused
+	_, response := connect(t, addr, testHandshake{user: "root", database: "plaintext"})
+	expectErr(t, response, 1045)
+	if message := errPacketMessage(response.Payload); !strings.Contains(message, "connections to the proxy must use TLS") {
+		t.Fatalf("refused with %q", message)
+	}
+	if backend.hasDatabase("plaintext") || len(ensurer.requested()) != 2 {
+		t.Fatal("a plaintext client had its database created")
+	}
+}
+
+func TestClientTLSConfiguration(t *testing.T) {
+	cert, certPEM := testCertificate(t)
+	certFile, keyFile := writeCertificate(t, cert, certPEM)
+	backend := startFakeMySQL(t)
+	for name, mutate := range map[string]func(*Config){
+		"no key":         func(c *Config) { c.ProxyTLSCert = certFile },
+		"no certificate": func(c *Config) { c.ProxyTLSKey = keyFile },
+		"key as cert":    func(c *Config) { c.ProxyTLSCert, c.ProxyTLSKey = keyFile, keyFile },
+		"missing file":   func(c *Config) { c.ProxyTLSCert, c.ProxyTLSKey = certFile+".missing", keyFile },
+		"required alone": func(c *Config) { c.ProxyTLSRequired = true },
+	} {
+		config := testConfig(backend)
+		mutate(&config)
+		logger, _ := testLogger()
+		if _, err := New(config, WithLogger(logger)); err == nil {
+			t.Errorf("%s: New succeeded", name)
+		}
+	}
+}
@@ -0,0 +1,10 @@
+package proxy
+
+var compressedPassthroughConnections = newCounter("mysql_autodb_compressed_passthrough_connections_total",
+	"Client connections relayed to MySQL untouched because they use the compressed protocol")
+
+// requestsCompression reports whether a handshake response asks for the
+// compressed protocol
+func requestsCompression(payload []byte) bool {
+	return len(payload) >= 4 && payload[0]&clientCompress != 0
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// compressingMySQL starts a fake MySQL server that offers the compressed
+// protocol
+func compressingMySQL(t *testing.T) *fakeMySQL {
+	backend := startFakeMySQL(t)
+	backend.mu.Lock()
+	backend.caps |= clientCompress
+	backend.mu.Unlock()
+	return backend
+}
+
+// receivedCapabilities returns the capabilities of the last handshake
+// response MySQL received
+func receivedCapabilities(t *testing.T, backend *fakeMySQL) uint32 {
+	t.Helper()
+	handshakes := backend.receivedHandshakes()
+	if len(handshakes) == 0 {
+		t.Fatal("MySQL received no handshake")
+	}
+	return binary.LittleEndian.Uint32(handshakes[len(handshakes)-1])
+}
+
+func TestCompressionModeStrip(t *testing.T) {
+	backend := compressingMySQL(t)
+	ensurer := &recordingEnsurer{backend: backend}
+	_, addr := startProxy(t, testConfig(backend), WithEnsurer(ensurer))
+
+	// The greeting hides compression, and a client asking for it anyway is
+	// connected uncompressed
+	c := dialTestClient(t, addr)
+	if capabilities, _ := parseGreetingCapabilities(c.greeting.Payload); capabilities&clientCompress != 0 {
+		t.Fatal("greeting offers compression")
+	}
+	handshake := testHandshake{capabilities: testClientCapabilities | clientCompress, user: "root", database: "orders"}
+	if response := c.send(1, handshake.payload()); response == nil || response.Payload[0] != 0x00 {
+		t.Fatalf("handshake answered with %s", describePacket(response))
+	}
+	if receivedCapabilities(t, backend)&clientCompress != 0 {
+		t.Fatal("CLIENT_COMPRESS was forwarded to MySQL")
+	}
+
+	// so that its commands are still intercepted
+	c.mustQuery("USE billing")
+	if !equalStrings(ensurer.requested(), []string{"orders", "billing"}) {
+		t.Fatalf("ensurer asked for %q", ensurer.requested())
+	}
+}
+
+func TestCompressionModePassthrough(t *testing.T) {
+	backend := compressingMySQL(t)
+	config := testConfig(backend)
+	config.CompressionMode = "passthrough"
+	ensurer := &recordingEnsurer{backend: backend}
+	_, addr := startProxy(t, config, WithEnsurer(ensurer))
+
+	c := dialTestClient(t, addr)
+	if capabilities, _ := parseGreetingCapabilities(c.greeting.Payload); capabilities&clientCompress == 0 {
+		t.Fatal("MySQL's compression support was hidden from the client")
+	}
+	passthrough := compressedPassthroughConnections.Value()
+	handshake := testHandshake{capabilities: testClientCapabilities | clientCompress, user: "root", database: "orders"}
+	if response := c.send(1, handshake.payload()); response == nil || response.Payload[0] != 0x00 {
+		t.Fatalf("handshake answered with %s", describePacket(response))
+	}
+	if receivedCapabilities(t, backend)&clientCompress == 0 {
+		t.Fatal("CLIENT_COMPRESS was not forwarded to MySQL")
+	}
+
+	// The database of the handshake is created, but the session after it is
+	// relayed untouched. The fake does not compress, so the relayed bytes
+	// still read as packets here.
+	expectErr(t, c.query("USE billing"), 1049)
+	if !equalStrings(ensurer.requested(), []string{"orders"}) {
+		t.Fatalf("ensurer asked for %q", ensurer.requested())
+	}
+	if compressedPassthroughConnections.Value() != passthrough+1 {
+		t.Fatal("the compressed session was not counted")
+	}
+
+	// Clients that do not ask for compression are intercepted as usual
+	mustConnect(t, addr, testHandshake{user: "root"}).mustQuery("USE inventory")
+	if !equalStrings(ensurer.requested(), []string{"orders", "inventory"}) {
+		t.Fatalf("ensurer asked for %q", ensurer.requested())
+	}
+}
+
+func TestCompressionStrippedFromUnofferedHandshake(t *testing.T) {
+	// MySQL that does not support compression never sees the bit either
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.CompressionMode = "passthrough"
+	_, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	c, response := connect(t, addr, testHandshake{capabilities: testClientCapabilities | clientCompress, user: "root"})
+	if response == nil || response.Payload[0] != 0x00 {
+		t.Fatalf("handshake answered with %s", describePacket(response))
+	}
+	if receivedCapabilities(t, backend)&clientCompress != 0 {
+		t.Fatal("CLIENT_COMPRESS was forwarded to MySQL")
+	}
+	c.mustQuery("SELECT 1")
+}
@@ -0,0 +1,196 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configSections are the sections config files group options under, in the
+// order gen-config writes them
+var configSections = []string{"tls", "limits", "creation"}
+
+// fileKey is the key that sets an option in a config file: its environment
+// variable in lower case
+func (o configOption) fileKey() string {
+	return strings.ToLower(o.env)
+}
+
+// fileValue is an option's value in a config file: a scalar as text, or the
+// items of a sequence
+type fileValue struct {
+	// key is where the value was found, such as "tls.mysql_tls"
+	key   string
+	text  string
+	items []string
+}
+
+// apply stores the value in the option's field of config
+func (v fileValue) apply(option configOption, config *Config) error {
+	if v.items != nil {
+		return option.setItems(config, v.items)
+	}
+	return option.set(config, v.text)
+}
+
+// readConfigFile reads a YAML or JSON config file into option values keyed by
+// environment variable. Files ending in .json are parsed as JSON and any other
+// as YAML. Options are set by their file key, either at the top level or, for
+// options that belong to one, in their section:
+//
+//	mysql_host: db.local
+//	tls:
+//	  mysql_tls: required
+//
+// Keys that match no option, options outside their section and options set
+// twice are an error; empty values are treated as unset.
+func readConfigFile(path string) (map[string]fileValue, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]interface{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&values)
+	} else {
+		err = yaml.Unmarshal(data, &values)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	optionByKey := make(map[string]configOption, len(configOptions))
+	for _, option := range configOptions {
+		optionByKey[option.fileKey()] = option
+	}
+	isSection := make(map[string]bool, len(configSections))
+	for _, section := range configSections {
+		isSection[section] = true
+	}
+
+	result := make(map[string]fileValue, len(values))
+	add := func(section, key string, value interface{}) error {
+		name := key
+		if section != "" {
+			name = section + "." + key
+		}
+		option, ok := optionByKey[key]
+		if !ok {
+			return fmt.Errorf("unknown key %q in %s", name, path)
+		}
+		if section != "" && option.section != section {
+			return fmt.Errorf("key %q in %s does not belong in section %q", key, path, section)
+		}
+		if previous, ok := result[option.env]; ok {
+			return fmt.Errorf("%s is set twice in %s, as %q and %q", option.env, path, previous.key, name)
+		}
+		fv := fileValue{key: name}
+		switch value := value.(type) {
+		case nil:
+		case []interface{}:
+			for _, item := range value {
+				fv.items = append(fv.items, fmt.Sprint(item))
+			}
+		case map[string]interface{}:
+			return fmt.Errorf("%q in %s must be a value, not a section", name, path)
+		default:
+			fv.text = fmt.Sprint(value)
+		}
+		if fv.text != "" || len(fv.items) != 0 {
+			result[option.env] = fv
+		}
+		return nil
+	}
+
+	for key, value := range values {
+		if isSection[key] {
+			entries, ok := value.(map[string]interface{})
+			if !ok && value != nil {
+				return nil, fmt.Errorf("section %q in %s must be a mapping", key, path)
+			}
+			for subkey, subvalue := range entries {
+				if err := add(key, subkey, subvalue); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if err := add("", key, value); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// GenConfig writes a config file that sets every option to its default, with
+// each option's description as a comment. Options that belong to a section are
+// written in it. Secrets are left empty.
+func GenConfig(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "# mysql-auto-db-proxy configuration")
+	fmt.Fprintln(out, "#")
+	fmt.Fprintln(out, "# Load with --config or CONFIG_FILE. Environment variables override the values set here.")
+
+	writeOptions(out, "", "")
+	for _, section := range configSections {
+		fmt.Fprintf(out, "\n%s:\n", section)
+		writeOptions(out, section, "  ")
+	}
+	return out.Flush()
+}
+
+// writeOptions writes the options of a section, or those in none for "", at
+// their defaults
+func writeOptions(out io.Writer, section, indent string) {
+	first := true
+	for _, option := range configOptions {
+		if option.section != section {
+			continue
+		}
+		if !first || section == "" {
+			fmt.Fprintln(out)
+		}
+		first = false
+		if option.help != "" {
+			fmt.Fprintf(out, "%s# %s\n", indent, option.help)
+		}
+		if option.secret {
+			fmt.Fprintf(out, "%s# Secret: prefer setting %s in the environment over storing it here.\n", indent, option.env)
+			fmt.Fprintf(out, "%s%s: \"\"\n", indent, option.fileKey())
+			continue
+		}
+		value := reflect.ValueOf(defaultConfig).FieldByName(option.field).Interface()
+		fmt.Fprintf(out, "%s%s: %s\n", indent, option.fileKey(), yamlValue(value))
+	}
+}
+
+// yamlValue renders a Config field value as a YAML scalar or flow sequence
+func yamlValue(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return strconv.Quote(value)
+	case time.Duration:
+		return strconv.Quote(value.String())
+	case []string:
+		items := make([]string, len(value))
+		for i, item := range value {
+			items[i] = strconv.Quote(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes content to a config file named name
+func writeConfigFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExampleConfigFile(t *testing.T) {
+	config, provenance, err := LoadConfig("", "../config.example.yaml", nil)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if config.ProxyPort != 3308 || config.MySQLHost != "mysql" || config.BackendTLS != "preferred" {
+		t.Fatalf("loaded %+v", config)
+	}
+	if config.IdleTimeout != 8*time.Hour || config.CacheTTL != 5*time.Minute || config.MaxCreatesPerConnection != 10 {
+		t.Fatalf("loaded %+v", config)
+	}
+	if !equalStrings(config.DBNameAllow, []string{"app_[a-z0-9_]{1,32}", "test_.*"}) || !equalStrings(config.DBNameDeny, []string{".*_prod"}) {
+		t.Fatalf("loaded patterns %q and %q", config.DBNameAllow, config.DBNameDeny)
+	}
+	if provenance["BackendTLS"] != sourceFile || provenance["SeedSQLDir"] != sourceDefault {
+		t.Fatalf("BackendTLS set by %s, SeedSQLDir by %s", provenance["BackendTLS"], provenance["SeedSQLDir"])
+	}
+}
+
+func TestJSONConfigFile(t *testing.T) {
+	path := writeConfigFile(t, "proxy.json", `{
+		"mysql_host": "db.local",
+		"limits": {"max_creates_per_connection": 3, "shutdown_timeout": "5s"},
+		"creation": {"db_name_deny": ["a,b", "c"], "strict_db_names": false}
+	}`)
+	config, _, err := LoadConfig("", path, nil)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if config.MySQLHost != "db.local" || config.MaxCreatesPerConnection != 3 || config.ShutdownTimeout != 5*time.Second || config.StrictDBNames {
+		t.Fatalf("loaded %+v", config)
+	}
+	if !equalStrings(config.DBNameDeny, []string{"a,b", "c"}) {
+		t.Fatalf("loaded %q", config.DBNameDeny)
+	}
+}
+
+func TestConfigFileEnvOverride(t *testing.T) {
+	path := writeConfigFile(t, "proxy.yaml", "mysql_host: file.local\nmysql_port: 3307\n")
+	t.Setenv("MYSQL_HOST", "env.local")
+	config, provenance, err := LoadConfig("", path, nil)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if config.MySQLHost != "env.local" || provenance["MySQLHost"] != sourceEnv {
+		t.Errorf("MySQLHost = %q from %s", config.MySQLHost, provenance["MySQLHost"])
+	}
+	if config.MySQLPort != 3307 || provenance["MySQLPort"] != sourceFile {
+		t.Errorf("MySQLPort = %d from %s", config.MySQLPort, provenance["MySQLPort"])
+	}
+}
+
+func TestInvalidConfigFiles(t *testing.T) {
+	for content, want := range map[string]string{
+		"mysql_hots: db.local\n":                        `unknown key "mysql_hots"`,
+		"tls:\n  unknown: 1\n":                          `unknown key "tls.unknown"`,
+		"limits:\n  mysql_tls: required\n":              `key "mysql_tls" in`,
+		"mysql_tls: off\ntls:\n  mysql_tls: required\n": "MYSQL_TLS is set twice",
+		"tls: required\n":                               `section "tls" in`,
+		"mysql_host:\n  nested: true\n":                 "must be a value, not a section",
+		"proxy_port: many\n":                            "invalid proxy_port in",
+		"mysql_host: [unterminated\n":                   "failed to parse",
+	} {
+		path := writeConfigFile(t, "proxy.yaml", content)
+		if _, _, err := LoadConfig("", path, nil); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("LoadConfig(%q) = %v, want an error containing %q", content, err, want)
+		}
+	}
+	if _, _, err := LoadConfig("", filepath.Join(t.TempDir(), "missing.yaml"), nil); err == nil {
+		t.Error("loaded a missing config file")
+	}
+}
+
+func TestGenConfigLoadsAsDefaults(t *testing.T) {
+	var generated bytes.Buffer
+	if err := GenConfig(&generated); err != nil {
+		t.Fatalf("GenConfig: %v", err)
+	}
+	path := writeConfigFile(t, "generated.yaml", generated.String())
+	config, _, err := LoadConfig("", path, nil)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if !reflect.DeepEqual(config, defaultConfig) {
+		t.Fatalf("generated file loads as %+v", config)
+	}
+}
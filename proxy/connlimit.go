@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"time"
+)
+
+var (
+	connectionsPeak = newGauge("mysql_autodb_connections_peak",
+		"Most client connections handled at once since the proxy started")
+	connectionsWaiting = newGauge("mysql_autodb_connections_waiting",
+		"Client connections waiting for a MAX_CONNECTIONS slot")
+)
+
+// connLimiter bounds the client connections handled at once to
+// MAX_CONNECTIONS. Connections over the limit wait up to MAX_CONNECTIONS_WAIT
+// for another to close.
+type connLimiter struct {
+	slots chan struct{}
+	wait  time.Duration
+}
+
+// newConnLimiter creates a limiter of max connections, or nil when max is 0
+// and connections are unlimited
+func newConnLimiter(max int, wait time.Duration) *connLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &connLimiter{slots: make(chan struct{}, max), wait: wait}
+}
+
+// acquire takes a slot for a new connection, waiting for one if allowed, and
+// reports whether it got one. Every successful acquire must be released.
+func (l *connLimiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.wait <= 0 {
+		return false
+	}
+
+	connectionsWaiting.Add(1)
+	defer connectionsWaiting.Add(-1)
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// release frees the slot of a connection that has closed
+func (l *connLimiter) release() {
+	if l != nil {
+		<-l.slots
+	}
+}
+
+// trackActive counts a connection the proxy has started handling and
+// returns the function that uncounts it, raising the peak if needed
+func trackActive() func() {
+	active := connectionsActive.value.Add(1)
+	for peak := connectionsPeak.Value(); active > peak; peak = connectionsPeak.Value() {
+		if connectionsPeak.value.CompareAndSwap(peak, active) {
+			break
+		}
+	}
+	return func() { connectionsActive.Add(-1) }
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimiter(t *testing.T) {
+	limiter := newConnLimiter(2, 0)
+	if !limiter.acquire() || !limiter.acquire() {
+		t.Fatal("refused a connection under the limit")
+	}
+	if limiter.acquire() {
+		t.Fatal("accepted a connection over the limit")
+	}
+	limiter.release()
+	if !limiter.acquire() {
+		t.Fatal("a released slot was not reused")
+	}
+
+	// With a wait, a connection over the limit takes the next released slot
+	limiter = newConnLimiter(1, time.Second)
+	limiter.acquire()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		limiter.release()
+	}()
+	if !limiter.acquire() {
+		t.Fatal("a waiting connection did not get the released slot")
+	}
+	limiter.wait = 50 * time.Millisecond
+	start := time.Now()
+	if limiter.acquire() {
+		t.Fatal("accepted a connection over the limit")
+	}
+	if elapsed := time.Since(start); elapsed < limiter.wait {
+		t.Fatalf("refused after %v, before the wait", elapsed)
+	}
+
+	// No limit is a nil limiter
+	if limiter := newConnLimiter(0, 0); limiter != nil || !limiter.acquire() {
+		t.Fatal("MAX_CONNECTIONS 0 limited connections")
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.MaxConnections = 3
+	_, addr := startProxy(t, config)
+
+	// Connections that fail their handshake give their slot back
+	for i := 0; i < config.MaxConnections+2; i++ {
+		_, response := connect(t, addr, testHandshake{user: "root", database: "mysql"})
+		expectErr(t, response, 1044)
+	}
+
+	var clients []*testClient
+	for i := 0; i < config.MaxConnections; i++ {
+		clients = append(clients, mustConnect(t, addr, testHandshake{user: "root"}))
+	}
+	if connectionsPeak.Value() < int64(config.MaxConnections) {
+		t.Fatalf("peak of %d connections", connectionsPeak.Value())
+	}
+
+	refused := connectionsRejected.Value("too_many_connections")
+	for i := 0; i < 5; i++ {
+		expectErr(t, readRejection(t, addr), 1040)
+	}
+	if got := connectionsRejected.Value("too_many_connections") - refused; got != 5 {
+		t.Fatalf("%d connections refused, want 5", got)
+	}
+
+	// A closed connection makes room for another
+	clients[0].conn.Close()
+	eventually(t, "a slot to be released", func() bool {
+		c, response := connect(t, addr, testHandshake{user: "root"})
+		c.conn.Close()
+		return response != nil && response.Payload[0] == 0x00
+	})
+}
+
+func TestMaxConnectionsWait(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.MaxConnections = 1
+	config.MaxConnectionsWait = 5 * time.Second
+	_, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	first := mustConnect(t, addr, testHandshake{user: "root"})
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+	eventually(t, "a connection to wait for a slot", func() bool { return connectionsWaiting.Value() == 1 })
+
+	first.conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	greeting, err := readPacket(conn)
+	if err != nil {
+		t.Fatalf("read greeting: %v", err)
+	}
+	if greeting.Payload[0] == 0xff {
+		t.Fatalf("the waiting connection was refused with %q", errPacketMessage(greeting.Payload))
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+)
+
+var (
+	connectionsAccepted = newCounter("mysql_autodb_connections_accepted_total",
+		"Client connections accepted")
+	acceptBackoffs = newCounter("mysql_autodb_accept_backoffs_total",
+		"Temporary accept errors the proxy paused accepting for")
+	handshakeTimeouts = newCounter("mysql_autodb_handshake_response_timeouts_total",
+		"Client connections dropped for not answering the greeting within HANDSHAKE_RESPONSE_TIMEOUT")
+	connectionsActive = newGauge("mysql_autodb_connections_active",
+		"Client connections currently handled by the proxy")
+	handshakesFailed = newCounter("mysql_autodb_handshakes_failed_total",
+		"Client connections closed before completing their handshake")
+	handshakeDatabasesStripped = newCounter("mysql_autodb_handshake_databases_stripped_total",
+		"Handshakes connected without their database because it could not be created (CREATE_FAILURE_MODE=strip)")
+	backendDialFailures = newCounter("mysql_autodb_backend_dial_failures_total",
+		"Failed attempts to connect to a MySQL backend for a client")
+	bytesForwarded = newCounterVec("mysql_autodb_forwarded_bytes_total",
+		"Bytes relayed between clients and MySQL after the handshake, by direction", "direction")
+	packetsForwarded = newCounterVec("mysql_autodb_forwarded_packets_total",
+		"Packets relayed between clients and MySQL after the handshake, by direction, except in sessions relayed as raw bytes", "direction")
+)
+
+// activeConn is a client connection that has entered the data phase
+type activeConn struct {
+	cc         *ConnContext
+	clientConn net.Conn
+	mysqlConn  net.Conn
+	backend    string
+	state      *relayState
+
+	// opaque is set for TLS and compressed sessions relayed untouched, into
+	// which the proxy cannot write packets of its own
+	opaque bool
+}
+
+// connRegistry tracks the connections currently relaying data
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[uint64]*activeConn
+}
+
+// newConnRegistry creates an empty registry
+func newConnRegistry() *connRegistry {
+	return &connRegistry{conns: make(map[uint64]*activeConn)}
+}
+
+// add registers a connection
+func (r *connRegistry) add(conn *activeConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conns[conn.cc.ID] = conn
+}
+
+// remove unregisters a connection
+func (r *connRegistry) remove(conn *activeConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, conn.cc.ID)
+}
+
+// forBackend returns the connections relaying to the given backend
+func (r *connRegistry) forBackend(backend string) []*activeConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var conns []*activeConn
+	for _, conn := range r.conns {
+		if conn.backend == backend {
+			conns = append(conns, conn)
+		}
+	}
+	return conns
+}
+
+// all returns every registered connection
+func (r *connRegistry) all() []*activeConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	conns := make([]*activeConn, 0, len(r.conns))
+	for _, conn := range r.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSilentClientsAreDropped(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.HandshakeResponseTimeout = 200 * time.Millisecond
+	p, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	timeouts := handshakeTimeouts.Value()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := readPacket(conn); err != nil {
+		t.Fatalf("read greeting: %v", err)
+	}
+
+	// A client that never answers the greeting is closed after
+	// HANDSHAKE_RESPONSE_TIMEOUT, long before HANDSHAKE_TIMEOUT
+	start := time.Now()
+	if _, err := readPacket(conn); !errors.Is(err, io.EOF) {
+		t.Fatalf("read after the greeting: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*config.HandshakeResponseTimeout {
+		t.Fatalf("silent client dropped after %v", elapsed)
+	}
+	if got := handshakeTimeouts.Value() - timeouts; got != 1 {
+		t.Fatalf("%d handshake timeouts counted, want 1", got)
+	}
+
+	// and the MySQL connection dialed for it is closed with it
+	eventually(t, "the MySQL connection to close", func() bool { return backend.openSessions() == 0 })
+	eventually(t, "the connection to end", func() bool { return p.connsOpen.Load() == 0 })
+
+	// Clients that answer in time are unaffected
+	c := dialTestClient(t, addr)
+	time.Sleep(config.HandshakeResponseTimeout / 2)
+	if response := c.send(1, testHandshake{user: "root"}.payload()); response == nil || response.Payload[0] != 0x00 {
+		t.Fatalf("handshake answered with %s", describePacket(response))
+	}
+	time.Sleep(config.HandshakeResponseTimeout)
+	c.mustQuery("SELECT 1")
+}
+
+// temporaryError is a net.Error for which Temporary is true, as for running
+// out of file descriptors
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "accept: too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// failingListener fails its first Accept calls with the errors in errs
+type failingListener struct {
+	net.Listener
+	mu   sync.Mutex
+	errs []error
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		l.mu.Unlock()
+		return nil, err
+	}
+	l.mu.Unlock()
+	return l.Listener.Accept()
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	backend := startFakeMySQL(t)
+	p, _ := startProxy(t, testConfig(backend), WithEnsurer(&recordingEnsurer{backend: backend}))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	// Temporary accept errors are retried after a pause
+	backoffs := acceptBackoffs.Value()
+	served := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		served <- p.Serve(&failingListener{Listener: listener, errs: []error{temporaryError{}, temporaryError{}, temporaryError{}}})
+	}()
+	mustConnect(t, listener.Addr().String(), testHandshake{user: "root"}).mustQuery("SELECT 1")
+	if got := acceptBackoffs.Value() - backoffs; got != 3 {
+		t.Fatalf("%d accept backoffs counted, want 3", got)
+	}
+	// of 5, 10 and 20ms
+	if elapsed := time.Since(start); elapsed < 35*time.Millisecond {
+		t.Fatalf("accepted after %v, without backing off", elapsed)
+	}
+
+	// while other errors end Serve
+	listener, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	broken := errors.New("accept: listener broken")
+	if err := p.Serve(&failingListener{Listener: listener, errs: []error{broken}}); !errors.Is(err, broken) {
+		t.Fatalf("Serve: %v", err)
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("Serve returned %v after temporary errors", err)
+	default:
+	}
+}
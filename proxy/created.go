@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// createdDatabase is a database the proxy created, as reported by the admin API
+type createdDatabase struct {
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Client    string    `json:"client"`
+	ConnID    uint64    `json:"conn_id,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	Backend   string    `json:"backend"`
+
+	// CreatedUser is the MySQL user created for the database, if any, which
+	// is dropped with it
+	CreatedUser string `json:"created_user,omitempty"`
+
+	// Trigger is what selected the database when it was created, as in
+	// CreationEvent
+	Trigger string `json:"trigger,omitempty"`
+
+	// LastUsedAt is when a connection last selected the database
+	LastUsedAt time.Time `json:"last_used_at"`
+
+	// ClientCreated is set for a database a client created itself with
+	// CREATE DATABASE through the proxy
+	ClientCreated bool `json:"client_created,omitempty"`
+
+	// Restored is set for a database recorded before the proxy restarted,
+	// replayed from the audit log or loaded from the state file
+	Restored bool `json:"restored,omitempty"`
+
+	// DryRun is set for a database a dry run would have created, which does
+	// not exist unless something else created it
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// creationEvent returns the creation event of the database, as carried over
+// in the audit log
+func (d createdDatabase) creationEvent(instance string) CreationEvent {
+	return CreationEvent{
+		Database:    d.Name,
+		Client:      d.Client,
+		ConnID:      d.ConnID,
+		Username:    d.Username,
+		Timestamp:   d.CreatedAt,
+		Backend:     d.Backend,
+		Instance:    instance,
+		CreatedUser: d.CreatedUser,
+		Trigger:     d.Trigger,
+	}
+}
+
+// restoredDatabase returns the registry entry of a database replayed from
+// the audit log. It is taken as last used when the proxy started, since
+// its use before the restart is not recorded.
+func restoredDatabase(event CreationEvent, startedAt time.Time) createdDatabase {
+	return createdDatabase{
+		Name:          event.Database,
+		CreatedAt:     event.Timestamp,
+		Client:        event.Client,
+		ConnID:        event.ConnID,
+		Username:      event.Username,
+		Backend:       event.Backend,
+		CreatedUser:   event.CreatedUser,
+		Trigger:       event.Trigger,
+		LastUsedAt:    startedAt,
+		ClientCreated: event.Trigger == "create_database",
+		Restored:      true,
+	}
+}
+
+// createdRegistry remembers the databases the proxy has created since it
+// started, and those clients created through it, so that the admin API can
+// list and drop them. Databases that already existed when a client asked for
+// them are not recorded.
+type createdRegistry struct {
+	mu        sync.RWMutex
+	databases map[string]createdDatabase
+
+	// version counts the changes to the registry, so that the state file
+	// knows when it is out of date. changed is signalled, without blocking,
+	// on every change but a touch, which the state file saves at once.
+	version uint64
+	changed chan struct{}
+}
+
+// newCreatedRegistry creates an empty registry
+func newCreatedRegistry() *createdRegistry {
+	return &createdRegistry{
+		databases: make(map[string]createdDatabase),
+		changed:   make(chan struct{}, 1),
+	}
+}
+
+// notify signals changed, unless a signal is already pending
+func (r *createdRegistry) notify() {
+	select {
+	case r.changed <- struct{}{}:
+	default:
+	}
+}
+
+// record adds a created database, replacing an earlier entry of the same name
+func (r *createdRegistry) record(database createdDatabase) {
+	if database.LastUsedAt.IsZero() {
+		database.LastUsedAt = database.CreatedAt
+	}
+	r.mu.Lock()
+	r.databases[database.Name] = database
+	r.version++
+	r.mu.Unlock()
+	r.notify()
+}
+
+// touch records that a connection selected a database, if the proxy created it
+func (r *createdRegistry) touch(name string, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if database, ok := r.databases[name]; ok && at.After(database.LastUsedAt) {
+		database.LastUsedAt = at
+		r.databases[name] = database
+		r.version++
+	}
+}
+
+// get returns the entry of a created database
+func (r *createdRegistry) get(name string) (createdDatabase, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	database, ok := r.databases[name]
+	return database, ok
+}
+
+// remove forgets a database, once it has been dropped
+func (r *createdRegistry) remove(name string) {
+	r.mu.Lock()
+	_, ok := r.databases[name]
+	delete(r.databases, name)
+	if ok {
+		r.version++
+	}
+	r.mu.Unlock()
+	if ok {
+		r.notify()
+	}
+}
+
+// removeFrom forgets a database dropped from backend, unless the proxy
+// created it on another backend
+func (r *createdRegistry) removeFrom(name, backend string) {
+	r.mu.Lock()
+	database, ok := r.databases[name]
+	if ok = ok && database.Backend == backend; ok {
+		delete(r.databases, name)
+		r.version++
+	}
+	r.mu.Unlock()
+	if ok {
+		r.notify()
+	}
+}
+
+// list returns the created databases, oldest first
+func (r *createdRegistry) list() []createdDatabase {
+	databases, _ := r.snapshot()
+	return databases
+}
+
+// snapshot returns the created databases, oldest first, and the version of
+// the registry they are
+func (r *createdRegistry) snapshot() ([]createdDatabase, uint64) {
+	r.mu.RLock()
+	databases := make([]createdDatabase, 0, len(r.databases))
+	for _, database := range r.databases {
+		databases = append(databases, database)
+	}
+	version := r.version
+	r.mu.RUnlock()
+
+	sort.Slice(databases, func(i, j int) bool {
+		return databases[i].CreatedAt.Before(databases[j].CreatedAt)
+	})
+	return databases, version
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+func TestWithoutHandshakeDatabase(t *testing.T) {
+	handshake := testHandshake{user: "app", auth: []byte("scrambled"), database: "orders", plugin: "caching_sha2_password",
+		attrs: [][2]string{{"program_name", "test"}}}
+	packet := withoutHandshakeDatabase(newPacket(1, handshake.payload()))
+	wire := packetBytes(packet)
+	if length := int(wire[0]) | int(wire[1])<<8 | int(wire[2])<<16; length != len(wire)-4 || wire[3] != 1 {
+		t.Fatalf("header gives a length of %d and sequence ID %d for a payload of %d bytes", length, wire[3], len(wire)-4)
+	}
+	hr, err := parseHandshakeResponse(wire[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hr.CapabilityFlags&clientConnectWithDB != 0 || hr.Database != "" || hr.Username != "app" || string(hr.AuthResponse) != "scrambled" ||
+		hr.AuthPlugin != "caching_sha2_password" || hr.Attributes["program_name"] != "test" {
+		t.Fatalf("stripped handshake parsed as %+v", hr)
+	}
+
+	// A handshake without a database, or that cannot be parsed, is kept
+	for _, payload := range [][]byte{testHandshake{capabilities: testClientCapabilities &^ clientConnectWithDB, user: "app"}.payload(), {0x01}} {
+		if stripped := withoutHandshakeDatabase(newPacket(1, payload)); string(stripped.Payload) != string(payload) {
+			t.Fatalf("rewrote %x as %x", payload, stripped.Payload)
+		}
+	}
+}
+
+func TestCreateFailureModes(t *testing.T) {
+	for _, tc := range []struct {
+		mode string
+		want func(t *testing.T, response *MySQLPacket)
+	}{
+		{"error", func(t *testing.T, response *MySQLPacket) { expectErr(t, response, 1053) }},
+		{"close", func(t *testing.T, response *MySQLPacket) {
+			if response != nil {
+				t.Fatalf("handshake answered with %s", describePacket(response))
+			}
+		}},
+		{"strip", func(t *testing.T, response *MySQLPacket) {
+			if response == nil || response.Payload[0] != 0x00 {
+				t.Fatalf("handshake answered with %s", describePacket(response))
+			}
+		}},
+	} {
+		t.Run(tc.mode, func(t *testing.T) {
+			backend := startFakeMySQL(t)
+			config := testConfig(backend)
+			config.ChaosCreateFailurePatterns = []string{"broken_*"}
+			config.CreateFailureMode = tc.mode
+			_, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+			stripped := handshakeDatabasesStripped.Value()
+			_, response := connect(t, addr, testHandshake{user: "root", database: "broken_orders"})
+			tc.want(t, response)
+			want := uint64(0)
+			if tc.mode == "strip" {
+				want = 1
+			}
+			if got := handshakeDatabasesStripped.Value() - stripped; got != want {
+				t.Fatalf("%d handshakes stripped, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestCreateFailureStripWithDriver(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.ChaosCreateFailurePatterns = []string{"broken_*"}
+	config.CreateFailureMode = "strip"
+	ensurer := &recordingEnsurer{backend: backend}
+	logger, hook := testLogger()
+	_, addr := startProxy(t, config, WithLogger(logger), WithEnsurer(ensurer))
+
+	db, err := sql.Open("mysql", "root@tcp("+addr+")/broken_orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	if err := db.Ping(); err != nil {
+		t.Fatalf("ping with a database that cannot be created: %v", err)
+	}
+
+	// The session has no database selected, and can select one later
+	var current sql.NullString
+	if err := db.QueryRow("SELECT DATABASE()").Scan(&current); err != nil {
+		t.Fatalf("SELECT DATABASE(): %v", err)
+	}
+	if current.String != "" {
+		t.Fatalf("connected with %q selected", current.String)
+	}
+	if _, err := db.ExecContext(context.Background(), "USE steady"); err != nil {
+		t.Fatalf("USE steady: %v", err)
+	}
+	if !equalStrings(ensurer.requested(), []string{"steady"}) {
+		t.Fatalf("ensurer asked for %q", ensurer.requested())
+	}
+	if entry := findEntry(hook, "Cannot create the handshake's database, connecting without one"); entry == nil || entry.Data["database"] != "broken_orders" {
+		t.Fatalf("logged %v", entry)
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+var knownDatabaseLookups = newCounterVec("mysql_autodb_known_database_lookups_total",
+	"Database existence checks answered from the known database cache or from MySQL, by result", "result")
+
+// knownDatabases is the set of databases the proxy has seen exist on a
+// backend, so that connections selecting them do not query
+// INFORMATION_SCHEMA every time. Entries expire after a TTL and are forgotten
+// early when MySQL reports the database unknown, since it may have been
+// dropped behind the proxy's back.
+type knownDatabases struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+// newKnownDatabases creates a cache whose entries expire after ttl, or nil
+// when ttl is 0 so that every check goes to MySQL
+func newKnownDatabases(ttl time.Duration) *knownDatabases {
+	if ttl <= 0 {
+		return nil
+	}
+	return &knownDatabases{ttl: ttl, entries: make(map[string]time.Time)}
+}
+
+// has reports whether the database is known to exist
+func (k *knownDatabases) has(key string) bool {
+	if k == nil {
+		return false
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	expires, ok := k.entries[key]
+	if ok && time.Now().After(expires) {
+		delete(k.entries, key)
+		ok = false
+	}
+	if ok {
+		knownDatabaseLookups.Inc("hit")
+	} else {
+		knownDatabaseLookups.Inc("miss")
+	}
+	return ok
+}
+
+// add records that the database exists, returning the number of databases
+// now cached
+func (k *knownDatabases) add(key string) int {
+	if k == nil {
+		return 0
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now()
+	for name, expires := range k.entries {
+		if now.After(expires) {
+			delete(k.entries, name)
+		}
+	}
+	k.entries[key] = now.Add(k.ttl)
+	return len(k.entries)
+}
+
+// forget removes the database, returning whether it was cached and the number
+// of databases still cached
+func (k *knownDatabases) forget(key string) (bool, int) {
+	if k == nil {
+		return false, 0
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	_, ok := k.entries[key]
+	delete(k.entries, key)
+	return ok, len(k.entries)
+}
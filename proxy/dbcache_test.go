@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKnownDatabases(t *testing.T) {
+	known := newKnownDatabases(50 * time.Millisecond)
+	if known.has("orders") {
+		t.Fatal("an empty cache knows a database")
+	}
+	if size := known.add("orders"); size != 1 {
+		t.Fatalf("add reported %d cached", size)
+	}
+	if !known.has("orders") {
+		t.Fatal("an added database is not known")
+	}
+	if cached, size := known.forget("orders"); !cached || size != 0 {
+		t.Fatalf("forget = %v, %d", cached, size)
+	}
+	if known.has("orders") {
+		t.Fatal("a forgotten database is still known")
+	}
+
+	// Entries expire after the TTL
+	known.add("billing")
+	time.Sleep(100 * time.Millisecond)
+	if known.has("billing") {
+		t.Fatal("an expired database is still known")
+	}
+
+	// A TTL of 0 disables the cache
+	disabled := newKnownDatabases(0)
+	disabled.add("orders")
+	if disabled.has("orders") {
+		t.Fatal("a disabled cache knows a database")
+	}
+}
+
+// schemataQueries counts the existence checks MySQL received
+func schemataQueries(backend *fakeMySQL) int {
+	count := 0
+	for _, query := range backend.receivedQueries() {
+		if strings.Contains(query, "INFORMATION_SCHEMA.SCHEMATA WHERE") {
+			count++
+		}
+	}
+	return count
+}
+
+func TestKnownDatabasesSkipExistenceChecks(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.AutoCreateOn1049 = false
+	_, addr := startProxy(t, config)
+
+	mustConnect(t, addr, testHandshake{user: "root", database: "orders"})
+	mustConnect(t, addr, testHandshake{user: "root", database: "orders"})
+	if checks := schemataQueries(backend); checks != 1 {
+		t.Fatalf("%d existence checks for two connections, want 1", checks)
+	}
+
+	// A database dropped behind the proxy's back is forgotten once MySQL
+	// reports it unknown, and created again by the next connection
+	backend.mu.Lock()
+	delete(backend.databases, "orders")
+	backend.mu.Unlock()
+	_, response := connect(t, addr, testHandshake{user: "root", database: "orders"})
+	expectErr(t, response, 1049)
+	mustConnect(t, addr, testHandshake{user: "root", database: "orders"})
+	if !backend.hasDatabase("orders") {
+		t.Fatal("the dropped database was not created again")
+	}
+	if checks := schemataQueries(backend); checks != 2 {
+		t.Fatalf("%d existence checks, want 2", checks)
+	}
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	databasesExpired = newCounter("mysql_autodb_databases_expired_total",
+		"Databases the proxy created and dropped after DB_TTL without use")
+	databaseExpiryFailures = newCounter("mysql_autodb_database_expiry_failures_total",
+		"Failed attempts to drop a database unused for DB_TTL, retried on the next sweep")
+)
+
+// expirySweeper drops the databases the proxy created once no connection has
+// selected them for DB_TTL, checking every DB_TTL_SWEEP_INTERVAL. Only the
+// databases in the registry of created databases are considered, so databases
+// that existed before the proxy saw them, or that it created before it last
+// started without an audit log or state file, are never dropped. Databases
+// clients created themselves are only dropped with DB_TTL_CLIENT_CREATED.
+type expirySweeper struct {
+	proxy    *Proxy
+	ttl      time.Duration
+	interval time.Duration
+	now      func() time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newExpirySweeper creates a sweeper for the proxy's created databases
+func newExpirySweeper(p *Proxy, ttl, interval time.Duration) *expirySweeper {
+	return &expirySweeper{
+		proxy:    p,
+		ttl:      ttl,
+		interval: interval,
+		now:      time.Now,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// run sweeps every interval until the sweeper is closed
+func (s *expirySweeper) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.sweep()
+		}
+	}
+}
+
+// sweep drops every created database unused for the TTL, except those a
+// connection has selected. A database that fails to drop stays in the
+// registry and is tried again on the next sweep.
+func (s *expirySweeper) sweep() {
+	p := s.proxy
+	inUse := make(map[string]bool)
+	for _, conn := range p.conns.all() {
+		inUse[conn.cc.CurrentDB()] = true
+	}
+
+	for _, database := range p.created.list() {
+		idle := s.now().Sub(database.LastUsedAt)
+		if idle < s.ttl || inUse[database.Name] || (database.ClientCreated && !p.config.DBTTLClientCreated) {
+			continue
+		}
+		logger := p.log.WithFields(logrus.Fields{
+			"database":     database.Name,
+			"backend":      database.Backend,
+			"last_used_at": database.LastUsedAt.UTC().Format(time.RFC3339),
+		})
+		// Reserved and invalid names are never dropped, however they got
+		// into the registry
+		if err := validateDatabaseName(database.Name, p.config.StrictDBNames); err != nil {
+			logger.WithError(err).Error("Refusing to drop expired database with an invalid name")
+			p.created.remove(database.Name)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		err := p.dropDatabase(ctx, database)
+		cancel()
+		if err != nil {
+			databaseExpiryFailures.Inc()
+			logger.WithError(err).Error("Failed to drop expired database, retrying on the next sweep")
+			continue
+		}
+		databasesExpired.Inc()
+		logger.WithField("idle", idle.Round(time.Second).String()).Info("Dropped database unused for DB_TTL")
+		if p.audit != nil {
+			p.audit.RecordDrop(dropAuditEvent{
+				Database:   database.Name,
+				Backend:    database.Backend,
+				Reason:     "ttl",
+				Timestamp:  s.now().UTC(),
+				LastUsedAt: database.LastUsedAt.UTC(),
+			})
+		}
+	}
+}
+
+// Close stops the sweeper, waiting for a sweep in progress to finish
+func (s *expirySweeper) Close(ctx context.Context) error {
+	close(s.stop)
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
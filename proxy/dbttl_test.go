@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExpirySweep(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.create("preexisting")
+
+	// The first drop of "flaky" fails, as when MySQL is briefly down
+	var (
+		mu     sync.Mutex
+		failed bool
+	)
+	backend.handleCommands(func(s *fakeSession, payload []byte) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if payload[0] == comQuery && string(payload[1:]) == "DROP DATABASE IF EXISTS `flaky`" && !failed {
+			failed = true
+			s.err(2013, "HY000", "Lost connection to MySQL server during query")
+			return true
+		}
+		return false
+	})
+	config := testConfig(backend)
+	config.AuditLogPath = filepath.Join(t.TempDir(), "audit.log")
+	p, addr := startProxy(t, config)
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	for _, name := range []string{"stale", "fresh", "flaky", "preexisting", "in_use"} {
+		c.mustQuery("USE " + name)
+	}
+
+	now := time.Now().Add(2 * time.Hour)
+	sweeper := newExpirySweeper(p, time.Hour, time.Minute)
+	sweeper.now = func() time.Time { return now }
+	p.created.touch("fresh", now.Add(-time.Minute))
+
+	// Only the stale databases the proxy created, and no connection is
+	// using, are dropped
+	sweeper.sweep()
+	for name, exists := range map[string]bool{"stale": false, "fresh": true, "flaky": true, "preexisting": true, "in_use": true} {
+		if backend.hasDatabase(name) != exists {
+			t.Errorf("%s exists: %v", name, !exists)
+		}
+	}
+	if _, ok := p.created.get("stale"); ok {
+		t.Fatal("the dropped database is still registered")
+	}
+
+	// A failed drop is retried on the next sweep
+	sweeper.sweep()
+	if backend.hasDatabase("flaky") {
+		t.Fatal("the failed drop was not retried")
+	}
+
+	// The drops are noted in the audit log
+	p.audit.Close(context.Background())
+	want := []string{":stale", ":fresh", ":flaky", ":in_use", "dropped:stale", "dropped:flaky"}
+	if got := auditDatabases(t, config.AuditLogPath); !equalStrings(got, want) {
+		t.Fatalf("audit log holds %q, want %q", got, want)
+	}
+}
+
+func TestExpirySweepSkipsInvalidNames(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.create("mysql")
+	p, _ := startProxy(t, testConfig(backend))
+	p.created.record(createdDatabase{Name: "mysql", Backend: backend.addr()})
+
+	sweeper := newExpirySweeper(p, time.Hour, time.Minute)
+	sweeper.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	sweeper.sweep()
+	if !backend.hasDatabase("mysql") {
+		t.Fatal("dropped a system schema")
+	}
+	if _, ok := p.created.get("mysql"); ok {
+		t.Fatal("the system schema is still registered")
+	}
+}
+
+func TestExpirySweeperStopsWithProxy(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.DBTTL = time.Hour
+	config.DBTTLSweepInterval = time.Millisecond
+	p, _ := startProxy(t, config)
+
+	var sweeper *expirySweeper
+	for _, sink := range p.sinks {
+		if s, ok := sink.(*expirySweeper); ok {
+			sweeper = s
+		}
+	}
+	if sweeper == nil {
+		t.Fatal("no sweeper started for DB_TTL")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	select {
+	case <-sweeper.done:
+	default:
+		t.Fatal("the sweeper is still running after shutdown")
+	}
+}
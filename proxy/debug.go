@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"sync"
+)
+
+// publishMetricsOnce publishes the metrics to expvar, which allows each name
+// once per process
+var publishMetricsOnce sync.Once
+
+// checkDebugPort fails if DEBUG_PORT is one the proxy already listens on for
+// something else
+func checkDebugPort(config Config) error {
+	if config.DebugPort == 0 {
+		return nil
+	}
+	for port, name := range map[int]string{
+		config.ProxyPort:   "PROXY_PORT",
+		config.AdminPort:   "ADMIN_PORT",
+		config.MetricsPort: "METRICS_PORT",
+		config.HealthPort:  "HEALTH_PORT",
+	} {
+		if port == config.DebugPort {
+			return fmt.Errorf("DEBUG_PORT %d is already %s", port, name)
+		}
+	}
+	return nil
+}
+
+// debugHandler returns the handler of DEBUG_PORT: the pprof profiles under
+// /debug/pprof/ and, at /debug/vars, expvar's memory statistics along with
+// the proxy's metrics under "mysql_autodb"
+func debugHandler() http.Handler {
+	publishMetricsOnce.Do(func() {
+		expvar.Publish("mysql_autodb", expvar.Func(func() interface{} {
+			return registry.values()
+		}))
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// serveDebug runs the DEBUG_PORT server until Shutdown stops it or it fails
+func (p *Proxy) serveDebug(addr string) {
+	server := newHTTPServer(addr, debugHandler())
+	if !p.trackServer(server) {
+		return
+	}
+
+	p.log.WithField("debug_addr", addr).Warn("Debug server listening, exposing profiles of the proxy")
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		p.log.WithError(err).Error("Debug server stopped")
+	}
+}
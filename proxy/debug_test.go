@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckDebugPort(t *testing.T) {
+	config := DefaultConfig()
+	config.ProxyPort, config.AdminPort, config.MetricsPort, config.HealthPort = 3306, 8080, 9090, 8086
+	for port, want := range map[int]string{
+		0:    "",
+		6060: "",
+		3306: "PROXY_PORT",
+		8080: "ADMIN_PORT",
+		9090: "METRICS_PORT",
+		8086: "HEALTH_PORT",
+	} {
+		config.DebugPort = port
+		err := checkDebugPort(config)
+		if want == "" && err != nil || want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Errorf("DEBUG_PORT %d: %v", port, err)
+		}
+	}
+}
+
+// unusedPort returns a loopback port nothing listens on
+func unusedPort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// getPage fetches path from the HTTP server at addr, once it answers
+func getPage(t *testing.T, addr, path string) string {
+	t.Helper()
+	var (
+		resp *http.Response
+		err  error
+	)
+	eventually(t, "the HTTP server to answer", func() bool {
+		resp, err = http.Get("http://" + addr + path)
+		return err == nil
+	})
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %d %s", path, resp.StatusCode, body)
+	}
+	return string(body)
+}
+
+func TestDebugServer(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.ListenAddress = "127.0.0.1"
+	config.ProxyPort = 0
+	config.StartupWait = 0
+	config.ShutdownTimeout = time.Second
+	config.DebugPort = unusedPort(t)
+	logger, _ := testLogger()
+	p, err := New(config, WithLogger(logger), WithEnsurer(&recordingEnsurer{backend: backend}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- p.ListenAndServe(ctx) }()
+	eventually(t, "the proxy to listen", func() bool { return p.Addr() != nil })
+
+	// The pages answer while the proxy relays connections
+	c := mustConnect(t, p.Addr().String(), testHandshake{user: "root", database: "orders"})
+	c.mustQuery("SELECT 1")
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(config.DebugPort))
+	if goroutines := getPage(t, addr, "/debug/pprof/goroutine?debug=1"); !strings.Contains(goroutines, "handleConnection") {
+		t.Fatalf("goroutine profile without the relayed connection:\n%s", goroutines)
+	}
+
+	var vars struct {
+		Memstats struct{ Alloc uint64 }     `json:"memstats"`
+		Metrics  map[string]json.RawMessage `json:"mysql_autodb"`
+	}
+	if err := json.Unmarshal([]byte(getPage(t, addr, "/debug/vars")), &vars); err != nil {
+		t.Fatalf("decode /debug/vars: %v", err)
+	}
+	if vars.Memstats.Alloc == 0 {
+		t.Error("/debug/vars without memory statistics")
+	}
+	var active int64
+	var packets map[string]uint64
+	json.Unmarshal(vars.Metrics["mysql_autodb_connections_active"], &active)
+	json.Unmarshal(vars.Metrics["mysql_autodb_forwarded_packets_total"], &packets)
+	if active < 1 || packets["client_to_server"] == 0 || packets["server_to_client"] == 0 {
+		t.Fatalf("/debug/vars shows %d active connections and %v packets relayed", active, packets)
+	}
+	if _, ok := vars.Metrics["mysql_autodb_forward_buffer_allocations_total"]; !ok {
+		t.Error("/debug/vars without the forward buffer allocations")
+	}
+
+	// and stop with the proxy
+	c.conn.Close()
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("ListenAndServe: %v", err)
+	}
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Fatal("the debug server is still listening after shutdown")
+	}
+}
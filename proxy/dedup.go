@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// dedupEntry is a database that has been announced, as stored on disk
+type dedupEntry struct {
+	Backend  string `json:"backend"`
+	Database string `json:"database"`
+}
+
+// dedupStore remembers, across restarts, which databases creation events have
+// been published for. Entries are appended to a file as JSON lines and the
+// whole file is loaded when the store is opened.
+type dedupStore struct {
+	mu   sync.Mutex
+	seen map[dedupEntry]bool
+	file *os.File
+}
+
+// openDedupStore loads the announced databases recorded at path, creating the
+// file if needed
+func openDedupStore(path string) (*dedupStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event dedup store: %w", err)
+	}
+
+	d := &dedupStore{seen: make(map[dedupEntry]bool), file: file}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry dedupEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("invalid entry on line %d of event dedup store: %w", line, err)
+		}
+		d.seen[entry] = true
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read event dedup store: %w", err)
+	}
+	return d, nil
+}
+
+// firstAnnouncement reports whether no event has been published yet for the
+// database on backend, recording it as announced if so. The entry is synced to
+// disk before it returns, so an event is not announced again after a crash.
+func (d *dedupStore) firstAnnouncement(backend, database string) (bool, error) {
+	entry := dedupEntry{Backend: backend, Database: database}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.seen[entry] {
+		return false, nil
+	}
+	if d.file == nil {
+		return true, errors.New("event dedup store closed")
+	}
+	d.seen[entry] = true
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return true, err
+	}
+	if _, err := d.file.Write(append(line, '\n')); err != nil {
+		return true, fmt.Errorf("failed to record announced database: %w", err)
+	}
+	return true, d.file.Sync()
+}
+
+// Close closes the store's file
+func (d *dedupStore) Close(ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
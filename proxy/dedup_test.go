@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDedupStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "announced")
+	store, err := openDedupStore(path)
+	if err != nil {
+		t.Fatalf("openDedupStore: %v", err)
+	}
+	for _, tc := range []struct {
+		backend, database string
+		first             bool
+	}{
+		{"mysql:3306", "orders", true},
+		{"mysql:3306", "orders", false},
+		{"mysql-eu:3306", "orders", true},
+	} {
+		if first, err := store.firstAnnouncement(tc.backend, tc.database); err != nil || first != tc.first {
+			t.Fatalf("firstAnnouncement(%s, %s) = %v, %v", tc.backend, tc.database, first, err)
+		}
+	}
+	store.Close(context.Background())
+
+	// A restarted proxy loads what was announced before
+	store, err = openDedupStore(path)
+	if err != nil {
+		t.Fatalf("openDedupStore: %v", err)
+	}
+	defer store.Close(context.Background())
+	if first, _ := store.firstAnnouncement("mysql-eu:3306", "orders"); first {
+		t.Fatal("a database announced before the restart was announced again")
+	}
+	if first, _ := store.firstAnnouncement("mysql:3306", "billing"); !first {
+		t.Fatal("a new database was not announced")
+	}
+
+	if err := os.WriteFile(path, []byte("{\"backend\":\"mysql:3306\"}\nnot json\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openDedupStore(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("openDedupStore: %v", err)
+	}
+}
+
+func TestCreationEventsDedupedAcrossRestarts(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		delivered []string
+	)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event CreationEvent
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &event)
+		mu.Lock()
+		delivered = append(delivered, event.Database)
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.WebhookURL = webhook.URL
+	config.CreateEventDedupStore = filepath.Join(t.TempDir(), "announced")
+
+	p, addr := startProxy(t, config)
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("USE orders")
+	c.conn.Close()
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	// After the restart, a database created again is not announced twice
+	backend.mu.Lock()
+	delete(backend.databases, "orders")
+	backend.mu.Unlock()
+	p, addr = startProxy(t, config)
+	c = mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("USE orders")
+	c.mustQuery("USE billing")
+	c.conn.Close()
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	if !backend.hasDatabase("orders") {
+		t.Fatal("the database was not created again")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"orders", "billing"}; !equalStrings(delivered, want) {
+		t.Fatalf("webhook received %q, want %q", delivered, want)
+	}
+}
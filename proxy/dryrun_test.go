@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// adminQueries returns the queries MySQL received that only the proxy's own
+// connections send
+func adminQueries(backend *fakeMySQL) []string {
+	var queries []string
+	for _, query := range backend.receivedQueries() {
+		if strings.Contains(query, "CREATE DATABASE") || strings.Contains(query, "SCHEMATA") || strings.Contains(query, "lower_case_table_names") {
+			queries = append(queries, query)
+		}
+	}
+	return queries
+}
+
+func TestDryRun(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.DryRun = true
+	logger, hook := testLogger()
+	p, addr := startProxy(t, config, WithLogger(logger))
+
+	// Clients are relayed untouched, so that MySQL refuses databases that do
+	// not exist
+	wouldCreate := dryRunDatabases.Value("would_create")
+	_, response := connect(t, addr, testHandshake{user: "app", database: "orders"})
+	expectErr(t, response, 1049)
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	expectErr(t, c.query("USE billing"), 1049)
+
+	// and the proxy never connects to MySQL itself
+	if queries := adminQueries(backend); len(queries) != 0 {
+		t.Fatalf("MySQL received %q", queries)
+	}
+	if sessions := backend.sessionCount(); sessions != 2 {
+		t.Fatalf("MySQL accepted %d connections for 2 clients", sessions)
+	}
+	if backend.hasDatabase("orders") || backend.hasDatabase("billing") {
+		t.Fatal("a dry run created a database")
+	}
+
+	// The databases it would have created are logged, counted and recorded
+	var logged []string
+	for _, entry := range queryEntries(hook, "Dry run: would create database") {
+		logged = append(logged, entry.Data["database"].(string))
+	}
+	if !equalStrings(logged, []string{"orders", "billing"}) {
+		t.Fatalf("logged %q", logged)
+	}
+	if got := dryRunDatabases.Value("would_create") - wouldCreate; got != 2 {
+		t.Fatalf("%d databases counted, want 2", got)
+	}
+	database, ok := p.created.get("orders")
+	if !ok || !database.DryRun || database.Username != "app" {
+		t.Fatalf("registered %+v, %v", database, ok)
+	}
+	if findEntry(hook, "Created database") != nil {
+		t.Fatal("a creation was logged")
+	}
+
+	// Dropping a dry-run entry only forgets it
+	if err := p.dropDatabase(context.Background(), database); err != nil {
+		t.Fatalf("dropDatabase: %v", err)
+	}
+	if _, ok := p.created.get("orders"); ok {
+		t.Fatal("the dropped entry is still registered")
+	}
+	if queries := adminQueries(backend); len(queries) != 0 {
+		t.Fatalf("MySQL received %q", queries)
+	}
+}
+
+func TestDryRunCheck(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.create("existing")
+	config := testConfig(backend)
+	config.DryRun = true
+	config.DryRunCheck = true
+	logger, hook := testLogger()
+	p, addr := startProxy(t, config, WithLogger(logger))
+
+	exists := dryRunDatabases.Value("exists")
+	c := mustConnect(t, addr, testHandshake{user: "root", database: "existing"})
+	expectErr(t, c.query("USE missing"), 1049)
+
+	// Existence is checked, but nothing created
+	if checks := schemataQueries(backend); checks != 2 {
+		t.Fatalf("%d existence checks, want 2", checks)
+	}
+	for _, query := range backend.receivedQueries() {
+		if strings.HasPrefix(query, "CREATE DATABASE") {
+			t.Fatalf("MySQL received %q", query)
+		}
+	}
+	if entry := findEntry(hook, "Dry run: database already exists"); entry == nil || entry.Data["database"] != "existing" {
+		t.Fatal("the existing database was not logged")
+	}
+	if entry := findEntry(hook, "Dry run: would create database"); entry == nil || entry.Data["database"] != "missing" || entry.Data["checked"] != true {
+		t.Fatal("the missing database was not logged")
+	}
+	if dryRunDatabases.Value("exists") != exists+1 {
+		t.Fatal("the existing database was not counted")
+	}
+	if _, ok := p.created.get("existing"); ok {
+		t.Fatal("an existing database was registered")
+	}
+	if database, ok := p.created.get("missing"); !ok || !database.DryRun {
+		t.Fatalf("registered %+v, %v", database, ok)
+	}
+}
+
+func TestDryRunCheckNeedsDryRun(t *testing.T) {
+	config := testConfig(startFakeMySQL(t))
+	config.DryRunCheck = true
+	if _, err := New(config); err == nil || !strings.Contains(err.Error(), "DRY_RUN_CHECK needs DRY_RUN") {
+		t.Fatalf("New: %v", err)
+	}
+}
@@ -0,0 +1,620 @@
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ConnContext carries per-connection data into database ensurers so that they
+// can log, audit and notify with the full context of the triggering client
+type ConnContext struct {
+	ID          uint64
+	ClientAddr  string
+	Username    string
+	ConnectedAt time.Time
+
+	// Backend is the address of the MySQL server the connection is relayed to
+	Backend string
+
+	// routedByAttribute is set when ATTRIBUTE_ROUTES chose the backend, which
+	// DATABASE_ROUTES then do not apply to
+	routedByAttribute bool
+
+	// Attributes are the connection attributes the client sent in its
+	// handshake, nil if it sent none
+	Attributes map[string]string
+
+	// capabilities are the capability flags of the client's handshake response
+	capabilities uint32
+
+	// namer maps the database names the client selects to their names on
+	// MySQL, with the prefix of the LISTENERS port it arrived on
+	namer *databaseNamer
+
+	// credentials, when set, are the client's own, which the connection's
+	// databases are created with instead of the configured admin account
+	credentials *adminCredentials
+
+	// logger carries the connection's conn_id and client_addr
+	logger *logrus.Entry
+
+	mu        sync.Mutex
+	currentDB string
+	creates   int
+}
+
+// Logger returns the connection's logger, or the standard logger for
+// operations not triggered by a client connection
+func (cc *ConnContext) Logger() *logrus.Entry {
+	if cc.logger == nil {
+		return logrus.NewEntry(logrus.StandardLogger())
+	}
+	return cc.logger
+}
+
+// CurrentDB returns the database currently selected on the connection, or ""
+// if none is selected
+func (cc *ConnContext) CurrentDB() string {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.currentDB
+}
+
+// Creates returns the number of databases created on behalf of the connection
+func (cc *ConnContext) Creates() int {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	return cc.creates
+}
+
+// recordCreate counts a database created on behalf of the connection
+func (cc *ConnContext) recordCreate() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.creates++
+}
+
+// setCurrentDB records the database selected on the connection
+func (cc *ConnContext) setCurrentDB(name string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.currentDB = name
+}
+
+var databasesCreated = newCounterVec("mysql_autodb_databases_created_total",
+	"Databases created by the proxy, by backend", "backend")
+
+var sharedEnsures = newCounter("mysql_autodb_shared_database_checks_total",
+	"Database checks and creations shared with a concurrent connection selecting the same database")
+
+var createLimitReached = newCounter("mysql_autodb_connection_create_limit_reached_total",
+	"Database creations refused because the connection reached MAX_CREATES_PER_CONNECTION")
+
+var dryRunDatabases = newCounterVec("mysql_autodb_dry_run_databases_total",
+	"Databases selected in a dry run, by outcome (would_create or exists)", "outcome")
+
+type connContextKey struct{}
+
+// withConnContext returns a context carrying the connection context
+func withConnContext(ctx context.Context, cc *ConnContext) context.Context {
+	return context.WithValue(ctx, connContextKey{}, cc)
+}
+
+// connContextFrom returns the connection context carried by ctx, or an empty
+// one for operations not triggered by a client connection
+func connContextFrom(ctx context.Context) *ConnContext {
+	if cc, ok := ctx.Value(connContextKey{}).(*ConnContext); ok {
+		return cc
+	}
+	return &ConnContext{}
+}
+
+type createTriggerKey struct{}
+
+// withCreateTrigger returns a context recording what made a connection ask
+// for a database: "handshake", "use", "com_init_db", "com_change_user" or
+// "com_field_list"
+func withCreateTrigger(ctx context.Context, trigger string) context.Context {
+	return context.WithValue(ctx, createTriggerKey{}, trigger)
+}
+
+// createTriggerFrom returns the trigger recorded in ctx, or ""
+func createTriggerFrom(ctx context.Context) string {
+	trigger, _ := ctx.Value(createTriggerKey{}).(string)
+	return trigger
+}
+
+// DatabaseEnsurer makes sure a database exists, creating it if necessary
+type DatabaseEnsurer interface {
+	EnsureExists(ctx context.Context, name string) error
+}
+
+// sqlEnsurer creates databases on the backend through an admin connection
+type sqlEnsurer struct {
+	config Config
+	log    logrus.FieldLogger
+
+	// db is the connection pool used to check for and create databases
+	db *sql.DB
+
+	// lowerCaseTableNames is the backend's @@lower_case_table_names value.
+	// lowerCaseKnown is unset while it could not be detected, for example
+	// because MySQL was still starting, and detection is retried in the
+	// background on use, no sooner than lowerCaseRetry.
+	lowerCaseMu         sync.Mutex
+	lowerCaseTableNames int
+	lowerCaseKnown      bool
+	lowerCaseDetecting  bool
+	lowerCaseRetry      time.Time
+	lowerCaseBackoff    time.Duration
+
+	// onCreate is called after a database has actually been created, with
+	// the user created for it, if any
+	onCreate func(ctx context.Context, name, user string)
+
+	// onDryRun is called, in a dry run, for a database that would have been
+	// created
+	onDryRun func(ctx context.Context, name string)
+
+	// locks serializes operations on the same database
+	locks nameLocks
+
+	// names restricts which databases may be created
+	names *namePolicy
+
+	// known caches the databases seen to exist, nil when CacheTTL is 0
+	known *knownDatabases
+
+	// rate limits creations, shared by the ensurers of every backend; nil
+	// when unlimited
+	rate *createRateLimiter
+
+	// flights shares an in-flight check and create between the connections
+	// selecting the same database
+	flights flightGroup
+}
+
+// nameLocks is a set of mutexes keyed by database name. Creating and dropping
+// a database hold its lock, so a drop never interleaves with a create that is
+// already in flight, even when the client that triggered the create has gone.
+type nameLocks struct {
+	mu    sync.Mutex
+	locks map[string]*nameLock
+}
+
+// nameLock is a mutex shared by the holders and waiters of one name
+type nameLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock acquires the lock for name, returning the function that releases it
+func (l *nameLocks) lock(name string) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*nameLock)
+	}
+	nl, ok := l.locks[name]
+	if !ok {
+		nl = &nameLock{}
+		l.locks[name] = nl
+	}
+	nl.refs++
+	l.mu.Unlock()
+
+	nl.Lock()
+	return func() {
+		nl.Unlock()
+
+		l.mu.Lock()
+		if nl.refs--; nl.refs == 0 {
+			delete(l.locks, name)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// flightGroup runs one call at a time per name, handing its result to every
+// caller that asked for the same name while it was in flight
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a call in progress and, once done is closed, its result
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+// do runs fn for name unless a call for name is already in flight, in which
+// case it waits for that call instead. It reports whether the result was
+// shared from another caller's call, and the result.
+func (g *flightGroup) do(name string, fn func() error) (bool, error) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	if f, ok := g.flights[name]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return true, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[name] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.flights, name)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.err = fn()
+	return false, f.err
+}
+
+// newSQLEnsurer creates an ensurer for the configured backend
+func newSQLEnsurer(config Config, log logrus.FieldLogger) (*sqlEnsurer, error) {
+	e := &sqlEnsurer{config: config, log: log, known: newKnownDatabases(config.CacheTTL)}
+
+	// sql.Open only validates the DSN; connections are made on first use
+	dsn, err := adminDSN(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MySQL connection settings: %w", err)
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MySQL connection settings: %w", err)
+	}
+	db.SetConnMaxLifetime(config.CreateConnMaxLifetime)
+	db.SetMaxOpenConns(config.CreateMaxOpenConns)
+	db.SetMaxIdleConns(config.CreateMaxIdleConns)
+	e.db = db
+
+	if e.names, err = newNamePolicy(config.DBNameAllow, config.DBNameDeny); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("invalid database name patterns: %w", err)
+	}
+
+	if config.LowerCaseTableNames == "auto" && e.offline() {
+		e.log.Info("Dry run without existence checks, assuming lower_case_table_names 0")
+	} else if config.LowerCaseTableNames == "auto" {
+		// MySQL may not be up yet, which must not stop the proxy from starting
+		e.detectLowerCase()
+	} else {
+		fmt.Sscanf(config.LowerCaseTableNames, "%d", &e.lowerCaseTableNames)
+		e.lowerCaseKnown = true
+		e.log.WithFields(logrus.Fields{
+			"lower_case_table_names": e.lowerCaseTableNames,
+			"source":                 config.LowerCaseTableNames,
+		}).Info("Backend lower_case_table_names setting")
+	}
+
+	return e, nil
+}
+
+// lowerCase returns the backend's lower_case_table_names setting. While it
+// is not known yet 0 is assumed and detection is retried in the background,
+// so that callers never wait on MySQL for it.
+func (e *sqlEnsurer) lowerCase() int {
+	e.lowerCaseMu.Lock()
+	defer e.lowerCaseMu.Unlock()
+
+	if !e.lowerCaseKnown && !e.lowerCaseDetecting && !e.offline() && !time.Now().Before(e.lowerCaseRetry) {
+		e.lowerCaseDetecting = true
+		go e.detectLowerCase()
+	}
+	return e.lowerCaseTableNames
+}
+
+// detectLowerCase asks MySQL for its lower_case_table_names setting. After a
+// failure the next attempt is put off, twice as long each time up to
+// maxLowerCaseBackoff.
+func (e *sqlEnsurer) detectLowerCase() {
+	value, err := detectLowerCaseTableNames(e.db)
+
+	e.lowerCaseMu.Lock()
+	defer e.lowerCaseMu.Unlock()
+	e.lowerCaseDetecting = false
+	if err != nil {
+		if e.lowerCaseBackoff *= 2; e.lowerCaseBackoff == 0 {
+			e.lowerCaseBackoff = minLowerCaseBackoff
+		} else if e.lowerCaseBackoff > maxLowerCaseBackoff {
+			e.lowerCaseBackoff = maxLowerCaseBackoff
+		}
+		e.lowerCaseRetry = time.Now().Add(e.lowerCaseBackoff)
+		e.log.WithError(err).WithField("retry_in", e.lowerCaseBackoff.String()).
+			Warn("Failed to detect lower_case_table_names, assuming 0 until MySQL answers")
+		return
+	}
+	e.lowerCaseTableNames, e.lowerCaseKnown = value, true
+	e.log.WithFields(logrus.Fields{
+		"lower_case_table_names": value,
+		"source":                 "auto",
+	}).Info("Backend lower_case_table_names setting")
+}
+
+// offline reports whether the ensurer never connects to MySQL, in a dry run
+// that does not check whether databases exist
+func (e *sqlEnsurer) offline() bool {
+	return e.config.DryRun && !e.config.DryRunCheck
+}
+
+// adminDSN builds the connection string used for administrative operations
+func adminDSN(config Config) (string, error) {
+	addr := net.JoinHostPort(config.MySQLHost, strconv.Itoa(config.MySQLPort))
+	tlsParams, err := adminTLSParams(config, addr)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s@tcp(%s)/?timeout=10s&readTimeout=10s&writeTimeout=10s%s",
+		config.MySQLUser, config.MySQLPassword, addr, tlsParams), nil
+}
+
+// minLowerCaseBackoff and maxLowerCaseBackoff bound the delay between
+// attempts at detecting lower_case_table_names
+const (
+	minLowerCaseBackoff = 250 * time.Millisecond
+	maxLowerCaseBackoff = 30 * time.Second
+)
+
+// detectLowerCaseTableNames queries the backend's @@lower_case_table_names setting
+func detectLowerCaseTableNames(db *sql.DB) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var value int
+	if err := db.QueryRowContext(ctx, "SELECT @@lower_case_table_names").Scan(&value); err != nil {
+		return 0, fmt.Errorf("failed to query lower_case_table_names: %w", err)
+	}
+	return value, nil
+}
+
+// databaseKey returns the form of a database name used for comparisons.
+// With lower_case_table_names set to 1 or 2 the server compares schema names
+// case-insensitively, so the name is lowercased to match.
+func (e *sqlEnsurer) databaseKey(dbName string) string {
+	if e.lowerCase() != 0 {
+		return strings.ToLower(dbName)
+	}
+	return dbName
+}
+
+// EnsureExists creates the database if it doesn't exist. The create is not
+// tied to the client connection, so it completes even if the client disconnects
+// while it is in flight.
+func (e *sqlEnsurer) EnsureExists(ctx context.Context, dbName string) error {
+	cc := connContextFrom(ctx)
+	logger := cc.Logger().WithField("database", dbName)
+
+	// Validate database name
+	if err := validateDatabaseName(dbName, e.config.StrictDBNames); err != nil {
+		return fmt.Errorf("invalid database name: %w", err)
+	}
+	if err := e.names.permit(dbName, logger); err != nil {
+		return err
+	}
+
+	// A dry run that does not check only reports what it would create
+	if e.offline() {
+		e.wouldCreate(ctx, dbName, logger)
+		return nil
+	}
+
+	// Databases seen recently need no round-trip to MySQL
+	key := e.databaseKey(dbName)
+	if e.known.has(key) {
+		logger.Debug("Database known to exist")
+		return nil
+	}
+
+	// Connections selecting the same database at once share a single check
+	// and create. The creation limit is per connection though, so a
+	// connection that joined one refused by the limit tries on its own.
+	for {
+		shared, err := e.flights.do(key, func() error {
+			return e.ensureExists(ctx, dbName, logger)
+		})
+		if !shared {
+			return err
+		}
+		sharedEnsures.Inc()
+		if err == nil || errorCategoryOf(err) != errCategoryRateLimited {
+			logger.Debug("Shared the database check of a concurrent connection")
+			return err
+		}
+	}
+}
+
+// ensureExists checks for the database and creates it if it is missing,
+// holding the name's lock throughout
+func (e *sqlEnsurer) ensureExists(ctx context.Context, dbName string, logger *logrus.Entry) error {
+	cc := connContextFrom(ctx)
+
+	// Time each phase so that slow creations can be explained
+	timer := newPhaseTimer()
+	defer func() {
+		if threshold := e.config.SlowCreateThreshold; threshold > 0 && timer.total() >= threshold {
+			logger.WithFields(timer.phases).WithField("total", timer.total().String()).Warn("Slow database creation")
+		}
+	}()
+
+	// Hold the name's lock so that a drop cannot race with the create below
+	unlock := e.locks.lock(e.databaseKey(dbName))
+	defer unlock()
+	timer.mark("lock_wait")
+
+	db, release, err := e.adminDB(cc)
+	if err != nil {
+		return fmt.Errorf("failed to connect with the client's credentials: %w", err)
+	}
+	defer release()
+
+	// Set connection timeout
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	// Check if database exists
+	var exists int
+	query := "SELECT COUNT(*) FROM INFORMATION_SCHEMA.SCHEMATA WHERE SCHEMA_NAME = ?"
+	if e.lowerCase() != 0 {
+		query = "SELECT COUNT(*) FROM INFORMATION_SCHEMA.SCHEMATA WHERE LOWER(SCHEMA_NAME) = ?"
+	}
+	err = db.QueryRowContext(ctx, query, e.databaseKey(dbName)).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("failed to check if database exists: %w", err)
+	}
+	timer.mark("exists_check")
+
+	if exists != 0 {
+		if e.config.DryRun {
+			dryRunDatabases.Inc("exists")
+			logger.Info("Dry run: database already exists")
+		}
+		logger.WithField("cached", e.known.add(e.databaseKey(dbName))).Debug("Database already exists")
+		return nil
+	}
+	if e.config.DryRun {
+		e.wouldCreate(ctx, dbName, logger)
+		return nil
+	}
+
+	// Refuse to create yet another database for a connection over its limit
+	if limit := e.config.MaxCreatesPerConnection; limit > 0 && cc.Creates() >= limit {
+		createLimitReached.Inc()
+		logger.WithField("limit", limit).Warn("Connection reached its database creation limit")
+		return newProxyError(errCategoryRateLimited, "connection may create at most %d databases", limit)
+	}
+	if err := e.rate.allow(cc.ClientAddr, logger); err != nil {
+		return err
+	}
+
+	// Database doesn't exist, create it
+	createQuery := "CREATE DATABASE " + quoteIdentifier(dbName)
+	_, err = db.ExecContext(ctx, createQuery)
+	if err != nil {
+		return fmt.Errorf("failed to create database %s: %w", dbName, err)
+	}
+	timer.mark("create")
+	logger.Info("Created database")
+	cc.recordCreate()
+	logger.WithField("cached", e.known.add(e.databaseKey(dbName))).Debug("Cached created database")
+
+	e.seed(ctx, db, dbName, logger)
+	timer.mark("seed")
+
+	user := e.createUser(ctx, db, dbName, logger)
+	timer.mark("create_user")
+
+	if e.onCreate != nil {
+		e.onCreate(ctx, dbName, user)
+		timer.mark("on_create")
+	}
+	return nil
+}
+
+// wouldCreate reports a database a dry run would have created. It is not
+// cached, so that a database created meanwhile is seen to exist.
+func (e *sqlEnsurer) wouldCreate(ctx context.Context, dbName string, logger *logrus.Entry) {
+	dryRunDatabases.Inc("would_create")
+	logger.WithField("checked", e.config.DryRunCheck).Info("Dry run: would create database")
+	if e.onDryRun != nil {
+		e.onDryRun(ctx, dbName)
+	}
+}
+
+// Drop drops a database. It holds the name's lock, so it never interleaves
+// with a create of the same database.
+func (e *sqlEnsurer) Drop(ctx context.Context, dbName string) error {
+	if err := validateDatabaseName(dbName, e.config.StrictDBNames); err != nil {
+		return fmt.Errorf("invalid database name: %w", err)
+	}
+
+	unlock := e.locks.lock(e.databaseKey(dbName))
+	defer unlock()
+	e.known.forget(e.databaseKey(dbName))
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if _, err := e.db.ExecContext(ctx, "DROP DATABASE IF EXISTS "+quoteIdentifier(dbName)); err != nil {
+		return fmt.Errorf("failed to drop database %s: %w", dbName, err)
+	}
+	e.log.WithField("database", dbName).Info("Dropped database")
+	return nil
+}
+
+// existingDatabases returns the databases on the backend, by databaseKey
+func (e *sqlEnsurer) existingDatabases(ctx context.Context) (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	rows, err := e.db.QueryContext(ctx, "SELECT SCHEMA_NAME FROM INFORMATION_SCHEMA.SCHEMATA")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to list databases: %w", err)
+		}
+		existing[e.databaseKey(name)] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to list databases: %w", err)
+	}
+	return existing, nil
+}
+
+// Forget removes a database from the cache of databases known to exist, so
+// that the next connection selecting it checks MySQL again
+func (e *sqlEnsurer) Forget(dbName string) {
+	if cached, size := e.known.forget(e.databaseKey(dbName)); cached {
+		e.log.WithFields(logrus.Fields{
+			"database": dbName,
+			"cached":   size,
+		}).Debug("Forgot database reported unknown by MySQL")
+	}
+}
+
+// Remember adds a database a client created itself to the cache of databases
+// known to exist
+func (e *sqlEnsurer) Remember(dbName string) {
+	e.known.add(e.databaseKey(dbName))
+}
+
+// phaseTimer records how long each phase of an operation took
+type phaseTimer struct {
+	start  time.Time
+	last   time.Time
+	phases logrus.Fields
+}
+
+// newPhaseTimer starts timing the first phase
+func newPhaseTimer() *phaseTimer {
+	now := time.Now()
+	return &phaseTimer{start: now, last: now, phases: logrus.Fields{}}
+}
+
+// mark ends the current phase, recording its duration under name
+func (t *phaseTimer) mark(name string) {
+	now := time.Now()
+	t.phases[name] = now.Sub(t.last).String()
+	t.last = now
+}
+
+// total returns the time since the timer started
+func (t *phaseTimer) total() time.Duration {
+	return time.Since(t.start)
+}
@@ -0,0 +1,494 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// newTestEnsurer creates a sqlEnsurer for the fake backend
+func newTestEnsurer(t *testing.T, config Config) *sqlEnsurer {
+	t.Helper()
+	logger, _ := testLogger()
+	e, err := newSQLEnsurer(config, logger)
+	if err != nil {
+		t.Fatalf("newSQLEnsurer: %v", err)
+	}
+	t.Cleanup(func() { e.db.Close() })
+	return e
+}
+
+func TestNameLocks(t *testing.T) {
+	var locks nameLocks
+	unlock := locks.lock("orders")
+
+	// Other names are not held up
+	locks.lock("billing")()
+
+	acquired := make(chan struct{})
+	go func() {
+		locks.lock("orders")()
+		close(acquired)
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("the lock of a held name was acquired")
+	case <-time.After(20 * time.Millisecond):
+	}
+	unlock()
+	<-acquired
+
+	locks.mu.Lock()
+	defer locks.mu.Unlock()
+	if len(locks.locks) != 0 {
+		t.Fatalf("%d locks kept after release", len(locks.locks))
+	}
+}
+
+func TestFlightGroup(t *testing.T) {
+	var (
+		group   flightGroup
+		calls   atomic.Int32
+		wg      sync.WaitGroup
+		started = make(chan struct{})
+		release = make(chan struct{})
+		failed  = errors.New("create failed")
+	)
+	results := make(chan error, 10)
+	shares := make(chan bool, 10)
+	run := func() {
+		defer wg.Done()
+		shared, err := group.do("orders", func() error {
+			calls.Add(1)
+			close(started)
+			<-release
+			return failed
+		})
+		shares <- shared
+		results <- err
+	}
+	wg.Add(1)
+	go run()
+	<-started
+	for i := 0; i < 9; i++ {
+		wg.Add(1)
+		go run()
+	}
+	// Give the other callers time to join the flight
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(shares)
+	close(results)
+
+	// Every caller got the error of the single call
+	if calls.Load() != 1 {
+		t.Fatalf("%d calls, want 1", calls.Load())
+	}
+	for err := range results {
+		if err != failed {
+			t.Fatalf("caller got %v", err)
+		}
+	}
+	owners := 0
+	for shared := range shares {
+		if !shared {
+			owners++
+		}
+	}
+	if owners != 1 {
+		t.Fatalf("%d callers ran the call themselves", owners)
+	}
+
+	// A finished flight is not shared with later callers
+	if shared, err := group.do("orders", func() error { return nil }); shared || err != nil {
+		t.Fatalf("do = %v, %v", shared, err)
+	}
+}
+
+func TestConcurrentEnsureExists(t *testing.T) {
+	backend := startFakeMySQL(t)
+	e := newTestEnsurer(t, testConfig(backend))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- e.EnsureExists(context.Background(), "orders")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("EnsureExists: %v", err)
+		}
+	}
+
+	creates := 0
+	for _, query := range backend.receivedQueries() {
+		if strings.HasPrefix(strings.ToUpper(query), "CREATE DATABASE") {
+			creates++
+		}
+	}
+	if creates != 1 {
+		t.Fatalf("%d CREATE DATABASE issued, want 1", creates)
+	}
+}
+
+func TestDropWaitsForInFlightCreate(t *testing.T) {
+	backend := startFakeMySQL(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	backend.handleCommands(func(s *fakeSession, payload []byte) bool {
+		if strings.HasPrefix(string(payload[1:]), "CREATE DATABASE") {
+			close(started)
+			<-release
+		}
+		return false
+	})
+	e := newTestEnsurer(t, testConfig(backend))
+
+	// A drop, as of an ephemeral database whose client went away, comes in
+	// while the create is in flight
+	created := make(chan error, 1)
+	go func() { created <- e.EnsureExists(context.Background(), "ephemeral") }()
+	<-started
+
+	dropped := make(chan error, 1)
+	go func() { dropped <- e.Drop(context.Background(), "ephemeral") }()
+	time.Sleep(50 * time.Millisecond)
+	if containsString(backend.receivedQueries(), "DROP DATABASE IF EXISTS `ephemeral`") {
+		t.Fatal("the drop reached MySQL while the create was in flight")
+	}
+
+	close(release)
+	if err := <-created; err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if err := <-dropped; err != nil {
+		t.Fatalf("drop: %v", err)
+	}
+	queries := backend.receivedQueries()
+	create, drop := indexOf(queries, "CREATE DATABASE `ephemeral`"), indexOf(queries, "DROP DATABASE IF EXISTS `ephemeral`")
+	if create < 0 || drop < create {
+		t.Fatalf("queries ran in the order %q", queries)
+	}
+	if backend.hasDatabase("ephemeral") {
+		t.Fatal("the database survived its drop")
+	}
+}
+
+// indexOf returns the index of the first element equal to s, or -1
+func indexOf(list []string, s string) int {
+	for i, element := range list {
+		if element == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestCreateCompletesAfterClientDisconnects(t *testing.T) {
+	backend := startFakeMySQL(t)
+	started, release := make(chan struct{}), make(chan struct{})
+	backend.handleCommands(func(s *fakeSession, payload []byte) bool {
+		if string(payload[1:]) == "CREATE DATABASE `abandoned`" {
+			close(started)
+			<-release
+		}
+		return false
+	})
+	_, addr := startProxy(t, testConfig(backend))
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	if err := writePacket(c.conn, newPacket(0, append([]byte{comQuery}, "USE abandoned"...))); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	<-started
+	c.conn.Close()
+	close(release)
+	eventually(t, "the database to be created", func() bool { return backend.hasDatabase("abandoned") })
+}
+
+func TestMaxCreatesPerConnection(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.create("existing")
+	config := testConfig(backend)
+	config.MaxCreatesPerConnection = 2
+	_, addr := startProxy(t, config)
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("USE first")
+	c.mustQuery("USE second")
+	refused := createLimitReached.Value()
+	expectErr(t, c.query("USE third"), 1226)
+	if got := createLimitReached.Value() - refused; got != 1 {
+		t.Fatalf("counted %d refused creations", got)
+	}
+	if backend.hasDatabase("third") {
+		t.Fatal("a connection over its limit created a database")
+	}
+
+	// Selecting databases that exist is not limited
+	c.mustQuery("USE existing")
+	c.mustQuery("USE first")
+
+	// The limit is per connection
+	mustConnect(t, addr, testHandshake{user: "root"}).mustQuery("USE third")
+	if !backend.hasDatabase("third") {
+		t.Fatal("another connection could not create a database")
+	}
+}
+
+func TestCreateConnMaxLifetime(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.CreateConnMaxLifetime = 50 * time.Millisecond
+	e := newTestEnsurer(t, config)
+
+	if err := e.EnsureExists(context.Background(), "first"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	sessions := backend.sessionCount()
+	time.Sleep(100 * time.Millisecond)
+	if err := e.EnsureExists(context.Background(), "second"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	// The pooled connection outlived its lifetime and was replaced
+	if backend.sessionCount() <= sessions {
+		t.Fatal("the second create reused the expired connection")
+	}
+	if closed := e.db.Stats().MaxLifetimeClosed; closed == 0 {
+		t.Fatal("no connection was closed for its lifetime")
+	}
+}
+
+func TestCreatePoolSettings(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.CreateMaxOpenConns = 3
+	config.CreateMaxIdleConns = 1
+	e := newTestEnsurer(t, config)
+
+	if open := e.db.Stats().MaxOpenConnections; open != 3 {
+		t.Fatalf("pool allows %d open connections, want 3", open)
+	}
+
+	// Creations share the pooled connections rather than dialing MySQL for
+	// each database
+	sessions := backend.sessionCount()
+	for i := 0; i < 20; i++ {
+		if err := e.EnsureExists(context.Background(), fmt.Sprintf("pooled_%d", i)); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	if dialed := backend.sessionCount() - sessions; dialed > config.CreateMaxOpenConns {
+		t.Fatalf("%d connections dialed for 20 creations", dialed)
+	}
+}
+
+func TestEnsurerStartsWithMySQLDown(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.create("mixed")
+	backend.stop()
+	config := testConfig(backend)
+	config.LowerCaseTableNames = "auto"
+	e := newTestEnsurer(t, config)
+
+	if err := e.EnsureExists(context.Background(), "Mixed"); err == nil {
+		t.Fatal("created a database with MySQL down")
+	}
+
+	// lower_case_table_names is detected once MySQL answers, so the existing
+	// database is found under its lowercased name
+	backend.mu.Lock()
+	backend.lowerCase = 1
+	backend.mu.Unlock()
+	backend.restart()
+	eventually(t, "lower_case_table_names to be detected", func() bool { return e.lowerCase() == 1 })
+	if err := e.EnsureExists(context.Background(), "Mixed"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if backend.hasDatabase("Mixed") {
+		t.Fatal("the database was created again without the detected setting")
+	}
+}
+
+func TestLowerCaseDetectionDoesNotBlock(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.stop()
+	config := testConfig(backend)
+	config.LowerCaseTableNames = "auto"
+	e := newTestEnsurer(t, config)
+
+	// MySQL comes back but takes its time answering the detection
+	answer := make(chan struct{})
+	var detections atomic.Int32
+	backend.handleCommands(func(s *fakeSession, payload []byte) bool {
+		if strings.Contains(strings.ToLower(string(payload)), "lower_case_table_names") {
+			detections.Add(1)
+			<-answer
+		}
+		return false
+	})
+	backend.mu.Lock()
+	backend.lowerCase = 2
+	backend.mu.Unlock()
+	backend.restart()
+
+	// Meanwhile callers go on assuming 0, without waiting on it
+	eventually(t, "detection to be retried", func() bool {
+		start := time.Now()
+		if e.lowerCase() != 0 || time.Since(start) > 100*time.Millisecond {
+			t.Fatal("lowerCase waited on the pending detection")
+		}
+		return detections.Load() == 1
+	})
+	for i := 0; i < 10; i++ {
+		e.lowerCase()
+	}
+	if detections.Load() != 1 {
+		t.Fatalf("%d detections running at once", detections.Load())
+	}
+	close(answer)
+	eventually(t, "the detected setting to be used", func() bool { return e.lowerCase() == 2 })
+}
+
+func TestLowerCaseTableNames(t *testing.T) {
+	for _, tc := range []struct {
+		setting  string
+		detected int
+		existing string
+		request  string
+		created  bool
+	}{
+		// 0 compares names as they are
+		{setting: "0", existing: "Mixed", request: "mixed", created: true},
+		{setting: "0", existing: "mixed", request: "mixed"},
+		{setting: "auto", existing: "Mixed", request: "mixed", created: true},
+		// 1 stores names lowercased, 2 as given, and both compare them lowercased
+		{setting: "1", existing: "mixed", request: "Mixed"},
+		{setting: "2", existing: "Mixed", request: "MIXED"},
+		{setting: "auto", detected: 1, existing: "mixed", request: "MiXeD"},
+		{setting: "auto", detected: 2, existing: "Mixed", request: "mixed"},
+		{setting: "2", existing: "Other", request: "mixed", created: true},
+	} {
+		backend := startFakeMySQL(t)
+		backend.mu.Lock()
+		backend.lowerCase = tc.detected
+		backend.mu.Unlock()
+		backend.create(tc.existing)
+		config := testConfig(backend)
+		config.LowerCaseTableNames = tc.setting
+		e := newTestEnsurer(t, config)
+		name := fmt.Sprintf("%s (detected %d) %s for %s", tc.setting, tc.detected, tc.request, tc.existing)
+
+		if err := e.EnsureExists(context.Background(), tc.request); err != nil {
+			t.Fatalf("%s: EnsureExists: %v", name, err)
+		}
+		if created := backend.hasDatabase(tc.request) && tc.request != tc.existing; created != tc.created {
+			t.Errorf("%s: created %v", name, created)
+		}
+
+		// Names are compared, and cached, in the form MySQL compares them
+		folded := tc.setting != "0" && (tc.setting != "auto" || tc.detected != 0)
+		check := ""
+		for _, query := range backend.receivedQueries() {
+			if strings.Contains(query, "INFORMATION_SCHEMA.SCHEMATA") {
+				check = query
+			}
+		}
+		if strings.Contains(check, "LOWER(SCHEMA_NAME)") != folded {
+			t.Errorf("%s: checked existence with %q", name, check)
+		}
+		key := tc.request
+		if folded {
+			key = strings.ToLower(key)
+		}
+		if e.databaseKey(tc.request) != key || !e.known.has(key) {
+			t.Errorf("%s: cached under %q", name, e.databaseKey(tc.request))
+		}
+	}
+}
+
+func BenchmarkEnsureExists(b *testing.B) {
+	backend := startFakeMySQL(b)
+	config := testConfig(backend)
+	// Without the cache every call asks MySQL through the pool
+	config.CacheTTL = 0
+	logger, _ := testLogger()
+	e, err := newSQLEnsurer(config, logger)
+	if err != nil {
+		b.Fatalf("newSQLEnsurer: %v", err)
+	}
+	defer e.db.Close()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if err := e.EnsureExists(context.Background(), "bench"); err != nil {
+				b.Errorf("EnsureExists: %v", err)
+				return
+			}
+		}
+	})
+}
+
+func TestSlowCreateThreshold(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.handleCommands(func(s *fakeSession, payload []byte) bool {
+		if strings.HasPrefix(string(payload), "\x03CREATE DATABASE `slow") {
+			time.Sleep(150 * time.Millisecond)
+		}
+		return false
+	})
+	config := testConfig(backend)
+	config.SlowCreateThreshold = 100 * time.Millisecond
+	e := newTestEnsurer(t, config)
+	ensure := func(e *sqlEnsurer, name string) *logrus.Entry {
+		logger, hook := testLogger()
+		ctx := withConnContext(context.Background(), &ConnContext{logger: logrus.NewEntry(logger)})
+		if err := e.EnsureExists(ctx, name); err != nil {
+			t.Fatalf("EnsureExists %s: %v", name, err)
+		}
+		return findEntry(hook, "Slow database creation")
+	}
+
+	// A creation over the threshold is broken down by phase
+	entry := ensure(e, "slow")
+	if entry == nil || entry.Level != logrus.WarnLevel || entry.Data["database"] != "slow" {
+		t.Fatalf("logged %v", entry)
+	}
+	for _, phase := range []string{"lock_wait", "exists_check", "create", "seed", "create_user"} {
+		if _, err := time.ParseDuration(fmt.Sprint(entry.Data[phase])); err != nil {
+			t.Errorf("phase %s logged as %v", phase, entry.Data[phase])
+		}
+	}
+	if create, _ := time.ParseDuration(fmt.Sprint(entry.Data["create"])); create < 150*time.Millisecond {
+		t.Errorf("the create phase took %v", create)
+	}
+	if total, _ := time.ParseDuration(fmt.Sprint(entry.Data["total"])); total < config.SlowCreateThreshold {
+		t.Errorf("total %v is below the threshold", total)
+	}
+
+	// Quicker ones are not
+	if entry := ensure(e, "quick"); entry != nil {
+		t.Fatalf("a quick creation logged %v", entry.Data)
+	}
+
+	// and nothing is without a threshold
+	config.SlowCreateThreshold = 0
+	if entry := ensure(newTestEnsurer(t, config), "slow_again"); entry != nil {
+		t.Fatalf("logged %v with no threshold", entry.Data)
+	}
+}
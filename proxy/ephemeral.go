@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var ephemeralDrops = newCounter("mysql_autodb_ephemeral_databases_dropped_total",
+	"Databases the proxy created and dropped after their last connection closed")
+
+// ephemeralTracker drops the databases the proxy created once the last
+// connection that has one selected closes or selects another, after a grace
+// period in which a connection selecting it again cancels the drop. Only the
+// databases in the registry of created databases are tracked, so databases
+// that existed before the proxy saw them are never dropped, nor are those
+// clients created themselves.
+type ephemeralTracker struct {
+	proxy *Proxy
+	grace time.Duration
+
+	mu sync.Mutex
+	// held is the tracked database each connection has selected, by ID
+	held map[uint64]string
+	// users counts the connections holding each database
+	users map[string]int
+	// pending are the drops scheduled for databases no connection holds
+	pending map[string]*time.Timer
+	closed  bool
+}
+
+// newEphemeralTracker creates a tracker that drops databases after grace
+func newEphemeralTracker(p *Proxy, grace time.Duration) *ephemeralTracker {
+	return &ephemeralTracker{
+		proxy:   p,
+		grace:   grace,
+		held:    make(map[uint64]string),
+		users:   make(map[string]int),
+		pending: make(map[string]*time.Timer),
+	}
+}
+
+// hold records that a connection has selected a database, releasing the one
+// it held before. Selecting a database cancels its pending drop.
+func (t *ephemeralTracker) hold(connID uint64, name string) {
+	if t == nil {
+		return
+	}
+	tracked := false
+	if name != "" {
+		database, ok := t.proxy.created.get(name)
+		tracked = ok && !database.ClientCreated
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	previous := t.held[connID]
+	if previous == name && tracked {
+		return
+	}
+	if previous != "" {
+		delete(t.held, connID)
+		t.releaseLocked(previous)
+	}
+	if !tracked {
+		return
+	}
+	t.held[connID] = name
+	t.users[name]++
+	if timer, ok := t.pending[name]; ok {
+		timer.Stop()
+		delete(t.pending, name)
+		t.proxy.log.WithField("database", name).Info("Database selected again, cancelled its drop")
+	}
+}
+
+// release records that a connection has closed
+func (t *ephemeralTracker) release(connID uint64) {
+	t.hold(connID, "")
+}
+
+// releaseLocked uncounts a connection holding name, scheduling the drop of
+// the database once none does
+func (t *ephemeralTracker) releaseLocked(name string) {
+	t.users[name]--
+	if t.users[name] > 0 {
+		return
+	}
+	delete(t.users, name)
+	if t.closed {
+		return
+	}
+	t.pending[name] = time.AfterFunc(t.grace, func() { t.drop(name) })
+	t.proxy.log.WithFields(logrus.Fields{
+		"database": name,
+		"grace":    t.grace.String(),
+	}).Info("Last connection to ephemeral database closed, dropping it after DROP_GRACE")
+}
+
+// drop drops a database whose grace period has expired, unless a connection
+// selected it in the meantime
+func (t *ephemeralTracker) drop(name string) {
+	t.mu.Lock()
+	if _, ok := t.pending[name]; !ok || t.users[name] > 0 {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.pending, name)
+	t.mu.Unlock()
+
+	logger := t.proxy.log.WithField("database", name)
+	database, ok := t.proxy.created.get(name)
+	if !ok {
+		logger.Debug("Ephemeral database already dropped")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := t.proxy.dropDatabase(ctx, database); err != nil {
+		logger.WithError(err).Error("Failed to drop ephemeral database")
+		return
+	}
+	ephemeralDrops.Inc()
+	logger.Info("Dropped ephemeral database")
+	if audit := t.proxy.audit; audit != nil {
+		audit.RecordDrop(dropAuditEvent{
+			Database:   name,
+			Backend:    database.Backend,
+			Reason:     "ephemeral",
+			Timestamp:  time.Now().UTC(),
+			LastUsedAt: database.LastUsedAt.UTC(),
+		})
+	}
+}
+
+// Close cancels the pending drops, leaving their databases in place, since
+// their grace period cannot be honoured once the proxy stops
+func (t *ephemeralTracker) Close(ctx context.Context) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for name, timer := range t.pending {
+		timer.Stop()
+		t.proxy.log.WithField("database", name).Info("Proxy stopping, leaving ephemeral database in place")
+	}
+	t.pending = nil
+	return nil
+}
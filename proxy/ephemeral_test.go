@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+// ephemeralProxy starts a proxy dropping its databases grace after their
+// last connection closes
+func ephemeralProxy(t *testing.T, backend *fakeMySQL, grace time.Duration) string {
+	t.Helper()
+	config := testConfig(backend)
+	config.EphemeralDatabases = true
+	config.DropGrace = grace
+	_, addr := startProxy(t, config)
+	return addr
+}
+
+func TestEphemeralDatabaseSharedByConnections(t *testing.T) {
+	backend := startFakeMySQL(t)
+	addr := ephemeralProxy(t, backend, 200*time.Millisecond)
+
+	first := mustConnect(t, addr, testHandshake{user: "root", database: "shared"})
+	second := mustConnect(t, addr, testHandshake{user: "root"})
+	second.mustQuery("USE shared")
+
+	// The database outlives one of its connections
+	drops := ephemeralDrops.Value()
+	first.conn.Close()
+	time.Sleep(400 * time.Millisecond)
+	if !backend.hasDatabase("shared") {
+		t.Fatal("dropped a database a connection still uses")
+	}
+
+	// and is dropped once both have closed and the grace period is over
+	second.conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	if !backend.hasDatabase("shared") {
+		t.Fatal("dropped the database before the grace period")
+	}
+	eventually(t, "the database to be dropped", func() bool { return !backend.hasDatabase("shared") })
+	if got := ephemeralDrops.Value() - drops; got != 1 {
+		t.Fatalf("%d drops counted", got)
+	}
+}
+
+func TestEphemeralDatabaseSwitching(t *testing.T) {
+	backend := startFakeMySQL(t)
+	addr := ephemeralProxy(t, backend, 50*time.Millisecond)
+
+	// Switching back and forth counts the connection once per database
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	for _, name := range []string{"one", "two", "one", "one", "two"} {
+		c.mustQuery("USE " + name)
+	}
+	eventually(t, "the database left behind to be dropped", func() bool { return !backend.hasDatabase("one") })
+	time.Sleep(100 * time.Millisecond)
+	if !backend.hasDatabase("two") {
+		t.Fatal("dropped the selected database")
+	}
+	c.conn.Close()
+	eventually(t, "the selected database to be dropped", func() bool { return !backend.hasDatabase("two") })
+}
+
+func TestEphemeralDropCancelledByReconnect(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.create("preexisting")
+	addr := ephemeralProxy(t, backend, 300*time.Millisecond)
+
+	c := mustConnect(t, addr, testHandshake{user: "root", database: "rerun"})
+	c.conn.Close()
+	time.Sleep(50 * time.Millisecond)
+	c = mustConnect(t, addr, testHandshake{user: "root", database: "rerun"})
+	time.Sleep(500 * time.Millisecond)
+	if !backend.hasDatabase("rerun") {
+		t.Fatal("dropped a database selected again during its grace period")
+	}
+
+	// Databases that existed before the proxy saw them are never dropped
+	c.mustQuery("USE preexisting")
+	c.conn.Close()
+	eventually(t, "the created database to be dropped", func() bool { return !backend.hasDatabase("rerun") })
+	time.Sleep(400 * time.Millisecond)
+	if !backend.hasDatabase("preexisting") {
+		t.Fatal("dropped a database the proxy did not create")
+	}
+}
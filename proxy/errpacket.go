@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// errorCategory identifies a kind of failure the proxy reports to clients itself
+type errorCategory string
+
+const (
+	errCategoryValidation         errorCategory = "validation"
+	errCategoryReserved           errorCategory = "reserved"
+	errCategoryRateLimited        errorCategory = "rate_limited"
+	errCategoryBackendUnavailable errorCategory = "backend_unavailable"
+	errCategoryAccessDenied       errorCategory = "access_denied"
+	errCategoryHostNotAllowed     errorCategory = "host_not_allowed"
+	errCategoryUnknownDatabase    errorCategory = "unknown_database"
+	errCategoryTooManyConnections errorCategory = "too_many_connections"
+	errCategoryPacketTooLarge     errorCategory = "packet_too_large"
+	errCategoryCrossBackend       errorCategory = "cross_backend"
+	errCategoryLocalInfile        errorCategory = "local_infile"
+)
+
+// mysqlErrorCode is the error number and SQLSTATE sent in an ERR packet
+type mysqlErrorCode struct {
+	Code     uint16
+	SQLState string
+}
+
+// defaultErrorCodes maps each error category to the MySQL error clients
+// most commonly translate into a sensible exception
+var defaultErrorCodes = map[errorCategory]mysqlErrorCode{
+	errCategoryValidation:         {1102, "42000"}, // ER_WRONG_DB_NAME
+	errCategoryReserved:           {1044, "42000"}, // ER_DBACCESS_DENIED_ERROR
+	errCategoryRateLimited:        {1226, "42000"}, // ER_USER_LIMIT_REACHED
+	errCategoryBackendUnavailable: {1053, "08S01"}, // ER_SERVER_SHUTDOWN
+	errCategoryAccessDenied:       {1045, "28000"}, // ER_ACCESS_DENIED_ERROR
+	errCategoryHostNotAllowed:     {1130, "HY000"}, // ER_HOST_NOT_PRIVILEGED
+	errCategoryUnknownDatabase:    {1049, "42000"}, // ER_BAD_DB_ERROR
+	errCategoryTooManyConnections: {1040, "08004"}, // ER_CON_COUNT_ERROR
+	errCategoryPacketTooLarge:     {1153, "08S01"}, // ER_NET_PACKET_TOO_LARGE
+	errCategoryCrossBackend:       {1044, "42000"}, // ER_DBACCESS_DENIED_ERROR
+	errCategoryLocalInfile:        {3948, "42000"}, // ER_CLIENT_LOCAL_FILES_DISABLED
+}
+
+// erBadDBError is the error MySQL reports when a selected database does not exist
+const erBadDBError = 1049
+
+// parseErrorCodes parses overrides of the form
+// "category=code[:sqlstate],..." on top of the default mapping
+func parseErrorCodes(value string) (map[errorCategory]mysqlErrorCode, error) {
+	codes := make(map[errorCategory]mysqlErrorCode, len(defaultErrorCodes))
+	for category, code := range defaultErrorCodes {
+		codes[category] = code
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, spec, ok := strings.Cut(entry, "=")
+		category := errorCategory(strings.TrimSpace(name))
+		if _, known := defaultErrorCodes[category]; !ok || !known {
+			return nil, fmt.Errorf("invalid error code mapping %q", entry)
+		}
+
+		codeText, sqlState, hasState := strings.Cut(strings.TrimSpace(spec), ":")
+		number, err := strconv.ParseUint(codeText, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid error code in %q: %w", entry, err)
+		}
+		code := mysqlErrorCode{Code: uint16(number), SQLState: codes[category].SQLState}
+		if hasState {
+			if len(sqlState) != 5 {
+				return nil, fmt.Errorf("invalid SQLSTATE in %q: must be 5 characters", entry)
+			}
+			code.SQLState = sqlState
+		}
+		codes[category] = code
+	}
+	return codes, nil
+}
+
+// proxyError is a failure the proxy reports to the client with a MySQL error
+type proxyError struct {
+	category errorCategory
+	message  string
+}
+
+func (e *proxyError) Error() string {
+	return e.message
+}
+
+// ErrBackendUnreachable reports that the MySQL backend could not be reached
+var ErrBackendUnreachable = newProxyError(errCategoryBackendUnavailable, "MySQL backend is unreachable")
+
+// newProxyError creates an error in the given category
+func newProxyError(category errorCategory, format string, args ...interface{}) error {
+	return &proxyError{category: category, message: fmt.Sprintf(format, args...)}
+}
+
+// errorCategoryOf returns the category of an error; errors the proxy did not
+// classify itself are assumed to come from an unreachable backend
+func errorCategoryOf(err error) errorCategory {
+	var pe *proxyError
+	if errors.As(err, &pe) {
+		return pe.category
+	}
+	return errCategoryBackendUnavailable
+}
+
+// buildErrPacket builds a MySQL ERR packet
+func buildErrPacket(sequenceID int, code mysqlErrorCode, message string) *MySQLPacket {
+	payload := make([]byte, 0, 9+len(message))
+	payload = append(payload, 0xff, byte(code.Code), byte(code.Code>>8), '#')
+	payload = append(payload, code.SQLState...)
+	payload = append(payload, message...)
+	return newPacket(sequenceID, payload)
+}
+
+// writeErrPacket sends the client an ERR packet for the given error category
+func (p *Proxy) writeErrPacket(conn net.Conn, sequenceID int, category errorCategory, message string) error {
+	code, ok := p.errorCodes[category]
+	if !ok {
+		code = defaultErrorCodes[category]
+	}
+	return writePacket(conn, buildErrPacket(sequenceID, code, "mysql-auto-db-proxy: "+message))
+}
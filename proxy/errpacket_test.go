@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestDefaultErrorCodes(t *testing.T) {
+	for category, want := range map[errorCategory]mysqlErrorCode{
+		errCategoryValidation:         {1102, "42000"},
+		errCategoryReserved:           {1044, "42000"},
+		errCategoryRateLimited:        {1226, "42000"},
+		errCategoryBackendUnavailable: {1053, "08S01"},
+		errCategoryAccessDenied:       {1045, "28000"},
+		errCategoryUnknownDatabase:    {1049, "42000"},
+		errCategoryTooManyConnections: {1040, "08004"},
+		errCategoryPacketTooLarge:     {1153, "08S01"},
+	} {
+		if got := defaultErrorCodes[category]; got != want {
+			t.Errorf("%s maps to %v, want %v", category, got, want)
+		}
+	}
+	for category, code := range defaultErrorCodes {
+		if len(code.SQLState) != 5 || code.Code == 0 {
+			t.Errorf("%s maps to %v", category, code)
+		}
+	}
+}
+
+func TestParseErrorCodes(t *testing.T) {
+	codes, err := parseErrorCodes(" reserved=1142:42S02, validation=1049 ,")
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if got := codes[errCategoryReserved]; got != (mysqlErrorCode{1142, "42S02"}) {
+		t.Errorf("reserved maps to %v", got)
+	}
+	// An override without a SQLSTATE keeps the default one
+	if got := codes[errCategoryValidation]; got != (mysqlErrorCode{1049, "42000"}) {
+		t.Errorf("validation maps to %v", got)
+	}
+	if got := codes[errCategoryRateLimited]; got != defaultErrorCodes[errCategoryRateLimited] {
+		t.Errorf("rate_limited maps to %v", got)
+	}
+	if defaultErrorCodes[errCategoryReserved].Code != 1044 {
+		t.Fatal("parsing overrides changed the defaults")
+	}
+
+	for _, value := range []string{"unknown=1044", "reserved", "reserved=abc", "reserved=70000", "reserved=1044:4200"} {
+		if _, err := parseErrorCodes(value); err == nil {
+			t.Errorf("parsed %q", value)
+		}
+	}
+}
+
+func TestBuildErrPacket(t *testing.T) {
+	packet := buildErrPacket(2, mysqlErrorCode{1049, "42000"}, "Unknown database 'x'")
+	want := append([]byte{0xff, 0x19, 0x04, '#'}, "42000Unknown database 'x'"...)
+	if packet.SequenceID != 2 || !bytes.Equal(packet.Payload, want) {
+		t.Fatalf("built %d %q", packet.SequenceID, packet.Payload)
+	}
+	if errPacketCode(packet.Payload) != 1049 || errPacketMessage(packet.Payload) != "Unknown database 'x'" {
+		t.Fatalf("parsed back as %d %q", errPacketCode(packet.Payload), errPacketMessage(packet.Payload))
+	}
+}
+
+func TestWriteErrPacketUsesMapping(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.ErrorCodes = "validation=1049:3D000"
+	logger, _ := testLogger()
+	p, err := New(config, WithLogger(logger))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer p.closePools()
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		p.writeErrPacket(server, 1, errCategoryValidation, "bad name")
+		p.writeErrPacket(server, 1, errCategoryReserved, "reserved name")
+		server.Close()
+	}()
+	for _, want := range []struct {
+		code     int
+		sqlState string
+	}{{1049, "3D000"}, {1044, "42000"}} {
+		packet, err := readPacket(client)
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if errPacketCode(packet.Payload) != want.code || string(packet.Payload[4:9]) != want.sqlState {
+			t.Fatalf("got %q, want ERR %d (%s)", packet.Payload, want.code, want.sqlState)
+		}
+	}
+
+	config.ErrorCodes = "validation=oops"
+	if _, err := New(config, WithLogger(logger)); err == nil {
+		t.Fatal("New accepted an invalid ERROR_CODES")
+	}
+}
+
+func TestValidationErrorCodeReachesClient(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.ErrorCodes = "validation=1210"
+	_, addr := startProxy(t, config)
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	expectErr(t, c.query("USE `bad;name`"), 1210)
+}
@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var eventsDropped = newCounter("mysql_autodb_events_dropped_total",
+	"Creation events dropped because the event bus or webhook buffer was full")
+
+// CreationEvent is published whenever the proxy creates a database
+type CreationEvent struct {
+	Database  string    `json:"database"`
+	Client    string    `json:"client"`
+	ConnID    uint64    `json:"conn_id,omitempty"`
+	Username  string    `json:"username,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Backend   string    `json:"backend"`
+
+	// Instance identifies the proxy that created the database
+	Instance string `json:"instance,omitempty"`
+
+	// CreatedUser is the MySQL user created for the database, if any
+	CreatedUser string `json:"created_user,omitempty"`
+
+	// Trigger is what selected the database: "handshake", "use",
+	// "com_init_db", "com_change_user" or "com_field_list", or
+	// "create_database" in the audit log for a client's own CREATE DATABASE
+	Trigger string `json:"trigger,omitempty"`
+}
+
+// EventPublisher delivers a payload to a topic on a message bus
+type EventPublisher interface {
+	Publish(ctx context.Context, topic string, payload []byte) error
+	Close() error
+}
+
+// newEventPublisher creates the publisher for an event bus URL
+func newEventPublisher(rawURL string) (EventPublisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid event bus URL: %w", err)
+	}
+
+	switch u.Scheme {
+	case "nats":
+		return newNATSPublisher(u), nil
+	default:
+		return nil, fmt.Errorf("unsupported event bus scheme %q", u.Scheme)
+	}
+}
+
+// eventBus publishes creation events in the background so that slow or
+// unavailable brokers, or webhooks, never block client connections
+type eventBus struct {
+	publisher EventPublisher
+	topic     string
+	queue     chan CreationEvent
+	done      chan struct{}
+	log       logrus.FieldLogger
+
+	// ctx is cancelled when Close gives up, aborting the publish in flight
+	// and dropping the events still buffered
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// mu guards closed against concurrent Emit and Close
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newEventBus starts a background publisher with a bounded buffer
+func newEventBus(publisher EventPublisher, topic string, buffer int, log logrus.FieldLogger) *eventBus {
+	bus := &eventBus{
+		publisher: publisher,
+		topic:     topic,
+		queue:     make(chan CreationEvent, buffer),
+		done:      make(chan struct{}),
+		log:       log,
+	}
+	bus.ctx, bus.cancel = context.WithCancel(context.Background())
+	go bus.run()
+	return bus
+}
+
+// Emit queues an event for publishing, dropping it if the buffer is full
+func (b *eventBus) Emit(event CreationEvent) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		eventsDropped.Inc()
+		b.log.WithField("database", event.Database).Warn("Event queue closed, dropping creation event")
+		return
+	}
+	select {
+	case b.queue <- event:
+	default:
+		eventsDropped.Inc()
+		b.log.WithField("database", event.Database).Warn("Event queue full, dropping creation event")
+	}
+}
+
+// run publishes queued events until the queue is closed
+func (b *eventBus) run() {
+	defer close(b.done)
+	for event := range b.queue {
+		if b.ctx.Err() != nil {
+			eventsDropped.Inc()
+			continue
+		}
+		payload, err := json.Marshal(event)
+		if err != nil {
+			b.log.WithError(err).Error("Failed to encode creation event")
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(b.ctx, 10*time.Second)
+		err = b.publisher.Publish(ctx, b.topic, payload)
+		cancel()
+		if err != nil {
+			b.log.WithError(err).WithField("database", event.Database).Error("Failed to publish creation event")
+		}
+	}
+}
+
+// Close stops accepting events and publishes the ones still buffered until
+// ctx expires, then closes the publisher. Once ctx expires the remaining
+// events are dropped, and Close returns without waiting any longer for a
+// broker that does not answer.
+func (b *eventBus) Close(ctx context.Context) error {
+	defer b.cancel()
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mu.Unlock()
+
+	var err error
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		err = fmt.Errorf("gave up publishing %d buffered creation events: %w", len(b.queue), ctx.Err())
+		b.cancel()
+	}
+
+	// Closing the publisher also fails a publish stuck on its connection
+	closed := make(chan error, 1)
+	go func() { closed <- b.publisher.Close() }()
+	select {
+	case closeErr := <-closed:
+		if err == nil {
+			err = closeErr
+		}
+	case <-ctx.Done():
+		if err == nil {
+			err = fmt.Errorf("gave up closing the event publisher: %w", ctx.Err())
+		}
+	}
+	return err
+}
+
+// errNATSClosed is returned by publishes after the NATS publisher is closed
+var errNATSClosed = errors.New("NATS publisher closed")
+
+// natsPublisher publishes messages using the NATS text protocol
+type natsPublisher struct {
+	addr string
+	user *url.Userinfo
+
+	// mu serializes publishes. conn is only changed holding both mu and
+	// connMu, so that Close can close it, and fail a publish stuck on it,
+	// without waiting for mu.
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+
+	connMu sync.Mutex
+	closed bool
+}
+
+// newNATSPublisher creates a publisher for a nats:// URL; it connects lazily
+func newNATSPublisher(u *url.URL) *natsPublisher {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	return &natsPublisher{addr: addr, user: u.User}
+}
+
+// connect dials the server and performs the CONNECT exchange
+func (n *natsPublisher) connect(ctx context.Context) error {
+	dialer := net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", n.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	reader := bufio.NewReader(conn)
+	info, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("unexpected NATS greeting: %q", info)
+	}
+
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "mysql-auto-db-proxy"}
+	if n.user != nil {
+		options["user"] = n.user.Username()
+		if password, ok := n.user.Password(); ok {
+			options["pass"] = password
+		}
+	}
+	connect, _ := json.Marshal(options)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to send NATS CONNECT: %w", err)
+	}
+	if err := readNATSPong(conn, reader); err != nil {
+		conn.Close()
+		return err
+	}
+
+	n.connMu.Lock()
+	defer n.connMu.Unlock()
+	if n.closed {
+		conn.Close()
+		return errNATSClosed
+	}
+	n.conn = conn
+	n.reader = reader
+	return nil
+}
+
+// readNATSPong waits for the PONG that acknowledges a PING, answering any server PINGs
+func readNATSPong(conn io.Writer, reader *bufio.Reader) error {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read NATS response: %w", err)
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := io.WriteString(conn, "PONG\r\n"); err != nil {
+				return fmt.Errorf("failed to answer NATS PING: %w", err)
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("NATS error: %s", line)
+		}
+	}
+}
+
+// Publish sends a message and waits for the server to acknowledge it
+func (n *natsPublisher) Publish(ctx context.Context, topic string, payload []byte) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.connMu.Lock()
+	closed := n.closed
+	n.connMu.Unlock()
+	if closed {
+		return errNATSClosed
+	}
+	if n.conn == nil {
+		if err := n.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		n.conn.SetDeadline(deadline)
+	}
+
+	// The trailing PING makes the server report errors for this message
+	_, err := fmt.Fprintf(n.conn, "PUB %s %d\r\n%s\r\nPING\r\n", topic, len(payload), payload)
+	if err == nil {
+		err = readNATSPong(n.conn, n.reader)
+	}
+	if err != nil {
+		n.connMu.Lock()
+		n.conn.Close()
+		n.conn = nil
+		n.connMu.Unlock()
+		return fmt.Errorf("failed to publish to NATS: %w", err)
+	}
+	return nil
+}
+
+// Close closes the connection to the server, failing a publish in flight on
+// it, and stops any further publishes
+func (n *natsPublisher) Close() error {
+	n.connMu.Lock()
+	defer n.connMu.Unlock()
+
+	if n.closed {
+		return nil
+	}
+	n.closed = true
+	if n.conn == nil {
+		return nil
+	}
+	return n.conn.Close()
+}
@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNATS is a NATS server speaking enough of the text protocol for the
+// publisher, recording what it is sent
+type fakeNATS struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	connects []map[string]interface{}
+	messages []string
+	pongs    int
+	conns    []net.Conn
+
+	// refused subjects are answered with -ERR, and once silent is set PINGs
+	// are no longer answered
+	refused map[string]bool
+	silent  bool
+}
+
+func startFakeNATS(t *testing.T) *fakeNATS {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	f := &fakeNATS{listener: listener, refused: map[string]bool{}}
+	t.Cleanup(func() {
+		listener.Close()
+		f.drop()
+	})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+// url returns a nats:// URL for the server with the given credentials
+func (f *fakeNATS) url(userinfo string) *url.URL {
+	u, _ := url.Parse("nats://" + userinfo + f.listener.Addr().String())
+	return u
+}
+
+func (f *fakeNATS) serve(conn net.Conn) {
+	defer conn.Close()
+	io.WriteString(conn, "INFO {\"server_id\":\"fake\",\"max_payload\":1048576}\r\n")
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		verb, args, _ := strings.Cut(strings.TrimSuffix(line, "\r\n"), " ")
+		f.mu.Lock()
+		switch verb {
+		case "CONNECT":
+			var options map[string]interface{}
+			json.Unmarshal([]byte(args), &options)
+			f.connects = append(f.connects, options)
+			// Servers may PING clients at any time, here before the PONG
+			io.WriteString(conn, "PING\r\n")
+		case "PUB":
+			subject, size, _ := strings.Cut(args, " ")
+			n, _ := strconv.Atoi(size)
+			payload := make([]byte, n+2)
+			f.mu.Unlock()
+			_, err := io.ReadFull(reader, payload)
+			f.mu.Lock()
+			if err != nil {
+				f.mu.Unlock()
+				return
+			}
+			f.messages = append(f.messages, fmt.Sprintf("%s %q", subject, payload))
+			if f.refused[subject] {
+				fmt.Fprintf(conn, "-ERR 'Permissions Violation for Publish to %s'\r\n", subject)
+			}
+		case "PING":
+			if !f.silent {
+				io.WriteString(conn, "PONG\r\n")
+			}
+		case "PONG":
+			f.pongs++
+		}
+		f.mu.Unlock()
+	}
+}
+
+// drop closes every connection the server has accepted
+func (f *fakeNATS) drop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+}
+
+// received returns the messages published, and the number of CONNECTs
+func (f *fakeNATS) received() ([]string, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.messages...), len(f.connects)
+}
+
+func TestNATSPublisher(t *testing.T) {
+	server := startFakeNATS(t)
+	n := newNATSPublisher(server.url("events:s3cret@"))
+	defer n.Close()
+	ctx := context.Background()
+
+	// The publisher connects on first use, with the URL's credentials, then
+	// frames each message with its size and a PING for acknowledgement
+	if err := n.Publish(ctx, "mysql-autodb.created", []byte(`{"database":"orders"}`)); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	if err := n.Publish(ctx, "mysql-autodb.created", []byte(`{"database":"billing"}`)); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	messages, connects := server.received()
+	if want := []string{
+		`mysql-autodb.created "{\"database\":\"orders\"}\r\n"`,
+		`mysql-autodb.created "{\"database\":\"billing\"}\r\n"`,
+	}; !equalStrings(messages, want) || connects != 1 {
+		t.Fatalf("server received %q over %d connections", messages, connects)
+	}
+	server.mu.Lock()
+	options, pongs := server.connects[0], server.pongs
+	server.mu.Unlock()
+	if options["user"] != "events" || options["pass"] != "s3cret" || options["verbose"] != false || options["name"] != "mysql-auto-db-proxy" {
+		t.Fatalf("CONNECT with %v", options)
+	}
+	if pongs != 1 {
+		t.Fatalf("the server's PING was answered %d times", pongs)
+	}
+
+	// A message the server refuses fails, and the next one reconnects
+	server.mu.Lock()
+	server.refused["forbidden"] = true
+	server.mu.Unlock()
+	if err := n.Publish(ctx, "forbidden", []byte("{}")); err == nil || !strings.Contains(err.Error(), "Permissions Violation") {
+		t.Fatalf("refused publish returned %v", err)
+	}
+	if err := n.Publish(ctx, "mysql-autodb.created", []byte("{}")); err != nil {
+		t.Fatalf("publish after -ERR: %v", err)
+	}
+
+	// as it does once the server drops the connection
+	server.drop()
+	if err := n.Publish(ctx, "mysql-autodb.created", []byte("{}")); err == nil {
+		t.Fatal("published over a dropped connection")
+	}
+	if err := n.Publish(ctx, "mysql-autodb.created", []byte("{}")); err != nil {
+		t.Fatalf("publish after the connection was dropped: %v", err)
+	}
+	if _, connects := server.received(); connects != 3 {
+		t.Fatalf("%d connections made, want 3", connects)
+	}
+
+	// Nothing is published once the publisher is closed
+	n.Close()
+	if err := n.Publish(ctx, "mysql-autodb.created", []byte("{}")); !errors.Is(err, errNATSClosed) {
+		t.Fatalf("publish after close returned %v", err)
+	}
+	if _, connects := server.received(); connects != 3 {
+		t.Fatal("the closed publisher reconnected")
+	}
+
+	if addr := newNATSPublisher(&url.URL{Scheme: "nats", Host: "bus.internal"}).addr; addr != "bus.internal:4222" {
+		t.Fatalf("default address %s", addr)
+	}
+}
+
+// blockingPublisher is an EventPublisher whose publishes wait for release or
+// for their context to end
+type blockingPublisher struct {
+	started   chan string
+	release   chan struct{}
+	cancelled chan string
+}
+
+func (b *blockingPublisher) Publish(ctx context.Context, topic string, payload []byte) error {
+	b.started <- string(payload)
+	select {
+	case <-b.release:
+		return nil
+	case <-ctx.Done():
+		b.cancelled <- string(payload)
+		return ctx.Err()
+	}
+}
+
+func (b *blockingPublisher) Close() error {
+	return nil
+}
+
+func TestEventBusDropsWhenFull(t *testing.T) {
+	publisher := &blockingPublisher{started: make(chan string, 10), release: make(chan struct{}), cancelled: make(chan string, 10)}
+	logger, hook := testLogger()
+	bus := newEventBus(publisher, "created", 1, logger)
+
+	// One event in flight and one buffered, so the third is dropped
+	dropped := eventsDropped.Value()
+	bus.Emit(CreationEvent{Database: "first"})
+	<-publisher.started
+	bus.Emit(CreationEvent{Database: "second"})
+	bus.Emit(CreationEvent{Database: "third"})
+	if got := eventsDropped.Value() - dropped; got != 1 {
+		t.Fatalf("%d events dropped, want 1", got)
+	}
+	if entry := findEntry(hook, "Event queue full, dropping creation event"); entry == nil || entry.Data["database"] != "third" {
+		t.Fatalf("logged %v", entry)
+	}
+
+	// Closing gives up on the stuck publish at the deadline, and drops the
+	// buffered event rather than publishing it
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := bus.Close(ctx)
+	if err == nil || !strings.Contains(err.Error(), "1 buffered creation events") {
+		t.Fatalf("Close returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Close took %v", elapsed)
+	}
+	if cancelled := <-publisher.cancelled; !strings.Contains(cancelled, "first") {
+		t.Fatalf("cancelled %s", cancelled)
+	}
+	<-bus.done
+	if got := eventsDropped.Value() - dropped; got != 2 {
+		t.Fatalf("%d events dropped, want 2", got)
+	}
+	if len(publisher.started) != 0 {
+		t.Fatal("a buffered event was published after Close gave up")
+	}
+
+	bus.Emit(CreationEvent{Database: "late"})
+	if eventsDropped.Value()-dropped != 3 || findEntry(hook, "Event queue closed, dropping creation event") == nil {
+		t.Fatal("an event emitted after Close was not dropped")
+	}
+}
+
+func TestEventBusCloseFailsStuckPublish(t *testing.T) {
+	server := startFakeNATS(t)
+	publisher := newNATSPublisher(server.url(""))
+	if err := publisher.Publish(context.Background(), "warmup", []byte("{}")); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	server.mu.Lock()
+	server.silent = true
+	server.mu.Unlock()
+
+	logger, hook := testLogger()
+	bus := newEventBus(publisher, "created", 10, logger)
+	bus.Emit(CreationEvent{Database: "orders"})
+	eventually(t, "the event to be published", func() bool {
+		messages, _ := server.received()
+		return len(messages) == 2
+	})
+
+	// The broker never acknowledges it, so closing the connection is what
+	// ends the publish, well before its own 10 second timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := bus.Close(ctx); err == nil {
+		t.Fatal("Close reported the unacknowledged event as published")
+	}
+	select {
+	case <-bus.done:
+	case <-time.After(time.Second):
+		t.Fatal("the stuck publish did not fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Close took %v", elapsed)
+	}
+	if entry := findEntry(hook, "Failed to publish creation event"); entry == nil || entry.Data["database"] != "orders" {
+		t.Fatalf("logged %v", entry)
+	}
+}
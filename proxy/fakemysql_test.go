@@ -0,0 +1,688 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCapabilities are those of a MySQL 8.0 server without TLS, compression
+// or CLIENT_DEPRECATE_EOF, so that result sets end with EOF packets
+const fakeCapabilities = defaultTerminateCapabilities &^ clientDeprecateEOF
+
+// fakeMySQL is a MySQL server speaking just enough of the protocol for the
+// proxy and go-sql-driver. It accepts any credentials, keeps a set of
+// databases that CREATE and DROP DATABASE change, and refuses unknown
+// databases with ERR 1049 as MySQL does.
+type fakeMySQL struct {
+	t        testing.TB
+	listener net.Listener
+
+	mu sync.Mutex
+
+	// greeting, if set, is sent instead of the fake's own greeting
+	greeting []byte
+
+	// onCommand, if set, sees each command first and answers it itself by
+	// returning true
+	onCommand func(s *fakeSession, payload []byte) bool
+
+	// authSwitch, if set, is the plugin the fake asks clients to switch to
+	// before accepting their handshake
+	authSwitch string
+
+	// tlsConfig, if set, lets clients switch to TLS, which requireTLS
+	// makes mandatory
+	tlsConfig   *tls.Config
+	requireTLS  bool
+	tlsSessions int
+
+	version    string
+	caps       uint32
+	plugin     string
+	lowerCase  int
+	databases  map[string]bool
+	users      map[string]bool
+	handshakes [][]byte
+	commands   [][]byte
+	queries    []string
+	sessions   int
+	open       int
+}
+
+// startFakeMySQL starts a fake MySQL server on a loopback port, which is
+// closed when the test ends
+func startFakeMySQL(t testing.TB) *fakeMySQL {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	f := &fakeMySQL{
+		t:         t,
+		listener:  listener,
+		version:   "8.0.36",
+		caps:      fakeCapabilities,
+		plugin:    "mysql_native_password",
+		databases: make(map[string]bool),
+		users:     make(map[string]bool),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go f.serve(listener)
+	return f
+}
+
+// stop stops accepting connections, as a MySQL server that is down
+func (f *fakeMySQL) stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listener.Close()
+}
+
+// restart accepts connections again on the address of a stopped server. It
+// may be called from any goroutine.
+func (f *fakeMySQL) restart() {
+	listener, err := net.Listen("tcp", f.addr())
+	if err != nil {
+		f.t.Errorf("listen: %v", err)
+		return
+	}
+	f.mu.Lock()
+	f.listener = listener
+	f.mu.Unlock()
+	f.t.Cleanup(func() { listener.Close() })
+	go f.serve(listener)
+}
+
+// addr returns the address of the fake server
+func (f *fakeMySQL) addr() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.listener.Addr().String()
+}
+
+// setGreeting makes the fake server send greeting to new connections
+func (f *fakeMySQL) setGreeting(greeting []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.greeting = greeting
+}
+
+// handleCommands makes fn see each command of new connections first,
+// answering it itself by returning true
+func (f *fakeMySQL) handleCommands(fn func(s *fakeSession, payload []byte) bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.onCommand = fn
+}
+
+// switchAuth makes the fake ask new connections to switch to plugin
+func (f *fakeMySQL) switchAuth(plugin string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.authSwitch = plugin
+}
+
+// enableTLS makes the fake offer TLS with the certificate, and refuse
+// clients that do not use it if required is set
+func (f *fakeMySQL) enableTLS(cert tls.Certificate, required bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.caps |= clientSSL
+	f.tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	f.requireTLS = required
+}
+
+// tlsSessionCount returns the number of connections that switched to TLS
+func (f *fakeMySQL) tlsSessionCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tlsSessions
+}
+
+// create adds a database, as if a client had created it
+func (f *fakeMySQL) create(names ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, name := range names {
+		f.databases[name] = true
+	}
+}
+
+// hasDatabase reports whether the database exists on the fake server
+func (f *fakeMySQL) hasDatabase(name string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.databases[name]
+}
+
+// receivedQueries returns the statements run on the fake server so far,
+// prepared ones with their parameters substituted
+func (f *fakeMySQL) receivedQueries() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.queries...)
+}
+
+// receivedCommands returns the payloads of the commands received so far
+func (f *fakeMySQL) receivedCommands() [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]byte(nil), f.commands...)
+}
+
+// receivedHandshakes returns the handshake responses received so far
+func (f *fakeMySQL) receivedHandshakes() [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]byte(nil), f.handshakes...)
+}
+
+// sessionCount returns the number of connections accepted so far
+func (f *fakeMySQL) sessionCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sessions
+}
+
+// openSessions returns how many connections to the fake are still open
+func (f *fakeMySQL) openSessions() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.open
+}
+
+func (f *fakeMySQL) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.sessions++
+		f.open++
+		id := uint32(f.sessions)
+		f.mu.Unlock()
+		go f.handle(&fakeSession{f: f, conn: conn, id: id, stmts: make(map[uint32]string)})
+	}
+}
+
+// fakeGreeting builds the HandshakeV10 the fake server sends
+func (f *fakeMySQL) fakeGreeting(id uint32) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return buildGreeting(f.version, id, f.caps, 0, f.plugin)
+}
+
+// buildGreeting builds a HandshakeV10 greeting. MariaDB servers clear
+// CLIENT_MYSQL and send their extended capabilities in the filler's last 4
+// bytes.
+func buildGreeting(version string, id uint32, caps, mariaDBCaps uint32, plugin string) []byte {
+	salt := []byte("abcdefghijklmnopqrst")
+	g := []byte{10}
+	g = append(g, version...)
+	g = append(g, 0)
+	g = binary.LittleEndian.AppendUint32(g, id)
+	g = append(g, salt[:8]...)
+	g = append(g, 0, byte(caps), byte(caps>>8), 45, 2, 0, byte(caps>>16), byte(caps>>24), 21)
+	g = append(g, make([]byte, 6)...)
+	g = binary.LittleEndian.AppendUint32(g, mariaDBCaps)
+	g = append(g, salt[8:]...)
+	g = append(g, 0)
+	g = append(g, plugin...)
+	return append(g, 0)
+}
+
+// fakeSession is a connection to the fake server
+type fakeSession struct {
+	f     *fakeMySQL
+	conn  net.Conn
+	id    uint32
+	db    string
+	stmts map[uint32]string
+	next  uint32
+	seq   int
+}
+
+// write sends a payload following the last packet received or sent, split
+// into continuation packets if it is maxPacketPayload bytes or longer
+func (s *fakeSession) write(payload []byte) error {
+	for {
+		part := payload
+		if len(part) > maxPacketPayload {
+			part = part[:maxPacketPayload]
+		}
+		s.seq++
+		header := []byte{byte(len(part)), byte(len(part) >> 8), byte(len(part) >> 16), byte(s.seq)}
+		if _, err := s.conn.Write(append(header, part...)); err != nil {
+			return err
+		}
+		payload = payload[len(part):]
+		if len(part) < maxPacketPayload {
+			return nil
+		}
+	}
+}
+
+// read reads the next payload, joining the continuation packets of one
+// longer than maxPacketPayload
+func (s *fakeSession) read() ([]byte, error) {
+	var payload []byte
+	for {
+		header := make([]byte, 4)
+		if _, err := io.ReadFull(s.conn, header); err != nil {
+			return nil, err
+		}
+		length, seq := parsePacketHeader(header)
+		part := make([]byte, length)
+		if _, err := io.ReadFull(s.conn, part); err != nil {
+			return nil, err
+		}
+		s.seq = seq
+		payload = append(payload, part...)
+		if length < maxPacketPayload {
+			return payload, nil
+		}
+	}
+}
+
+// ok sends an OK packet
+func (s *fakeSession) ok() error {
+	return s.write([]byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00})
+}
+
+// err sends an ERR packet
+func (s *fakeSession) err(code uint16, state, message string) error {
+	payload := []byte{0xff, byte(code), byte(code >> 8), '#'}
+	payload = append(payload, state...)
+	return s.write(append(payload, message...))
+}
+
+// eof sends an EOF packet
+func (s *fakeSession) eof() error {
+	return s.write([]byte{0xfe, 0x00, 0x00, 0x02, 0x00})
+}
+
+// resultSet sends a result set of string columns, in the binary format of
+// prepared statements if binary is set
+func (s *fakeSession) resultSet(columns []string, rows [][]string, binaryRows bool) error {
+	if err := s.write(appendLengthEncodedInt(nil, uint64(len(columns)))); err != nil {
+		return err
+	}
+	for _, column := range columns {
+		def := appendLengthEncodedString(nil, "def")
+		for _, field := range []string{"", "", "", column, column} {
+			def = appendLengthEncodedString(def, field)
+		}
+		def = append(def, 0x0c, 33, 0, 0, 1, 0, 0, 0xfd, 0, 0, 0, 0, 0)
+		if err := s.write(def); err != nil {
+			return err
+		}
+	}
+	if err := s.eof(); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		var payload []byte
+		if binaryRows {
+			payload = append([]byte{0x00}, make([]byte, (len(columns)+7+2)/8)...)
+		}
+		for _, value := range row {
+			payload = appendLengthEncodedString(payload, value)
+		}
+		if err := s.write(payload); err != nil {
+			return err
+		}
+	}
+	return s.eof()
+}
+
+// appendLengthEncodedString appends a length-encoded string
+func appendLengthEncodedString(data []byte, value string) []byte {
+	return append(appendLengthEncodedInt(data, uint64(len(value))), value...)
+}
+
+func (f *fakeMySQL) handle(s *fakeSession) {
+	conn := s.conn
+	defer func() {
+		conn.Close()
+		f.mu.Lock()
+		f.open--
+		f.mu.Unlock()
+	}()
+	f.mu.Lock()
+	greeting, onCommand, authSwitch := f.greeting, f.onCommand, f.authSwitch
+	tlsConfig, requireTLS := f.tlsConfig, f.requireTLS
+	f.mu.Unlock()
+	if greeting == nil {
+		greeting = f.fakeGreeting(s.id)
+	}
+	s.seq = -1
+	if s.write(greeting) != nil {
+		return
+	}
+	payload, err := s.read()
+	if err != nil {
+		return
+	}
+	switch {
+	case tlsConfig != nil && len(payload) == 32 && binary.LittleEndian.Uint32(payload)&clientSSL != 0:
+		// An SSLRequest, after which the handshake response comes over TLS
+		tlsConn := tls.Server(s.conn, tlsConfig)
+		if tlsConn.Handshake() != nil {
+			return
+		}
+		s.conn = tlsConn
+		f.mu.Lock()
+		f.tlsSessions++
+		f.mu.Unlock()
+		if payload, err = s.read(); err != nil {
+			return
+		}
+	case requireTLS:
+		s.err(3159, "HY000", "Connections using insecure transport are prohibited while --require_secure_transport=ON.")
+		return
+	}
+	f.mu.Lock()
+	f.handshakes = append(f.handshakes, payload)
+	f.mu.Unlock()
+	if handshake, err := parseHandshakeResponse(payload); err == nil && handshake.CapabilityFlags&clientConnectWithDB != 0 && handshake.Database != "" {
+		if !f.hasDatabase(handshake.Database) {
+			s.err(1049, "42000", fmt.Sprintf("Unknown database '%s'", handshake.Database))
+			return
+		}
+		s.db = handshake.Database
+	}
+	if authSwitch != "" {
+		if s.write(append(append([]byte{0xfe}, authSwitch...), 0)) != nil {
+			return
+		}
+		if _, err := s.read(); err != nil {
+			return
+		}
+	}
+	if s.ok() != nil {
+		return
+	}
+
+	for {
+		s.seq = -1
+		payload, err := s.read()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.commands = append(f.commands, payload)
+		f.mu.Unlock()
+		if onCommand != nil && onCommand(s, payload) {
+			continue
+		}
+		if len(payload) == 0 || payload[0] == comQuit {
+			return
+		}
+		if err := s.answer(payload); err != nil {
+			return
+		}
+	}
+}
+
+// answer answers a command the way MySQL would
+func (s *fakeSession) answer(payload []byte) error {
+	switch payload[0] {
+	case comQuery:
+		return s.query(string(payload[1:]), false)
+	case comInitDB:
+		return s.use(string(payload[1:]))
+	case comFieldList:
+		return s.eof()
+	case 0x0e: // COM_PING
+		return s.ok()
+	case comChangeUser:
+		request, err := parseChangeUser(payload, fakeCapabilities)
+		if err == nil && request.Database != "" && !s.f.hasDatabase(request.Database) {
+			return s.err(1049, "42000", fmt.Sprintf("Unknown database '%s'", request.Database))
+		}
+		return s.ok()
+	case comStmtPrepare:
+		return s.prepare(string(payload[1:]))
+	case comStmtExecute:
+		return s.execute(payload)
+	case comStmtClose:
+		return nil
+	default:
+		return s.ok()
+	}
+}
+
+// use selects a database if it exists
+func (s *fakeSession) use(name string) error {
+	if !s.f.hasDatabase(name) {
+		return s.err(1049, "42000", fmt.Sprintf("Unknown database '%s'", name))
+	}
+	s.db = name
+	return s.ok()
+}
+
+// query runs a statement
+func (s *fakeSession) query(query string, binaryRows bool) error {
+	f := s.f
+	f.mu.Lock()
+	f.queries = append(f.queries, query)
+	f.mu.Unlock()
+
+	upper := strings.ToUpper(strings.TrimSpace(query))
+	switch {
+	case upper == "SELECT @@LOWER_CASE_TABLE_NAMES":
+		f.mu.Lock()
+		value := strconv.Itoa(f.lowerCase)
+		f.mu.Unlock()
+		return s.resultSet([]string{"@@lower_case_table_names"}, [][]string{{value}}, binaryRows)
+	case strings.HasPrefix(upper, "SELECT COUNT(*) FROM INFORMATION_SCHEMA.SCHEMATA WHERE"):
+		name := unquoteString(query[strings.LastIndex(query, "=")+1:])
+		count := 0
+		f.mu.Lock()
+		for database := range f.databases {
+			if database == name || strings.Contains(upper, "LOWER(") && strings.ToLower(database) == name {
+				count++
+			}
+		}
+		f.mu.Unlock()
+		return s.resultSet([]string{"COUNT(*)"}, [][]string{{strconv.Itoa(count)}}, binaryRows)
+	case upper == "SELECT SCHEMA_NAME FROM INFORMATION_SCHEMA.SCHEMATA":
+		var rows [][]string
+		f.mu.Lock()
+		for database := range f.databases {
+			rows = append(rows, []string{database})
+		}
+		f.mu.Unlock()
+		return s.resultSet([]string{"SCHEMA_NAME"}, rows, binaryRows)
+	case strings.HasPrefix(upper, "SELECT COUNT(*) FROM MYSQL.USER"):
+		user := unquoteString(strings.TrimSuffix(query[strings.Index(query, "User =")+6:], " AND Host = '%'"))
+		f.mu.Lock()
+		count := 0
+		if f.users[user] {
+			count = 1
+		}
+		f.mu.Unlock()
+		return s.resultSet([]string{"COUNT(*)"}, [][]string{{strconv.Itoa(count)}}, binaryRows)
+	case strings.HasPrefix(upper, "CREATE USER "):
+		user, _, _ := strings.Cut(query[len("CREATE USER "):], "@")
+		f.mu.Lock()
+		f.users[unquoteString(user)] = true
+		f.mu.Unlock()
+		return s.ok()
+	case strings.HasPrefix(upper, "CREATE DATABASE "):
+		rest := query[len("CREATE DATABASE "):]
+		ifNotExists := strings.HasPrefix(strings.ToUpper(rest), "IF NOT EXISTS ")
+		if ifNotExists {
+			rest = rest[len("IF NOT EXISTS "):]
+		}
+		name := unquoteIdentifier(rest)
+		switch {
+		case f.hasDatabase(name) && ifNotExists:
+			return s.ok()
+		case f.hasDatabase(name):
+			return s.err(1007, "HY000", fmt.Sprintf("Can't create database '%s'; database exists", name))
+		}
+		f.create(name)
+		// MySQL reports a created database as one row affected
+		return s.write([]byte{0x00, 0x01, 0x00, 0x02, 0x00, 0x00, 0x00})
+	case strings.HasPrefix(upper, "DROP DATABASE "):
+		rest := query[len("DROP DATABASE "):]
+		if strings.HasPrefix(strings.ToUpper(rest), "IF EXISTS ") {
+			rest = rest[len("IF EXISTS "):]
+		}
+		f.mu.Lock()
+		delete(f.databases, unquoteIdentifier(rest))
+		f.mu.Unlock()
+		return s.ok()
+	case isUseCommand(append([]byte{comQuery}, query...)):
+		if name := parseUseStatement(query); name != "" {
+			return s.use(name)
+		}
+		return s.err(1064, "42000", "You have an error in your SQL syntax")
+	case upper == "SELECT DATABASE()":
+		return s.resultSet([]string{"DATABASE()"}, [][]string{{s.db}}, binaryRows)
+	}
+	return s.ok()
+}
+
+// prepare answers a COM_STMT_PREPARE, describing one parameter per "?" and
+// no columns, which a statement's result set describes when it is executed
+func (s *fakeSession) prepare(query string) error {
+	s.next++
+	s.stmts[s.next] = query
+	params := strings.Count(query, "?")
+	payload := []byte{0x00}
+	payload = binary.LittleEndian.AppendUint32(payload, s.next)
+	payload = append(payload, 0, 0, byte(params), byte(params>>8), 0, 0, 0)
+	if err := s.write(payload); err != nil {
+		return err
+	}
+	if params == 0 {
+		return nil
+	}
+	for i := 0; i < params; i++ {
+		def := appendLengthEncodedString(nil, "def")
+		for _, field := range []string{"", "", "", "?", ""} {
+			def = appendLengthEncodedString(def, field)
+		}
+		if err := s.write(append(def, 0x0c, 63, 0, 0, 0, 0, 0, 0xfd, 0, 0, 0, 0, 0)); err != nil {
+			return err
+		}
+	}
+	return s.eof()
+}
+
+// execute runs a prepared statement with the parameters of a
+// COM_STMT_EXECUTE substituted into it
+func (s *fakeSession) execute(payload []byte) error {
+	if len(payload) < 10 {
+		return s.err(1210, "HY000", "Incorrect arguments to mysqld_stmt_execute")
+	}
+	query, ok := s.stmts[binary.LittleEndian.Uint32(payload[1:5])]
+	if !ok {
+		return s.err(1243, "HY000", "Unknown prepared statement handler")
+	}
+	params := strings.Count(query, "?")
+	values, err := decodeStmtParams(payload[10:], params)
+	if err != nil {
+		return s.err(1210, "HY000", err.Error())
+	}
+	for _, value := range values {
+		query = strings.Replace(query, "?", value, 1)
+	}
+	return s.query(query, true)
+}
+
+// decodeStmtParams decodes the parameters of a COM_STMT_EXECUTE, from the
+// NULL bitmap on, as quoted SQL literals
+func decodeStmtParams(data []byte, count int) ([]string, error) {
+	if count == 0 {
+		return nil, nil
+	}
+	nullBitmap := (count + 7) / 8
+	if len(data) < nullBitmap+1+2*count || data[nullBitmap] != 1 {
+		return nil, errors.New("parameters without types")
+	}
+	types := data[nullBitmap+1 : nullBitmap+1+2*count]
+	pos := nullBitmap + 1 + 2*count
+	values := make([]string, count)
+	for i := range values {
+		if data[i/8]&(1<<(i%8)) != 0 {
+			values[i] = "NULL"
+			continue
+		}
+		switch types[2*i] {
+		case 0x08:
+			values[i] = strconv.FormatInt(int64(binary.LittleEndian.Uint64(data[pos:])), 10)
+			pos += 8
+		default:
+			value, n, err := readLengthEncodedString(data[pos:])
+			if err != nil {
+				return nil, err
+			}
+			values[i] = "'" + strings.ReplaceAll(value, "'", "''") + "'"
+			pos += n
+		}
+	}
+	return values, nil
+}
+
+// unquoteIdentifier returns a possibly backtick-quoted identifier
+func unquoteIdentifier(value string) string {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "`") && strings.HasSuffix(value, "`") && len(value) > 1 {
+		return strings.ReplaceAll(value[1:len(value)-1], "``", "`")
+	}
+	return value
+}
+
+// unquoteString returns a possibly single-quoted string literal
+func unquoteString(value string) string {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "'") && strings.HasSuffix(value, "'") && len(value) > 1 {
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+	}
+	return value
+}
+
+// testCertificate returns a self-signed certificate for 127.0.0.1 and its
+// PEM encoding
+func testCertificate(t testing.TB) (tls.Certificate, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"localhost"},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
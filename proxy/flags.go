@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// flagName is the command-line flag that sets an option: its environment
+// variable in lower case, with hyphens for underscores
+func (o configOption) flagName() string {
+	return strings.ReplaceAll(strings.ToLower(o.env), "_", "-")
+}
+
+// optionFlag is the command-line flag of a config option. It keeps the raw
+// value given, which LoadConfig applies over the environment.
+type optionFlag struct {
+	option configOption
+	raw    *string
+}
+
+// String returns the value given, or the option's default before one is
+func (f *optionFlag) String() string {
+	if f.option.field == "" {
+		// The flag package probes a zero optionFlag for its zero value
+		return ""
+	}
+	if f.raw == nil {
+		return f.option.format(defaultConfig)
+	}
+	return *f.raw
+}
+
+// Set records the value after checking that the option accepts it, so that
+// an invalid flag stops the proxy before it starts
+func (f *optionFlag) Set(raw string) error {
+	config := defaultConfig
+	if err := f.option.set(&config, raw); err != nil {
+		return err
+	}
+	f.raw = &raw
+	return nil
+}
+
+// IsBoolFlag lets boolean options be given without a value
+func (f *optionFlag) IsBoolFlag() bool {
+	return reflect.ValueOf(defaultConfig).FieldByName(f.option.field).Kind() == reflect.Bool
+}
+
+// ConfigFlags defines a flag on fs for every config option. The returned
+// function gives, once fs has been parsed, the raw values of the flags that
+// were set, keyed by environment variable like the other layers.
+func ConfigFlags(fs *flag.FlagSet) func() map[string]string {
+	flags := make([]*optionFlag, 0, len(configOptions))
+	for _, option := range configOptions {
+		f := &optionFlag{option: option}
+		fs.Var(f, option.flagName(), fmt.Sprintf("%s (env %s)", option.help, option.env))
+		flags = append(flags, f)
+	}
+	return func() map[string]string {
+		raw := make(map[string]string)
+		for _, f := range flags {
+			if f.raw != nil {
+				raw[f.option.env] = *f.raw
+			}
+		}
+		return raw
+	}
+}
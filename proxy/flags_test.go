@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"strings"
+	"testing"
+)
+
+// parseConfigFlags parses args with the config flags, returning the raw
+// values of the flags set
+func parseConfigFlags(t *testing.T, args ...string) (map[string]string, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("mysql-auto-db-proxy", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	values := ConfigFlags(fs)
+	err := fs.Parse(args)
+	return values(), err
+}
+
+func TestConfigFlags(t *testing.T) {
+	raw, err := parseConfigFlags(t, "--proxy-port", "3310", "--mysql-host=db.local", "--log-level", "debug", "--strict-db-names=false", "--dry-run")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	want := map[string]string{
+		"PROXY_PORT":      "3310",
+		"MYSQL_HOST":      "db.local",
+		"LOG_LEVEL":       "debug",
+		"STRICT_DB_NAMES": "false",
+		"DRY_RUN":         "true",
+	}
+	if len(raw) != len(want) {
+		t.Fatalf("flags set %v, want %v", raw, want)
+	}
+	for env, value := range want {
+		if raw[env] != value {
+			t.Errorf("%s = %q, want %q", env, raw[env], value)
+		}
+	}
+
+	// Invalid values stop the parse rather than falling back to a default
+	for _, args := range [][]string{{"--proxy-port", "abc"}, {"--proxy-port", "70000"}, {"--shutdown-timeout", "soon"}} {
+		if _, err := parseConfigFlags(t, args...); err == nil {
+			t.Errorf("accepted %q", args)
+		}
+	}
+}
+
+func TestConfigFlagsHelp(t *testing.T) {
+	var help bytes.Buffer
+	fs := flag.NewFlagSet("mysql-auto-db-proxy", flag.ContinueOnError)
+	fs.SetOutput(&help)
+	ConfigFlags(fs)
+	fs.PrintDefaults()
+	for _, option := range configOptions {
+		if !strings.Contains(help.String(), "-"+option.flagName()) || !strings.Contains(help.String(), "(env "+option.env+")") {
+			t.Errorf("help does not describe %s", option.env)
+		}
+	}
+	if !strings.Contains(help.String(), "Port for the proxy to listen on") || !strings.Contains(help.String(), "(default 3306)") {
+		t.Fatalf("help misses descriptions or defaults:\n%s", help.String())
+	}
+}
+
+func TestFlagPrecedence(t *testing.T) {
+	t.Setenv("PROXY_PORT", "4000")
+	t.Setenv("MYSQL_HOST", "env.local")
+	raw, err := parseConfigFlags(t, "--proxy-port", "3310")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+
+	// Flags win over the environment, which wins over the defaults
+	config, provenance, err := LoadConfig("", "", raw)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if config.ProxyPort != 3310 || provenance["ProxyPort"] != sourceFlag {
+		t.Errorf("ProxyPort = %d from %s", config.ProxyPort, provenance["ProxyPort"])
+	}
+	if config.MySQLHost != "env.local" || provenance["MySQLHost"] != sourceEnv {
+		t.Errorf("MySQLHost = %q from %s", config.MySQLHost, provenance["MySQLHost"])
+	}
+	if config.MySQLPort != defaultConfig.MySQLPort || provenance["MySQLPort"] != sourceDefault {
+		t.Errorf("MySQLPort = %d from %s", config.MySQLPort, provenance["MySQLPort"])
+	}
+
+	// An invalid environment variable is an error too
+	t.Setenv("PROXY_PORT", "abc")
+	if _, _, err := LoadConfig("", "", nil); err == nil || !strings.Contains(err.Error(), "invalid PROXY_PORT") {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+var forwardBufferAllocations = newCounter("mysql_autodb_forward_buffer_allocations_total",
+	"FORWARD_BUFFER_SIZE buffers allocated because the pool had none to reuse")
+
+// bufferPool pools the FORWARD_BUFFER_SIZE buffers relayed packets are read
+// into, so that connections opening and closing do not allocate new ones
+type bufferPool struct {
+	size int
+	pool sync.Pool
+}
+
+// newBufferPool creates a pool of buffers of size bytes
+func newBufferPool(size int) *bufferPool {
+	p := &bufferPool{size: size}
+	p.pool.New = func() interface{} {
+		forwardBufferAllocations.Inc()
+		buf := make([]byte, size)
+		return &buf
+	}
+	return p
+}
+
+// get returns a buffer from the pool
+func (p *bufferPool) get() *[]byte {
+	return p.pool.Get().(*[]byte)
+}
+
+// put returns a buffer to the pool once nothing refers to it
+func (p *bufferPool) put(buf *[]byte) {
+	p.pool.Put(buf)
+}
+
+// packetReader reads the packets of one direction of a connection into a
+// pooled buffer reused from packet to packet, so that relaying a packet that
+// fits in it allocates nothing. Larger packets are read into a buffer of
+// their own, which is not kept. A packet, and the header returned by
+// readHeader, are only valid until the next read.
+type packetReader struct {
+	conn   net.Conn
+	pool   *bufferPool
+	buf    *[]byte
+	packet MySQLPacket
+}
+
+// newPacketReader creates a reader of conn's packets, which must be released
+func (p *Proxy) newPacketReader(conn net.Conn) *packetReader {
+	return &packetReader{conn: conn, pool: p.forwardBuffers, buf: p.forwardBuffers.get()}
+}
+
+// readPacket reads a complete packet
+func (r *packetReader) readPacket() (*MySQLPacket, error) {
+	if _, err := r.readHeader(); err != nil {
+		return nil, err
+	}
+	return r.readPayload()
+}
+
+// readHeader reads the header of the next packet into the buffer
+func (r *packetReader) readHeader() ([]byte, error) {
+	header := (*r.buf)[:4]
+	if _, err := io.ReadFull(r.conn, header); err != nil {
+		return nil, fmt.Errorf("failed to read packet header: %w", err)
+	}
+	return header, nil
+}
+
+// readPayload reads the payload of the packet whose header was just read
+func (r *packetReader) readPayload() (*MySQLPacket, error) {
+	buf := *r.buf
+	if length, _ := parsePacketHeader(buf); 4+length > len(buf) {
+		buf = make([]byte, 4+length)
+		copy(buf, (*r.buf)[:4])
+	}
+	packet, err := readPacketInto(r.conn, buf)
+	if err != nil {
+		return nil, err
+	}
+	r.packet = packet
+	return &r.packet, nil
+}
+
+// readLogicalPayload reads the payload of the packet whose header was just
+// read together with its continuation packets, as readLogicalPacket does.
+// Only a payload that does not continue is read into the reader's buffer.
+func (r *packetReader) readLogicalPayload(maxBytes int) (*MySQLPacket, error) {
+	if length, _ := parsePacketHeader(*r.buf); length == maxPacketPayload {
+		return readLogicalPacket(r.conn, (*r.buf)[:4], maxBytes)
+	}
+	packet, err := r.readPayload()
+	if err != nil {
+		return nil, err
+	}
+	packet.Packets = 1
+	return packet, nil
+}
+
+// release returns the reader's buffer to the pool once the connection is done
+func (r *packetReader) release() {
+	r.pool.put(r.buf)
+	r.buf = nil
+}
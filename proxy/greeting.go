@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// clientCompress is the capability flag for the compressed protocol
+const clientCompress = 0x00000020
+
+// defaultTerminateCapabilities are the capability flags of the proxy's own
+// greeting: those of a MySQL 8.0 server without TLS or compression
+const defaultTerminateCapabilities = 0x01bff7ff &^ (clientSSL | clientCompress)
+
+// checkGreeting verifies that the first packet sent by the backend looks like a
+// MySQL handshake, so that a backend speaking another protocol is reported
+// instead of its bytes being relayed to the client as a greeting
+func checkGreeting(payload []byte) error {
+	if len(payload) == 0 {
+		return fmt.Errorf("empty greeting")
+	}
+
+	switch payload[0] {
+	case 0xff:
+		// The server refused the connection with an ERR, which the client understands
+		return nil
+	case 9, 10:
+	default:
+		return fmt.Errorf("unsupported protocol version %d", payload[0])
+	}
+
+	// The protocol version is followed by the printable, NUL-terminated server version
+	version, _, err := readNullTerminated(payload[1:])
+	if err != nil || version == "" {
+		return fmt.Errorf("missing server version")
+	}
+	for _, c := range []byte(version) {
+		if c < 0x20 || c > 0x7e {
+			return fmt.Errorf("malformed server version %q", version)
+		}
+	}
+	return nil
+}
+
+// parseGreetingCapabilities returns the capability flags advertised in a
+// HandshakeV10 greeting
+func parseGreetingCapabilities(payload []byte) (uint32, error) {
+	if len(payload) == 0 || payload[0] != 10 {
+		return 0, fmt.Errorf("not a protocol 10 greeting")
+	}
+	_, n, err := readNullTerminated(payload[1:])
+	if err != nil {
+		return 0, err
+	}
+
+	// Skip the connection ID, the first part of the auth data and the filler
+	pos := 1 + n + 4 + 8 + 1
+	if len(payload) < pos+2 {
+		return 0, errTruncatedHandshake
+	}
+	capabilities := uint32(payload[pos]) | uint32(payload[pos+1])<<8
+
+	// The upper capability flags follow the character set and status flags
+	if len(payload) >= pos+7 {
+		capabilities |= uint32(payload[pos+5])<<16 | uint32(payload[pos+6])<<24
+	}
+	return capabilities, nil
+}
+
+// mariaDBVersionPrefix is put before the version of MariaDB servers so that
+// MySQL replicas, which only expect 5.x masters, accept them
+const mariaDBVersionPrefix = "5.5.5-"
+
+// serverInfo is what a HandshakeV10 greeting tells of the server behind it
+type serverInfo struct {
+	// Flavor is "mariadb" or "mysql"
+	Flavor string
+	// Version is the server version without MariaDB's replication prefix
+	Version      string
+	Capabilities uint32
+
+	// MariaDBCapabilities are the extended capabilities MariaDB 10.2+
+	// servers advertise in the last 4 bytes of the reserved filler, when
+	// they clear CLIENT_MYSQL
+	MariaDBCapabilities uint32
+}
+
+// parseServerGreeting returns the flavor, version and capabilities of the
+// server that sent a HandshakeV10 greeting
+func parseServerGreeting(payload []byte) (*serverInfo, error) {
+	capabilities, err := parseGreetingCapabilities(payload)
+	if err != nil {
+		return nil, err
+	}
+	version, n, _ := readNullTerminated(payload[1:])
+	info := &serverInfo{Flavor: "mysql", Version: version, Capabilities: capabilities}
+	if strings.Contains(strings.ToLower(version), "mariadb") {
+		info.Flavor = "mariadb"
+		info.Version = strings.TrimPrefix(version, mariaDBVersionPrefix)
+	}
+
+	// The extended capabilities close the 10 reserved bytes that follow the
+	// upper capability flags and the auth data length
+	if extended := 1 + n + 4 + 8 + 1 + 8 + 6; capabilities&clientMySQL == 0 && len(payload) >= extended+4 {
+		info.Flavor = "mariadb"
+		info.MariaDBCapabilities = uint32(payload[extended]) | uint32(payload[extended+1])<<8 |
+			uint32(payload[extended+2])<<16 | uint32(payload[extended+3])<<24
+	}
+	return info, nil
+}
+
+// noteServer logs the flavor and version of the server that sent a greeting:
+// at debug level for every connection, and at info level the first time a
+// backend shows them and whenever they change, as after an upgrade. It returns
+// nil for a greeting it cannot parse, such as an ERR.
+func (p *Proxy) noteServer(addr string, greeting []byte, logger *logrus.Entry) *serverInfo {
+	info, err := parseServerGreeting(greeting)
+	if err != nil {
+		return nil
+	}
+	fields := logrus.Fields{
+		"mysql_addr":     addr,
+		"server_flavor":  info.Flavor,
+		"server_version": info.Version,
+	}
+	logger.WithFields(fields).Debug("Read the server greeting")
+	seen := info.Flavor + " " + info.Version
+	if previous, loaded := p.serverVersions.Swap(addr, seen); !loaded || previous != seen {
+		p.log.WithFields(fields).Info("Detected the MySQL server version")
+	}
+	return info
+}
+
+// rewriteGreetingCapabilities returns a copy of a HandshakeV10 greeting that
+// also advertises the capability flags set and no longer advertises clear
+func rewriteGreetingCapabilities(payload []byte, set, clear uint32) ([]byte, error) {
+	if _, err := parseGreetingCapabilities(payload); err != nil {
+		return nil, err
+	}
+
+	// pos is the offset of the lower capability flags, as in parseGreetingCapabilities
+	_, n, _ := readNullTerminated(payload[1:])
+	pos := 1 + n + 4 + 8 + 1
+	rewritten := append([]byte(nil), payload...)
+	rewritten[pos] = rewritten[pos]&^byte(clear) | byte(set)
+	rewritten[pos+1] = rewritten[pos+1]&^byte(clear>>8) | byte(set>>8)
+	if len(rewritten) >= pos+7 {
+		rewritten[pos+5] = rewritten[pos+5]&^byte(clear>>16) | byte(set>>16)
+		rewritten[pos+6] = rewritten[pos+6]&^byte(clear>>24) | byte(set>>24)
+	}
+	return rewritten, nil
+}
+
+// rewriteGreetingAuthPlugin returns a copy of a HandshakeV10 greeting that
+// advertises the given default auth plugin, setting CLIENT_PLUGIN_AUTH if the
+// server did not. Only the advertisement changes; the server must accept the
+// plugin when the client authenticates with it.
+func rewriteGreetingAuthPlugin(payload []byte, plugin string) ([]byte, error) {
+	capabilities, err := parseGreetingCapabilities(payload)
+	if err != nil {
+		return nil, err
+	}
+	if capabilities&clientSecureConnection == 0 {
+		return nil, fmt.Errorf("greeting without CLIENT_SECURE_CONNECTION cannot name an auth plugin")
+	}
+
+	// pos is the offset of the lower capability flags, as in parseGreetingCapabilities
+	_, n, _ := readNullTerminated(payload[1:])
+	pos := 1 + n + 4 + 8 + 1
+	authDataLenPos := pos + 7
+	part2 := authDataLenPos + 1 + 10
+	if len(payload) < part2 {
+		return nil, errTruncatedHandshake
+	}
+
+	authDataLen := int(payload[authDataLenPos])
+	if capabilities&clientPluginAuth == 0 || authDataLen == 0 {
+		authDataLen = 21
+	}
+	part2Len := authDataLen - 8
+	if part2Len < 13 {
+		part2Len = 13
+	}
+	if len(payload) < part2+part2Len {
+		return nil, errTruncatedHandshake
+	}
+
+	rewritten := append([]byte(nil), payload[:part2+part2Len]...)
+	capabilities |= clientPluginAuth
+	rewritten[pos+5] = byte(capabilities >> 16)
+	rewritten[pos+6] = byte(capabilities >> 24)
+	rewritten[authDataLenPos] = byte(authDataLen)
+	rewritten = append(rewritten, plugin...)
+	return append(rewritten, 0), nil
+}
+
+// greetingAuthData returns the auth plugin data (the scramble) of a
+// HandshakeV10 greeting
+func greetingAuthData(payload []byte) ([]byte, error) {
+	capabilities, err := parseGreetingCapabilities(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// pos is the offset of the lower capability flags, as in parseGreetingCapabilities
+	_, n, _ := readNullTerminated(payload[1:])
+	part1 := 1 + n + 4
+	pos := part1 + 8 + 1
+	authDataLenPos := pos + 7
+	part2 := authDataLenPos + 1 + 10
+	data := append([]byte(nil), payload[part1:part1+8]...)
+	if capabilities&clientSecureConnection == 0 {
+		return data, nil
+	}
+	if len(payload) < part2 {
+		return nil, errTruncatedHandshake
+	}
+
+	// The second part is at least 13 bytes and ends with a NUL that is not
+	// part of the scramble
+	part2Len := int(payload[authDataLenPos]) - 8
+	if part2Len < 13 {
+		part2Len = 13
+	}
+	if len(payload) < part2+part2Len {
+		return nil, errTruncatedHandshake
+	}
+	data = append(data, payload[part2:part2+part2Len]...)
+	if data[len(data)-1] == 0 {
+		data = data[:len(data)-1]
+	}
+	return data, nil
+}
+
+// proxyGreeting builds the HandshakeV10 greeting the proxy sends itself when
+// TerminateHandshake is set, with a fresh scramble
+func (p *Proxy) proxyGreeting(connID uint64) ([]byte, error) {
+	capabilities, err := terminateCapabilities(p.config.TerminateCapabilities)
+	if err != nil {
+		return nil, err
+	}
+
+	// The scramble is 20 printable bytes, so that it never contains a NUL
+	scramble := make([]byte, 20)
+	if _, err := rand.Read(scramble); err != nil {
+		return nil, err
+	}
+	for i, b := range scramble {
+		scramble[i] = '!' + b%94
+	}
+
+	plugin := p.config.AdvertiseAuthPlugin
+	if plugin == "" {
+		plugin = "mysql_native_password"
+	}
+
+	greeting := []byte{10}
+	greeting = append(greeting, p.config.TerminateServerVersion...)
+	greeting = append(greeting, 0, byte(connID), byte(connID>>8), byte(connID>>16), byte(connID>>24))
+	greeting = append(greeting, scramble[:8]...)
+	greeting = append(greeting, 0, byte(capabilities), byte(capabilities>>8))
+	// utf8mb4_general_ci, then SERVER_STATUS_AUTOCOMMIT
+	greeting = append(greeting, 45, 0x02, 0x00)
+	greeting = append(greeting, byte(capabilities>>16), byte(capabilities>>24), byte(len(scramble)+1))
+	greeting = append(greeting, make([]byte, 10)...)
+	greeting = append(greeting, scramble[8:]...)
+	greeting = append(greeting, 0)
+	greeting = append(greeting, plugin...)
+	return append(greeting, 0), nil
+}
+
+// terminateCapabilities parses TERMINATE_CAPABILITIES, a hexadecimal (0x...)
+// or decimal capability mask; empty selects defaultTerminateCapabilities
+func terminateCapabilities(value string) (uint32, error) {
+	if value == "" {
+		return defaultTerminateCapabilities, nil
+	}
+	capabilities, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid capability mask %q", value)
+	}
+	if capabilities&(clientProtocol41|clientSecureConnection|clientPluginAuth) != clientProtocol41|clientSecureConnection|clientPluginAuth {
+		return 0, fmt.Errorf("capability mask must include CLIENT_PROTOCOL_41, CLIENT_SECURE_CONNECTION and CLIENT_PLUGIN_AUTH")
+	}
+	if capabilities&(clientSSL|clientCompress) != 0 {
+		return 0, fmt.Errorf("capability mask must not include CLIENT_SSL or CLIENT_COMPRESS")
+	}
+	return uint32(capabilities), nil
+}
+
+// capabilityMask accepts valid TERMINATE_CAPABILITIES values
+func capabilityMask(value interface{}) error {
+	_, err := terminateCapabilities(value.(string))
+	return err
+}
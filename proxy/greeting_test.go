@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckGreeting(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		ok      bool
+	}{
+		{"protocol 10", buildGreeting("8.0.36", 1, fakeCapabilities, 0, "mysql_native_password"), true},
+		{"protocol 9", append([]byte("\x093.23.58\x00"), make([]byte, 13)...), true},
+		{"refused", []byte("\xff\x69\x04Host '10.0.0.1' is blocked"), true},
+		{"empty", nil, false},
+		{"other protocol", []byte("\x05garbage\x00"), false},
+		{"http", []byte("HTTP/1.1 400 Bad Request\r\n"), false},
+		{"no version", []byte{10, 0, 1, 0, 0, 0}, false},
+		{"unterminated version", []byte("\x0a8.0.36"), false},
+		{"binary version", []byte("\x0a8.0\x01\x00"), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := checkGreeting(tc.payload); (err == nil) != tc.ok {
+				t.Fatalf("checkGreeting: %v", err)
+			}
+		})
+	}
+}
+
+// startRawBackend serves each connection by writing response and closing it
+func startRawBackend(t *testing.T, response []byte) Config {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write(response)
+			conn.Close()
+		}
+	}()
+
+	config := DefaultConfig()
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	config.MySQLHost = host
+	config.MySQLPort, _ = strconv.Atoi(port)
+	config.HandshakeTimeout = 5 * time.Second
+	config.StatsInterval = 0
+	return config
+}
+
+func TestNonMySQLBackendIsReported(t *testing.T) {
+	for name, response := range map[string][]byte{
+		"http":           []byte("HTTP/1.1 400 Bad Request\r\nContent-Length: 0\r\n\r\n"),
+		"other protocol": packetBytes(newPacket(0, []byte("\x05garbage\x00"))),
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, addr := startProxy(t, startRawBackend(t, response), WithEnsurer(&recordingEnsurer{}))
+			conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+			if err != nil {
+				t.Fatalf("dial proxy: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+			packet, err := readPacket(conn)
+			if err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			expectErr(t, packet, 1053)
+			if message := errPacketMessage(packet.Payload); !strings.Contains(message, "backend did not speak MySQL protocol") {
+				t.Fatalf("refused with %q", message)
+			}
+		})
+	}
+}
+
+func TestRewriteGreetingAuthPlugin(t *testing.T) {
+	greeting := buildGreeting("8.0.36", 7, fakeCapabilities, 0, "caching_sha2_password")
+	rewritten, err := rewriteGreetingAuthPlugin(greeting, "mysql_native_password")
+	if err != nil {
+		t.Fatalf("rewriteGreetingAuthPlugin: %v", err)
+	}
+	if !bytes.HasSuffix(rewritten, []byte("\x00mysql_native_password\x00")) {
+		t.Fatalf("rewritten greeting %q", rewritten)
+	}
+	// Everything but the plugin name is kept
+	if !bytes.Equal(rewritten[:len(greeting)-len("caching_sha2_password\x00")], greeting[:len(greeting)-len("caching_sha2_password\x00")]) {
+		t.Fatalf("rewritten greeting %q, from %q", rewritten, greeting)
+	}
+	scramble, _ := greetingAuthData(greeting)
+	if got, err := greetingAuthData(rewritten); err != nil || !bytes.Equal(got, scramble) {
+		t.Fatalf("scramble %q (%v), want %q", got, err, scramble)
+	}
+
+	// A server that names no plugin gets CLIENT_PLUGIN_AUTH and an auth data length
+	bare := buildGreeting("5.6.51", 7, fakeCapabilities&^clientPluginAuth, 0, "")
+	bare = bare[:len(bare)-1]
+	bare[len("\x0a5.6.51\x00")+4+8+1+7] = 0
+	rewritten, err = rewriteGreetingAuthPlugin(bare, "mysql_native_password")
+	if err != nil {
+		t.Fatalf("rewriteGreetingAuthPlugin: %v", err)
+	}
+	if capabilities, _ := parseGreetingCapabilities(rewritten); capabilities != fakeCapabilities {
+		t.Fatalf("capabilities 0x%x, want 0x%x", capabilities, uint32(fakeCapabilities))
+	}
+	if got, err := greetingAuthData(rewritten); err != nil || !bytes.Equal(got, scramble) {
+		t.Fatalf("scramble %q (%v), want %q", got, err, scramble)
+	}
+	if !bytes.HasSuffix(rewritten, []byte("\x00mysql_native_password\x00")) {
+		t.Fatalf("rewritten greeting %q", rewritten)
+	}
+
+	if _, err := rewriteGreetingAuthPlugin(buildGreeting("4.0.30", 7, clientProtocol41, 0, ""), "mysql_native_password"); err == nil {
+		t.Fatal("rewrote a greeting without CLIENT_SECURE_CONNECTION")
+	}
+	if _, err := rewriteGreetingAuthPlugin(greeting[:30], "mysql_native_password"); err == nil {
+		t.Fatal("rewrote a truncated greeting")
+	}
+}
+
+func TestAdvertiseAuthPlugin(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.setGreeting(buildGreeting("8.0.36", 1, fakeCapabilities, 0, "caching_sha2_password"))
+	config := testConfig(backend)
+	config.AdvertiseAuthPlugin = "mysql_native_password"
+	_, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	c := mustConnect(t, addr, testHandshake{user: "root", plugin: "mysql_native_password"})
+	if !bytes.HasSuffix(c.greeting.Payload, []byte("\x00mysql_native_password\x00")) {
+		t.Fatalf("client was greeted with %q", c.greeting.Payload)
+	}
+	c.mustQuery("SELECT 1")
+}
+
+func TestTerminateCapabilities(t *testing.T) {
+	if capabilities, err := terminateCapabilities(""); err != nil || capabilities != defaultTerminateCapabilities {
+		t.Fatalf("default capabilities 0x%x, %v", capabilities, err)
+	}
+	if capabilities, err := terminateCapabilities("0x000fa20f"); err != nil || capabilities != 0x000fa20f {
+		t.Fatalf("capabilities 0x%x, %v", capabilities, err)
+	}
+	for _, value := range []string{"full", "0x0000a200", "0x000fa20f|0x800", fmt.Sprint(0x000fa20f | clientSSL), fmt.Sprint(0x000fa20f | clientCompress)} {
+		if _, err := terminateCapabilities(value); err == nil {
+			t.Errorf("accepted %q", value)
+		}
+	}
+}
+
+func TestProxyGreeting(t *testing.T) {
+	config := DefaultConfig()
+	config.StatsInterval = 0
+	p, err := New(config, WithEnsurer(&recordingEnsurer{}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	greeting, err := p.proxyGreeting(0x01020304)
+	if err != nil {
+		t.Fatalf("proxyGreeting: %v", err)
+	}
+	if err := checkGreeting(greeting); err != nil {
+		t.Fatalf("checkGreeting: %v", err)
+	}
+	info, err := parseServerGreeting(greeting)
+	if err != nil {
+		t.Fatalf("parseServerGreeting: %v", err)
+	}
+	if info.Version != config.TerminateServerVersion || info.Capabilities != defaultTerminateCapabilities {
+		t.Fatalf("greeting announces %+v", info)
+	}
+	if id := greeting[1+len(config.TerminateServerVersion)+1:][:4]; !bytes.Equal(id, []byte{4, 3, 2, 1}) {
+		t.Fatalf("connection ID %x", id)
+	}
+	if !bytes.HasSuffix(greeting, []byte("\x00mysql_native_password\x00")) {
+		t.Fatalf("greeting %q", greeting)
+	}
+
+	// Each greeting has a fresh scramble of 20 printable bytes
+	scramble, err := greetingAuthData(greeting)
+	if err != nil || len(scramble) != 20 {
+		t.Fatalf("scramble %q, %v", scramble, err)
+	}
+	for _, b := range scramble {
+		if b < '!' || b > '~' {
+			t.Fatalf("scramble %q is not printable", scramble)
+		}
+	}
+	other, _ := p.proxyGreeting(0x01020304)
+	if otherScramble, _ := greetingAuthData(other); bytes.Equal(otherScramble, scramble) {
+		t.Fatal("two greetings have the same scramble")
+	}
+
+	p.config.AdvertiseAuthPlugin = "caching_sha2_password"
+	if greeting, _ := p.proxyGreeting(1); !bytes.HasSuffix(greeting, []byte("\x00caching_sha2_password\x00")) {
+		t.Fatalf("greeting %q", greeting)
+	}
+}
+
+func TestTerminateHandshake(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.TerminateHandshake = true
+	ensurer := &recordingEnsurer{backend: backend}
+	_, addr := startProxy(t, config, WithEnsurer(ensurer))
+
+	// The proxy greets the client before MySQL is dialed
+	sessions := backend.sessionCount()
+	c := dialTestClient(t, addr)
+	if info, err := parseServerGreeting(c.greeting.Payload); err != nil || info.Version != config.TerminateServerVersion {
+		t.Fatalf("greeted with %+v, %v", info, err)
+	}
+	if backend.sessionCount() != sessions {
+		t.Fatal("MySQL was dialed before the client answered the greeting")
+	}
+
+	// The client scrambles its password again for MySQL's greeting, and the
+	// numbering it follows is the proxy's
+	handshake := testHandshake{user: "root", auth: []byte("for the proxy"), database: "orders"}
+	authSwitch := c.send(1, handshake.payload())
+	if authSwitch == nil || authSwitch.Payload[0] != 0xfe || authSwitch.SequenceID != 2 {
+		t.Fatalf("handshake answered with %s", describePacket(authSwitch))
+	}
+	scramble, _ := greetingAuthData(backend.fakeGreeting(0))
+	if !bytes.HasSuffix(authSwitch.Payload, append(scramble, 0)) {
+		t.Fatalf("auth switch %q does not carry MySQL's scramble", authSwitch.Payload)
+	}
+	response := c.send(3, []byte("for MySQL"))
+	if response == nil || response.Payload[0] != 0x00 || response.SequenceID != 4 {
+		t.Fatalf("auth switch response answered with %s", describePacket(response))
+	}
+	c.mustQuery("SELECT 1")
+
+	handshakes := backend.receivedHandshakes()
+	hr, err := parseHandshakeResponse(handshakes[len(handshakes)-1])
+	if err != nil || string(hr.AuthResponse) != "for MySQL" || hr.Database != "orders" {
+		t.Fatalf("MySQL received %+v, %v", hr, err)
+	}
+	if !equalStrings(ensurer.requested(), []string{"orders"}) {
+		t.Fatalf("ensurer asked for %q", ensurer.requested())
+	}
+}
+
+func TestTerminateHandshakeWithoutBackend(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := startRawBackend(t, nil)
+	config.MySQLPort = listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	config.TerminateHandshake = true
+	_, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{}))
+
+	// The client is greeted, then learns that MySQL is down once it answers
+	_, response := connect(t, addr, testHandshake{user: "root"})
+	expectErr(t, response, 1053)
+	if response.SequenceID != 2 {
+		t.Fatalf("ERR numbered %d, want 2", response.SequenceID)
+	}
+}
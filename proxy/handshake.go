@@ -0,0 +1,544 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Capability flags from the MySQL client/server protocol
+const (
+	clientMySQL                      = 0x00000001
+	clientConnectWithDB              = 0x00000008
+	clientProtocol41                 = 0x00000200
+	clientSecureConnection           = 0x00008000
+	clientPluginAuth                 = 0x00080000
+	clientConnectAttrs               = 0x00100000
+	clientPluginAuthLenencClientData = 0x00200000
+	clientSessionTrack               = 0x00800000
+	clientDeprecateEOF               = 0x01000000
+	clientQueryAttributes            = 0x08000000
+)
+
+// responseFormatCapabilities change the format of commands or responses once
+// negotiated, so a client and backend must agree on them
+const responseFormatCapabilities = clientProtocol41 | clientSessionTrack | clientDeprecateEOF | clientQueryAttributes
+
+// Command bytes of the client commands the proxy inspects
+const (
+	comQuit             = 0x01
+	comInitDB           = 0x02
+	comQuery            = 0x03
+	comFieldList        = 0x04
+	comChangeUser       = 0x11
+	comStmtPrepare      = 0x16
+	comStmtExecute      = 0x17
+	comStmtSendLongData = 0x18
+	comStmtClose        = 0x19
+	comStmtReset        = 0x1a
+	comStmtFetch        = 0x1c
+	comResetConnection  = 0x1f
+)
+
+var clientDriverConnections = newCounterVec("mysql_autodb_client_connections_total",
+	"Client handshakes by the driver reported in the connection attributes", "client_name", "client_version")
+
+var errTruncatedHandshake = errors.New("truncated handshake response")
+
+// handshakeResponse is a parsed HandshakeResponse41 packet
+type handshakeResponse struct {
+	CapabilityFlags uint32
+	MaxPacketSize   uint32
+	CharacterSet    byte
+	Username        string
+	AuthResponse    []byte
+	Database        string
+	AuthPlugin      string
+	Attributes      map[string]string
+
+	// MariaDBCapabilities are the extended capabilities a MariaDB client
+	// sends in the last 4 bytes of the reserved filler, when it clears
+	// CLIENT_MYSQL in answer to a MariaDB 10.2+ server that did. They never
+	// change where the other fields are.
+	MariaDBCapabilities uint32
+
+	// authOffset and authEnd delimit the encoded auth response in the payload
+	authOffset, authEnd int
+
+	// databaseOffset and databaseEnd delimit the null-terminated database,
+	// when CLIENT_CONNECT_WITH_DB is set
+	databaseOffset, databaseEnd int
+
+	// attrsOffset is where the connection attributes start in the payload
+	attrsOffset int
+}
+
+// parseHandshakeResponse parses a client HandshakeResponse41 payload, using the
+// capability flags to decide which optional fields are present
+func parseHandshakeResponse(payload []byte) (*handshakeResponse, error) {
+	if len(payload) < 32 {
+		return nil, errTruncatedHandshake
+	}
+
+	hr := &handshakeResponse{
+		CapabilityFlags: uint32(payload[0]) | uint32(payload[1])<<8 | uint32(payload[2])<<16 | uint32(payload[3])<<24,
+		MaxPacketSize:   uint32(payload[4]) | uint32(payload[5])<<8 | uint32(payload[6])<<16 | uint32(payload[7])<<24,
+		CharacterSet:    payload[8],
+	}
+	if hr.CapabilityFlags&clientProtocol41 == 0 {
+		return nil, fmt.Errorf("unsupported pre-4.1 handshake response")
+	}
+	if hr.CapabilityFlags&clientMySQL == 0 {
+		hr.MariaDBCapabilities = uint32(payload[28]) | uint32(payload[29])<<8 | uint32(payload[30])<<16 | uint32(payload[31])<<24
+	}
+
+	// Skip capability flags, max packet size, character set, and reserved
+	pos := 32
+
+	username, n, err := readNullTerminated(payload[pos:])
+	if err != nil {
+		return nil, err
+	}
+	hr.Username = username
+	pos += n
+
+	hr.authOffset = pos
+	hr.AuthResponse, pos, err = readAuthResponse(payload, pos, hr.CapabilityFlags)
+	if err != nil {
+		return nil, err
+	}
+	hr.authEnd = pos
+
+	if hr.CapabilityFlags&clientConnectWithDB != 0 {
+		database, n, err := readNullTerminated(payload[pos:])
+		if err != nil {
+			return nil, err
+		}
+		hr.Database = database
+		hr.databaseOffset, hr.databaseEnd = pos, pos+n
+		pos += n
+	}
+
+	if hr.CapabilityFlags&clientPluginAuth != 0 {
+		// Some clients end the packet without terminating the plugin name
+		plugin, n, err := readNullTerminated(payload[pos:])
+		if err != nil {
+			plugin, n = string(payload[pos:]), len(payload)-pos
+		}
+		hr.AuthPlugin = plugin
+		pos += n
+	}
+
+	// Malformed or truncated attributes are left out rather than failing the
+	// handshake, whose database and credentials were read before them
+	if hr.CapabilityFlags&clientConnectAttrs != 0 && pos < len(payload) {
+		if attrs, err := parseConnectAttrs(payload[pos:]); err == nil {
+			hr.Attributes = attrs
+			hr.attrsOffset = pos
+		}
+	}
+
+	return hr, nil
+}
+
+// parseConnectAttrs parses the length-prefixed key/value pairs of the
+// connection attributes sent with CLIENT_CONNECT_ATTRS
+func parseConnectAttrs(data []byte) (map[string]string, error) {
+	length, n, err := readLengthEncodedInt(data)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(data)-n) < length {
+		return nil, errTruncatedHandshake
+	}
+	data = data[n : n+int(length)]
+
+	attrs := make(map[string]string)
+	for len(data) > 0 {
+		key, n, err := readLengthEncodedString(data)
+		if err != nil {
+			return nil, err
+		}
+		data = data[n:]
+		value, n, err := readLengthEncodedString(data)
+		if err != nil {
+			return nil, err
+		}
+		data = data[n:]
+		attrs[key] = value
+	}
+	return attrs, nil
+}
+
+// authPlugin returns the auth plugin the client authenticates with. Clients
+// without CLIENT_PLUGIN_AUTH use the plugin implied by their capabilities.
+func (hr *handshakeResponse) authPlugin() string {
+	switch {
+	case hr.AuthPlugin != "":
+		return hr.AuthPlugin
+	case hr.CapabilityFlags&clientSecureConnection != 0:
+		return "mysql_native_password"
+	default:
+		return "mysql_old_password"
+	}
+}
+
+// authResponseBinding is how an auth plugin's first response depends on the
+// greeting the client answered, which decides whether it can be replayed to
+// another server
+type authResponseBinding int
+
+const (
+	// boundToGreeting responses scramble the password with the greeting's
+	// auth data; an auth switch carrying another greeting's asks again
+	boundToGreeting authResponseBinding = iota
+	// unbound responses, such as mysql_clear_password's password, do not
+	// depend on the greeting and are replayed as they are
+	unbound
+	// boundToServer responses sign data that only the server's own auth
+	// switch carries, such as client_ed25519's nonce, and cannot be replayed
+	boundToServer
+)
+
+// authPluginBindings are the auth plugins of MySQL and MariaDB clients the
+// proxy knows; others are treated as boundToGreeting
+var authPluginBindings = map[string]authResponseBinding{
+	"mysql_native_password": boundToGreeting,
+	"caching_sha2_password": boundToGreeting,
+	"sha256_password":       boundToGreeting,
+	"mysql_old_password":    boundToGreeting,
+	"mysql_clear_password":  unbound,
+	"client_ed25519":        boundToServer,
+}
+
+// authBinding returns how the client's auth response depends on the greeting
+func (hr *handshakeResponse) authBinding() authResponseBinding {
+	if binding, ok := authPluginBindings[hr.authPlugin()]; ok {
+		return binding
+	}
+	return boundToGreeting
+}
+
+// parseAuthSwitchRequest returns the plugin requested by an AuthSwitchRequest
+// packet sent by the server during authentication, or false if the payload
+// is not an auth switch
+func parseAuthSwitchRequest(payload []byte) (string, bool) {
+	if len(payload) == 0 || payload[0] != 0xfe {
+		return "", false
+	}
+
+	// A lone 0xfe is the old "use the pre-4.1 password" request
+	if len(payload) == 1 {
+		return "mysql_old_password", true
+	}
+
+	plugin, _, err := readNullTerminated(payload[1:])
+	if err != nil {
+		return "", false
+	}
+	return plugin, true
+}
+
+// readNullTerminated reads a null-terminated string, returning it and the
+// number of bytes consumed including the terminator
+func readNullTerminated(data []byte) (string, int, error) {
+	for i, b := range data {
+		if b == 0 {
+			return string(data[:i]), i + 1, nil
+		}
+	}
+	return "", 0, errTruncatedHandshake
+}
+
+// withoutAttribute returns a copy of the handshake response payload with a
+// connection attribute removed, or the payload itself if it was not sent
+func (hr *handshakeResponse) withoutAttribute(payload []byte, key string) []byte {
+	if _, ok := hr.Attributes[key]; !ok {
+		return payload
+	}
+
+	// Re-encode the remaining attributes in their original order
+	var attrs []byte
+	data := payload[hr.attrsOffset:]
+	length, n, _ := readLengthEncodedInt(data)
+	data = data[n : n+int(length)]
+	for len(data) > 0 {
+		k, kn, _ := readLengthEncodedString(data)
+		_, vn, _ := readLengthEncodedString(data[kn:])
+		if k != key {
+			attrs = append(attrs, data[:kn+vn]...)
+		}
+		data = data[kn+vn:]
+	}
+
+	rewritten := append([]byte(nil), payload[:hr.attrsOffset]...)
+	rewritten = appendLengthEncodedInt(rewritten, uint64(len(attrs)))
+	return append(rewritten, attrs...)
+}
+
+// withoutDatabase returns a copy of the handshake response payload that
+// selects no database: CLIENT_CONNECT_WITH_DB is cleared and the database
+// removed, leaving the auth plugin and attributes that follow it intact. The
+// payload itself is returned if it selects none.
+func (hr *handshakeResponse) withoutDatabase(payload []byte) []byte {
+	if hr.CapabilityFlags&clientConnectWithDB == 0 {
+		return payload
+	}
+	rewritten := append([]byte(nil), payload[:hr.databaseOffset]...)
+	rewritten = append(rewritten, payload[hr.databaseEnd:]...)
+	return withoutCapability(rewritten, clientConnectWithDB)
+}
+
+// withDatabase returns a copy of the handshake response payload that selects
+// the database, setting CLIENT_CONNECT_WITH_DB if the client did not
+func (hr *handshakeResponse) withDatabase(payload []byte, name string) []byte {
+	if hr.CapabilityFlags&clientConnectWithDB != 0 {
+		return withDatabase(payload, hr.databaseOffset, hr.databaseEnd, name)
+	}
+	rewritten := withDatabase(payload, hr.authEnd, hr.authEnd, name)
+	rewritten[0] |= byte(clientConnectWithDB)
+	rewritten[1] |= byte(clientConnectWithDB >> 8)
+	rewritten[2] |= byte(clientConnectWithDB >> 16)
+	rewritten[3] |= byte(clientConnectWithDB >> 24)
+	return rewritten
+}
+
+// withoutHandshakeDatabase returns the handshake response packet rewritten
+// to select no database, with its sequence ID
+func withoutHandshakeDatabase(packet *MySQLPacket) *MySQLPacket {
+	hr, err := parseHandshakeResponse(packet.Payload)
+	if err != nil {
+		return packet
+	}
+	return newPacket(packet.SequenceID, hr.withoutDatabase(packet.Payload))
+}
+
+// withAuthResponse returns a copy of the handshake response payload with the
+// auth response replaced, encoded as the client's capabilities require
+func (hr *handshakeResponse) withAuthResponse(payload, auth []byte) ([]byte, error) {
+	rewritten := append([]byte(nil), payload[:hr.authOffset]...)
+	switch {
+	case hr.CapabilityFlags&clientPluginAuthLenencClientData != 0:
+		rewritten = appendLengthEncodedInt(rewritten, uint64(len(auth)))
+		rewritten = append(rewritten, auth...)
+	case hr.CapabilityFlags&clientSecureConnection != 0:
+		if len(auth) > 0xff {
+			return nil, fmt.Errorf("auth response of %d bytes is too long", len(auth))
+		}
+		rewritten = append(rewritten, byte(len(auth)))
+		rewritten = append(rewritten, auth...)
+	default:
+		rewritten = append(rewritten, auth...)
+		rewritten = append(rewritten, 0)
+	}
+	return append(rewritten, payload[hr.authEnd:]...), nil
+}
+
+// appendLengthEncodedInt appends a length-encoded integer
+func appendLengthEncodedInt(data []byte, value uint64) []byte {
+	switch {
+	case value < 0xfb:
+		return append(data, byte(value))
+	case value <= 0xffff:
+		return append(data, 0xfc, byte(value), byte(value>>8))
+	case value <= 0xffffff:
+		return append(data, 0xfd, byte(value), byte(value>>8), byte(value>>16))
+	default:
+		data = append(data, 0xfe)
+		for i := 0; i < 8; i++ {
+			data = append(data, byte(value>>(8*i)))
+		}
+		return data
+	}
+}
+
+// readLengthEncodedString reads a string prefixed with its length-encoded
+// length, returning it and the number of bytes consumed
+func readLengthEncodedString(data []byte) (string, int, error) {
+	length, n, err := readLengthEncodedInt(data)
+	if err != nil {
+		return "", 0, err
+	}
+	if uint64(len(data)-n) < length {
+		return "", 0, errTruncatedHandshake
+	}
+	return string(data[n : n+int(length)]), n + int(length), nil
+}
+
+// readLengthEncodedInt reads a length-encoded integer, returning it and the
+// number of bytes consumed
+func readLengthEncodedInt(data []byte) (uint64, int, error) {
+	if len(data) == 0 {
+		return 0, 0, errTruncatedHandshake
+	}
+
+	var size int
+	switch data[0] {
+	case 0xfc:
+		size = 2
+	case 0xfd:
+		size = 3
+	case 0xfe:
+		size = 8
+	case 0xfb, 0xff:
+		return 0, 0, fmt.Errorf("invalid length-encoded integer prefix 0x%x", data[0])
+	default:
+		return uint64(data[0]), 1, nil
+	}
+
+	if len(data) < 1+size {
+		return 0, 0, errTruncatedHandshake
+	}
+	var value uint64
+	for i := 0; i < size; i++ {
+		value |= uint64(data[1+i]) << (8 * i)
+	}
+	return value, 1 + size, nil
+}
+
+// readAuthResponse reads the auth response starting at pos, which is
+// length-encoded, length-prefixed or null-terminated depending on the
+// capabilities, and returns it with the position after it
+func readAuthResponse(payload []byte, pos int, capabilities uint32) ([]byte, int, error) {
+	switch {
+	case capabilities&clientPluginAuthLenencClientData != 0:
+		length, n, err := readLengthEncodedInt(payload[pos:])
+		if err != nil {
+			return nil, 0, err
+		}
+		pos += n
+		if uint64(len(payload)-pos) < length {
+			return nil, 0, errTruncatedHandshake
+		}
+		return payload[pos : pos+int(length)], pos + int(length), nil
+	case capabilities&clientSecureConnection != 0:
+		if pos >= len(payload) {
+			return nil, 0, errTruncatedHandshake
+		}
+		length := int(payload[pos])
+		pos++
+		if len(payload)-pos < length {
+			return nil, 0, errTruncatedHandshake
+		}
+		return payload[pos : pos+length], pos + length, nil
+	default:
+		auth, n, err := readNullTerminated(payload[pos:])
+		if err != nil {
+			return nil, 0, err
+		}
+		return []byte(auth), pos + n, nil
+	}
+}
+
+// changeUserRequest is a parsed COM_CHANGE_USER command
+type changeUserRequest struct {
+	Username     string
+	AuthResponse []byte
+	Database     string
+	AuthPlugin   string
+
+	// databaseOffset and databaseEnd delimit the null-terminated database
+	databaseOffset, databaseEnd int
+}
+
+// parseChangeUser parses a COM_CHANGE_USER payload. Its fields follow those
+// of a handshake response, interpreted with the connection's capabilities,
+// except that the auth response is never length-encoded and the database is
+// always present, empty when the request selects none.
+func parseChangeUser(payload []byte, capabilities uint32) (*changeUserRequest, error) {
+	if len(payload) == 0 || payload[0] != comChangeUser {
+		return nil, fmt.Errorf("not a COM_CHANGE_USER command")
+	}
+	pos := 1
+
+	username, n, err := readNullTerminated(payload[pos:])
+	if err != nil {
+		return nil, err
+	}
+	pos += n
+	cu := &changeUserRequest{Username: username}
+
+	cu.AuthResponse, pos, err = readAuthResponse(payload, pos, capabilities&^clientPluginAuthLenencClientData)
+	if err != nil {
+		return nil, err
+	}
+
+	database, n, err := readNullTerminated(payload[pos:])
+	if err != nil {
+		return nil, err
+	}
+	cu.Database = database
+	cu.databaseOffset, cu.databaseEnd = pos, pos+n
+	pos += n
+
+	// The character set and the plugin name were added in later versions of
+	// the command, and old clients end the packet before them
+	if pos+2 <= len(payload) && capabilities&clientPluginAuth != 0 {
+		pos += 2
+		if plugin, _, err := readNullTerminated(payload[pos:]); err == nil {
+			cu.AuthPlugin = plugin
+		} else {
+			cu.AuthPlugin = string(payload[pos:])
+		}
+	}
+	return cu, nil
+}
+
+// attributeOrUnknown returns a connection attribute, or "unknown" if the client
+// did not send it
+func attributeOrUnknown(attrs map[string]string, key string) string {
+	if value, ok := attrs[key]; ok && value != "" {
+		return value
+	}
+	return "unknown"
+}
+
+// parseAttrLogFields parses ATTR_LOG_FIELDS entries of the form
+// attribute=field into a map from attribute to log field
+func parseAttrLogFields(entries []string) (map[string]string, error) {
+	mapping := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		attr, field, ok := strings.Cut(entry, "=")
+		if !ok || attr == "" || field == "" {
+			return nil, fmt.Errorf("%q is not of the form attribute=field", entry)
+		}
+		mapping[attr] = field
+	}
+	return mapping, nil
+}
+
+// attrLogFields accepts lists of valid ATTR_LOG_FIELDS entries
+func attrLogFields(value interface{}) error {
+	_, err := parseAttrLogFields(value.([]string))
+	return err
+}
+
+// attributeLogFields returns the log fields mapped from the connection
+// attributes the client sent; attributes it did not send are left out
+func attributeLogFields(attrs map[string]string, mapping map[string]string) logrus.Fields {
+	fields := logrus.Fields{}
+	for attr, field := range mapping {
+		if value, ok := attrs[attr]; ok {
+			fields[field] = value
+		}
+	}
+	return fields
+}
+
+// logClientDriver logs the driver and program a client reported in its
+// connection attributes
+func logClientDriver(logger *logrus.Entry, attrs map[string]string) {
+	fields := logrus.Fields{}
+	for _, key := range []string{"_client_name", "_client_version", "program_name"} {
+		if value, ok := attrs[key]; ok {
+			fields[strings.TrimPrefix(key, "_")] = value
+		}
+	}
+	if len(fields) == 0 {
+		logger.Info("Client did not report its driver")
+		return
+	}
+	logger.WithFields(fields).Info("Client driver")
+}
@@ -0,0 +1,589 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Handshake responses as sent by clients. goDriverResponse and
+// goDriverEmptyPassword were captured from go-sql-driver/mysql v1.9.3, the
+// first connecting to "shop" as app:secret with a program_name attribute, the
+// second as app with an empty password and no database. mysqlCLIResponse has
+// the layout of the mysql 8.0 command-line client: a length-encoded
+// caching_sha2_password scramble and CLIENT_DEPRECATE_EOF. mysqlChangeUser
+// has the layout of the same client's COM_CHANGE_USER to "tenant_db" as app,
+// with a length-prefixed scramble, the character set, the plugin name and
+// connection attributes.
+const (
+	goDriverResponse = "8da21a00000000002d000000000000000000000000000000000000000000000061707000148817c50fa779daef010ee7577825b0847df9842e73686f70006d7973716c5f6e61746976655f70617373776f7264006d0c5f636c69656e745f6e616d650f476f2d4d7953514c2d447269766572035f6f73056c696e7578095f706c6174666f726d05616d643634045f70696404393231360c5f7365727665725f686f7374093132372e302e302e310c70726f6772616d5f6e616d650763617074757265"
+
+	goDriverEmptyPassword = "85a21a00000000002d000000000000000000000000000000000000000000000061707000006d7973716c5f6e61746976655f70617373776f726400580c5f636c69656e745f6e616d650f476f2d4d7953514c2d447269766572035f6f73056c696e7578095f706c6174666f726d05616d643634045f70696404393231360c5f7365727665725f686f7374093132372e302e302e31"
+
+	mysqlCLIResponse = "8da6bf09000000012d0000000000000000000000000000000000000000000000726f6f7400205c1e2b7a90d1f433a8e0c6715b29de8f04a7cc3e91b6528d7f30e4a1c9b8d265696e76656e746f72790063616368696e675f736861325f70617373776f72640071045f7069640434323432095f706c6174666f726d067838365f3634035f6f73054c696e75780c5f636c69656e745f6e616d65086c69626d7973716c076f735f75736572036465760f5f636c69656e745f76657273696f6e06382e302e33360c70726f6772616d5f6e616d65056d7973716c"
+
+	mysqlChangeUser = "1161707000143c9a01f27e55d8b04a6e1f93c2d75b0e8846af1274656e616e745f646200ff0063616368696e675f736861325f70617373776f7264000a045f7069640434323432"
+)
+
+// Server greetings and a MariaDB client's response to one. mysqlGreeting has
+// the layout of MySQL 8.0.36's, with caching_sha2_password; mariaDBGreeting
+// that of MariaDB 10.11.6's, with the replication version prefix, CLIENT_MYSQL
+// cleared and the extended capabilities 0x1d at the end of the filler.
+// mariaDBClientResponse answers it as MariaDB Connector/C 3.3 does, clearing
+// CLIENT_MYSQL and echoing the extended capabilities.
+const (
+	mysqlGreeting = "0a382e302e3336000b000000616263646566676800ffff2d0200ffdf1500000000000000000000696a6b6c6d6e6f70717273740063616368696e675f736861325f70617373776f726400"
+
+	mariaDBGreeting = "0a352e352e352d31302e31312e362d4d6172696144422d313a31302e31312e362b6d617269617e75627532323034001f000000616263646566676800fef72d0200bfa1150000000000001d000000696a6b6c6d6e6f7071727374006d7973716c5f6e61746976655f70617373776f726400"
+
+	mariaDBClientResponse = "8ca63f00000000012d000000000000000000000000000000000000001d00000061707000143f1a64e2c0b718d95a4e0f22b1c7d86a93e5f01773686f70006d7973716c5f6e61746976655f70617373776f726400620c5f636c69656e745f6e616d650a6c69626d6172696164620f5f636c69656e745f76657273696f6e05332e332e38035f6f73054c696e7578045f70696403373737095f706c6174666f726d067838365f36340c5f7365727665725f686f7374026462"
+)
+
+// mustHex decodes a hex fixture
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("invalid fixture: %v", err)
+	}
+	return data
+}
+
+func TestParseHandshakeResponse(t *testing.T) {
+	scramble := bytes.Repeat([]byte{0xab}, 20)
+	tests := []struct {
+		name     string
+		payload  func(t *testing.T) []byte
+		user     string
+		auth     []byte
+		database string
+		plugin   string
+		attrs    map[string]string
+	}{
+		{
+			name:     "go-sql-driver",
+			payload:  func(t *testing.T) []byte { return mustHex(t, goDriverResponse) },
+			user:     "app",
+			auth:     mustHex(t, "8817c50fa779daef010ee7577825b0847df9842e"),
+			database: "shop",
+			plugin:   "mysql_native_password",
+			attrs: map[string]string{"_client_name": "Go-MySQL-Driver", "_os": "linux", "_platform": "amd64",
+				"_pid": "9216", "_server_host": "127.0.0.1", "program_name": "capture"},
+		},
+		{
+			// CLIENT_CONNECT_WITH_DB is clear, so no database is read
+			name:    "go-sql-driver without database",
+			payload: func(t *testing.T) []byte { return mustHex(t, goDriverEmptyPassword) },
+			user:    "app",
+			auth:    []byte{},
+			plugin:  "mysql_native_password",
+			attrs: map[string]string{"_client_name": "Go-MySQL-Driver", "_os": "linux", "_platform": "amd64",
+				"_pid": "9216", "_server_host": "127.0.0.1"},
+		},
+		{
+			name:     "mysql client",
+			payload:  func(t *testing.T) []byte { return mustHex(t, mysqlCLIResponse) },
+			user:     "root",
+			auth:     mustHex(t, "5c1e2b7a90d1f433a8e0c6715b29de8f04a7cc3e91b6528d7f30e4a1c9b8d265"),
+			database: "inventory",
+			plugin:   "caching_sha2_password",
+			attrs: map[string]string{"_pid": "4242", "_platform": "x86_64", "_os": "Linux", "_client_name": "libmysql",
+				"os_user": "dev", "_client_version": "8.0.36", "program_name": "mysql"},
+		},
+		{
+			// A database-looking string is not read without the flag
+			name: "database bytes without CLIENT_CONNECT_WITH_DB",
+			payload: func(t *testing.T) []byte {
+				payload := testHandshake{capabilities: testClientCapabilities &^ (clientConnectWithDB | clientConnectAttrs | clientPluginAuth),
+					user: "u", auth: scramble}.payload()
+				return append(payload, "notadb\x00"...)
+			},
+			user: "u",
+			auth: scramble,
+		},
+		{
+			name: "length-prefixed auth response",
+			payload: func(t *testing.T) []byte {
+				return testHandshake{capabilities: clientProtocol41 | clientSecureConnection | clientConnectWithDB | clientPluginAuth,
+					user: "u", auth: scramble, database: "db"}.payload()
+			},
+			user:     "u",
+			auth:     scramble,
+			database: "db",
+			plugin:   "mysql_native_password",
+		},
+		{
+			name: "null-terminated auth response",
+			payload: func(t *testing.T) []byte {
+				return testHandshake{capabilities: clientProtocol41 | clientConnectWithDB,
+					user: "old", auth: []byte("0123456789abcdef"), database: "legacy"}.payload()
+			},
+			user:     "old",
+			auth:     []byte("0123456789abcdef"),
+			database: "legacy",
+		},
+		{
+			name: "plugin name without terminator",
+			payload: func(t *testing.T) []byte {
+				payload := testHandshake{capabilities: clientProtocol41 | clientSecureConnection | clientPluginAuth,
+					user: "u", auth: scramble}.payload()
+				return payload[:len(payload)-1]
+			},
+			user:   "u",
+			auth:   scramble,
+			plugin: "mysql_native_password",
+		},
+		{
+			name: "empty database",
+			payload: func(t *testing.T) []byte {
+				return testHandshake{user: "u", auth: scramble}.payload()
+			},
+			user:   "u",
+			auth:   scramble,
+			plugin: "mysql_native_password",
+			attrs:  map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hr, err := parseHandshakeResponse(tt.payload(t))
+			if err != nil {
+				t.Fatalf("parse: %v", err)
+			}
+			if hr.Username != tt.user || hr.Database != tt.database || hr.AuthPlugin != tt.plugin {
+				t.Fatalf("parsed user %q database %q plugin %q, want %q %q %q",
+					hr.Username, hr.Database, hr.AuthPlugin, tt.user, tt.database, tt.plugin)
+			}
+			if !bytes.Equal(hr.AuthResponse, tt.auth) {
+				t.Fatalf("auth response %x, want %x", hr.AuthResponse, tt.auth)
+			}
+			if len(hr.Attributes) != len(tt.attrs) {
+				t.Fatalf("attributes %v, want %v", hr.Attributes, tt.attrs)
+			}
+			for key, value := range tt.attrs {
+				if hr.Attributes[key] != value {
+					t.Fatalf("attribute %s is %q, want %q", key, hr.Attributes[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestParseHandshakeResponseErrors(t *testing.T) {
+	full := mustHex(t, goDriverResponse)
+	tests := map[string][]byte{
+		"empty":                 nil,
+		"shorter than fixed":    full[:31],
+		"pre-4.1":               append([]byte{0x8d, 0x80, 0x1a, 0}, full[4:]...),
+		"unterminated username": full[:34],
+		"truncated auth":        full[:45],
+		"unterminated database": full[:58],
+	}
+	for name, payload := range tests {
+		t.Run(name, func(t *testing.T) {
+			if hr, err := parseHandshakeResponse(payload); err == nil {
+				t.Fatalf("parsed %+v", hr)
+			}
+		})
+	}
+}
+
+func TestParseDatabaseName(t *testing.T) {
+	logger := logrus.NewEntry(logrus.New())
+	for name, tt := range map[string]struct {
+		payload []byte
+		want    string
+	}{
+		"captured":        {mustHex(t, goDriverResponse), "shop"},
+		"no database":     {mustHex(t, goDriverEmptyPassword), ""},
+		"malformed":       {[]byte("garbage"), ""},
+		"name with space": {testHandshake{user: "u", database: "my db"}.payload(), "my db"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got := parseDatabaseName(newPacket(1, tt.payload), logger); got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandshakeDatabaseRewrites(t *testing.T) {
+	for _, fixture := range []string{goDriverResponse, mysqlCLIResponse} {
+		payload := mustHex(t, fixture)
+		hr, err := parseHandshakeResponse(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		renamed, err := parseHandshakeResponse(hr.withDatabase(payload, "tenant_42"))
+		if err != nil {
+			t.Fatalf("parse renamed: %v", err)
+		}
+		if renamed.Database != "tenant_42" || renamed.Username != hr.Username || len(renamed.Attributes) != len(hr.Attributes) {
+			t.Fatalf("renamed handshake parsed as %+v", renamed)
+		}
+
+		stripped, err := parseHandshakeResponse(hr.withoutDatabase(payload))
+		if err != nil {
+			t.Fatalf("parse stripped: %v", err)
+		}
+		if stripped.CapabilityFlags&clientConnectWithDB != 0 || stripped.Database != "" ||
+			stripped.AuthPlugin != hr.AuthPlugin || len(stripped.Attributes) != len(hr.Attributes) {
+			t.Fatalf("stripped handshake parsed as %+v", stripped)
+		}
+	}
+
+	// A handshake without a database gains one along with the flag
+	payload := mustHex(t, goDriverEmptyPassword)
+	hr, _ := parseHandshakeResponse(payload)
+	added, err := parseHandshakeResponse(hr.withDatabase(payload, "added"))
+	if err != nil || added.Database != "added" || added.CapabilityFlags&clientConnectWithDB == 0 {
+		t.Fatalf("added database parsed as %+v, %v", added, err)
+	}
+}
+
+func TestReadLogicalPacket(t *testing.T) {
+	// frame splits a payload into physical packets as a client sends it
+	frame := func(seq int, payload []byte) []byte {
+		var wire bytes.Buffer
+		frames := newPacket(seq, payload).frames()
+		frames.WriteTo(&wire)
+		return wire.Bytes()
+	}
+	tests := []struct {
+		name     string
+		length   int
+		maxBytes int
+		packets  int
+		err      error
+	}{
+		{name: "single", length: 1000, packets: 1},
+		{name: "one short of a continuation", length: maxPacketPayload - 1, packets: 1},
+		{name: "exactly the maximum", length: maxPacketPayload, packets: 2},
+		{name: "continued", length: 2*maxPacketPayload + 10, packets: 3},
+		{name: "within the limit", length: maxPacketPayload + 10, maxBytes: 2 * maxPacketPayload, packets: 2},
+		{name: "over the limit", length: 2*maxPacketPayload + 10, maxBytes: maxPacketPayload + 100, err: errPacketTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := bytes.Repeat([]byte{0x5a}, tt.length)
+			payload[0] = comQuery
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write(frame(0, payload))
+				client.Close()
+			}()
+
+			header, err := readPacketHeader(server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			packet, err := readLogicalPacket(server, header, tt.maxBytes)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("got %v, want %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if packet.Packets != tt.packets || packet.Length != tt.length || !bytes.Equal(packet.Payload, payload) {
+				t.Fatalf("read %d bytes in %d packets, want %d in %d", packet.Length, packet.Packets, tt.length, tt.packets)
+			}
+			if !bytes.Equal(packet.FullPacket, frame(0, payload)) {
+				t.Fatal("the packet as read differs from what was sent")
+			}
+			if packet.lastSequenceID() != tt.packets-1 {
+				t.Fatalf("last sequence ID %d, want %d", packet.lastSequenceID(), tt.packets-1)
+			}
+		})
+	}
+}
+
+func TestParseHandshakeResponseAuthEncodings(t *testing.T) {
+	long := bytes.Repeat([]byte{0x42}, 300)
+	tests := []struct {
+		name    string
+		payload []byte
+		auth    []byte
+	}{
+		{
+			name:    "length-encoded empty password",
+			payload: testHandshake{user: "app", database: "shop"}.payload(),
+			auth:    []byte{},
+		},
+		{
+			name:    "length-prefixed empty password",
+			payload: testHandshake{capabilities: testClientCapabilities &^ clientPluginAuthLenencClientData, user: "app", database: "shop"}.payload(),
+			auth:    []byte{},
+		},
+		{
+			// Longer than 250 bytes, the length takes a 0xfc prefix
+			name:    "length-encoded long auth response",
+			payload: testHandshake{user: "app", auth: long, database: "shop"}.payload(),
+			auth:    long,
+		},
+		{
+			name:    "captured empty password",
+			payload: mustHex(t, goDriverEmptyPassword),
+			auth:    []byte{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hr, err := parseHandshakeResponse(tt.payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(hr.AuthResponse, tt.auth) {
+				t.Fatalf("auth response of %d bytes, want %d", len(hr.AuthResponse), len(tt.auth))
+			}
+			if hr.Username != "app" {
+				t.Fatalf("username %q", hr.Username)
+			}
+			if hr.CapabilityFlags&clientConnectWithDB != 0 && hr.Database != "shop" {
+				t.Fatalf("database %q after the auth response", hr.Database)
+			}
+
+			// Replacing the auth response keeps its encoding
+			rewritten, err := hr.withAuthResponse(tt.payload, []byte("replaced"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, err := parseHandshakeResponse(rewritten)
+			if err != nil || string(again.AuthResponse) != "replaced" || again.Database != hr.Database {
+				t.Fatalf("rewritten handshake parsed as %+v, %v", again, err)
+			}
+		})
+	}
+}
+
+func TestParseHandshakeResponseMalformedAttributes(t *testing.T) {
+	valid := mustHex(t, goDriverResponse)
+	hr, _ := parseHandshakeResponse(valid)
+	tests := map[string][]byte{
+		// The attributes claim more bytes than the packet holds
+		"truncated":         valid[:len(valid)-5],
+		"bad length prefix": append(append([]byte(nil), valid[:hr.attrsOffset]...), 0xfb, 0x01),
+		"overlong value": append(append([]byte(nil), valid[:hr.attrsOffset]...),
+			0x05, 0x01, 'k', 0x09, 'v', 'v'),
+	}
+	for name, payload := range tests {
+		t.Run(name, func(t *testing.T) {
+			parsed, err := parseHandshakeResponse(payload)
+			if err != nil {
+				t.Fatalf("malformed attributes failed the handshake: %v", err)
+			}
+			if parsed.Database != "shop" || parsed.Username != "app" || parsed.AuthPlugin != "mysql_native_password" {
+				t.Fatalf("parsed as %+v", parsed)
+			}
+			if parsed.Attributes != nil {
+				t.Fatalf("kept malformed attributes %v", parsed.Attributes)
+			}
+		})
+	}
+}
+
+func TestProxyRelaysEmptyPassword(t *testing.T) {
+	backend := startFakeMySQL(t)
+	_, addr := startProxy(t, testConfig(backend))
+
+	mustConnect(t, addr, testHandshake{user: "app", database: "nopass"})
+	if !backend.hasDatabase("nopass") {
+		t.Fatal("the database of a handshake with an empty password was not created")
+	}
+	handshakes := backend.receivedHandshakes()
+	if got := handshakes[len(handshakes)-1]; !bytes.Equal(got, testHandshake{user: "app", database: "nopass"}.payload()) {
+		t.Fatalf("MySQL received a different handshake: %x", got)
+	}
+}
+
+func TestParseServerGreeting(t *testing.T) {
+	tests := []struct {
+		name        string
+		greeting    string
+		flavor      string
+		version     string
+		mysqlFlag   bool
+		mariaDBCaps uint32
+	}{
+		{name: "mysql", greeting: mysqlGreeting, flavor: "mysql", version: "8.0.36", mysqlFlag: true},
+		{name: "mariadb", greeting: mariaDBGreeting, flavor: "mariadb", version: "10.11.6-MariaDB-1:10.11.6+maria~ubu2204", mariaDBCaps: 0x1d},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := mustHex(t, tt.greeting)
+			if err := checkGreeting(payload); err != nil {
+				t.Fatalf("checkGreeting: %v", err)
+			}
+			info, err := parseServerGreeting(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Flavor != tt.flavor || info.Version != tt.version || info.MariaDBCapabilities != tt.mariaDBCaps {
+				t.Fatalf("parsed %+v", info)
+			}
+			if (info.Capabilities&clientMySQL != 0) != tt.mysqlFlag || info.Capabilities&clientPluginAuth == 0 {
+				t.Fatalf("capabilities 0x%x", info.Capabilities)
+			}
+
+			// Rewriting the capabilities leaves the extended ones alone
+			rewritten, err := rewriteGreetingCapabilities(payload, 0, clientSSL|clientCompress)
+			if err != nil {
+				t.Fatal(err)
+			}
+			again, _ := parseServerGreeting(rewritten)
+			if again.Capabilities != info.Capabilities&^(clientSSL|clientCompress) || again.MariaDBCapabilities != tt.mariaDBCaps {
+				t.Fatalf("rewritten greeting parsed as %+v", again)
+			}
+			if data, err := greetingAuthData(payload); err != nil || string(data) != "abcdefghijklmnopqrst" {
+				t.Fatalf("scramble %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestParseMariaDBClientResponse(t *testing.T) {
+	hr, err := parseHandshakeResponse(mustHex(t, mariaDBClientResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hr.MariaDBCapabilities != 0x1d || hr.CapabilityFlags&clientMySQL != 0 {
+		t.Fatalf("capabilities 0x%x, extended 0x%x", hr.CapabilityFlags, hr.MariaDBCapabilities)
+	}
+	if hr.Username != "app" || hr.Database != "shop" || hr.Attributes["_client_name"] != "libmariadb" {
+		t.Fatalf("parsed %+v", hr)
+	}
+
+	// A MySQL client sets CLIENT_MYSQL, and its filler is not read
+	mysql := mustHex(t, goDriverResponse)
+	mysql[28] = 0xff
+	if hr, _ := parseHandshakeResponse(mysql); hr.MariaDBCapabilities != 0 {
+		t.Fatalf("read extended capabilities 0x%x from a MySQL client", hr.MariaDBCapabilities)
+	}
+}
+
+func TestProxyRelaysMariaDB(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.setGreeting(mustHex(t, mariaDBGreeting))
+	_, addr := startProxy(t, testConfig(backend))
+
+	c := dialTestClient(t, addr)
+	if !bytes.Equal(c.greeting.Payload[:40], mustHex(t, mariaDBGreeting)[:40]) {
+		t.Fatalf("client was greeted with %x", c.greeting.Payload)
+	}
+	response := c.send(1, mustHex(t, mariaDBClientResponse))
+	if response == nil || response.Payload[0] != 0x00 {
+		t.Fatalf("handshake answered with %s", describePacket(response))
+	}
+	if !backend.hasDatabase("shop") {
+		t.Fatal("the MariaDB client's database was not created")
+	}
+	c.mustQuery("USE other")
+	if !backend.hasDatabase("other") {
+		t.Fatal("USE from a MariaDB client did not create the database")
+	}
+}
+
+func TestAttributeLogFields(t *testing.T) {
+	mapping, err := parseAttrLogFields([]string{"_service_name=service", "_team=team"})
+	if err != nil {
+		t.Fatalf("parseAttrLogFields: %v", err)
+	}
+	fields := attributeLogFields(map[string]string{"_service_name": "billing-api", "_os": "linux"}, mapping)
+	if len(fields) != 1 || fields["service"] != "billing-api" {
+		t.Fatalf("mapped %v", fields)
+	}
+	for _, entry := range []string{"_service_name", "=service", "_service_name="} {
+		if _, err := parseAttrLogFields([]string{entry}); err == nil {
+			t.Errorf("accepted %q", entry)
+		}
+	}
+
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.AttrLogFields = []string{"_service_name=service"}
+	logger, hook := testLogger()
+	_, addr := startProxy(t, config, WithLogger(logger), WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	// Every line logged for the connection once its handshake is read carries the field
+	mustConnect(t, addr, testHandshake{user: "root", database: "orders", attrs: [][2]string{{"_service_name", "billing-api"}}})
+	entry := findEntry(hook, "Database is ready")
+	if entry == nil || entry.Data["service"] != "billing-api" {
+		t.Fatalf("logged %v", entry)
+	}
+
+	// A connection without the attribute is logged without the field
+	mustConnect(t, addr, testHandshake{user: "root", database: "billing"})
+	entry = findEntry(hook, "Database is ready")
+	if _, ok := entry.Data["service"]; entry.Data["database"] != "billing" || ok {
+		t.Fatalf("logged %v", entry.Data)
+	}
+}
+
+func TestParseChangeUser(t *testing.T) {
+	captured := mustHex(t, mysqlChangeUser)
+	tests := []struct {
+		name         string
+		payload      []byte
+		capabilities uint32
+		want         changeUserRequest
+	}{
+		{
+			// The auth response is length-prefixed even with
+			// CLIENT_PLUGIN_AUTH_LENENC_CLIENT_DATA
+			name:         "captured",
+			payload:      captured,
+			capabilities: testClientCapabilities,
+			want:         changeUserRequest{Username: "app", AuthResponse: captured[6:26], Database: "tenant_db", AuthPlugin: "caching_sha2_password"},
+		},
+		{
+			name:         "no database",
+			payload:      changeUserPayload("app", []byte("scrambled"), ""),
+			capabilities: testClientCapabilities,
+			want:         changeUserRequest{Username: "app", AuthResponse: []byte("scrambled"), AuthPlugin: "mysql_native_password"},
+		},
+		{
+			name:         "old client without character set or plugin",
+			payload:      append([]byte{comChangeUser}, "app\x00\x03abcshop\x00"...),
+			capabilities: testClientCapabilities,
+			want:         changeUserRequest{Username: "app", AuthResponse: []byte("abc"), Database: "shop"},
+		},
+		{
+			name:         "null-terminated auth response",
+			payload:      append([]byte{comChangeUser}, "app\x00abc\x00shop\x00\x2d\x00"...),
+			capabilities: testClientCapabilities &^ (clientSecureConnection | clientPluginAuth),
+			want:         changeUserRequest{Username: "app", AuthResponse: []byte("abc"), Database: "shop"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request, err := parseChangeUser(tt.payload, tt.capabilities)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if request.Username != tt.want.Username || !bytes.Equal(request.AuthResponse, tt.want.AuthResponse) ||
+				request.Database != tt.want.Database || request.AuthPlugin != tt.want.AuthPlugin {
+				t.Fatalf("parsed %+v, want %+v", *request, tt.want)
+			}
+		})
+	}
+
+	for _, payload := range [][]byte{
+		nil,
+		{comQuery},
+		captured[:3],
+		captured[:20],
+		captured[:30],
+	} {
+		if _, err := parseChangeUser(payload, testClientCapabilities); err == nil {
+			t.Errorf("parsed %x", payload)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// backendHealth periodically pings a backend and reports transitions between
+// healthy and unhealthy
+type backendHealth struct {
+	backend   string
+	db        *sql.DB
+	interval  time.Duration
+	threshold int
+	log       logrus.FieldLogger
+
+	// onUnhealthy is called when the backend becomes unhealthy
+	onUnhealthy func(backend string)
+
+	mu       sync.Mutex
+	healthy  bool
+	failures int
+	lastErr  error
+}
+
+// newBackendHealth creates a tracker for the configured backend, initially healthy
+func newBackendHealth(config Config, backend string, log logrus.FieldLogger) (*backendHealth, error) {
+	dsn, err := adminDSN(config)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	return &backendHealth{
+		backend:   backend,
+		db:        db,
+		interval:  config.BackendHealthInterval,
+		threshold: config.BackendUnhealthyThreshold,
+		log:       log,
+		healthy:   true,
+	}, nil
+}
+
+// run checks the backend every interval until ctx is cancelled
+func (h *backendHealth) run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.check(ctx)
+		}
+	}
+}
+
+// check pings the backend once and updates the health state
+func (h *backendHealth) check(ctx context.Context) {
+	pingCtx, cancel := context.WithTimeout(ctx, h.interval)
+	err := h.db.PingContext(pingCtx)
+	cancel()
+
+	h.mu.Lock()
+	wasHealthy := h.healthy
+	h.lastErr = err
+	if err == nil {
+		h.failures = 0
+		h.healthy = true
+	} else {
+		h.failures++
+		if h.failures >= h.threshold {
+			h.healthy = false
+		}
+	}
+	healthy := h.healthy
+	h.mu.Unlock()
+
+	logger := h.log.WithField("backend", h.backend)
+	switch {
+	case wasHealthy && !healthy:
+		logger.WithError(err).Error("Backend became unhealthy")
+		if h.onUnhealthy != nil {
+			h.onUnhealthy(h.backend)
+		}
+	case !wasHealthy && healthy:
+		logger.Info("Backend recovered")
+	case err != nil:
+		logger.WithError(err).Warn("Backend health check failed")
+	}
+}
+
+// Healthy reports the current health state and the last check error
+func (h *backendHealth) Healthy() (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.healthy, h.lastErr
+}
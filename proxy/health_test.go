@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// failPings makes the fake answer COM_PING with an ERR while failing is set
+func failPings(backend *fakeMySQL, failing *atomic.Bool) {
+	backend.handleCommands(func(s *fakeSession, payload []byte) bool {
+		if payload[0] != 0x0e || !failing.Load() {
+			return false
+		}
+		s.err(1053, "08S01", "Server shutdown in progress")
+		return true
+	})
+}
+
+func TestBackendHealthTransitions(t *testing.T) {
+	backend := startFakeMySQL(t)
+	var failing atomic.Bool
+	failPings(backend, &failing)
+	config := testConfig(backend)
+	config.BackendUnhealthyThreshold = 2
+	logger, _ := testLogger()
+	health, err := newBackendHealth(config, backend.addr(), logger)
+	if err != nil {
+		t.Fatalf("newBackendHealth: %v", err)
+	}
+	defer health.db.Close()
+	var unhealthy []string
+	health.onUnhealthy = func(backend string) { unhealthy = append(unhealthy, backend) }
+
+	ctx := context.Background()
+	health.check(ctx)
+	if healthy, err := health.Healthy(); !healthy || err != nil {
+		t.Fatalf("healthy %v, %v after a successful check", healthy, err)
+	}
+
+	failing.Store(true)
+	health.check(ctx)
+	if healthy, err := health.Healthy(); !healthy || err == nil {
+		t.Fatalf("healthy %v, %v after one failed check out of two", healthy, err)
+	}
+	health.check(ctx)
+	health.check(ctx)
+	if healthy, _ := health.Healthy(); healthy {
+		t.Fatal("still healthy after reaching the threshold")
+	}
+	if len(unhealthy) != 1 || unhealthy[0] != backend.addr() {
+		t.Fatalf("onUnhealthy called for %q, want once", unhealthy)
+	}
+
+	failing.Store(false)
+	health.check(ctx)
+	if healthy, err := health.Healthy(); !healthy || err != nil {
+		t.Fatalf("healthy %v, %v after recovering", healthy, err)
+	}
+}
+
+func TestUnhealthyBackendClosesConnections(t *testing.T) {
+	backend := startFakeMySQL(t)
+	var failing atomic.Bool
+	failPings(backend, &failing)
+	config := testConfig(backend)
+	config.CloseOnBackendUnhealthy = true
+	config.BackendHealthInterval = time.Hour
+	config.BackendUnhealthyThreshold = 1
+	p, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("SELECT 1")
+	eventually(t, "the connection to be tracked", func() bool {
+		return len(p.conns.forBackend(p.backendAddr())) == 1
+	})
+
+	failing.Store(true)
+	p.health.check(context.Background())
+	expectErr(t, c.read(), 1053)
+	if packet := c.read(); packet != nil {
+		t.Fatalf("the connection stayed open, sending %s", describePacket(packet))
+	}
+
+	// New connections still reach MySQL
+	failing.Store(false)
+	mustConnect(t, addr, testHandshake{user: "root"}).mustQuery("SELECT 1")
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Command is a client command packet as seen by interceptors. Interceptors may
+// modify the payload in place or replace it; the packet is re-framed with the
+// new length before it is forwarded to MySQL.
+type Command struct {
+	SequenceID int
+
+	// Payload is the command byte followed by its arguments
+	Payload []byte
+}
+
+// CommandInterceptor inspects, and optionally rewrites, client commands before
+// they are forwarded to MySQL. Returning an error stops the command from being
+// forwarded; errors created with newProxyError are reported to the client as
+// an ERR packet of that category, any other error as backend_unavailable.
+type CommandInterceptor interface {
+	InterceptCommand(ctx context.Context, cmd *Command) error
+}
+
+// EnsurerAware is implemented by interceptors that create databases. The proxy
+// hands them its ensurer once they have been built.
+type EnsurerAware interface {
+	SetEnsurer(ensurer DatabaseEnsurer)
+}
+
+// InterceptorFactory builds an interceptor from the proxy configuration
+type InterceptorFactory func(config Config) CommandInterceptor
+
+var (
+	interceptorsMu       sync.Mutex
+	interceptorFactories = map[string]InterceptorFactory{}
+)
+
+// RegisterInterceptor makes an interceptor available to the ENABLED_INTERCEPTORS
+// option under the given name. It is meant to be called from init functions
+// and panics if the name is already taken.
+func RegisterInterceptor(name string, factory func(config Config) CommandInterceptor) {
+	interceptorsMu.Lock()
+	defer interceptorsMu.Unlock()
+
+	if _, exists := interceptorFactories[name]; exists {
+		panic(fmt.Sprintf("interceptor %q registered twice", name))
+	}
+	interceptorFactories[name] = factory
+}
+
+// namedInterceptor is an enabled interceptor together with its registered name
+type namedInterceptor struct {
+	name string
+	CommandInterceptor
+}
+
+// buildInterceptors instantiates the enabled interceptors in the configured order
+func buildInterceptors(config Config, ensurer DatabaseEnsurer) ([]namedInterceptor, error) {
+	interceptorsMu.Lock()
+	defer interceptorsMu.Unlock()
+
+	interceptors := make([]namedInterceptor, 0, len(config.EnabledInterceptors))
+	for _, name := range config.EnabledInterceptors {
+		factory, ok := interceptorFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown interceptor %q", name)
+		}
+		interceptor := factory(config)
+		if aware, ok := interceptor.(EnsurerAware); ok {
+			aware.SetEnsurer(ensurer)
+		}
+		interceptors = append(interceptors, namedInterceptor{name: name, CommandInterceptor: interceptor})
+	}
+	return interceptors, nil
+}
+
+// interceptCommand runs a command through the enabled interceptors in order,
+// stopping at the first that rejects it
+func (p *Proxy) interceptCommand(ctx context.Context, cmd *Command, logger *logrus.Entry) error {
+	for _, interceptor := range p.interceptors {
+		if err := interceptor.InterceptCommand(ctx, cmd); err != nil {
+			logger.WithError(err).WithField("interceptor", interceptor.name).Warn("Interceptor rejected command")
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	RegisterInterceptor("auto-create", func(config Config) CommandInterceptor {
+		return &autoCreateInterceptor{config: config}
+	})
+}
+
+// autoCreateInterceptor creates the databases selected with USE statements,
+// COM_INIT_DB or COM_CHANGE_USER and, if enabled, referenced by
+// database-qualified COM_FIELD_LIST commands
+type autoCreateInterceptor struct {
+	config  Config
+	ensurer DatabaseEnsurer
+}
+
+// SetEnsurer sets the ensurer used to create databases
+func (a *autoCreateInterceptor) SetEnsurer(ensurer DatabaseEnsurer) {
+	a.ensurer = ensurer
+}
+
+// InterceptCommand creates the database a command refers to. A database
+// that cannot be created fails the command with an ERR naming it, except
+// that system schemas, which always exist, and names the name policy does
+// not allow are left for MySQL to resolve, as are names failing validation
+// when DeniedHandshakeAction is "passthrough".
+func (a *autoCreateInterceptor) InterceptCommand(ctx context.Context, cmd *Command) error {
+	databaseName, source := "", ""
+	if isUseCommand(cmd.Payload) {
+		databaseName, source = extractDatabaseFromUseCommand(cmd.Payload), "USE command"
+	} else if isInitDBCommand(cmd.Payload) {
+		databaseName, source = string(cmd.Payload[1:]), "COM_INIT_DB"
+	} else if isChangeUserCommand(cmd.Payload) {
+		// A reset to no database selects none, leaving nothing to create
+		if request, err := parseChangeUser(cmd.Payload, connContextFrom(ctx).capabilities); err == nil {
+			databaseName, source = request.Database, "COM_CHANGE_USER"
+		}
+	} else if a.config.CreateFromFieldList && isFieldListCommand(cmd.Payload) {
+		databaseName, source = extractDatabaseFromFieldList(cmd.Payload), "COM_FIELD_LIST"
+	}
+	ctx = withCreateTrigger(ctx, commandTrigger(cmd.Payload))
+	if databaseName == "" || a.ensurer == nil {
+		return nil
+	}
+	logger := connContextFrom(ctx).Logger().WithField("database", databaseName)
+	if source != "COM_FIELD_LIST" && usePassthrough(a.config.UsePassthroughPatterns, databaseName) {
+		logger.Debug("USE target matches a passthrough pattern")
+		return nil
+	}
+
+	logger.Infof("Intercepted %s", source)
+	err := a.ensurer.EnsureExists(ctx, databaseName)
+	switch category := errorCategoryOf(err); {
+	case err == nil:
+		// A dry run has already logged what it would have done
+		if !a.config.DryRun {
+			logger.Infof("Database created from %s", source)
+		}
+		return nil
+	case errors.Is(err, errNameNotAllowed):
+		return nil
+	case category == errCategoryReserved:
+		logger.Debug("Selecting a system schema, leaving it to MySQL")
+		return nil
+	case category == errCategoryValidation && a.config.DeniedHandshakeAction == "passthrough":
+		logger.WithError(err).Warnf("Database from %s may not be created, forwarding the command", source)
+		return nil
+	default:
+		logger.WithError(err).Errorf("Failed to create database from %s", source)
+		return newProxyError(category, "cannot create database '%s': %v", databaseName, err)
+	}
+}
+
+// commandTrigger returns the creation trigger of a command selecting a database
+func commandTrigger(payload []byte) string {
+	switch {
+	case isUseCommand(payload):
+		return "use"
+	case isInitDBCommand(payload):
+		return "com_init_db"
+	case isChangeUserCommand(payload):
+		return "com_change_user"
+	default:
+		return "com_field_list"
+	}
+}
+
+// usePassthrough reports whether a USE or COM_INIT_DB target matches one of
+// the UsePassthroughPatterns, and is forwarded without being created
+func usePassthrough(patterns []string, databaseName string) bool {
+	name := strings.ToLower(databaseName)
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), name); matched {
+			return true
+		}
+	}
+	return false
+}
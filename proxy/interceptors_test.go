@@ -0,0 +1,236 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fieldListPayload builds a COM_FIELD_LIST for table with the field wildcard
+func fieldListPayload(table, wildcard string) []byte {
+	payload := append([]byte{comFieldList}, table...)
+	return append(append(payload, 0), wildcard...)
+}
+
+func TestExtractDatabaseFromFieldList(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		want    string
+	}{
+		{"qualified", fieldListPayload("orders.items", "%"), "orders"},
+		{"quoted", fieldListPayload("`orders`.`items`", ""), "orders"},
+		{"bare table", fieldListPayload("items", "%"), ""},
+		{"leading dot", fieldListPayload(".items", "%"), ""},
+		{"dot in wildcard", fieldListPayload("items", "a.b"), ""},
+		{"unterminated", append([]byte{comFieldList}, "orders.items"...), "orders"},
+		{"not a field list", append([]byte{comQuery}, "orders.items"...), ""},
+		{"empty", []byte{comFieldList}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := extractDatabaseFromFieldList(tc.payload); got != tc.want {
+				t.Fatalf("extracted %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestFieldListCreatesDatabase(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		backend := startFakeMySQL(t)
+		ensurer := &recordingEnsurer{backend: backend}
+		config := testConfig(backend)
+		config.CreateFromFieldList = enabled
+		_, addr := startProxy(t, config, WithEnsurer(ensurer))
+
+		c := mustConnect(t, addr, testHandshake{user: "root"})
+		payload := fieldListPayload("ledger.entries", "%")
+		if response := c.send(0, payload); response.Payload[0] != 0xfe {
+			t.Fatalf("COM_FIELD_LIST answered with %s", describePacket(response))
+		}
+		if got := string(lastCommand(backend)); got != string(payload) {
+			t.Fatalf("backend received %q", got)
+		}
+
+		want := []string(nil)
+		if enabled {
+			want = []string{"ledger"}
+		}
+		if got := ensurer.requested(); !equalStrings(got, want) {
+			t.Fatalf("with CreateFromFieldList %v created %q, want %q", enabled, got, want)
+		}
+	}
+}
+
+// testRecorder records the commands the "test-record" interceptor sees
+var testRecorder = &recordingInterceptor{}
+
+func init() {
+	RegisterInterceptor("test-record", func(Config) CommandInterceptor { return testRecorder })
+	RegisterInterceptor("test-rewrite", func(Config) CommandInterceptor { return rewritingInterceptor{} })
+}
+
+// recordingInterceptor records the payloads of the commands it sees, and
+// rejects the ones starting like reject
+type recordingInterceptor struct {
+	mu       sync.Mutex
+	payloads []string
+	reject   string
+}
+
+func (r *recordingInterceptor) InterceptCommand(_ context.Context, cmd *Command) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payloads = append(r.payloads, string(cmd.Payload))
+	if r.reject != "" && strings.HasPrefix(string(cmd.Payload[1:]), r.reject) {
+		return newProxyError(errCategoryAccessDenied, "statement not allowed")
+	}
+	return nil
+}
+
+// reset forgets the commands seen and rejects those starting like reject
+func (r *recordingInterceptor) reset(reject string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.payloads, r.reject = nil, reject
+}
+
+// seen returns the payloads seen since the last reset
+func (r *recordingInterceptor) seen() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.payloads...)
+}
+
+// rewritingInterceptor replaces the statement "SELECT 'before'" with one
+// selecting 'after', changing its length
+type rewritingInterceptor struct{}
+
+func (rewritingInterceptor) InterceptCommand(_ context.Context, cmd *Command) error {
+	if string(cmd.Payload) == "\x03SELECT 'before'" {
+		cmd.Payload = []byte("\x03SELECT 'rewritten'")
+	}
+	return nil
+}
+
+func TestEnabledInterceptorsRunInOrder(t *testing.T) {
+	backend := startFakeMySQL(t)
+	ensurer := &recordingEnsurer{backend: backend}
+	config := testConfig(backend)
+	config.EnabledInterceptors = []string{"test-rewrite", "test-record", "auto-create"}
+	testRecorder.reset("DELETE")
+	_, addr := startProxy(t, config, WithEnsurer(ensurer))
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("SELECT 'before'")
+	c.mustQuery("USE orders")
+	if got, want := testRecorder.seen(), []string{"\x03SELECT 'rewritten'", "\x03USE orders"}; !equalStrings(got, want) {
+		t.Fatalf("the interceptor saw %q, want %q", got, want)
+	}
+	if !containsString(backend.receivedQueries(), "SELECT 'rewritten'") {
+		t.Fatalf("MySQL received %q", backend.receivedQueries())
+	}
+	if got := ensurer.requested(); !equalStrings(got, []string{"orders"}) {
+		t.Fatalf("created %q", got)
+	}
+
+	// A rejected command is answered with an ERR instead of being forwarded,
+	// and stops the interceptors after the one rejecting it
+	expectErr(t, c.query("DELETE FROM orders"), 1045)
+	if containsString(backend.receivedQueries(), "DELETE FROM orders") {
+		t.Fatal("a rejected command was forwarded")
+	}
+	c.mustQuery("SELECT 1")
+}
+
+func TestDisabledAutoCreate(t *testing.T) {
+	backend := startFakeMySQL(t)
+	ensurer := &recordingEnsurer{backend: backend}
+	config := testConfig(backend)
+	config.EnabledInterceptors = []string{"test-record"}
+	testRecorder.reset("")
+	_, addr := startProxy(t, config, WithEnsurer(ensurer))
+
+	// With auto-create disabled the interceptor does not ask for the database
+	backend.create("orders")
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("USE orders")
+	if got := ensurer.requested(); len(got) != 0 {
+		t.Fatalf("created %q without the auto-create interceptor", got)
+	}
+	if got := testRecorder.seen(); len(got) != 1 {
+		t.Fatalf("the interceptor saw %q", got)
+	}
+}
+
+func TestBuildInterceptors(t *testing.T) {
+	config := DefaultConfig()
+	config.EnabledInterceptors = []string{"test-record", "missing"}
+	if _, err := buildInterceptors(config, nil); err == nil || !strings.Contains(err.Error(), `unknown interceptor "missing"`) {
+		t.Fatalf("built an unknown interceptor: %v", err)
+	}
+
+	ensurer := &recordingEnsurer{}
+	config.EnabledInterceptors = []string{"auto-create"}
+	interceptors, err := buildInterceptors(config, ensurer)
+	if err != nil || len(interceptors) != 1 || interceptors[0].name != "auto-create" {
+		t.Fatalf("built %v, %v", interceptors, err)
+	}
+	if got := interceptors[0].CommandInterceptor.(*autoCreateInterceptor).ensurer; got != ensurer {
+		t.Fatal("the ensurer was not handed to the interceptor")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a name twice did not panic")
+		}
+	}()
+	RegisterInterceptor("test-record", func(Config) CommandInterceptor { return testRecorder })
+}
+
+func TestUsePassthrough(t *testing.T) {
+	patterns := []string{"information_schema", "report_*"}
+	for name, want := range map[string]bool{
+		"information_schema": true,
+		"INFORMATION_SCHEMA": true,
+		"report_2024":        true,
+		"Report_x":           true,
+		"reports":            false,
+		"orders":             false,
+	} {
+		if got := usePassthrough(patterns, name); got != want {
+			t.Errorf("%q passed through: %v, want %v", name, got, want)
+		}
+	}
+	if usePassthrough(nil, "information_schema") {
+		t.Error("passed through without patterns")
+	}
+}
+
+func TestUsePassthroughPatterns(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.create("report_q1")
+	ensurer := &recordingEnsurer{backend: backend}
+	config := testConfig(backend)
+	config.UsePassthroughPatterns = []string{"report_*"}
+	_, addr := startProxy(t, config, WithEnsurer(ensurer))
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("USE `report_q1`")
+	if response := c.command(append([]byte{comInitDB}, "report_q2"...)); response[0].Payload[0] != 0xff {
+		t.Fatalf("COM_INIT_DB of a missing passthrough database answered with %s", describePacket(response[0]))
+	}
+	if got := string(lastCommand(backend)); got != "\x02report_q2" {
+		t.Fatalf("backend received %q", got)
+	}
+
+	// Other targets are still created
+	c.mustQuery("USE orders")
+	if got := ensurer.requested(); !equalStrings(got, []string{"orders"}) {
+		t.Fatalf("created %q", got)
+	}
+	if !containsString(backend.receivedQueries(), "USE `report_q1`") {
+		t.Fatalf("the passthrough USE was not forwarded verbatim: %q", backend.receivedQueries())
+	}
+}
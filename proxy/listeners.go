@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// listenerPrefix marks a LISTENERS entry whose port prefixes the client's
+// database name instead of selecting a database of its own
+const listenerPrefix = "prefix:"
+
+// portListener is an extra port from LISTENERS, which implies the database of
+// the connections that arrive on it
+type portListener struct {
+	port int
+
+	// database is selected by every connection on the port, whichever the
+	// handshake asked for; prefix is put before the database name the client
+	// selects instead. Exactly one of them is set.
+	database string
+	prefix   string
+}
+
+// parseListeners parses LISTENERS entries of the form port=database or
+// port=prefix:text
+func parseListeners(entries []string) ([]portListener, error) {
+	listeners := make([]portListener, 0, len(entries))
+	ports := make(map[int]bool, len(entries))
+	for _, entry := range entries {
+		rawPort, target, ok := strings.Cut(entry, "=")
+		if !ok || target == "" {
+			return nil, fmt.Errorf("listener %q is not of the form port=database or port=prefix:text", entry)
+		}
+		port, err := strconv.Atoi(rawPort)
+		if err != nil || portNumber(port) != nil || port == 0 {
+			return nil, fmt.Errorf("listener %q has an invalid port", entry)
+		}
+		if ports[port] {
+			return nil, fmt.Errorf("port %d is listed more than once", port)
+		}
+		ports[port] = true
+
+		listener := portListener{port: port}
+		if prefix, ok := strings.CutPrefix(target, listenerPrefix); ok {
+			if prefix == "" {
+				return nil, fmt.Errorf("listener %q has an empty prefix", entry)
+			}
+			listener.prefix = prefix
+		} else {
+			if err := validateDatabaseName(target, false); err != nil {
+				return nil, fmt.Errorf("listener %q: %w", entry, err)
+			}
+			listener.database = target
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// listenerEntries accepts lists of valid LISTENERS entries
+func listenerEntries(value interface{}) error {
+	_, err := parseListeners(value.([]string))
+	return err
+}
+
+// checkListenerPorts fails if a LISTENERS port is one the proxy already
+// listens on for something else
+func checkListenerPorts(config Config, listeners []portListener) error {
+	taken := map[int]string{
+		config.ProxyPort:   "PROXY_PORT",
+		config.AdminPort:   "ADMIN_PORT",
+		config.MetricsPort: "METRICS_PORT",
+		config.HealthPort:  "HEALTH_PORT",
+		config.DebugPort:   "DEBUG_PORT",
+	}
+	for _, listener := range listeners {
+		if name, ok := taken[listener.port]; ok && listener.port != 0 {
+			return fmt.Errorf("LISTENERS port %d is already %s", listener.port, name)
+		}
+	}
+	return nil
+}
+
+// fixedDatabase returns the database every connection on the listener
+// selects, or "" if it has none
+func (l *portListener) fixedDatabase() string {
+	if l == nil {
+		return ""
+	}
+	return l.database
+}
+
+// namer returns the namer of the connections on the listener: the proxy's,
+// with the listener's prefix put before the client's database name
+func (l *portListener) namer(n *databaseNamer) *databaseNamer {
+	if l == nil || l.prefix == "" {
+		return n
+	}
+	template, lowercase := "{name}", false
+	if n != nil {
+		template, lowercase = n.template, n.lowercase
+	}
+	return &databaseNamer{
+		template:  strings.ReplaceAll(template, "{name}", l.prefix+"{name}"),
+		lowercase: lowercase,
+	}
+}
+
+// databaseListener is a net.Listener for a LISTENERS port, which Serve hands
+// the connections of along with the port's mapping
+type databaseListener struct {
+	net.Listener
+	mapping *portListener
+}
+
+// listenerMapping returns the LISTENERS mapping of a listener, or nil for
+// the proxy's other listeners
+func listenerMapping(listener net.Listener) *portListener {
+	if l, ok := listener.(*databaseListener); ok {
+		return l.mapping
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParseListeners(t *testing.T) {
+	listeners, err := parseListeners([]string{"3310=orders", "3311=billing", "3312=prefix:pr1234_"})
+	if err != nil {
+		t.Fatalf("parseListeners: %v", err)
+	}
+	want := []portListener{{port: 3310, database: "orders"}, {port: 3311, database: "billing"}, {port: 3312, prefix: "pr1234_"}}
+	if len(listeners) != len(want) {
+		t.Fatalf("parsed %+v", listeners)
+	}
+	for i := range want {
+		if listeners[i] != want[i] {
+			t.Errorf("listener %d parsed as %+v, want %+v", i, listeners[i], want[i])
+		}
+	}
+
+	for _, entries := range [][]string{
+		{"3310"},
+		{"3310="},
+		{"=orders"},
+		{"port=orders"},
+		{"0=orders"},
+		{"70000=orders"},
+		{"3310=prefix:"},
+		{"3310=mysql"},
+		{"3310=trailing "},
+		{"3310=orders", "3310=billing"},
+	} {
+		if _, err := parseListeners(entries); err == nil {
+			t.Errorf("accepted %q", entries)
+		}
+	}
+
+	config := DefaultConfig()
+	config.ProxyPort, config.AdminPort = 3306, 8080
+	if err := checkListenerPorts(config, want); err != nil {
+		t.Fatalf("checkListenerPorts: %v", err)
+	}
+	for _, port := range []int{3306, 8080} {
+		if err := checkListenerPorts(config, []portListener{{port: port, database: "orders"}}); err == nil {
+			t.Errorf("accepted port %d, already in use", port)
+		}
+	}
+}
+
+// serveListener serves the LISTENERS mapping on a loopback port of p,
+// returning its address
+func serveListener(t *testing.T, p *Proxy, mapping *portListener) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go p.Serve(&databaseListener{Listener: listener, mapping: mapping})
+	return listener.Addr().String()
+}
+
+func TestListenerPorts(t *testing.T) {
+	backend := startFakeMySQL(t)
+	p, addr := startProxy(t, testConfig(backend))
+	orders := serveListener(t, p, &portListener{port: 3310, database: "orders"})
+	prefixed := serveListener(t, p, &portListener{port: 3312, prefix: "pr1234_"})
+
+	// A fixed port selects its database, whichever the client asked for
+	for _, handshake := range []testHandshake{
+		{capabilities: testClientCapabilities &^ clientConnectWithDB, user: "root"},
+		{user: "root", database: "other"},
+	} {
+		c := mustConnect(t, orders, handshake)
+		c.mustQuery("SELECT 1")
+		if current := p.conns.all()[0].cc.CurrentDB(); current != "orders" {
+			t.Fatalf("connected with %q selected", current)
+		}
+		c.conn.Close()
+		eventually(t, "the connection to end", func() bool { return len(p.conns.all()) == 0 })
+	}
+	if !backend.hasDatabase("orders") || backend.hasDatabase("other") {
+		t.Fatal("the port's database was not the one created")
+	}
+	handshakes := backend.receivedHandshakes()
+	if hr, err := parseHandshakeResponse(handshakes[len(handshakes)-1]); err != nil || hr.Database != "orders" {
+		t.Fatalf("MySQL received a handshake parsed as %+v, %v", hr, err)
+	}
+
+	// A prefix port puts its prefix before the databases the client selects
+	c := mustConnect(t, prefixed, testHandshake{user: "root", database: "orders"})
+	c.mustQuery("USE billing")
+	if !backend.hasDatabase("pr1234_orders") || !backend.hasDatabase("pr1234_billing") {
+		t.Fatal("the prefixed databases were not created")
+	}
+	if backend.hasDatabase("billing") {
+		t.Fatal("a database was created without the prefix")
+	}
+	c.conn.Close()
+
+	// and other ports leave names alone
+	mustConnect(t, addr, testHandshake{user: "root"}).mustQuery("USE billing")
+	if !backend.hasDatabase("billing") {
+		t.Fatal("the main port prefixed the database")
+	}
+}
+
+func TestListenerPortConflicts(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.ProxyPort = 3310
+	config.Listeners = []string{"3310=orders"}
+	if _, err := New(config); err == nil || !strings.Contains(err.Error(), "already PROXY_PORT") {
+		t.Fatalf("New: %v", err)
+	}
+
+	// A port that cannot be listened on fails startup
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	_, port, _ := net.SplitHostPort(busy.Addr().String())
+	config.ListenAddress = "127.0.0.1"
+	config.ProxyPort = 0
+	config.ProxySocket = ""
+	config.Listeners = []string{port + "=orders"}
+	p, err := New(config)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := p.ListenAndServe(context.Background()); err == nil || !strings.Contains(err.Error(), "LISTENERS port "+port) {
+		t.Fatalf("ListenAndServe: %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+var localInfileBlocked = newCounter("mysql_autodb_local_infile_blocked_total",
+	"LOAD DATA LOCAL INFILE requests from MySQL refused with BLOCK_LOCAL_INFILE")
+
+// isLocalInfileRequest reports whether the first packet answering a query is
+// MySQL asking the client for the contents of a local file. Later packets of
+// a response may start with 0xfb too, as a text row whose first column is
+// NULL does.
+func isLocalInfileRequest(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == 0xfb
+}
+
+// refuseLocalInfile answers a LOCAL INFILE request from MySQL with an empty
+// file, as a client that does not send one does, and the client with an ERR
+// in its place, so that no file on the client's host is read through the
+// proxy. MySQL's answer to the empty file is swallowed by forwardFromServer.
+func (p *Proxy) refuseLocalInfile(clientConn, mysqlConn net.Conn, state *relayState, request *MySQLPacket, logger *logrus.Entry) error {
+	logger.WithField("file", string(request.Payload[1:])).Warn("Blocked LOAD DATA LOCAL INFILE request from MySQL")
+	localInfileBlocked.Inc()
+
+	emptyFile := newPacket(nextSequenceID(request.SequenceID), nil)
+	state.serverWriteMu.Lock()
+	state.serverSpokeLast.Store(false)
+	state.nextSeq.Store(uint32(nextSequenceID(emptyFile.SequenceID)))
+	state.swallowAnswer.Store(true)
+	err := writePacketWithTimeout(mysqlConn, emptyFile, state.writeTimeout)
+	state.serverWriteMu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to send MySQL an empty file: %w", err)
+	}
+
+	state.clientWriteMu.Lock()
+	defer state.clientWriteMu.Unlock()
+	return p.writeErrPacket(clientConn, request.SequenceID, errCategoryLocalInfile, "LOAD DATA LOCAL INFILE is blocked by the proxy")
+}
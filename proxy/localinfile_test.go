@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+// serveLocalInfile makes the fake ask for the file of LOAD DATA LOCAL INFILE
+// statements, recording the contents the client sends, and answer SELECT
+// NULL with a row whose column is NULL
+func serveLocalInfile(backend *fakeMySQL) func() []string {
+	var (
+		mu    sync.Mutex
+		files []string
+	)
+	backend.handleCommands(func(s *fakeSession, payload []byte) bool {
+		query := string(payload[1:])
+		switch {
+		case strings.HasPrefix(query, "LOAD DATA LOCAL INFILE"):
+			s.write(append([]byte{0xfb}, "/etc/passwd"...))
+			var file []byte
+			for {
+				packet, err := s.read()
+				if err != nil || len(packet) == 0 {
+					break
+				}
+				file = append(file, packet...)
+			}
+			mu.Lock()
+			files = append(files, string(file))
+			mu.Unlock()
+			s.ok()
+			return true
+		case query == "SELECT NULL":
+			s.write([]byte{1})
+			def := appendLengthEncodedString(nil, "def")
+			for _, field := range []string{"", "", "", "NULL", "NULL"} {
+				def = appendLengthEncodedString(def, field)
+			}
+			s.write(append(def, 0x0c, 63, 0, 0, 0, 0, 0, 6, 0x80, 0, 0, 0, 0))
+			s.eof()
+			s.write([]byte{0xfb})
+			s.eof()
+			return true
+		}
+		return false
+	})
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), files...)
+	}
+}
+
+func TestBlockLocalInfile(t *testing.T) {
+	backend := startFakeMySQL(t)
+	files := serveLocalInfile(backend)
+	config := testConfig(backend)
+	config.BlockLocalInfile = true
+	_, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	response := c.send(0, append([]byte{comQuery}, "LOAD DATA LOCAL INFILE '/etc/passwd' INTO TABLE t"...))
+	expectErr(t, response, 3948)
+	if response.SequenceID != 1 {
+		t.Fatalf("ERR numbered %d, want 1", response.SequenceID)
+	}
+	eventually(t, "MySQL to receive the empty file", func() bool { return len(files()) == 1 })
+	if got := files(); got[0] != "" {
+		t.Fatalf("MySQL received the file %q", got[0])
+	}
+
+	// MySQL's answer to the empty file is not relayed, and the connection
+	// stays usable
+	c.mustQuery("SELECT 1")
+
+	// A text row whose first column is NULL starts with 0xfb too
+	packets := c.command(append([]byte{comQuery}, "SELECT NULL"...))
+	if len(packets) != 5 || string(packets[3].Payload) != "\xfb" {
+		t.Fatalf("SELECT NULL answered with %d packets", len(packets))
+	}
+}
+
+func TestLocalInfileAllowedByDefault(t *testing.T) {
+	backend := startFakeMySQL(t)
+	files := serveLocalInfile(backend)
+	_, addr := startProxy(t, testConfig(backend), WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	request := c.send(0, append([]byte{comQuery}, "LOAD DATA LOCAL INFILE 'rows.csv' INTO TABLE t"...))
+	if !isLocalInfileRequest(request.Payload) {
+		t.Fatalf("LOAD DATA LOCAL INFILE answered with %s", describePacket(request))
+	}
+	if err := writePacket(c.conn, newPacket(2, []byte("1,2\n"))); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if response := c.send(3, nil); response == nil || response.Payload[0] != 0x00 {
+		t.Fatalf("the file was answered with %s", describePacket(response))
+	}
+	if got := files(); len(got) != 1 || got[0] != "1,2\n" {
+		t.Fatalf("MySQL received the files %q", got)
+	}
+}
@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// checkProxyLoop refuses a configuration with a backend whose address is one
+// the proxy listens on, which would make every connection dial back into the
+// proxy until resources run out
+func checkProxyLoop(config Config) error {
+	// PROXY_SOCKET is never dialed, MySQL connections being TCP only, but a
+	// MYSQL_HOST naming it shows the same mistake
+	if config.ProxySocket != "" && config.MySQLHost == config.ProxySocket {
+		return fmt.Errorf("MYSQL_HOST=%s is the proxy's own PROXY_SOCKET; set MYSQL_HOST/MYSQL_PORT to the real MySQL server", config.MySQLHost)
+	}
+
+	ports := listeningPorts(config)
+	if len(ports) == 0 {
+		return nil
+	}
+	var localAddrs []net.Addr
+	for _, backend := range loopBackends(config) {
+		host, rawPort, err := net.SplitHostPort(backend.addr)
+		if err != nil {
+			continue
+		}
+		port, _ := strconv.Atoi(rawPort)
+		listener, ok := ports[port]
+		if !ok {
+			continue
+		}
+
+		backendIPs, err := net.LookupIP(host)
+		if err != nil {
+			// An unresolvable backend is reported when connections are made
+			continue
+		}
+		if localAddrs == nil {
+			if localAddrs, err = net.InterfaceAddrs(); err != nil {
+				return fmt.Errorf("failed to list local addresses: %w", err)
+			}
+		}
+		for _, ip := range backendIPs {
+			if listensOn(config.ListenAddress, ip, localAddrs) {
+				return fmt.Errorf("%s %s points at the proxy itself (%s is an address the proxy listens on, on port %d of %s); "+
+					"set it to a real MySQL server", backend.setting, backend.addr, ip, port, listener)
+			}
+		}
+	}
+	return nil
+}
+
+// listeningPorts returns the TCP ports the proxy listens on, with the
+// setting each comes from
+func listeningPorts(config Config) map[int]string {
+	ports := make(map[int]string)
+	if config.ProxyPort != 0 {
+		ports[config.ProxyPort] = "PROXY_PORT"
+	}
+	listeners, _ := parseListeners(config.Listeners)
+	for _, listener := range listeners {
+		ports[listener.port] = "LISTENERS"
+	}
+	return ports
+}
+
+// loopBackend is an address the proxy dials, with the setting it comes from
+type loopBackend struct {
+	setting string
+	addr    string
+}
+
+// loopBackends returns every address the proxy may dial for its clients
+func loopBackends(config Config) []loopBackend {
+	backends := []loopBackend{{"MYSQL_HOST/MYSQL_PORT", net.JoinHostPort(config.MySQLHost, strconv.Itoa(config.MySQLPort))}}
+	named, _ := parseBackends(config.Backends)
+	for _, backend := range named {
+		backends = append(backends, loopBackend{"BACKENDS entry " + backend.name, backend.addr})
+	}
+	routes, _ := parseAttributeRoutes(config.AttributeRoutes)
+	for value, addr := range routes {
+		backends = append(backends, loopBackend{"ATTRIBUTE_ROUTES entry " + value, addr})
+	}
+	if config.ShadowBackend != "" {
+		backends = append(backends, loopBackend{"SHADOW_BACKEND", config.ShadowBackend})
+	}
+	return backends
+}
+
+// listensOn reports whether a proxy listening on listenAddress accepts
+// connections made to ip
+func listensOn(listenAddress string, ip net.IP, localAddrs []net.Addr) bool {
+	if ip.IsUnspecified() {
+		return true
+	}
+	switch listenIP := net.ParseIP(listenAddress); {
+	case listenAddress == "localhost":
+		return ip.IsLoopback()
+	case listenIP != nil && !listenIP.IsUnspecified():
+		return ip.Equal(listenIP)
+	}
+
+	// On all interfaces, any local address reaches the proxy
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, addr := range localAddrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// backendConnSet tracks the local addresses of the proxy's own connections to
+// MySQL, so that an inbound connection originating from one of them can be
+// recognised as the proxy connecting to itself
+type backendConnSet struct {
+	addrs sync.Map
+}
+
+// add records an outbound backend connection
+func (s *backendConnSet) add(conn net.Conn) {
+	s.addrs.Store(conn.LocalAddr().String(), struct{}{})
+}
+
+// remove forgets an outbound backend connection
+func (s *backendConnSet) remove(conn net.Conn) {
+	s.addrs.Delete(conn.LocalAddr().String())
+}
+
+// isLoop reports whether an inbound connection was opened by the proxy itself
+func (s *backendConnSet) isLoop(conn net.Conn) bool {
+	_, ok := s.addrs.Load(conn.RemoteAddr().String())
+	return ok
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckProxyLoop(t *testing.T) {
+	for name, tc := range map[string]struct {
+		mutate func(*Config)
+		want   string
+	}{
+		"mysql elsewhere":       {mutate: func(c *Config) {}},
+		"mysql on another port": {mutate: func(c *Config) { c.MySQLHost, c.MySQLPort = "127.0.0.1", 3306 }},
+		"mysql on the proxy port": {
+			mutate: func(c *Config) { c.MySQLHost, c.MySQLPort = "127.0.0.1", 3308 },
+			want:   "MYSQL_HOST/MYSQL_PORT 127.0.0.1:3308 points at the proxy itself",
+		},
+		"localhost": {
+			mutate: func(c *Config) { c.MySQLHost, c.MySQLPort = "localhost", 3308 },
+			want:   "MYSQL_HOST/MYSQL_PORT localhost:3308",
+		},
+		"unspecified address": {
+			mutate: func(c *Config) { c.MySQLHost, c.MySQLPort = "0.0.0.0", 3308 },
+			want:   "MYSQL_HOST/MYSQL_PORT 0.0.0.0:3308",
+		},
+		"LISTENERS port": {
+			mutate: func(c *Config) {
+				c.Listeners = []string{"3310=orders"}
+				c.MySQLHost, c.MySQLPort = "127.0.0.1", 3310
+			},
+			want: "on port 3310 of LISTENERS",
+		},
+		"BACKENDS entry": {
+			mutate: func(c *Config) { c.Backends = []string{"legacy=mysql://127.0.0.1:3308"} },
+			want:   "BACKENDS entry legacy 127.0.0.1:3308",
+		},
+		"ATTRIBUTE_ROUTES entry": {
+			mutate: func(c *Config) {
+				c.Listeners = []string{"3310=prefix:eu_"}
+				c.AttributeRoutes = []string{"eu=127.0.0.1:3310"}
+			},
+			want: "ATTRIBUTE_ROUTES entry eu 127.0.0.1:3310",
+		},
+		"SHADOW_BACKEND": {
+			mutate: func(c *Config) { c.ShadowBackend = "127.0.0.1:3308" },
+			want:   "SHADOW_BACKEND 127.0.0.1:3308",
+		},
+		"on the listen address": {
+			mutate: func(c *Config) {
+				c.ListenAddress = "127.0.0.1"
+				c.MySQLHost, c.MySQLPort = "127.0.0.1", 3308
+			},
+			want: "MYSQL_HOST/MYSQL_PORT 127.0.0.1:3308",
+		},
+		"beside the listen address": {
+			mutate: func(c *Config) {
+				c.ListenAddress = "127.0.0.2"
+				c.MySQLHost, c.MySQLPort = "127.0.0.1", 3308
+			},
+		},
+		"socket only": {
+			mutate: func(c *Config) {
+				c.ProxyPort, c.ProxySocket = 0, "/run/mysql-auto-db-proxy.sock"
+				c.MySQLHost, c.MySQLPort = "127.0.0.1", 3308
+			},
+		},
+		"MYSQL_HOST naming PROXY_SOCKET": {
+			mutate: func(c *Config) {
+				c.ProxySocket = "/run/mysql-auto-db-proxy.sock"
+				c.MySQLHost = c.ProxySocket
+			},
+			want: "is the proxy's own PROXY_SOCKET",
+		},
+	} {
+		config := DefaultConfig()
+		config.MySQLHost = "192.0.2.10"
+		tc.mutate(&config)
+		err := checkProxyLoop(config)
+		if tc.want == "" && err != nil {
+			t.Errorf("%s: %v", name, err)
+		} else if tc.want != "" && (err == nil || !strings.Contains(err.Error(), tc.want)) {
+			t.Errorf("%s: checkProxyLoop returned %v, want %q", name, err, tc.want)
+		}
+	}
+
+	// Any address of a local interface reaches a proxy listening on all of them
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			config := DefaultConfig()
+			config.MySQLHost, config.MySQLPort = ipNet.IP.String(), config.ProxyPort
+			if err := checkProxyLoop(config); err == nil {
+				t.Errorf("local address %s accepted as the backend", ipNet.IP)
+			}
+			config.ListenAddress = "127.0.0.1"
+			if err := checkProxyLoop(config); err != nil {
+				t.Errorf("local address %s refused with the proxy listening on loopback only: %v", ipNet.IP, err)
+			}
+			break
+		}
+	}
+}
+
+func TestBackendConnSet(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+	dial := func() (net.Conn, net.Conn) {
+		out, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		in, err := listener.Accept()
+		if err != nil {
+			t.Fatalf("accept: %v", err)
+		}
+		t.Cleanup(func() {
+			out.Close()
+			in.Close()
+		})
+		return out, in
+	}
+
+	var set backendConnSet
+	out, in := dial()
+	_, other := dial()
+	set.add(out)
+	if !set.isLoop(in) {
+		t.Fatal("the proxy's own connection was not recognised")
+	}
+	if set.isLoop(other) || set.isLoop(out) {
+		t.Fatal("a client connection was taken for a loop")
+	}
+	set.remove(out)
+	if set.isLoop(in) {
+		t.Fatal("a removed connection is still recognised")
+	}
+}
+
+func TestProxyLoopRefusedOnAccept(t *testing.T) {
+	// MySQL is reached through an address that leads back to the proxy, as
+	// a port forward would, so the startup check cannot see the loop
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	config := DefaultConfig()
+	config.MySQLHost = "127.0.0.1"
+	config.MySQLPort = listener.Addr().(*net.TCPAddr).Port
+	config.LowerCaseTableNames = "0"
+	config.HandshakeTimeout = 5 * time.Second
+	config.StatsInterval = 0
+	logger, hook := testLogger()
+	p, err := New(config, WithLogger(logger), WithEnsurer(&recordingEnsurer{}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	var hooked atomic.Int32
+	p.AcceptHook = func(net.Conn) error {
+		hooked.Add(1)
+		return nil
+	}
+	go p.Serve(listener)
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		p.Shutdown(ctx)
+	}()
+
+	// The connection the proxy opens to itself is refused as soon as it is
+	// accepted, before the accept hook, and does not dial again
+	rejected := connectionsRejected.Value("proxy_loop")
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	if packet, err := readPacket(client); err == nil && packet.Payload[0] != 0xff {
+		t.Fatalf("the client was greeted with %s", describePacket(packet))
+	}
+	eventually(t, "the loop to be refused", func() bool { return connectionsRejected.Value("proxy_loop") == rejected+1 })
+	if entry := findEntry(hook, "Rejected connection: proxy loop detected: this connection was opened by the proxy itself to reach MySQL. "+
+		"MYSQL_HOST/MYSQL_PORT, BACKENDS and ATTRIBUTE_ROUTES must point at real MySQL servers, not at the proxy"); entry == nil || entry.Data["conn_id"] != uint64(2) {
+		t.Fatalf("logged %v", entry)
+	}
+	if hooked.Load() != 1 || p.nextConnID.Load() != 2 {
+		t.Fatalf("accept hook ran %d times for %d connections", hooked.Load(), p.nextConnID.Load())
+	}
+}
@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is a single Prometheus metric family
+type metric interface {
+	write(w io.Writer)
+
+	// snapshot returns the metric's name and current value, as DEBUG_PORT's
+	// /debug/vars shows it
+	snapshot() (string, interface{})
+}
+
+// metricsRegistry holds every metric exported by the proxy
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// registry is the process-wide metrics registry
+var registry = &metricsRegistry{}
+
+// register adds a metric to the registry
+func (r *metricsRegistry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// values returns every registered metric's value by name
+func (r *metricsRegistry) values() map[string]interface{} {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	values := make(map[string]interface{}, len(metrics))
+	for _, m := range metrics {
+		name, value := m.snapshot()
+		values[name] = value
+	}
+	return values
+}
+
+// writeTo renders all registered metrics in the Prometheus text exposition format
+func (r *metricsRegistry) writeTo(w io.Writer) {
+	r.mu.Lock()
+	metrics := append([]metric(nil), r.metrics...)
+	r.mu.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+// serveMetrics serves the registry in the Prometheus text exposition format
+// at /metrics until Shutdown stops the server or it fails
+func (p *Proxy) serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		registry.writeTo(w)
+	})
+
+	server := newHTTPServer(addr, mux)
+	if !p.trackServer(server) {
+		return
+	}
+
+	p.log.WithField("metrics_addr", addr).Info("Metrics listening")
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		p.log.WithError(err).Error("Metrics server stopped")
+	}
+}
+
+// counter is a monotonically increasing value
+type counter struct {
+	name  string
+	help  string
+	value atomic.Uint64
+}
+
+// newCounter creates and registers a counter
+func newCounter(name, help string) *counter {
+	c := &counter{name: name, help: help}
+	registry.register(c)
+	return c
+}
+
+// Inc increments the counter by one
+func (c *counter) Inc() {
+	c.value.Add(1)
+}
+
+// Add increments the counter by n
+func (c *counter) Add(n uint64) {
+	c.value.Add(n)
+}
+
+// Value returns the current counter value
+func (c *counter) Value() uint64 {
+	return c.value.Load()
+}
+
+func (c *counter) snapshot() (string, interface{}) {
+	return c.name, c.value.Load()
+}
+
+func (c *counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value.Load())
+}
+
+// gauge is a value that can go up and down
+type gauge struct {
+	name  string
+	help  string
+	value atomic.Int64
+}
+
+// newGauge creates and registers a gauge
+func newGauge(name, help string) *gauge {
+	g := &gauge{name: name, help: help}
+	registry.register(g)
+	return g
+}
+
+// Set sets the gauge to v
+func (g *gauge) Set(v int64) {
+	g.value.Store(v)
+}
+
+// Add adds delta to the gauge
+func (g *gauge) Add(delta int64) {
+	g.value.Add(delta)
+}
+
+// Value returns the current gauge value
+func (g *gauge) Value() int64 {
+	return g.value.Load()
+}
+
+func (g *gauge) snapshot() (string, interface{}) {
+	return g.name, g.value.Load()
+}
+
+func (g *gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.value.Load())
+}
+
+// maxLabelSets bounds the label combinations a counterVec tracks; further
+// combinations are counted under "other" so that client-supplied values cannot
+// grow the metrics without limit
+const maxLabelSets = 100
+
+// labelEscaper escapes label values for the text exposition format
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// counterVec is a family of counters partitioned by label values
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]*labeledCounter
+	order  []string
+}
+
+// labeledCounter is one counter of a counterVec
+type labeledCounter struct {
+	labelValues []string
+	value       atomic.Uint64
+}
+
+// newCounterVec creates and registers a counter family with the given labels
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	v := &counterVec{name: name, help: help, labels: labels, values: make(map[string]*labeledCounter)}
+	registry.register(v)
+	return v
+}
+
+// Inc increments the counter for the given label values
+func (v *counterVec) Inc(labelValues ...string) {
+	v.with(labelValues).value.Add(1)
+}
+
+// Add increments the counter for the given label values by n
+func (v *counterVec) Add(n uint64, labelValues ...string) {
+	v.with(labelValues).value.Add(n)
+}
+
+// with returns the counter for the given label values, creating it if needed
+func (v *counterVec) with(labelValues []string) *labeledCounter {
+	key := strings.Join(labelValues, "\xff")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if c, ok := v.values[key]; ok {
+		return c
+	}
+	if len(v.values) >= maxLabelSets {
+		labelValues = make([]string, len(v.labels))
+		for i := range labelValues {
+			labelValues[i] = "other"
+		}
+		key = strings.Join(labelValues, "\xff")
+		if c, ok := v.values[key]; ok {
+			return c
+		}
+	}
+	c := &labeledCounter{labelValues: labelValues}
+	v.values[key] = c
+	v.order = append(v.order, key)
+	return c
+}
+
+// Value returns the counter for the given label values, 0 if never counted
+func (v *counterVec) Value(labelValues ...string) uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok := v.values[strings.Join(labelValues, "\xff")]; ok {
+		return c.value.Load()
+	}
+	return 0
+}
+
+// Total returns the sum of the counters of every label value
+func (v *counterVec) Total() uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	var total uint64
+	for _, c := range v.values {
+		total += c.value.Load()
+	}
+	return total
+}
+
+// snapshot returns the counters keyed by their label values, joined with commas
+func (v *counterVec) snapshot() (string, interface{}) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	values := make(map[string]uint64, len(v.values))
+	for _, c := range v.values {
+		values[strings.Join(c.labelValues, ",")] = c.value.Load()
+	}
+	return v.name, values
+}
+
+func (v *counterVec) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", v.name, v.help, v.name)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, key := range v.order {
+		c := v.values[key]
+		pairs := make([]string, len(v.labels))
+		for i, label := range v.labels {
+			pairs[i] = fmt.Sprintf(`%s="%s"`, label, labelEscaper.Replace(c.labelValues[i]))
+		}
+		fmt.Fprintf(w, "%s{%s} %d\n", v.name, strings.Join(pairs, ","), c.value.Load())
+	}
+}
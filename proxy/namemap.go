@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultNameTemplate places DB_NAME_PREFIX before the client's database name
+const defaultNameTemplate = "{prefix}_{name}"
+
+// databaseNamer maps the database names clients select to the names of the
+// databases on MySQL, by DB_NAME_TEMPLATE and DB_NAME_LOWERCASE. System
+// schemas keep their names. A nil namer leaves every name as it is.
+type databaseNamer struct {
+	// template is the name on MySQL with {name} standing for the client's,
+	// and {prefix} already replaced
+	template  string
+	lowercase bool
+}
+
+// newDatabaseNamer returns the namer of the configuration, or nil if it does
+// not map database names
+func newDatabaseNamer(config Config) (*databaseNamer, error) {
+	template := config.DBNameTemplate
+	if template == "" && config.DBNamePrefix != "" {
+		template = defaultNameTemplate
+	}
+	if template == "" && !config.DBNameLowercase {
+		return nil, nil
+	}
+	if template == "" {
+		template = "{name}"
+	}
+	if strings.Contains(template, "{prefix}") && config.DBNamePrefix == "" {
+		return nil, errors.New("DB_NAME_TEMPLATE uses {prefix}, which needs DB_NAME_PREFIX")
+	}
+	return &databaseNamer{
+		template:  strings.ReplaceAll(template, "{prefix}", config.DBNamePrefix),
+		lowercase: config.DBNameLowercase,
+	}, nil
+}
+
+// nameTemplate accepts templates that include the client's database name, or ""
+func nameTemplate(value interface{}) error {
+	if template := value.(string); template != "" && !strings.Contains(template, "{name}") {
+		return fmt.Errorf("must include {name}")
+	}
+	return nil
+}
+
+// backendName returns the name on MySQL of the database a client selected.
+// It fails when the mapped name is longer than MySQL allows; the mapped name
+// is otherwise validated like any other when it is created.
+func (n *databaseNamer) backendName(name string) (string, error) {
+	if n == nil || name == "" {
+		return name, nil
+	}
+	for _, reserved := range reservedDatabases {
+		if strings.EqualFold(name, reserved) {
+			return name, nil
+		}
+	}
+
+	mapped := strings.ReplaceAll(n.template, "{name}", name)
+	if n.lowercase {
+		mapped = strings.ToLower(mapped)
+	}
+	if length := utf8.RuneCountInString(mapped); length > maxDatabaseNameLength {
+		return "", newProxyError(errCategoryValidation, "database name '%s' is %d characters long as '%s' on MySQL, longer than %d",
+			name, length, mapped, maxDatabaseNameLength)
+	}
+	return mapped, nil
+}
+
+// rewriteCommand replaces the database selected by a USE, COM_INIT_DB or
+// COM_CHANGE_USER command with its name on MySQL. The command keeps its
+// sequence ID; its length changes with the name, which is why it is written
+// to MySQL as a new packet.
+func (n *databaseNamer) rewriteCommand(cmd *Command, capabilities uint32, logger *logrus.Entry) error {
+	if n == nil {
+		return nil
+	}
+
+	var name string
+	var rewrite func(mapped string) []byte
+	switch {
+	case isUseCommand(cmd.Payload):
+		name = extractDatabaseFromUseCommand(cmd.Payload)
+		rewrite = func(mapped string) []byte {
+			return append([]byte{comQuery}, "USE "+quoteIdentifier(mapped)...)
+		}
+	case isInitDBCommand(cmd.Payload):
+		name = string(cmd.Payload[1:])
+		rewrite = func(mapped string) []byte {
+			return append([]byte{comInitDB}, mapped...)
+		}
+	case isChangeUserCommand(cmd.Payload):
+		request, err := parseChangeUser(cmd.Payload, capabilities)
+		if err != nil {
+			return nil
+		}
+		name = request.Database
+		rewrite = func(mapped string) []byte {
+			return withDatabase(cmd.Payload, request.databaseOffset, request.databaseEnd, mapped)
+		}
+	}
+
+	mapped, err := n.backendName(name)
+	if err != nil {
+		return err
+	}
+	if mapped != name {
+		cmd.Payload = rewrite(mapped)
+		logger.WithFields(logrus.Fields{
+			"database":         name,
+			"backend_database": mapped,
+		}).Debug("Mapped the command's database to its name on MySQL")
+	}
+	return nil
+}
+
+// withDatabase returns a copy of a handshake response or COM_CHANGE_USER
+// payload with the null-terminated database name between offset and end
+// replaced
+func withDatabase(payload []byte, offset, end int, name string) []byte {
+	rewritten := append([]byte(nil), payload[:offset]...)
+	rewritten = append(rewritten, name...)
+	rewritten = append(rewritten, 0)
+	return append(rewritten, payload[end:]...)
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestDatabaseNamer(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, template string
+		lowercase        bool
+		names            map[string]string
+	}{
+		{
+			prefix: "pr1234",
+			names:  map[string]string{"orders": "pr1234_orders", "": "", "mysql": "mysql", "INFORMATION_SCHEMA": "INFORMATION_SCHEMA"},
+		},
+		{
+			prefix:   "pr1234",
+			template: "{name}__{prefix}",
+			names:    map[string]string{"orders": "orders__pr1234"},
+		},
+		{
+			template:  "dev_{name}",
+			lowercase: true,
+			names:     map[string]string{"Orders": "dev_orders"},
+		},
+		{
+			lowercase: true,
+			names:     map[string]string{"Orders": "orders", "Performance_Schema": "Performance_Schema"},
+		},
+	} {
+		config := DefaultConfig()
+		config.DBNamePrefix, config.DBNameTemplate, config.DBNameLowercase = tc.prefix, tc.template, tc.lowercase
+		namer, err := newDatabaseNamer(config)
+		if err != nil || namer == nil {
+			t.Fatalf("newDatabaseNamer(%+v) = %v, %v", tc, namer, err)
+		}
+		for name, want := range tc.names {
+			if got, err := namer.backendName(name); err != nil || got != want {
+				t.Errorf("backendName(%q) with %q = %q, %v, want %q", name, namer.template, got, err, want)
+			}
+		}
+	}
+
+	// Names are left alone without any option, and a nil namer maps nothing
+	namer, err := newDatabaseNamer(DefaultConfig())
+	if err != nil || namer != nil {
+		t.Fatalf("newDatabaseNamer = %v, %v", namer, err)
+	}
+	if got, err := namer.backendName("Orders"); err != nil || got != "Orders" {
+		t.Fatalf("nil namer mapped Orders to %q, %v", got, err)
+	}
+
+	config := DefaultConfig()
+	config.DBNameTemplate = "{prefix}{name}"
+	if _, err := newDatabaseNamer(config); err == nil {
+		t.Fatal("accepted {prefix} without DB_NAME_PREFIX")
+	}
+	if err := nameTemplate("dev_"); err == nil {
+		t.Fatal("accepted a template without {name}")
+	}
+
+	// The prefix may push a name over MySQL's limit
+	config.DBNamePrefix = "pr1234"
+	namer, _ = newDatabaseNamer(config)
+	if _, err := namer.backendName(strings.Repeat("a", 58)); err != nil {
+		t.Fatalf("backendName of a 64 character mapped name: %v", err)
+	}
+	_, err = namer.backendName(strings.Repeat("a", 59))
+	if err == nil || errorCategoryOf(err) != errCategoryValidation || !strings.Contains(err.Error(), "65 characters long") {
+		t.Fatalf("backendName of a 65 character mapped name: %v", err)
+	}
+}
+
+func TestRewriteCommand(t *testing.T) {
+	config := DefaultConfig()
+	config.DBNamePrefix = "pr1234"
+	namer, _ := newDatabaseNamer(config)
+	logger := logrus.NewEntry(logrus.New())
+
+	for _, tc := range []struct {
+		payload []byte
+		want    string
+	}{
+		{append([]byte{comQuery}, "use `orders`"...), "pr1234_orders"},
+		{append([]byte{comInitDB}, "orders"...), "pr1234_orders"},
+		{changeUserPayload("app", []byte("scrambled"), "orders"), "pr1234_orders"},
+	} {
+		cmd := &Command{SequenceID: 0, Payload: tc.payload}
+		if err := namer.rewriteCommand(cmd, testClientCapabilities, logger); err != nil {
+			t.Fatalf("rewriteCommand(%q): %v", tc.payload, err)
+		}
+		var got string
+		switch cmd.Payload[0] {
+		case comQuery:
+			got = extractDatabaseFromUseCommand(cmd.Payload)
+		case comInitDB:
+			got = string(cmd.Payload[1:])
+		case comChangeUser:
+			request, err := parseChangeUser(cmd.Payload, testClientCapabilities)
+			if err != nil || request.Username != "app" || string(request.AuthResponse) != "scrambled" || request.AuthPlugin != "mysql_native_password" {
+				t.Fatalf("rewritten COM_CHANGE_USER parsed as %+v, %v", request, err)
+			}
+			got = request.Database
+		}
+		if got != tc.want {
+			t.Errorf("rewriteCommand(%q) selects %q, want %q", tc.payload, got, tc.want)
+		}
+	}
+
+	// Other commands are left alone
+	query := append([]byte{comQuery}, "SELECT 1"...)
+	cmd := &Command{Payload: query}
+	if err := namer.rewriteCommand(cmd, testClientCapabilities, logger); err != nil || string(cmd.Payload) != string(query) {
+		t.Fatalf("rewriteCommand(SELECT 1) = %q, %v", cmd.Payload, err)
+	}
+}
+
+func TestRewrittenHandshakeIsAValidPacket(t *testing.T) {
+	payload := testHandshake{user: "app", auth: []byte("scrambled"), database: "orders", attrs: [][2]string{{"program_name", "test"}}}.payload()
+	hr, err := parseHandshakeResponse(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := newPacket(1, withDatabase(payload, hr.databaseOffset, hr.databaseEnd, "pr1234_orders"))
+	wire := packetBytes(packet)
+	if length := int(wire[0]) | int(wire[1])<<8 | int(wire[2])<<16; length != len(payload)+len("pr1234_") || length != len(wire)-4 {
+		t.Fatalf("header gives a length of %d for a payload of %d bytes", length, len(wire)-4)
+	}
+	if wire[3] != 1 {
+		t.Fatalf("sequence ID %d, want 1", wire[3])
+	}
+	rewritten, err := parseHandshakeResponse(wire[4:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rewritten.Database != "pr1234_orders" || rewritten.Username != "app" || string(rewritten.AuthResponse) != "scrambled" ||
+		rewritten.Attributes["program_name"] != "test" || rewritten.CapabilityFlags != hr.CapabilityFlags {
+		t.Fatalf("rewritten handshake parsed as %+v", rewritten)
+	}
+}
+
+func TestDatabaseNamePrefix(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.DBNamePrefix = "pr1234"
+	p, addr := startProxy(t, config)
+
+	c := mustConnect(t, addr, testHandshake{user: "root", database: "orders"})
+	c.mustQuery("USE billing")
+	if response := c.command(append([]byte{comInitDB}, "inventory"...)); response[0].Payload[0] != 0x00 {
+		t.Fatalf("COM_INIT_DB answered with %s", describePacket(response[0]))
+	}
+	for _, name := range []string{"pr1234_orders", "pr1234_billing", "pr1234_inventory"} {
+		if !backend.hasDatabase(name) {
+			t.Fatalf("%s was not created", name)
+		}
+	}
+	if backend.hasDatabase("orders") || backend.hasDatabase("billing") {
+		t.Fatal("a database was created under the client's name")
+	}
+
+	// MySQL receives the prefixed names
+	handshakes := backend.receivedHandshakes()
+	hr, err := parseHandshakeResponse(handshakes[len(handshakes)-1])
+	if err != nil || hr.Database != "pr1234_orders" || hr.Username != "root" {
+		t.Fatalf("MySQL received a handshake parsed as %+v, %v", hr, err)
+	}
+	if !containsString(backend.receivedQueries(), "USE `pr1234_billing`") {
+		t.Fatalf("MySQL received %q", backend.receivedQueries())
+	}
+	if current := p.conns.all()[0].cc.CurrentDB(); current != "pr1234_inventory" {
+		t.Fatalf("the connection has %q selected", current)
+	}
+
+	// Names the prefix makes too long are refused
+	long := strings.Repeat("a", 60)
+	_, response := connect(t, addr, testHandshake{user: "root", database: long})
+	expectErr(t, response, 1102)
+	expectErr(t, c.query("USE "+long), 1102)
+	for _, query := range backend.receivedQueries() {
+		if strings.Contains(query, long) {
+			t.Fatalf("MySQL received %q", query)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+)
+
+// errNameNotAllowed reports a database the name policy does not let the proxy
+// create. The client's command or handshake is still forwarded, so that MySQL
+// reports the database as unknown.
+var errNameNotAllowed = errors.New("database name not allowed by DB_NAME_ALLOW or DB_NAME_DENY")
+
+var namesNotAllowed = newCounter("mysql_autodb_database_names_not_allowed_total",
+	"Database creations skipped because the name is denied or not allowed")
+
+// namePolicy restricts which databases may be created to the names matching
+// an allow pattern, if there are any, and matching no deny pattern. Patterns
+// are regular expressions matched against the whole name.
+type namePolicy struct {
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+// newNamePolicy compiles the DB_NAME_ALLOW and DB_NAME_DENY patterns
+func newNamePolicy(allow, deny []string) (*namePolicy, error) {
+	policy := &namePolicy{}
+	var err error
+	if policy.allow, err = compileNamePatterns("DB_NAME_ALLOW", allow); err != nil {
+		return nil, err
+	}
+	if policy.deny, err = compileNamePatterns("DB_NAME_DENY", deny); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// compileNamePatterns compiles patterns anchored to match whole names
+func compileNamePatterns(option string, patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %w", option, pattern, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// permit returns errNameNotAllowed, logging the reason, if the database may
+// not be created. Deny patterns are checked first.
+func (n *namePolicy) permit(dbName string, logger *logrus.Entry) error {
+	for _, re := range n.deny {
+		if re.MatchString(dbName) {
+			namesNotAllowed.Inc()
+			logger.WithField("pattern", re.String()).Warn("Database name matches a DB_NAME_DENY pattern, not creating it")
+			return errNameNotAllowed
+		}
+	}
+	if len(n.allow) == 0 {
+		return nil
+	}
+	for _, re := range n.allow {
+		if re.MatchString(dbName) {
+			return nil
+		}
+	}
+	namesNotAllowed.Inc()
+	logger.Warn("Database name matches no DB_NAME_ALLOW pattern, not creating it")
+	return errNameNotAllowed
+}
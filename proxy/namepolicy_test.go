@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestNamePolicy(t *testing.T) {
+	logger, hook := testLogger()
+	for _, tc := range []struct {
+		allow, deny []string
+		name        string
+		permitted   bool
+	}{
+		{nil, nil, "anything", true},
+		// Patterns are anchored to the whole name
+		{[]string{"test"}, nil, "test", true},
+		{[]string{"test"}, nil, "mytest_db", false},
+		{[]string{"test"}, nil, "test_db", false},
+		{nil, []string{"tmp"}, "tmp_orders", true},
+		{[]string{"app_.*", "test_.*"}, nil, "test_orders", true},
+		{[]string{"app_.*|test_.*"}, nil, "xapp_orders", false},
+		// Deny wins over an overlapping allow
+		{[]string{"app_.*"}, []string{".*_tmp"}, "app_orders", true},
+		{[]string{"app_.*"}, []string{".*_tmp"}, "app_orders_tmp", false},
+		{[]string{"app_.*"}, []string{".*_tmp"}, "other_tmp", false},
+	} {
+		policy, err := newNamePolicy(tc.allow, tc.deny)
+		if err != nil {
+			t.Fatalf("newNamePolicy: %v", err)
+		}
+		err = policy.permit(tc.name, logger.WithField("database", tc.name))
+		if permitted := err == nil; permitted != tc.permitted || err != nil && !errors.Is(err, errNameNotAllowed) {
+			t.Errorf("allow %q deny %q: permit(%q) = %v", tc.allow, tc.deny, tc.name, err)
+		}
+	}
+
+	// Denials are logged with the pattern that matched
+	policy, _ := newNamePolicy(nil, []string{"scratch_.*"})
+	policy.permit("scratch_1", logger.WithField("database", "scratch_1"))
+	if entry := hook.LastEntry(); entry.Data["pattern"] != "^(?:scratch_.*)$" {
+		t.Fatalf("logged %v", entry.Data)
+	}
+}
+
+func TestInvalidNamePattern(t *testing.T) {
+	config := DefaultConfig()
+	config.DBNameDeny = []string{"ok", "broken("}
+	logger, _ := testLogger()
+	if _, err := newSQLEnsurer(config, logger); err == nil || !strings.Contains(err.Error(), `invalid DB_NAME_DENY pattern "broken("`) {
+		t.Fatalf("newSQLEnsurer: %v", err)
+	}
+}
+
+func TestNotAllowedNamesAreForwarded(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.create("typo_existing")
+	config := testConfig(backend)
+	config.DBNameAllow = []string{"app_.*"}
+	_, addr := startProxy(t, config)
+
+	// The client gets MySQL's own error for a name it may not create
+	_, response := connect(t, addr, testHandshake{user: "root", database: "typo"})
+	expectErr(t, response, 1049)
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	expectErr(t, c.query("USE apps_typo"), 1049)
+	c.mustQuery("USE app_orders")
+	if backend.hasDatabase("typo") || backend.hasDatabase("apps_typo") || !backend.hasDatabase("app_orders") {
+		t.Fatal("databases created regardless of DB_NAME_ALLOW")
+	}
+
+	// Databases that already exist can still be selected, as the proxy only
+	// forwards the command
+	c.mustQuery("USE typo_existing")
+	if err := newTestEnsurer(t, config).EnsureExists(context.Background(), "typo_existing"); !errors.Is(err, errNameNotAllowed) {
+		t.Fatalf("EnsureExists: %v", err)
+	}
+}
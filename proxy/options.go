@@ -0,0 +1,25 @@
+package proxy
+
+import "github.com/sirupsen/logrus"
+
+// Option customizes a Proxy created by New
+type Option func(*Proxy)
+
+// WithLogger makes the proxy log to logger instead of the standard logrus
+// logger
+func WithLogger(logger logrus.FieldLogger) Option {
+	return func(p *Proxy) {
+		p.log = logger
+	}
+}
+
+// WithEnsurer makes the proxy create the databases clients ask for through
+// ensurer instead of over SQL on the MySQL backend. The proxy does not see
+// what ensurer creates: those databases are not announced or recorded, so
+// neither the admin API, EPHEMERAL_DATABASES nor DB_TTL drop them, and
+// CREATE_RATE_LIMIT does not apply.
+func WithEnsurer(ensurer DatabaseEnsurer) Option {
+	return func(p *Proxy) {
+		p.ensurer = ensurer
+	}
+}
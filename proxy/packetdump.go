@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maskedByte stands in a packet dump for a byte that carries credentials
+const maskedByte = "**"
+
+// payloadRedactor returns the part of a payload, from start to end, that a
+// packet dump masks; start == end masks nothing
+type payloadRedactor func(payload []byte) (start, end int)
+
+// redactHandshakeResponse masks the auth response of a handshake response.
+// A handshake that cannot be parsed is masked after its fixed-size fields,
+// since where its auth response ends is not known.
+func redactHandshakeResponse(payload []byte) (int, int) {
+	handshake, err := parseHandshakeResponse(payload)
+	if err != nil {
+		return min(32, len(payload)), len(payload)
+	}
+	return handshake.authOffset, handshake.authEnd
+}
+
+// redactCommand masks all of a COM_CHANGE_USER but its command byte, and
+// leaves other commands as they are
+func redactCommand(payload []byte) (int, int) {
+	if isChangeUserCommand(payload) {
+		return 1, len(payload)
+	}
+	return 0, 0
+}
+
+// redactAuthExchange masks the packets of an authentication exchange after
+// their first byte, which tells an auth switch, more data, OK or ERR apart.
+// OK and ERR carry no credentials and are left as they are.
+func redactAuthExchange(payload []byte) (int, int) {
+	if isOKOrErr(payload) {
+		return 0, 0
+	}
+	return min(1, len(payload)), len(payload)
+}
+
+// redactAll masks a whole payload, such as a client's reply during an
+// authentication exchange
+func redactAll(payload []byte) (int, int) {
+	return 0, len(payload)
+}
+
+// redactedHex encodes a payload as hex with the bytes the redactor picks
+// replaced by maskedByte
+func redactedHex(payload []byte, redact payloadRedactor) string {
+	start, end := redact(payload)
+	var dump strings.Builder
+	dump.Grow(2 * len(payload))
+	dump.WriteString(hex.EncodeToString(payload[:start]))
+	dump.WriteString(strings.Repeat(maskedByte, end-start))
+	dump.WriteString(hex.EncodeToString(payload[end:]))
+	return dump.String()
+}
+
+// withPacketDump adds a packet's payload to a debug line as payload_hex, with
+// its credentials masked, when LOG_PACKET_DUMP is set and debug logging is on
+func (p *Proxy) withPacketDump(logger *logrus.Entry, payload []byte, redact payloadRedactor) *logrus.Entry {
+	if !p.config.LogPacketDump || !logger.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		return logger
+	}
+	return logger.WithField("payload_hex", redactedHex(payload, redact))
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestRedactedHex(t *testing.T) {
+	secret := []byte("s3cr3t-scramble")
+	handshake := testHandshake{user: "app", auth: secret, database: "orders"}.payload()
+	query := append([]byte{comQuery}, "SELECT 1"...)
+
+	for _, tc := range []struct {
+		name    string
+		payload []byte
+		redact  payloadRedactor
+		masked  int
+	}{
+		// The length before the auth response is masked with it
+		{"handshake", handshake, redactHandshakeResponse, 1 + len(secret)},
+		{"unparsable handshake", handshake[:40], redactHandshakeResponse, 8},
+		{"COM_CHANGE_USER", changeUserPayload("app", secret, "orders"), redactCommand, len(changeUserPayload("app", secret, "orders")) - 1},
+		{"query", query, redactCommand, 0},
+		{"auth switch", append([]byte{0xfe}, "mysql_native_password\x00nonce"...), redactAuthExchange, 27},
+		{"OK", []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}, redactAuthExchange, 0},
+		{"auth reply", secret, redactAll, len(secret)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dump := redactedHex(tc.payload, tc.redact)
+			if len(dump) != 2*len(tc.payload) {
+				t.Fatalf("dump of %d characters for %d bytes", len(dump), len(tc.payload))
+			}
+			if masked := strings.Count(dump, maskedByte); masked != tc.masked {
+				t.Fatalf("%d bytes masked, want %d", masked, tc.masked)
+			}
+			if tc.masked > 0 && strings.Contains(dump, hex.EncodeToString(secret[:4])) {
+				t.Fatalf("dump %s shows the auth response", dump)
+			}
+			if start, _ := tc.redact(tc.payload); dump[:2*start] != hex.EncodeToString(tc.payload[:start]) {
+				t.Fatalf("dump %s changes the bytes before the masked ones", dump)
+			}
+		})
+	}
+}
+
+func TestPacketDumps(t *testing.T) {
+	secret := []byte("s3cr3t-scramble")
+	for _, dump := range []bool{false, true} {
+		backend := startFakeMySQL(t)
+		config := testConfig(backend)
+		config.LogPacketDump = dump
+		logger, hook := testLogger()
+		_, addr := startProxy(t, config, WithLogger(logger), WithEnsurer(&recordingEnsurer{backend: backend}))
+
+		c := mustConnect(t, addr, testHandshake{user: "app", auth: secret, database: "orders"})
+		c.command(changeUserPayload("app", secret, "billing"))
+		c.mustQuery("SELECT 1")
+
+		dumped := 0
+		for _, entry := range hook.AllEntries() {
+			if _, ok := entry.Data["payload_hex"]; ok {
+				dumped++
+			}
+			line, _ := entry.String()
+			if strings.Contains(line, hex.EncodeToString(secret)) || strings.Contains(line, string(secret)) {
+				t.Fatalf("logged the auth response in %q", line)
+			}
+		}
+		if dump != (dumped > 0) {
+			t.Fatalf("%d packets dumped with LOG_PACKET_DUMP=%v", dumped, dump)
+		}
+		if !dump {
+			continue
+		}
+
+		// The dumps leave everything but the credentials readable
+		if entry := findEntry(hook, "Parsed database name from handshake"); entry == nil ||
+			!strings.Contains(entry.Data["payload_hex"].(string), hex.EncodeToString([]byte("orders"))) {
+			t.Fatalf("handshake dumped as %v", entry)
+		}
+		var dumps []string
+		for _, entry := range queryEntries(hook, "Read packet from client") {
+			dumps = append(dumps, entry.Data["payload_hex"].(string))
+		}
+		if !containsString(dumps, "11"+strings.Repeat(maskedByte, len(changeUserPayload("app", secret, "billing"))-1)) ||
+			!containsString(dumps, hex.EncodeToString(append([]byte{comQuery}, "SELECT 1"...))) {
+			t.Fatalf("commands dumped as %q", dumps)
+		}
+	}
+}
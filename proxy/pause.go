@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	pausedGauge = newGauge("mysql_autodb_paused",
+		"Whether the proxy is paused and holding new connections (1) or not (0)")
+	pauseQueuedGauge = newGauge("mysql_autodb_pause_queued_connections",
+		"Connections currently held while the proxy is paused")
+)
+
+var (
+	errPauseQueueFull = errors.New("pause queue is full")
+	errPauseTimeout   = errors.New("timed out waiting for the proxy to resume")
+)
+
+// pauseGate holds new connections while the proxy is paused for maintenance
+type pauseGate struct {
+	maxQueued int
+
+	mu      sync.Mutex
+	paused  bool
+	resumed chan struct{}
+	queued  int
+}
+
+// newPauseGate creates an open gate that holds at most maxQueued connections while paused
+func newPauseGate(maxQueued int) *pauseGate {
+	return &pauseGate{maxQueued: maxQueued}
+}
+
+// Pause starts holding new connections
+func (g *pauseGate) Pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.paused {
+		g.paused = true
+		g.resumed = make(chan struct{})
+		pausedGauge.Set(1)
+	}
+}
+
+// Resume releases every held connection
+func (g *pauseGate) Resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.paused {
+		g.paused = false
+		close(g.resumed)
+		pausedGauge.Set(0)
+	}
+}
+
+// State reports whether the gate is paused and how many connections it holds
+func (g *pauseGate) State() (paused bool, queued int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused, g.queued
+}
+
+// Wait blocks while the proxy is paused, for at most timeout. It fails
+// immediately when the queue of held connections is already full.
+func (g *pauseGate) Wait(timeout time.Duration) error {
+	g.mu.Lock()
+	if !g.paused {
+		g.mu.Unlock()
+		return nil
+	}
+	if g.queued >= g.maxQueued {
+		g.mu.Unlock()
+		return errPauseQueueFull
+	}
+	g.queued++
+	pauseQueuedGauge.Add(1)
+	resumed := g.resumed
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		g.queued--
+		pauseQueuedGauge.Add(-1)
+		g.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-resumed:
+		return nil
+	case <-timer.C:
+		return errPauseTimeout
+	}
+}
@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+var preparedSelections = newCounterVec("mysql_autodb_prepared_statements_followed_total",
+	"Prepared statements selecting, creating or dropping a database the proxy followed, by stage", "stage")
+
+// preparedStatement is a statement a client prepared that selects, creates
+// or drops a database, the only ones the proxy follows
+type preparedStatement struct {
+	// query is the statement as the COM_QUERY payload that would run it,
+	// which is what COM_STMT_EXECUTE of the statement is intercepted as
+	query []byte
+}
+
+// preparedStatements are the statements of a connection the proxy follows,
+// by the ID MySQL gave them. The client direction looks them up and closes
+// them, the server direction adds them once MySQL answers the prepare.
+type preparedStatements struct {
+	mu         sync.Mutex
+	statements map[uint32]preparedStatement
+}
+
+// add records a prepared statement under its ID
+func (s *preparedStatements) add(id uint32, statement preparedStatement) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.statements == nil {
+		s.statements = make(map[uint32]preparedStatement)
+	}
+	s.statements[id] = statement
+}
+
+// get returns the followed statement with the given ID
+func (s *preparedStatements) get(id uint32) (preparedStatement, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statement, ok := s.statements[id]
+	return statement, ok
+}
+
+// remove forgets a statement closed by the client
+func (s *preparedStatements) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.statements, id)
+}
+
+// reset forgets every statement, as MySQL does on COM_RESET_CONNECTION and
+// COM_CHANGE_USER
+func (s *preparedStatements) reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statements = nil
+}
+
+// statementID returns the statement ID of a COM_STMT_EXECUTE or
+// COM_STMT_CLOSE payload, or of a COM_STMT_PREPARE_OK answering a prepare
+func statementID(payload []byte) (uint32, bool) {
+	if len(payload) < 5 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(payload[1:5]), true
+}
+
+// followedStatement returns the COM_QUERY equivalent of a statement a
+// COM_STMT_PREPARE payload prepares, if it selects, creates or drops a
+// database
+func followedStatement(payload []byte) ([]byte, bool) {
+	if len(payload) < 2 || payload[0] != comStmtPrepare {
+		return nil, false
+	}
+	query := append([]byte{comQuery}, payload[1:]...)
+	if _, ok := parseSchemaStatement(string(query[1:])); ok || extractDatabaseFromUseCommand(query) != "" {
+		return query, true
+	}
+	return nil, false
+}
+
+// trackStatement follows the prepared statements of a connection: a
+// COM_STMT_PREPARE of a statement that selects, creates or drops a database
+// is remembered until MySQL numbers it, and its database is mapped like that
+// of the same COM_QUERY. It returns the command an executed statement is
+// intercepted as: the COM_QUERY equivalent of a followed statement, and the
+// command itself otherwise. Other binary protocol commands are left as they
+// are.
+func (s *relayState) trackStatement(cc *ConnContext, cmd *Command, logger *logrus.Entry) (*Command, error) {
+	switch cmd.Payload[0] {
+	case comStmtPrepare:
+		query, ok := followedStatement(cmd.Payload)
+		if !ok {
+			return cmd, nil
+		}
+		mapped := &Command{SequenceID: cmd.SequenceID, Payload: query}
+		if err := cc.namer.rewriteCommand(mapped, cc.capabilities, logger); err != nil {
+			return nil, err
+		}
+		cmd.Payload = append([]byte{comStmtPrepare}, mapped.Payload[1:]...)
+		s.pendingPrepare.Store(&preparedStatement{query: mapped.Payload})
+		preparedSelections.Inc("prepare")
+		logger.Debug("Following a prepared statement that changes databases")
+	case comStmtExecute:
+		if id, ok := statementID(cmd.Payload); ok {
+			if statement, ok := s.prepared.get(id); ok {
+				preparedSelections.Inc("execute")
+				logger.WithField("statement_id", id).Debug("Executing a followed prepared statement")
+				return &Command{SequenceID: cmd.SequenceID, Payload: statement.query}, nil
+			}
+		}
+	case comStmtClose:
+		if id, ok := statementID(cmd.Payload); ok {
+			s.prepared.remove(id)
+		}
+	case comResetConnection, comChangeUser:
+		s.prepared.reset()
+	}
+	return cmd, nil
+}
+
+// preparedAnswer records the statement ID MySQL gave a followed prepare, from
+// the first packet answering it. An ERR, such as MySQL's refusal to prepare
+// USE, leaves nothing to follow.
+func (s *relayState) preparedAnswer(statement *preparedStatement, payload []byte, logger *logrus.Entry) {
+	if len(payload) < 12 || payload[0] != 0x00 {
+		return
+	}
+	id, _ := statementID(payload)
+	s.prepared.add(id, *statement)
+	logger.WithField("statement_id", id).Debug("MySQL prepared a followed statement")
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestFollowedStatement(t *testing.T) {
+	for _, tc := range []struct {
+		payload string
+		want    string
+	}{
+		{"\x16USE orders", "\x03USE orders"},
+		{"\x16use `orders`", "\x03use `orders`"},
+		{"\x16CREATE DATABASE IF NOT EXISTS reports", "\x03CREATE DATABASE IF NOT EXISTS reports"},
+		{"\x16DROP SCHEMA reports", "\x03DROP SCHEMA reports"},
+		{"\x16SELECT 'USE orders'", ""},
+		{"\x16INSERT INTO t VALUES (?)", ""},
+		{"\x03USE orders", ""},
+		{"\x16", ""},
+	} {
+		query, ok := followedStatement([]byte(tc.payload))
+		if ok != (tc.want != "") || string(query) != tc.want {
+			t.Errorf("followedStatement(%q) = %q, %v", tc.payload, query, ok)
+		}
+	}
+}
+
+// prepare prepares query on c, returning the statement ID MySQL gave it
+func (c *testClient) prepare(query string) uint32 {
+	c.t.Helper()
+	response := c.command(append([]byte{comStmtPrepare}, query...))
+	id, ok := statementID(response[0].Payload)
+	if !ok || response[0].Payload[0] != 0x00 {
+		c.t.Fatalf("prepare %q answered with %s", query, describePacket(response[0]))
+	}
+	return id
+}
+
+// executePayload builds a COM_STMT_EXECUTE of a statement without parameters
+func executePayload(id uint32) []byte {
+	payload := binary.LittleEndian.AppendUint32([]byte{comStmtExecute}, id)
+	return binary.LittleEndian.AppendUint32(append(payload, 0), 1)
+}
+
+func TestPreparedUseCreatesDatabase(t *testing.T) {
+	backend := startFakeMySQL(t)
+	ensurer := &recordingEnsurer{backend: backend}
+	p, addr := startProxy(t, testConfig(backend), WithEnsurer(ensurer))
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+
+	// Preparing the USE creates nothing, executing it does, once
+	executions := preparedSelections.Value("execute")
+	id := c.prepare("USE newdb")
+	if len(ensurer.requested()) != 0 {
+		t.Fatalf("ensurer asked for %q on prepare", ensurer.requested())
+	}
+	if response := c.command(executePayload(id)); response[0].Payload[0] != 0x00 {
+		t.Fatalf("execute answered with %s", describePacket(response[0]))
+	}
+	if !equalStrings(ensurer.requested(), []string{"newdb"}) {
+		t.Fatalf("ensurer asked for %q", ensurer.requested())
+	}
+	if got := preparedSelections.Value("execute") - executions; got != 1 {
+		t.Fatalf("%d executions followed, want 1", got)
+	}
+	if current := p.conns.all()[0].cc.CurrentDB(); current != "newdb" {
+		t.Fatalf("the connection has %q selected", current)
+	}
+
+	// Other statements are relayed as they are
+	other := c.prepare("SELECT 'USE trap'")
+	c.command(executePayload(other))
+	if len(ensurer.requested()) != 1 {
+		t.Fatalf("ensurer asked for %q", ensurer.requested())
+	}
+
+	// and closed statements are no longer followed
+	closed := c.prepare("USE closed_db")
+	if err := writePacket(c.conn, newPacket(0, binary.LittleEndian.AppendUint32([]byte{comStmtClose}, closed))); err != nil {
+		t.Fatalf("write COM_STMT_CLOSE: %v", err)
+	}
+	expectErr(t, c.command(executePayload(closed))[0], 1049)
+	if len(ensurer.requested()) != 1 {
+		t.Fatalf("ensurer asked for %q after the statement was closed", ensurer.requested())
+	}
+	c.mustQuery("SELECT 1")
+}
+
+func TestPreparedSchemaStatements(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.DBNamePrefix = "pr1234"
+	p, addr := startProxy(t, config)
+	backend.handleCommands(func(s *fakeSession, payload []byte) bool {
+		if payload[0] != comStmtPrepare || !strings.Contains(string(payload), "refused") {
+			return false
+		}
+		s.err(1295, "HY000", "This command is not supported in the prepared statement protocol yet")
+		return true
+	})
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+
+	// Prepared statements are mapped like the same COM_QUERY
+	id := c.prepare("USE billing")
+	if prepared := lastCommand(backend); string(prepared) != "\x16USE `pr1234_billing`" {
+		t.Fatalf("MySQL prepared %q", prepared)
+	}
+	if response := c.command(executePayload(id)); response[0].Payload[0] != 0x00 {
+		t.Fatalf("execute answered with %s", describePacket(response[0]))
+	}
+	if !backend.hasDatabase("pr1234_billing") || backend.hasDatabase("billing") {
+		t.Fatal("the executed USE did not create the mapped database")
+	}
+
+	// and databases created by an executed CREATE DATABASE are registered
+	id = c.prepare("CREATE DATABASE reports")
+	if response := c.command(executePayload(id)); response[0].Payload[0] != 0x00 {
+		t.Fatalf("execute answered with %s", describePacket(response[0]))
+	}
+	if database, ok := p.created.get("reports"); !ok || !database.ClientCreated {
+		t.Fatalf("the executed CREATE DATABASE registered %+v, %v", database, ok)
+	}
+
+	// A prepare MySQL refuses leaves nothing to follow
+	executions := preparedSelections.Value("execute")
+	expectErr(t, c.command(append([]byte{comStmtPrepare}, "USE refused"...))[0], 1295)
+	c.command(executePayload(id + 1))
+	if preparedSelections.Value("execute") != executions || backend.hasDatabase("pr1234_refused") {
+		t.Fatal("a statement MySQL refused to prepare was followed")
+	}
+	c.mustQuery("SELECT 1")
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Version is the proxy's version, set at build time with
+// -ldflags "-X github.com/Ibmurai/mysql-auto-db-proxy/proxy.Version=..."
+var Version = "dev"
+
+// readinessCacheTTL is how long the result of a backend ping answers
+// readiness probes before MySQL is pinged again
+const readinessCacheTTL = 5 * time.Second
+
+// readinessProbe pings the MySQL backend for readiness probes, caching the
+// result so that frequent probes do not each open a connection to MySQL
+type readinessProbe struct {
+	db *sql.DB
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+// newReadinessProbe creates a probe of the configured backend
+func newReadinessProbe(config Config) (*readinessProbe, error) {
+	dsn, err := adminDSN(config)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	return &readinessProbe{db: db}, nil
+}
+
+// check returns the result of the last ping, pinging MySQL again once it is
+// older than readinessCacheTTL
+func (r *readinessProbe) check(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.checkedAt.IsZero() && time.Since(r.checkedAt) < readinessCacheTTL {
+		return r.err
+	}
+	pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	r.err = r.db.PingContext(pingCtx)
+	r.checkedAt = time.Now()
+	return r.err
+}
+
+// probesHandler returns the HTTP handler for the health and readiness probes
+func (p *Proxy) probesHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", p.handleHealthz)
+	mux.HandleFunc("/readyz", p.handleReadyz)
+	return mux
+}
+
+// serveProbes runs the probes HTTP server until Shutdown stops it or it fails
+func (p *Proxy) serveProbes(addr string) {
+	server := newHTTPServer(addr, p.probesHandler())
+	if !p.trackServer(server) {
+		return
+	}
+
+	p.log.WithField("health_addr", addr).Info("Health probes listening")
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		p.log.WithError(err).Error("Health probes stopped")
+	}
+}
+
+// handleHealthz reports whether the proxy is listening for connections
+func (p *Proxy) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	p.listenersMu.Lock()
+	listening := len(p.listeners) > 0
+	p.listenersMu.Unlock()
+
+	if !listening {
+		p.writeProbe(w, http.StatusServiceUnavailable, "not listening")
+		return
+	}
+	p.writeProbe(w, http.StatusOK, "")
+}
+
+// handleReadyz reports whether the proxy can relay connections to MySQL
+func (p *Proxy) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if p.closing.Load() {
+		p.writeProbe(w, http.StatusServiceUnavailable, "shutting down")
+		return
+	}
+	if err := p.readiness.check(r.Context()); err != nil {
+		p.writeProbe(w, http.StatusServiceUnavailable, "MySQL backend is unreachable: "+err.Error())
+		return
+	}
+	p.writeProbe(w, http.StatusOK, "")
+}
+
+// writeProbe writes a probe response, with the proxy's version and uptime
+func (p *Proxy) writeProbe(w http.ResponseWriter, status int, problem string) {
+	body := map[string]interface{}{
+		"status":         "ok",
+		"version":        Version,
+		"uptime":         time.Since(p.startedAt).Round(time.Second).String(),
+		"uptime_seconds": int64(time.Since(p.startedAt).Seconds()),
+	}
+	if problem != "" {
+		body["status"] = "unavailable"
+		body["error"] = problem
+	}
+	writeJSON(w, status, body)
+}
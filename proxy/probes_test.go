@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProbesListenApartFromAdmin(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.ListenAddress = "127.0.0.1"
+	config.ProxyPort = 0
+	config.StartupWait = 0
+	config.ShutdownTimeout = time.Second
+	config.AdminPort, config.HealthPort = unusedPort(t), unusedPort(t)
+	logger, hook := testLogger()
+	p, err := New(config, WithLogger(logger), WithEnsurer(&recordingEnsurer{backend: backend}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.ListenAndServe(ctx) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The probes listen on all interfaces, for the kubelet, while the admin
+	// API stays on METRICS_LISTEN_ADDRESS
+	health := getPage(t, net.JoinHostPort("127.0.0.1", strconv.Itoa(config.HealthPort)), "/healthz")
+	if health == "" {
+		t.Fatal("/healthz answered without a body")
+	}
+	if entry := findEntry(hook, "Health probes listening"); entry == nil || entry.Data["health_addr"] != ":"+strconv.Itoa(config.HealthPort) {
+		t.Fatalf("probes listening as %v", entry)
+	}
+	eventually(t, "the admin API to listen", func() bool { return findEntry(hook, "Admin API listening") != nil })
+	if entry := findEntry(hook, "Admin API listening"); entry == nil || entry.Data["admin_addr"] != "127.0.0.1:"+strconv.Itoa(config.AdminPort) {
+		t.Fatalf("admin API listening as %v", entry)
+	}
+}
+
+// probe requests path from the probes handler, returning the status and the
+// decoded JSON body
+func probe(t *testing.T, p *Proxy, path string) (int, map[string]interface{}) {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	p.probesHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Fatalf("%s answered with %s", path, contentType)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s answered %q: %v", path, recorder.Body, err)
+	}
+	if body["version"] != Version || body["uptime"] == nil || body["uptime_seconds"] == nil {
+		t.Fatalf("%s answered %v", path, body)
+	}
+	return recorder.Code, body
+}
+
+func TestProbes(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.HealthPort = unusedPort(t)
+	logger, _ := testLogger()
+	p, err := New(config, WithLogger(logger), WithEnsurer(&recordingEnsurer{backend: backend}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// The proxy is healthy once it listens
+	if status, body := probe(t, p, "/healthz"); status != http.StatusServiceUnavailable || body["status"] != "unavailable" || body["error"] != "not listening" {
+		t.Fatalf("/healthz before listening answered %d %v", status, body)
+	}
+	serveProxy(t, p)
+	eventually(t, "the proxy to be healthy", func() bool {
+		status, body := probe(t, p, "/healthz")
+		return status == http.StatusOK && body["status"] == "ok" && body["error"] == nil
+	})
+
+	// but only ready while MySQL answers
+	backend.stop()
+	status, body := probe(t, p, "/readyz")
+	if message, _ := body["error"].(string); status != http.StatusServiceUnavailable || body["status"] != "unavailable" ||
+		!strings.HasPrefix(message, "MySQL backend is unreachable: ") {
+		t.Fatalf("/readyz with MySQL down answered %d %v", status, body)
+	}
+	if status, _ := probe(t, p, "/healthz"); status != http.StatusOK {
+		t.Fatalf("/healthz with MySQL down answered %d", status)
+	}
+
+	// The result of a ping answers probes for readinessCacheTTL
+	expire := func() {
+		p.readiness.mu.Lock()
+		p.readiness.checkedAt = time.Now().Add(-readinessCacheTTL)
+		p.readiness.mu.Unlock()
+	}
+	backend.restart()
+	if status, _ := probe(t, p, "/readyz"); status != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz answered %d within readinessCacheTTL", status)
+	}
+	expire()
+	if status, body := probe(t, p, "/readyz"); status != http.StatusOK || body["status"] != "ok" || body["error"] != nil {
+		t.Fatalf("/readyz once MySQL is back answered %d %v", status, body)
+	}
+	pings := func() (n int) {
+		for _, command := range backend.receivedCommands() {
+			if command[0] == 0x0e {
+				n++
+			}
+		}
+		return n
+	}
+	before := pings()
+	probe(t, p, "/readyz")
+	if pings() != before {
+		t.Fatal("a probe within readinessCacheTTL pinged MySQL")
+	}
+	expire()
+	probe(t, p, "/readyz")
+	if pings() != before+1 {
+		t.Fatalf("%d pings once the cached result expired", pings()-before)
+	}
+
+	// Shutting down, the proxy is neither
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	p.Shutdown(ctx)
+	if status, body := probe(t, p, "/readyz"); status != http.StatusServiceUnavailable || body["error"] != "shutting down" {
+		t.Fatalf("/readyz after Shutdown answered %d %v", status, body)
+	}
+	if status, _ := probe(t, p, "/healthz"); status != http.StatusServiceUnavailable {
+		t.Fatalf("/healthz after Shutdown answered %d", status)
+	}
+}
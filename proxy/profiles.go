@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// profiles are bundles of defaults for the environments the proxy typically
+// runs in, selected with --profile. They are written as the environment
+// variables they stand for and are applied over the built-in defaults, so
+// environment variables still override them.
+var profiles = map[string]map[string]string{
+	// dev is lenient: verbose, readable logs, and reserved databases in the handshake
+	// are left for MySQL to judge
+	"dev": {
+		"LOG_LEVEL":               "debug",
+		"LOG_FORMAT":              "text",
+		"CREATE_FROM_FIELD_LIST":  "true",
+		"DENIED_HANDSHAKE_ACTION": "passthrough",
+		"LOG_CLIENT_DRIVER":       "true",
+	},
+
+	// ci favours fast, deterministic runs: readiness only once MySQL is up,
+	// databases dropped once the test run that created them disconnects,
+	// only strictly named databases created, a guard against runaway test
+	// suites and a short shutdown
+	"ci": {
+		"LOG_LEVEL":                  "info",
+		"READY_WAIT_FOR_BACKEND":     "true",
+		"EPHEMERAL_DATABASES":        "true",
+		"STRICT_DB_NAMES":            "true",
+		"MAX_CREATES_PER_CONNECTION": "100",
+		"SHUTDOWN_TIMEOUT":           "5s",
+		"USE_PASSTHROUGH_PATTERNS":   "information_schema,performance_schema",
+	},
+
+	// staging behaves like a shared server: idle connections are cleaned up,
+	// sessions are tagged for DBAs and creations per connection are capped
+	"staging": {
+		"LOG_LEVEL":                  "info",
+		"IDLE_TIMEOUT":               "8h",
+		"IDLE_KEEPALIVE_PING":        "5m",
+		"TAG_CONNECTIONS":            "true",
+		"MAX_CREATES_PER_CONNECTION": "10",
+		"CLOSE_ON_BACKEND_UNHEALTHY": "true",
+	},
+}
+
+// profileValues returns the values of a profile, or an error naming the known
+// profiles
+func profileValues(name string) (map[string]string, error) {
+	values, ok := profiles[name]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown profile %q (available: %s)", name, strings.Join(names, ", "))
+	}
+	return values, nil
+}
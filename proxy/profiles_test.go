@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProfilesLoad(t *testing.T) {
+	known := make(map[string]bool, len(configOptions))
+	for _, option := range configOptions {
+		known[option.env] = true
+	}
+	for name, values := range profiles {
+		for env := range values {
+			if !known[env] {
+				t.Errorf("profile %s sets unknown option %s", name, env)
+			}
+		}
+		if _, provenance, err := LoadConfig(name, "", nil); err != nil {
+			t.Errorf("profile %s: %v", name, err)
+		} else if provenance["LogLevel"] != sourceProfile {
+			t.Errorf("profile %s: LogLevel set by %s", name, provenance["LogLevel"])
+		}
+	}
+}
+
+func TestProfileDefaults(t *testing.T) {
+	ci, _, err := LoadConfig("ci", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ci.EphemeralDatabases || !ci.StrictDBNames || ci.MaxCreatesPerConnection != 100 || ci.ShutdownTimeout != 5*time.Second {
+		t.Fatalf("ci profile loaded as %+v", ci)
+	}
+	if !equalStrings(ci.UsePassthroughPatterns, []string{"information_schema", "performance_schema"}) {
+		t.Fatalf("ci passes through %q", ci.UsePassthroughPatterns)
+	}
+
+	dev, _, err := LoadConfig("dev", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dev.LogLevel != "debug" || dev.DeniedHandshakeAction != "passthrough" || !dev.CreateFromFieldList {
+		t.Fatalf("dev profile loaded as %+v", dev)
+	}
+
+	staging, _, err := LoadConfig("staging", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if staging.IdleTimeout != 8*time.Hour || !staging.TagConnections || !staging.CloseOnBackendUnhealthy {
+		t.Fatalf("staging profile loaded as %+v", staging)
+	}
+
+	// Options a profile does not set keep their defaults
+	if ci.ProxyPort != defaultConfig.ProxyPort || staging.EphemeralDatabases {
+		t.Fatal("a profile changed options it does not set")
+	}
+}
+
+func TestProfilePrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.yaml")
+	if err := os.WriteFile(path, []byte("max_creates_per_connection: 7\nlimits:\n  shutdown_timeout: 20s\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SHUTDOWN_TIMEOUT", "30s")
+	t.Setenv("STRICT_DB_NAMES", "false")
+
+	config, provenance, err := LoadConfig("ci", path, map[string]string{"STRICT_DB_NAMES": "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for field, want := range map[string]configSource{
+		"EphemeralDatabases":      sourceProfile,
+		"MaxCreatesPerConnection": sourceFile,
+		"ShutdownTimeout":         sourceEnv,
+		"StrictDBNames":           sourceFlag,
+		"ProxyPort":               sourceDefault,
+	} {
+		if provenance[field] != want {
+			t.Errorf("%s set by %s, want %s", field, provenance[field], want)
+		}
+	}
+	if !config.EphemeralDatabases || config.MaxCreatesPerConnection != 7 || config.ShutdownTimeout != 30*time.Second || !config.StrictDBNames {
+		t.Fatalf("loaded %+v", config)
+	}
+}
+
+func TestUnknownProfile(t *testing.T) {
+	_, _, err := LoadConfig("prod", "", nil)
+	if err == nil || !strings.Contains(err.Error(), `unknown profile "prod" (available: ci, dev, staging)`) {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+}
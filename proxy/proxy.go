@@ -0,0 +1,1979 @@
+// Package proxy implements a MySQL Auto DB proxy that automatically creates
+// databases when clients connect to them. This is designed for development and
+// testing environments where you need to automatically provision databases for
+// multiple services.
+//
+// The proxy intercepts MySQL connections, extracts the requested database name
+// from the handshake, creates the database if it doesn't exist, and then
+// forwards the connection to the real MySQL server.
+//
+// A proxy is created with New from a Config, usually loaded with LoadConfig,
+// and serves clients with ListenAndServe, or Serve on a listener of the
+// caller's, until Shutdown.
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/sirupsen/logrus"
+)
+
+// maxPacketPayload is the largest payload a single packet carries; longer
+// payloads continue in the packets that follow
+const maxPacketPayload = 0xffffff
+
+// MySQLPacket represents a MySQL protocol packet
+type MySQLPacket struct {
+	Length     int
+	SequenceID int
+	Payload    []byte
+
+	// FullPacket is the packet as read, headers included. A single packet
+	// shares its payload with Payload. It is nil for packets framed by
+	// newPacket, whose headers are only built when the packet is written.
+	FullPacket []byte
+
+	// Packets is the number of physical packets a reassembled packet was
+	// received in (0 or 1 for a single packet)
+	Packets int
+}
+
+// errPacketTooLarge is returned when a reassembled packet exceeds its limit
+var errPacketTooLarge = errors.New("packet too large")
+
+// readPacket reads a complete MySQL packet from the connection
+func readPacket(conn net.Conn) (*MySQLPacket, error) {
+	return readPacketWithTimeout(conn, 0)
+}
+
+// readPacketWithTimeout reads a complete MySQL packet from the connection with a timeout
+func readPacketWithTimeout(conn net.Conn, timeout time.Duration) (*MySQLPacket, error) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{}) // Clear deadline
+	}
+
+	header, err := readPacketHeader(conn)
+	if err != nil {
+		return nil, err
+	}
+	return readPacketPayload(conn, header)
+}
+
+// readPacketBefore reads a complete MySQL packet within timeout, and no later
+// than deadline, the deadline the caller set on the connection, which it is
+// left with again afterwards (a zero deadline means none)
+func readPacketBefore(conn net.Conn, timeout time.Duration, deadline time.Time) (*MySQLPacket, error) {
+	readDeadline := time.Now().Add(timeout)
+	if !deadline.IsZero() {
+		readDeadline = earliest(readDeadline, deadline)
+	}
+	conn.SetReadDeadline(readDeadline)
+	defer conn.SetReadDeadline(deadline)
+	return readPacket(conn)
+}
+
+// readPacketHeader reads the header of the next packet (3 bytes length + 1
+// byte sequence ID)
+func readPacketHeader(conn net.Conn) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("failed to read packet header: %w", err)
+	}
+	return header, nil
+}
+
+// parsePacketHeader returns the payload length and sequence ID of a packet header
+func parsePacketHeader(header []byte) (length, sequenceID int) {
+	return int(header[0]) | int(header[1])<<8 | int(header[2])<<16, int(header[3])
+}
+
+// readPacketPayload reads the payload of the packet whose header has been
+// read, after the header in a single buffer
+func readPacketPayload(conn net.Conn, header []byte) (*MySQLPacket, error) {
+	packetLength, _ := parsePacketHeader(header)
+	fullPacket := make([]byte, 4+packetLength)
+	copy(fullPacket, header)
+	packet, err := readPacketInto(conn, fullPacket)
+	if err != nil {
+		return nil, err
+	}
+	return &packet, nil
+}
+
+// readPacketInto reads the payload of the packet whose header starts buf,
+// which must have room for it
+func readPacketInto(conn net.Conn, buf []byte) (MySQLPacket, error) {
+	packetLength, sequenceID := parsePacketHeader(buf)
+	if _, err := io.ReadFull(conn, buf[4:4+packetLength]); err != nil {
+		return MySQLPacket{}, fmt.Errorf("failed to read packet payload: %w", err)
+	}
+	return MySQLPacket{
+		Length:     packetLength,
+		SequenceID: sequenceID,
+		Payload:    buf[4 : 4+packetLength],
+		FullPacket: buf[:4+packetLength],
+	}, nil
+}
+
+// readLogicalPacket reads the packet whose header has been read together with
+// the continuation packets of a payload longer than maxPacketPayload, aborting
+// with errPacketTooLarge once the reassembled payload exceeds maxBytes (0 means
+// no limit)
+func readLogicalPacket(conn net.Conn, header []byte, maxBytes int) (*MySQLPacket, error) {
+	first, err := readPacketPayload(conn, header)
+	if err != nil {
+		return nil, err
+	}
+	first.Packets = 1
+	if first.Length < maxPacketPayload {
+		return first, nil
+	}
+
+	packet := &MySQLPacket{
+		SequenceID: first.SequenceID,
+		Payload:    first.Payload,
+		FullPacket: first.FullPacket,
+		Packets:    1,
+	}
+	for last := first; last.Length == maxPacketPayload; packet.Packets++ {
+		if maxBytes > 0 && len(packet.Payload) > maxBytes-maxPacketPayload {
+			return nil, fmt.Errorf("%w: payload exceeds %d bytes", errPacketTooLarge, maxBytes)
+		}
+		if last, err = readPacket(conn); err != nil {
+			return nil, err
+		}
+		packet.Payload = append(packet.Payload, last.Payload...)
+		packet.FullPacket = append(packet.FullPacket, last.FullPacket...)
+	}
+	packet.Length = len(packet.Payload)
+	return packet, nil
+}
+
+// writePacket writes a MySQL packet to the connection
+func writePacket(conn net.Conn, packet *MySQLPacket) error {
+	if err := packet.writeTo(conn); err != nil {
+		return fmt.Errorf("failed to write packet: %w", err)
+	}
+	return nil
+}
+
+// writeTo writes the packet as is when it was read, or else its headers and
+// payload in a single writev where the connection supports it, without
+// copying the payload
+func (p *MySQLPacket) writeTo(conn net.Conn) error {
+	if p.FullPacket != nil {
+		_, err := conn.Write(p.FullPacket)
+		return err
+	}
+	frames := p.frames()
+	_, err := frames.WriteTo(conn)
+	return err
+}
+
+// frames returns the header of each physical packet of a packet framed by
+// newPacket, followed by its part of the payload
+func (p *MySQLPacket) frames() net.Buffers {
+	headers := make([]byte, 4*p.Packets)
+	frames := make(net.Buffers, 0, 2*p.Packets)
+	rest := p.Payload
+	for i := 0; i < p.Packets; i++ {
+		n := min(len(rest), maxPacketPayload)
+		header := headers[4*i : 4*i+4]
+		header[0], header[1], header[2], header[3] = byte(n), byte(n>>8), byte(n>>16), byte(p.SequenceID+i)
+		frames = append(frames, header, rest[:n])
+		rest = rest[n:]
+	}
+	return frames
+}
+
+// wireLength is the number of bytes the packet takes on the wire
+func (p *MySQLPacket) wireLength() int {
+	if p.FullPacket != nil {
+		return len(p.FullPacket)
+	}
+	return len(p.Payload) + 4*p.Packets
+}
+
+// newPacket frames a payload as a MySQL packet, splitting payloads of
+// maxPacketPayload bytes or more across continuation packets. The payload is
+// not copied.
+func newPacket(sequenceID int, payload []byte) *MySQLPacket {
+	return &MySQLPacket{
+		Length:     len(payload),
+		SequenceID: sequenceID,
+		Payload:    payload,
+		Packets:    len(payload)/maxPacketPayload + 1,
+	}
+}
+
+// parseUsername extracts the username from a MySQL client handshake packet
+func parseUsername(packet *MySQLPacket) string {
+	if len(packet.Payload) < 32 {
+		return ""
+	}
+
+	// The null-terminated username follows the 32 fixed-size bytes of the handshake
+	end := 32
+	for end < len(packet.Payload) && packet.Payload[end] != 0 {
+		end++
+	}
+	return string(packet.Payload[32:end])
+}
+
+// parseDatabaseName extracts the database name from a MySQL client handshake
+// packet. The capability flags decide which fields are present, so the name is
+// only found when the client set CLIENT_CONNECT_WITH_DB.
+func parseDatabaseName(packet *MySQLPacket, logger *logrus.Entry) string {
+	handshake, err := parseHandshakeResponse(packet.Payload)
+	if err != nil {
+		logger.WithError(err).WithField("payload_length", len(packet.Payload)).Debug("Failed to parse handshake response")
+		return ""
+	}
+	if handshake.CapabilityFlags&clientConnectWithDB == 0 {
+		logger.Debug("Handshake does not select a database")
+		return ""
+	}
+	return handshake.Database
+}
+
+// min returns the minimum of two integers
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// earliest returns the earlier of two times
+func earliest(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// forwardWithUseInterception forwards commands from client to MySQL, running
+// each through the enabled interceptors first, until the client goes away or
+// the connection is closed. It returns why it stopped.
+func (p *Proxy) forwardWithUseInterception(ctx context.Context, clientConn, mysqlConn net.Conn, state *relayState, logger *logrus.Entry) string {
+	logger.Debug("Starting forwardWithUseInterception")
+	if state.shadow != nil {
+		defer state.shadow.close()
+	}
+	reader := p.newPacketReader(clientConn)
+	defer reader.release()
+	for {
+		header, err := reader.readHeader()
+		if err == nil {
+			// Only commands start at sequence ID 0. Other packets, such as the
+			// file contents of a LOAD DATA LOCAL INFILE, are never intercepted
+			// and are streamed to MySQL instead of being buffered whole.
+			if length, seq := parsePacketHeader(header); seq != 0 && state.shadow == nil {
+				state.checkSequence("client", seq, 1, logger)
+				if err := state.streamToServer(mysqlConn, clientConn, header, length); err != nil {
+					logger.WithError(err).Error("Error streaming packet to MySQL, closing connection")
+					mysqlConn.Close()
+					return "mysql_write_failed"
+				}
+				continue
+			}
+		}
+		var packet *MySQLPacket
+		if err == nil {
+			packet, err = reader.readLogicalPayload(p.config.MaxReassembledPacketBytes)
+		}
+		if err != nil {
+			if errors.Is(err, errPacketTooLarge) {
+				logger.WithError(err).Warn("Client sent a packet over MAX_REASSEMBLED_PACKET_BYTES, closing connection")
+				state.clientWriteMu.Lock()
+				p.writeErrPacket(clientConn, 0, errCategoryPacketTooLarge, "got a packet bigger than MAX_REASSEMBLED_PACKET_BYTES")
+				state.clientWriteMu.Unlock()
+				mysqlConn.Close()
+				return "packet_too_large"
+			}
+			switch {
+			case errors.Is(err, io.EOF):
+				logger.Debug("Client closed connection (EOF)")
+				return "client_closed"
+			case errors.Is(err, net.ErrClosed):
+				// Closed once MySQL went away, or by the proxy itself
+				logger.Debug("Stopped reading from the closed client connection")
+				return "closed"
+			default:
+				logger.WithError(err).Error("Error reading from client")
+				return "client_read_failed"
+			}
+		}
+		redact := payloadRedactor(redactCommand)
+		if state.authenticating.Load() {
+			redact = redactAll
+		}
+		p.withPacketDump(logger.WithField("bytes_read", len(packet.FullPacket)), packet.Payload, redact).
+			Debug("Read packet from client")
+
+		state.checkSequence("client", packet.SequenceID, packet.Packets, logger)
+
+		// Neither an empty packet, which ends the file sent for a LOAD DATA
+		// LOCAL INFILE or carries an empty auth response, nor a reply of the
+		// client's during an authentication exchange is a command, so both are
+		// relayed without being intercepted
+		cmd := &Command{SequenceID: packet.SequenceID, Payload: packet.Payload}
+		isCommand := len(cmd.Payload) > 0 && !state.authenticating.Load()
+		if isCommand {
+			// An executed prepared statement that changes databases is
+			// intercepted as the COM_QUERY that runs the statement, while the
+			// COM_STMT_EXECUTE itself is forwarded
+			intercepted := cmd
+			err := connContextFrom(ctx).namer.rewriteCommand(cmd, connContextFrom(ctx).capabilities, logger)
+			if err == nil {
+				intercepted, err = state.trackStatement(connContextFrom(ctx), cmd, logger)
+			}
+			if err == nil {
+				err = p.checkDatabaseRoute(connContextFrom(ctx), intercepted.Payload)
+			}
+			if err == nil {
+				err = p.interceptCommand(ctx, intercepted, logger)
+			}
+			if err != nil {
+				// A refused prepare is never answered by MySQL
+				state.pendingPrepare.Store(nil)
+				state.clientWriteMu.Lock()
+				p.writeErrPacket(clientConn, nextSequenceID(packet.lastSequenceID()), errorCategoryOf(err), err.Error())
+				state.clientWriteMu.Unlock()
+				continue
+			}
+			state.trackDatabaseChange(connContextFrom(ctx), intercepted.Payload, logger)
+			if p.config.AutoCreateOn1049 && !p.config.DryRun && (isUseCommand(intercepted.Payload) || isInitDBCommand(intercepted.Payload)) {
+				retry := append([]byte(nil), intercepted.Payload...)
+				state.pendingRetry.Store(&retry)
+			}
+
+			// MySQL may answer COM_CHANGE_USER with an auth switch, starting a
+			// new authentication exchange
+			if isChangeUserCommand(cmd.Payload) {
+				state.authenticating.Store(true)
+				logger.Debug("COM_CHANGE_USER started an authentication exchange")
+			}
+		}
+
+		// Forward the packet to MySQL
+		if isCommand && packet.SequenceID == 0 {
+			state.queryInFlight.Store(cmd.Payload[0] == comQuery)
+		}
+		forwarded := packet
+		if !bytes.Equal(cmd.Payload, packet.Payload) || cmd.SequenceID != packet.SequenceID {
+			forwarded = newPacket(cmd.SequenceID, cmd.Payload)
+		}
+		err = state.writeToServer(mysqlConn, forwarded)
+		if err != nil {
+			logger.WithError(err).Error("Error writing to MySQL, closing connection")
+			mysqlConn.Close()
+			return "mysql_write_failed"
+		}
+		logger.WithField("bytes_written", forwarded.wireLength()).Debug("Forwarded packet to MySQL")
+		if isCommand && packet.SequenceID == 0 {
+			state.queryLog.sent(connContextFrom(ctx), cmd.Payload, logger)
+		}
+
+		// The mirror is written asynchronously, after the buffer the command
+		// was read into has been reused
+		if state.shadow != nil {
+			state.shadow.mirror(newPacket(cmd.SequenceID, append([]byte(nil), cmd.Payload...)))
+		}
+	}
+}
+
+// isUseCommand checks if a command payload is a COM_QUERY containing a USE statement
+func isUseCommand(data []byte) bool {
+	if len(data) < 1 || data[0] != comQuery {
+		return false
+	}
+	query := strings.TrimLeft(string(data[1:]), sqlWhitespace)
+	return len(query) > 3 && strings.EqualFold(query[:3], "USE") &&
+		(strings.IndexByte(sqlWhitespace, query[3]) >= 0 || query[3] == '`')
+}
+
+// extractDatabaseFromUseCommand extracts the database name from a USE command
+func extractDatabaseFromUseCommand(data []byte) string {
+	if !isUseCommand(data) {
+		return ""
+	}
+	return parseUseStatement(string(data[1:]))
+}
+
+// sqlWhitespace is the set of characters MySQL treats as whitespace between tokens
+const sqlWhitespace = " \t\r\n\f\v"
+
+// parseUseStatement extracts the target of a "USE name" statement. The name may
+// be backtick-quoted, and may be followed by whitespace, a single semicolon and
+// "-- ", "#" or "/* */" comments; anything else after the name means the
+// statement is not a plain USE and "" is returned.
+func parseUseStatement(query string) string {
+	rest := strings.TrimLeft(query, sqlWhitespace)
+	if len(rest) < 4 || !strings.EqualFold(rest[:3], "USE") {
+		return ""
+	}
+	name, rest := parseIdentifier(strings.TrimLeft(rest[3:], sqlWhitespace))
+	if name == "" || !isStatementEnd(rest) {
+		return ""
+	}
+	return name
+}
+
+// parseIdentifier splits the identifier at the start of rest from what
+// follows it. The identifier may be backtick-quoted, where a doubled backtick
+// stands for a backtick; an unterminated quoted identifier gives "".
+func parseIdentifier(rest string) (string, string) {
+	if !strings.HasPrefix(rest, "`") {
+		end := 0
+		for end < len(rest) && strings.IndexByte(sqlWhitespace+";#\x00", rest[end]) < 0 &&
+			!strings.HasPrefix(rest[end:], "/*") && !strings.HasPrefix(rest[end:], "--") {
+			end++
+		}
+		return rest[:end], rest[end:]
+	}
+
+	var b strings.Builder
+	for i := 1; i < len(rest); i++ {
+		if rest[i] == '`' {
+			if i+1 < len(rest) && rest[i+1] == '`' {
+				b.WriteByte('`')
+				i++
+				continue
+			}
+			return b.String(), rest[i+1:]
+		}
+		b.WriteByte(rest[i])
+	}
+	return "", rest
+}
+
+// isStatementEnd reports whether the remainder of a statement is only
+// whitespace, comments and an optional terminating semicolon. Anything after
+// the semicolon belongs to the next statement of a multi-statement query.
+func isStatementEnd(rest string) bool {
+	for {
+		rest = strings.TrimLeft(rest, sqlWhitespace+"\x00")
+		switch {
+		case rest == "", rest[0] == ';':
+			return true
+		case strings.HasPrefix(rest, "#"), strings.HasPrefix(rest, "-- "), rest == "--",
+			strings.HasPrefix(rest, "--\t"), strings.HasPrefix(rest, "--\n"), strings.HasPrefix(rest, "--\r"):
+			newline := strings.IndexByte(rest, '\n')
+			if newline < 0 {
+				return true
+			}
+			rest = rest[newline+1:]
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest[2:], "*/")
+			if end < 0 {
+				return false
+			}
+			rest = rest[2+end+2:]
+		default:
+			return false
+		}
+	}
+}
+
+// isInitDBCommand checks if a command payload is a COM_INIT_DB command, which
+// drivers send to select a database instead of a USE statement
+func isInitDBCommand(data []byte) bool {
+	return len(data) > 1 && data[0] == comInitDB
+}
+
+// isFieldListCommand checks if a command payload is a COM_FIELD_LIST command
+func isFieldListCommand(data []byte) bool {
+	return len(data) > 1 && data[0] == comFieldList
+}
+
+// isChangeUserCommand checks if a command payload is a COM_CHANGE_USER
+func isChangeUserCommand(data []byte) bool {
+	return len(data) > 0 && data[0] == comChangeUser
+}
+
+// extractDatabaseFromFieldList extracts the database from a database-qualified
+// COM_FIELD_LIST table reference ("db.table"), returning "" for bare table names
+func extractDatabaseFromFieldList(data []byte) string {
+	if !isFieldListCommand(data) {
+		return ""
+	}
+
+	// The table name is null-terminated and followed by the field wildcard
+	payload := data[1:]
+	end := 0
+	for end < len(payload) && payload[end] != 0 {
+		end++
+	}
+	table := string(payload[:end])
+
+	dot := strings.IndexByte(table, '.')
+	if dot <= 0 {
+		return ""
+	}
+	return strings.Trim(table[:dot], "`")
+}
+
+// maxDatabaseNameLength is the longest identifier MySQL accepts, in characters
+const maxDatabaseNameLength = 64
+
+// reservedDatabases are MySQL's system schemas, which the proxy never creates
+var reservedDatabases = []string{"information_schema", "mysql", "performance_schema", "sys"}
+
+// strictDatabaseName is the conservative character set STRICT_DB_NAMES allows
+var strictDatabaseName = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// validateDatabaseName ensures the database name is safe to create. Strict
+// names may only use letters, digits, underscores and hyphens; otherwise any
+// name MySQL accepts as a quoted identifier is allowed.
+func validateDatabaseName(dbName string, strict bool) error {
+	if dbName == "" {
+		return newProxyError(errCategoryValidation, "database name cannot be empty")
+	}
+
+	for _, reserved := range reservedDatabases {
+		if strings.EqualFold(dbName, reserved) {
+			return newProxyError(errCategoryReserved, "database name '%s' is not allowed", dbName)
+		}
+	}
+
+	if utf8.RuneCountInString(dbName) > maxDatabaseNameLength {
+		return newProxyError(errCategoryValidation, "database name '%s' is longer than %d characters", dbName, maxDatabaseNameLength)
+	}
+
+	if strict {
+		if !strictDatabaseName.MatchString(dbName) {
+			return newProxyError(errCategoryValidation, "database name '%s' contains invalid characters", dbName)
+		}
+		return nil
+	}
+
+	// MySQL rejects NUL and characters outside the Basic Multilingual Plane
+	// in identifiers, and names ending with a space
+	if !utf8.ValidString(dbName) {
+		return newProxyError(errCategoryValidation, "database name '%s' is not valid UTF-8", dbName)
+	}
+	for _, r := range dbName {
+		if r == 0 || r > 0xffff {
+			return newProxyError(errCategoryValidation, "database name '%s' contains invalid characters", dbName)
+		}
+	}
+	if strings.HasSuffix(dbName, " ") {
+		return newProxyError(errCategoryValidation, "database name '%s' ends with a space", dbName)
+	}
+	return nil
+}
+
+// quoteIdentifier quotes a name for use in SQL, doubling any backticks in it
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// Proxy holds the configuration and backend state shared by all connections
+type Proxy struct {
+	// AcceptHook, if set, runs as soon as a connection is accepted (and, without
+	// PROXY_PROTOCOL, allowed by ALLOWED_CLIENTS), before any MySQL protocol
+	// bytes are exchanged. It sees the raw accepted connection, so it runs
+	// before PROXY protocol parsing and before any TLS upgrade, and RemoteAddr
+	// is the immediate TCP peer. Returning an error closes the connection;
+	// errors created with newProxyError are first reported to the client as
+	// an ERR packet.
+	AcceptHook func(conn net.Conn) error
+
+	config Config
+
+	// log is where the proxy logs, the standard logrus logger unless WithLogger
+	// replaced it
+	log logrus.FieldLogger
+
+	// namer maps the databases clients select to their names on MySQL; nil
+	// when names are not mapped
+	namer *databaseNamer
+
+	// portListeners are the LISTENERS ports and what they imply about
+	// databases
+	portListeners []portListener
+
+	// ensurer creates the databases requested by clients
+	ensurer DatabaseEnsurer
+
+	// connLimit bounds the connections handled at once, if MaxConnections is set
+	connLimit *connLimiter
+
+	// forwardBuffers are the buffers the relay reads packets into
+	forwardBuffers *bufferPool
+
+	// allowedClients are the ALLOWED_CLIENTS prefixes
+	allowedClients []netip.Prefix
+
+	// backendEnsurers are the ensurers of the default and routed backends, by
+	// address, for dropping databases through the admin API
+	backendEnsurers map[string]*sqlEnsurer
+
+	// created records the databases the proxy has created
+	created *createdRegistry
+
+	// ephemeral drops created databases once their last connection closes,
+	// if EphemeralDatabases is set
+	ephemeral *ephemeralTracker
+
+	// nextConnID numbers accepted connections
+	nextConnID atomic.Uint64
+
+	// errorCodes maps error categories to the MySQL errors sent to clients
+	errorCodes map[errorCategory]mysqlErrorCode
+
+	// conns tracks the connections in the data phase
+	conns *connRegistry
+
+	// health tracks the backend's health, if enabled
+	health *backendHealth
+
+	// attrLogFields maps connection attributes to per-connection log fields
+	attrLogFields map[string]string
+
+	// routes maps values of the RouteAttribute connection attribute to backends
+	routes map[string]string
+
+	// databaseRoutes select the backend by the database a connection selects
+	// in its handshake, if DatabaseRoutes is set
+	databaseRoutes []databaseRoute
+
+	// backendConfigs are the configurations of the backends other than the
+	// default one, by address, with their own credentials and TLS settings
+	backendConfigs map[string]Config
+
+	// clientTLS terminates TLS for clients, if ProxyTLSCert is configured
+	clientTLS *tls.Config
+
+	// backendConns tracks outbound connections to detect proxy loops
+	backendConns backendConnSet
+
+	// auth authenticates clients to the proxy, if ProxyAuth is enabled
+	auth *proxyAuthenticator
+
+	// audit records created databases to the audit log, if configured
+	audit *auditLog
+
+	// state saves the registry of created databases to StateFile, if configured
+	state *stateFile
+
+	// events publishes creation events to the configured event bus, if any
+	events *eventBus
+
+	// webhook delivers creation events to WebhookURL, if configured
+	webhook *eventBus
+
+	// instance identifies the proxy in creation events
+	instance string
+
+	// dedup remembers which databases have been announced, if configured
+	dedup *dedupStore
+
+	// pause holds new connections while the proxy is paused
+	pause *pauseGate
+
+	// rejections keeps the most recent rejected connections for /status
+	rejections rejectionLog
+
+	// interceptors inspect client commands before they are forwarded
+	interceptors []namedInterceptor
+
+	// sinks are the asynchronous components flushed on shutdown
+	sinks []asyncSink
+
+	// connCtx is the parent of every connection's context; Shutdown cancels
+	// it when it gives up waiting for connections to finish
+	connCtx     context.Context
+	cancelConns context.CancelFunc
+
+	// runCtx is the context of the proxy's background work, such as health
+	// checks and stats logging; Shutdown always cancels it
+	runCtx    context.Context
+	cancelRun context.CancelFunc
+
+	// startedAt is when the proxy was created, for reporting its uptime
+	startedAt time.Time
+
+	// readiness pings MySQL for readiness probes, if HealthPort is set
+	readiness *readinessProbe
+
+	// listeners are closed, and connWG waited on, by Shutdown; tcpAddr is
+	// the address ListenAndServe bound for clients. connsOpen counts the
+	// connections connWG tracks, which Shutdown reports.
+	listenersMu sync.Mutex
+	listeners   []net.Listener
+	tcpAddr     net.Addr
+	connWG      sync.WaitGroup
+	connsOpen   atomic.Int64
+	closing     atomic.Bool
+
+	// stopped is closed by Shutdown, which ends ListenAndServe
+	stopped chan struct{}
+
+	// servers are the admin, metrics, probes and debug HTTP servers, which
+	// Shutdown stops
+	servers []*http.Server
+
+	// serverVersions holds, by backend address, the flavor and version of the
+	// server last logged by noteServer
+	serverVersions sync.Map
+}
+
+// New creates a proxy for the given configuration and inspects the backend.
+// It fails on a configuration the proxy cannot run with, without listening;
+// ListenAndServe or Serve then serve clients.
+func New(config Config, opts ...Option) (*Proxy, error) {
+	if err := checkProxyLoop(config); err != nil {
+		return nil, fmt.Errorf("proxy loop misconfiguration: %w", err)
+	}
+
+	p := &Proxy{
+		config:         config,
+		log:            logrus.StandardLogger(),
+		pause:          newPauseGate(config.PauseQueueSize),
+		connLimit:      newConnLimiter(config.MaxConnections, config.MaxConnectionsWait),
+		errorCodes:     defaultErrorCodes,
+		conns:          newConnRegistry(),
+		created:        newCreatedRegistry(),
+		forwardBuffers: newBufferPool(config.ForwardBufferSize),
+		startedAt:      time.Now(),
+		stopped:        make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	p.connCtx, p.cancelConns = context.WithCancel(context.Background())
+	p.runCtx, p.cancelRun = context.WithCancel(context.Background())
+
+	p.instance = config.InstanceID
+	if p.instance == "" {
+		p.instance, _ = os.Hostname()
+	}
+
+	if config.ChaosLatency > 0 {
+		p.log.WithFields(logrus.Fields{
+			"latency":     config.ChaosLatency.String(),
+			"probability": config.ChaosLatencyProbability,
+			"points":      strings.Join(config.ChaosLatencyPoints, ","),
+		}).Warn("Chaos latency injection is enabled")
+	}
+
+	allowedClients, err := parseClientPrefixes(config.AllowedClients)
+	if err != nil {
+		return p.abandon(fmt.Errorf("invalid ALLOWED_CLIENTS: %w", err))
+	}
+	p.allowedClients = allowedClients
+
+	if config.ErrorCodes != "" {
+		codes, err := parseErrorCodes(config.ErrorCodes)
+		if err != nil {
+			return p.abandon(fmt.Errorf("invalid ERROR_CODES: %w", err))
+		}
+		p.errorCodes = codes
+	}
+
+	// LoadConfig has already rejected malformed entries
+	p.attrLogFields, _ = parseAttrLogFields(config.AttrLogFields)
+	if len(config.AttributeRoutes) > 0 {
+		// Validated when the configuration was loaded
+		p.routes, _ = parseAttributeRoutes(config.AttributeRoutes)
+	}
+	named, _ := parseBackends(config.Backends)
+	routes, _ := parseDatabaseRoutes(config.DatabaseRoutes)
+	if err := p.resolveDatabaseRoutes(routes, named); err != nil {
+		return p.abandon(fmt.Errorf("invalid DATABASE_ROUTES: %w", err))
+	}
+
+	// Attribute routes use the MYSQL_ settings, named backends their own
+	p.backendConfigs = make(map[string]Config)
+	for _, addr := range p.routes {
+		if addr != p.backendAddr() {
+			host, port, _ := net.SplitHostPort(addr)
+			backendConfig := config
+			backendConfig.MySQLHost = host
+			backendConfig.MySQLPort, _ = strconv.Atoi(port)
+			p.backendConfigs[addr] = backendConfig
+		}
+	}
+	for _, backend := range named {
+		if backend.addr == p.backendAddr() {
+			return p.abandon(fmt.Errorf("invalid BACKENDS: backend %s has the address of MYSQL_HOST:MYSQL_PORT", backend.name))
+		}
+		backendConfig := config
+		backend.apply(&backendConfig)
+		p.backendConfigs[backend.addr] = backendConfig
+		p.log.WithFields(logrus.Fields{
+			"backend":    backend.name,
+			"mysql_addr": backend.addr,
+		}).Info("Configured named backend")
+	}
+
+	namer, err := newDatabaseNamer(config)
+	if err != nil {
+		return p.abandon(err)
+	}
+	p.namer = namer
+
+	// Validated when the configuration was loaded
+	p.portListeners, _ = parseListeners(config.Listeners)
+	if err := checkListenerPorts(config, p.portListeners); err != nil {
+		return p.abandon(err)
+	}
+	if err := checkDebugPort(config); err != nil {
+		return p.abandon(err)
+	}
+	if namer != nil {
+		p.log.WithField("template", namer.template).Info("Mapping database names to their names on MySQL")
+	}
+
+	// Databases are created on MySQL unless WithEnsurer replaced the ensurer
+	if p.ensurer == nil {
+		ensurer, err := newSQLEnsurer(config, p.log)
+		if err != nil {
+			return p.abandon(err)
+		}
+		ensurer.onCreate = p.announceCreation
+		ensurer.onDryRun = p.recordDryRun
+		p.ensurer = ensurer
+		p.backendEnsurers = map[string]*sqlEnsurer{p.backendAddr(): ensurer}
+
+		if len(p.backendConfigs) > 0 {
+			routing, err := newRoutingEnsurer(ensurer, p.backendConfigs)
+			if err != nil {
+				return p.abandon(err)
+			}
+			for addr, backendEnsurer := range routing.backends {
+				p.backendEnsurers[addr] = backendEnsurer
+			}
+			p.ensurer = routing
+		}
+
+		// The creation rate limits apply across every backend
+		rate := newCreateRateLimiter(config.CreateRateLimit, config.CreateRateLimitPerClient)
+		for _, backendEnsurer := range p.backendEnsurers {
+			backendEnsurer.rate = rate
+		}
+	}
+
+	if config.ChaosCreateFailureRate > 0 || len(config.ChaosCreateFailurePatterns) > 0 {
+		p.log.WithFields(logrus.Fields{
+			"rate":     config.ChaosCreateFailureRate,
+			"patterns": strings.Join(config.ChaosCreateFailurePatterns, ","),
+		}).Warn("Chaos database creation failures are enabled")
+		p.ensurer = &chaosEnsurer{
+			DatabaseEnsurer: p.ensurer,
+			rate:            config.ChaosCreateFailureRate,
+			patterns:        config.ChaosCreateFailurePatterns,
+		}
+	}
+
+	interceptors, err := buildInterceptors(config, p.ensurer)
+	if err != nil {
+		return p.abandon(fmt.Errorf("invalid ENABLED_INTERCEPTORS: %w", err))
+	}
+	p.interceptors = interceptors
+
+	if config.ProxyAuth == "token" {
+		auth, err := newProxyAuthenticator(config)
+		if err != nil {
+			return p.abandon(fmt.Errorf("failed to configure proxy authentication: %w", err))
+		}
+		p.auth = auth
+	}
+
+	if config.ProxyTLSCert != "" || config.ProxyTLSKey != "" {
+		clientTLS, err := loadClientTLS(config.ProxyTLSCert, config.ProxyTLSKey)
+		if err != nil {
+			return p.abandon(fmt.Errorf("failed to configure client TLS: %w", err))
+		}
+		p.clientTLS = clientTLS
+		p.log.Info("Terminating client TLS")
+	} else if config.ProxyTLSRequired {
+		return p.abandon(errors.New("PROXY_TLS_REQUIRED needs PROXY_TLS_CERT and PROXY_TLS_KEY"))
+	}
+
+	if config.CreateUsers && config.AutoUserPassword == "" && config.AdminCredentials != "passthrough" {
+		return p.abandon(errors.New("CREATE_USERS needs AUTO_USER_PASSWORD, unless ADMIN_CREDENTIALS is passthrough"))
+	}
+
+	if config.DryRunCheck && !config.DryRun {
+		return p.abandon(errors.New("DRY_RUN_CHECK needs DRY_RUN"))
+	}
+	if config.DryRun {
+		p.log.WithField("check_existence", config.DryRunCheck).Warn("Dry run: databases are logged and recorded but not created")
+	}
+
+	if config.AuditLogPath != "" {
+		// The databases created before a restart are known again, until they
+		// are checked against MySQL once it is reachable
+		events, malformed, err := readAuditLog(config.AuditLogPath)
+		if err != nil {
+			return p.abandon(err)
+		}
+		for _, event := range events {
+			p.created.record(restoredDatabase(event, p.startedAt))
+		}
+		p.log.WithFields(logrus.Fields{
+			"audit_log": config.AuditLogPath,
+			"databases": len(events),
+			"malformed": malformed,
+		}).Info("Restored created databases from the audit log")
+
+		audit, err := openAuditLog(config, p.log)
+		if err != nil {
+			return p.abandon(fmt.Errorf("failed to configure audit log: %w", err))
+		}
+		audit.carryOver = p.knownCreations
+		p.audit = audit
+		p.sinks = append(p.sinks, audit)
+	}
+
+	if config.StateFile != "" {
+		// Restored after the audit log, whose entries it replaces with their
+		// last use
+		p.restoreState(config.StateFile)
+		p.state = newStateFile(config.StateFile, p.created, config.StateFlushInterval, p.log)
+		p.sinks = append(p.sinks, p.state)
+		go p.state.run()
+	}
+
+	if config.EventBusURL != "" {
+		publisher, err := newEventPublisher(config.EventBusURL)
+		if err != nil {
+			return p.abandon(fmt.Errorf("failed to configure event bus: %w", err))
+		}
+		p.events = newEventBus(publisher, config.EventBusTopic, config.EventBusBuffer, p.log.WithField("sink", "event_bus"))
+		p.sinks = append(p.sinks, p.events)
+		p.log.WithField("topic", config.EventBusTopic).Info("Publishing creation events to event bus")
+	}
+
+	if config.WebhookURL != "" {
+		p.webhook = newEventBus(newWebhookPublisher(config), "", config.WebhookBuffer, p.log.WithField("sink", "webhook"))
+		p.sinks = append(p.sinks, p.webhook)
+		p.log.Info("Delivering creation events to webhook")
+	}
+
+	if config.CreateEventDedupStore != "" {
+		dedup, err := openDedupStore(config.CreateEventDedupStore)
+		if err != nil {
+			return p.abandon(fmt.Errorf("failed to configure creation event de-duplication: %w", err))
+		}
+		p.dedup = dedup
+		p.sinks = append(p.sinks, dedup)
+	}
+
+	if config.HealthPort != 0 {
+		readiness, err := newReadinessProbe(config)
+		if err != nil {
+			return p.abandon(fmt.Errorf("failed to configure readiness probe: %w", err))
+		}
+		p.readiness = readiness
+	}
+
+	if config.CloseOnBackendUnhealthy {
+		health, err := newBackendHealth(config, p.backendAddr(), p.log)
+		if err != nil {
+			return p.abandon(fmt.Errorf("failed to configure backend health checks: %w", err))
+		}
+		health.onUnhealthy = p.closeBackendConns
+		p.health = health
+		go health.run(p.runCtx)
+	}
+
+	if config.EphemeralDatabases {
+		p.ephemeral = newEphemeralTracker(p, config.DropGrace)
+		p.sinks = append([]asyncSink{p.ephemeral}, p.sinks...)
+		p.log.WithField("grace", config.DropGrace.String()).Info("Dropping created databases when their last connection closes")
+	}
+
+	if config.DBTTL > 0 {
+		sweeper := newExpirySweeper(p, config.DBTTL, config.DBTTLSweepInterval)
+		// Stopped before the audit log it writes to is closed
+		p.sinks = append([]asyncSink{sweeper}, p.sinks...)
+		go sweeper.run()
+		p.log.WithFields(logrus.Fields{
+			"ttl":            config.DBTTL.String(),
+			"sweep_interval": config.DBTTLSweepInterval.String(),
+		}).Info("Dropping created databases unused for DB_TTL")
+	}
+
+	return p, nil
+}
+
+// abandon closes what New opened before it failed with err
+func (p *Proxy) abandon(err error) (*Proxy, error) {
+	p.cancelConns()
+	p.cancelRun()
+	for _, sink := range p.sinks {
+		sink.Close(context.Background())
+	}
+	p.closePools()
+	return nil, err
+}
+
+// backendAddr returns the address of the MySQL backend
+func (p *Proxy) backendAddr() string {
+	return net.JoinHostPort(p.config.MySQLHost, fmt.Sprintf("%d", p.config.MySQLPort))
+}
+
+// backendConfig returns the configuration the backend at addr is used with,
+// which differs from the proxy's in its address, credentials and TLS settings
+func (p *Proxy) backendConfig(addr string) Config {
+	if backendConfig, ok := p.backendConfigs[addr]; ok {
+		return backendConfig
+	}
+	return p.config
+}
+
+// closeBackendConns closes every connection relaying to a backend, telling
+// clients with an ERR packet so that they reconnect instead of hanging
+func (p *Proxy) closeBackendConns(backend string) {
+	conns := p.conns.forBackend(backend)
+	p.log.WithFields(logrus.Fields{
+		"backend":     backend,
+		"connections": len(conns),
+	}).Warn("Closing connections to unhealthy backend")
+
+	for _, conn := range conns {
+		if !conn.opaque {
+			conn.state.clientWriteMu.Lock()
+			p.writeErrPacket(conn.clientConn, 0, errCategoryBackendUnavailable, "MySQL backend is unhealthy, please reconnect")
+			conn.state.clientWriteMu.Unlock()
+		}
+		conn.state.end("backend_unhealthy")
+		conn.clientConn.Close()
+		conn.mysqlConn.Close()
+	}
+}
+
+// authPluginAllowed reports whether clients may authenticate with the given plugin
+func (p *Proxy) authPluginAllowed(plugin string) bool {
+	if len(p.config.AllowedAuthPlugins) == 0 {
+		return true
+	}
+	for _, allowed := range p.config.AllowedAuthPlugins {
+		if allowed == plugin {
+			return true
+		}
+	}
+	return false
+}
+
+// forgetDatabase drops a database MySQL reported as unknown (ER_BAD_DB_ERROR)
+// from the cache of databases known to exist on the backend, since it may
+// have been dropped behind the proxy's back
+func (p *Proxy) forgetDatabase(backend, dbName string) {
+	if backend == "" {
+		backend = p.backendAddr()
+	}
+	if ensurer, ok := p.backendEnsurers[backend]; ok {
+		ensurer.Forget(dbName)
+	}
+}
+
+// dropDatabase drops a database and the user created for it, if any, on its
+// backend, and removes it from the registry of created databases
+func (p *Proxy) dropDatabase(ctx context.Context, database createdDatabase) error {
+	ensurer, ok := p.backendEnsurers[database.Backend]
+	if !ok {
+		return fmt.Errorf("no connection to backend %s", database.Backend)
+	}
+	// A dry run created nothing to drop
+	if database.DryRun {
+		p.created.removeFrom(database.Name, database.Backend)
+		return nil
+	}
+	if err := ensurer.Drop(ctx, database.Name); err != nil {
+		return err
+	}
+	if database.CreatedUser != "" {
+		if err := ensurer.DropUser(ctx, database.CreatedUser); err != nil {
+			return err
+		}
+	}
+	p.created.removeFrom(database.Name, database.Backend)
+	return nil
+}
+
+// selectDatabase records the database a connection has selected, as the time
+// a database the proxy created was last used
+func (p *Proxy) selectDatabase(cc *ConnContext, name string) {
+	cc.setCurrentDB(name)
+	if name != "" {
+		p.created.touch(name, time.Now())
+	}
+	p.ephemeral.hold(cc.ID, name)
+}
+
+// announceCreation records a database created by the proxy and publishes an
+// event for it
+func (p *Proxy) announceCreation(ctx context.Context, dbName, user string) {
+	cc := connContextFrom(ctx)
+	event := CreationEvent{
+		Database:    dbName,
+		Client:      cc.ClientAddr,
+		ConnID:      cc.ID,
+		Username:    cc.Username,
+		Timestamp:   time.Now().UTC(),
+		Backend:     cc.Backend,
+		Instance:    p.instance,
+		CreatedUser: user,
+		Trigger:     createTriggerFrom(ctx),
+	}
+	if event.Backend == "" {
+		event.Backend = p.backendAddr()
+	}
+	databasesCreated.Inc(event.Backend)
+	p.created.record(createdDatabase{
+		Name:        dbName,
+		CreatedAt:   event.Timestamp,
+		Client:      event.Client,
+		ConnID:      event.ConnID,
+		Username:    event.Username,
+		Backend:     event.Backend,
+		CreatedUser: user,
+		Trigger:     event.Trigger,
+	})
+
+	if p.audit != nil {
+		p.audit.Record(event)
+	}
+	if (p.events != nil || p.webhook != nil) && p.firstAnnouncement(event) {
+		if p.events != nil {
+			p.events.Emit(event)
+		}
+		if p.webhook != nil {
+			p.webhook.Emit(event)
+		}
+	}
+}
+
+// recordDryRun records a database a dry run would have created, as of the
+// first time a connection selected it. Nothing is audited or published.
+func (p *Proxy) recordDryRun(ctx context.Context, dbName string) {
+	if _, ok := p.created.get(dbName); ok {
+		return
+	}
+	cc := connContextFrom(ctx)
+	backend := cc.Backend
+	if backend == "" {
+		backend = p.backendAddr()
+	}
+	p.created.record(createdDatabase{
+		Name:      dbName,
+		CreatedAt: time.Now().UTC(),
+		Client:    cc.ClientAddr,
+		ConnID:    cc.ID,
+		Username:  cc.Username,
+		Backend:   backend,
+		DryRun:    true,
+	})
+}
+
+// knownCreations returns the creation events of the databases in the
+// registry, which a new audit log starts with
+func (p *Proxy) knownCreations() []CreationEvent {
+	var events []CreationEvent
+	for _, database := range p.created.list() {
+		if !database.DryRun {
+			events = append(events, database.creationEvent(p.instance))
+		}
+	}
+	return events
+}
+
+// firstAnnouncement reports whether a creation event should be published,
+// consulting the dedup store if one is configured. Events are published when
+// the store cannot record them, so that none is lost.
+func (p *Proxy) firstAnnouncement(event CreationEvent) bool {
+	if p.dedup == nil {
+		return true
+	}
+	logger := p.log.WithFields(logrus.Fields{"database": event.Database, "backend": event.Backend, "conn_id": event.ConnID})
+	first, err := p.dedup.firstAnnouncement(event.Backend, event.Database)
+	if err != nil {
+		logger.WithError(err).Warn("Failed to record announced database, publishing creation event anyway")
+	}
+	if !first {
+		logger.Debug("Creation event already published, skipping")
+	}
+	return first
+}
+
+// ReopenLogs reopens the files the proxy writes to, after they were rotated
+func (p *Proxy) ReopenLogs() {
+	if p.audit == nil {
+		return
+	}
+	if err := p.audit.Reopen(); err != nil {
+		p.log.WithError(err).Error("Failed to reopen audit log")
+		return
+	}
+	p.log.WithField("audit_log", p.config.AuditLogPath).Info("Reopened audit log")
+}
+
+// handleConnection handles a single client connection, which arrived on the
+// LISTENERS port of mapping unless it is nil
+func (p *Proxy) handleConnection(clientConn net.Conn, mapping *portListener) {
+	config := p.config
+
+	defer clientConn.Close()
+
+	// Every log line of the connection carries its ID, which tells apart the
+	// connections of clients that reconnect from the same address
+	connID := p.nextConnID.Add(1)
+	clientAddr := clientConn.RemoteAddr().String()
+	logger := p.log.WithFields(logrus.Fields{
+		"conn_id":     connID,
+		"client_addr": clientAddr,
+	})
+	if mapping != nil {
+		logger = logger.WithField("listener_port", mapping.port)
+	}
+
+	// Refuse connections the proxy opened to itself before they dial again
+	// and multiply, without holding them in the pause queue or the hooks
+	if p.backendConns.isLoop(clientConn) {
+		p.rejectConnection(clientConn, logger, "proxy_loop", 0, "",
+			"proxy loop detected: this connection was opened by the proxy itself to reach MySQL. "+
+				"MYSQL_HOST/MYSQL_PORT, BACKENDS and ATTRIBUTE_ROUTES must point at real MySQL servers, not at the proxy")
+		return
+	}
+
+	// Behind a load balancer the client's address is only known from the
+	// PROXY protocol header, so it is checked once the header is read
+	if !config.ProxyProtocol && !p.admitClient(clientConn, logger) {
+		return
+	}
+
+	if p.AcceptHook != nil {
+		if err := p.AcceptHook(clientConn); err != nil {
+			var category errorCategory
+			var pe *proxyError
+			if errors.As(err, &pe) {
+				category = pe.category
+			}
+			p.rejectConnection(clientConn, logger, "accept_hook", 0, category, err.Error())
+			return
+		}
+	}
+
+	if config.ProxyProtocol {
+		clientConn.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+		proxied, err := readProxyHeader(clientConn)
+		if err != nil {
+			p.rejectConnection(clientConn, logger.WithError(err), "proxy_protocol", 0, "", err.Error())
+			return
+		}
+		peerAddr := clientAddr
+		clientConn = proxied
+		clientAddr = clientConn.RemoteAddr().String()
+		logger = logger.WithFields(logrus.Fields{
+			"client_addr": clientAddr,
+			"proxied_by":  peerAddr,
+		})
+		if !p.admitClient(clientConn, logger) {
+			return
+		}
+	}
+	logger.Info("New connection")
+
+	// Count the connections that never got through their handshake
+	handshakeCompleted := false
+	defer func() {
+		if !handshakeCompleted {
+			handshakesFailed.Inc()
+		}
+	}()
+
+	cc := &ConnContext{
+		ID:          connID,
+		ClientAddr:  clientAddr,
+		ConnectedAt: time.Now(),
+		logger:      logger,
+		namer:       mapping.namer(p.namer),
+	}
+	ctx := withConnContext(p.connCtx, cc)
+	p.chaosDelay(ctx, chaosPointAccept, logger)
+
+	// Hold the connection while the proxy is paused for maintenance
+	if err := p.pause.Wait(config.PauseTimeout); err != nil {
+		p.rejectConnection(clientConn, logger, "paused", 0, "", err.Error())
+		return
+	}
+
+	mysqlAddr := p.backendAddr()
+	cc.Backend = mysqlAddr
+	handshakeDeadline := time.Now().Add(config.HandshakeTimeout)
+	clientConn.SetDeadline(handshakeDeadline)
+
+	var mysqlConn net.Conn
+	var serverGreeting *MySQLPacket
+	if config.TerminateHandshake {
+		// Greet the client without waiting for MySQL, which is only dialed
+		// once the client's handshake response has been read
+		greeting, err := p.proxyGreeting(cc.ID)
+		if err != nil {
+			logger.WithError(err).Error("Failed to build greeting")
+			return
+		}
+		serverGreeting = newPacket(0, greeting)
+	} else {
+		// Connect to the real MySQL server
+		conn, err := p.dialBackend(mysqlAddr, logger)
+		if err != nil {
+			p.rejectConnection(clientConn, logger.WithError(err).WithField("mysql_addr", mysqlAddr),
+				"backend_unavailable", 0, errCategoryBackendUnavailable, "cannot connect to MySQL server")
+			return
+		}
+		defer conn.Close()
+		p.backendConns.add(conn)
+		defer p.backendConns.remove(conn)
+		mysqlConn = conn
+		backendDeadline := time.Now().Add(config.HandshakeTimeout)
+		mysqlConn.SetDeadline(backendDeadline)
+
+		// Read the server greeting
+		serverGreeting, err = readPacketBefore(mysqlConn, config.HandshakeTimeout, backendDeadline)
+		if err == nil {
+			err = checkGreeting(serverGreeting.Payload)
+		}
+		if err != nil {
+			p.rejectConnection(clientConn, logger.WithError(err).WithField("mysql_addr", mysqlAddr),
+				"backend_protocol", 0, errCategoryBackendUnavailable, "backend did not speak MySQL protocol")
+			return
+		}
+		p.noteServer(mysqlAddr, serverGreeting.Payload, logger)
+
+		// Steer the client towards a specific auth plugin
+		if config.AdvertiseAuthPlugin != "" && serverGreeting.Payload[0] != 0xff {
+			if rewritten, err := rewriteGreetingAuthPlugin(serverGreeting.Payload, config.AdvertiseAuthPlugin); err != nil {
+				logger.WithError(err).Warn("Cannot rewrite the auth plugin advertised in the greeting")
+			} else {
+				serverGreeting = newPacket(serverGreeting.SequenceID, rewritten)
+			}
+		}
+	}
+
+	// Offer TLS when the proxy terminates it, and hide MySQL's when TLS
+	// clients are rejected so that clients that merely prefer it connect in
+	// plaintext. Compression is hidden the same way unless it is relayed.
+	clientGreeting := serverGreeting
+	if serverGreeting.Payload[0] != 0xff {
+		set, clear := uint32(0), uint32(0)
+		if p.clientTLS != nil {
+			set |= clientSSL
+		} else if config.TLSMode == "reject" {
+			clear |= clientSSL
+		}
+		if config.CompressionMode == "strip" {
+			clear |= clientCompress
+		}
+		if set|clear != 0 {
+			if rewritten, err := rewriteGreetingCapabilities(serverGreeting.Payload, set, clear); err != nil {
+				logger.WithError(err).Warn("Cannot rewrite the capabilities advertised in the greeting")
+			} else {
+				clientGreeting = newPacket(serverGreeting.SequenceID, rewritten)
+			}
+		}
+	}
+
+	// Send server greeting to client
+	p.chaosDelay(ctx, chaosPointGreeting, logger)
+	sequence := newExchangeSequence(logger)
+	if err := sequence.write(clientConn, clientGreeting); err != nil {
+		logger.WithError(err).Error("Failed to send server greeting to client")
+		return
+	}
+
+	// Read client handshake response. A client that connected and went
+	// silent, as port scanners do, is dropped well before HANDSHAKE_TIMEOUT,
+	// releasing the MySQL connection dialed for it.
+	clientConn.SetReadDeadline(earliest(handshakeDeadline, time.Now().Add(config.HandshakeResponseTimeout)))
+	clientHandshake, err := readPacket(clientConn)
+	if err == nil {
+		sequence.readFrom(clientHandshake)
+	}
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			handshakeTimeouts.Inc()
+			logger.WithField("timeout", config.HandshakeResponseTimeout.String()).Debug("Client did not answer the greeting in time, closing connection")
+			return
+		}
+		logger.WithError(err).Error("Failed to read client handshake")
+		return
+	}
+	clientConn.SetReadDeadline(handshakeDeadline)
+
+	// A client switching to TLS sends its handshake response encrypted, after
+	// an SSLRequest
+	terminatedTLS := false
+	if isSSLRequest(clientHandshake.Payload) {
+		switch {
+		case p.clientTLS != nil:
+			tlsConn, response, err := p.acceptClientTLS(clientConn)
+			if err != nil {
+				logger.WithError(err).Warn("Failed to establish TLS with client")
+				return
+			}
+			logger.Debug("Terminated client TLS")
+			clientConn, clientHandshake = tlsConn, response
+			sequence.readFrom(clientHandshake)
+			terminatedTLS = true
+		case config.TLSMode == "reject" || mysqlConn == nil:
+			p.rejectConnection(clientConn, logger, "tls", sequence.next(), errCategoryAccessDenied,
+				"TLS connections are not accepted by the proxy, connect without TLS (e.g. --ssl-mode=DISABLED)")
+			return
+		default:
+			handshakeCompleted = true
+			p.relayTLS(clientConn, mysqlConn, mysqlAddr, cc, clientHandshake, logger)
+			return
+		}
+	} else if config.ProxyTLSRequired {
+		p.rejectConnection(clientConn, logger, "tls_required", sequence.next(), errCategoryAccessDenied,
+			"connections to the proxy must use TLS")
+		return
+	}
+
+	// A client may only compress if the greeting it answered offered it;
+	// otherwise MySQL would compress a session the client reads uncompressed
+	if requestsCompression(clientHandshake.Payload) {
+		offered, _ := parseGreetingCapabilities(clientGreeting.Payload)
+		if offered&clientCompress == 0 {
+			clientHandshake = newPacket(clientHandshake.SequenceID, withoutCapability(clientHandshake.Payload, clientCompress))
+			logger.Debug("Stripped CLIENT_COMPRESS from the client's handshake")
+		}
+	}
+
+	// Parse and handle database creation (but don't fail if parsing fails)
+	databaseName := parseDatabaseName(clientHandshake, logger)
+	cc.Username = parseUsername(clientHandshake)
+	p.withPacketDump(logger.WithField("database", databaseName), clientHandshake.Payload, redactHandshakeResponse).
+		Debug("Parsed database name from handshake")
+
+	handshake, handshakeErr := parseHandshakeResponse(clientHandshake.Payload)
+	if handshakeErr == nil {
+		cc.capabilities = handshake.CapabilityFlags
+		cc.Attributes = handshake.Attributes
+		if config.AdminCredentials == "passthrough" {
+			cc.credentials = passthroughCredentials(handshake, terminatedTLS, logger)
+		}
+	}
+
+	// An absurdly long username is usually a malformed or misparsed handshake
+	if config.MaxUsernameLength > 0 && utf8.RuneCountInString(cc.Username) > config.MaxUsernameLength {
+		p.rejectConnection(clientConn, logger.WithField("username_length", utf8.RuneCountInString(cc.Username)), "username_too_long",
+			sequence.next(), errCategoryAccessDenied,
+			fmt.Sprintf("username is longer than %d characters", config.MaxUsernameLength))
+		return
+	}
+
+	// Label the rest of the connection's log lines with its mapped attributes
+	if len(p.attrLogFields) > 0 {
+		logger = logger.WithFields(attributeLogFields(cc.Attributes, p.attrLogFields))
+		cc.logger = logger
+	}
+
+	if config.LogClientDriver {
+		logClientDriver(logger, cc.Attributes)
+	}
+	clientDriverConnections.Inc(attributeOrUnknown(cc.Attributes, "_client_name"), attributeOrUnknown(cc.Attributes, "_client_version"))
+
+	// Refuse clients that do not identify themselves with the required attributes
+	if len(config.RequiredConnectionAttrs) > 0 {
+		if err := handshakeErr; err != nil {
+			p.rejectConnection(clientConn, logger.WithError(err), "malformed_handshake",
+				sequence.next(), errCategoryAccessDenied, "malformed handshake response")
+			return
+		}
+		for _, key := range config.RequiredConnectionAttrs {
+			if _, ok := handshake.Attributes[key]; !ok {
+				p.rejectConnection(clientConn, logger, "missing_attribute", sequence.next(),
+					errCategoryAccessDenied, fmt.Sprintf("connection attribute '%s' is required", key))
+				return
+			}
+		}
+	}
+
+	// Require clients to authenticate to the proxy itself
+	if p.auth != nil {
+		if handshakeErr != nil || !p.auth.authenticate(handshake.Username, handshake.Attributes) {
+			p.rejectConnection(clientConn, logger, "proxy_auth", sequence.next(),
+				errCategoryAccessDenied, fmt.Sprintf("access denied for user '%s' by proxy authentication", cc.Username))
+			return
+		}
+		// Keep the token out of MySQL's performance_schema
+		clientHandshake = newPacket(clientHandshake.SequenceID, handshake.withoutAttribute(clientHandshake.Payload, p.auth.attribute))
+	}
+
+	// Refuse auth plugins that are not allowed through the proxy
+	if len(config.AllowedAuthPlugins) > 0 {
+		if err := handshakeErr; err != nil {
+			p.rejectConnection(clientConn, logger.WithError(err), "malformed_handshake",
+				sequence.next(), errCategoryAccessDenied, "malformed handshake response")
+			return
+		}
+		if plugin := handshake.authPlugin(); !p.authPluginAllowed(plugin) {
+			p.rejectConnection(clientConn, logger, "auth_plugin", sequence.next(),
+				errCategoryAccessDenied, fmt.Sprintf("authentication plugin '%s' is not allowed", plugin))
+			return
+		}
+	}
+
+	// A LISTENERS port selects its database, whichever the handshake asked for
+	if database := mapping.fixedDatabase(); database != "" && database != databaseName {
+		if handshakeErr != nil {
+			p.rejectConnection(clientConn, logger.WithError(handshakeErr), "malformed_handshake",
+				sequence.next(), errCategoryAccessDenied, "malformed handshake response")
+			return
+		}
+		clientHandshake = newPacket(clientHandshake.SequenceID, handshake.withDatabase(clientHandshake.Payload, database))
+		handshake, handshakeErr = parseHandshakeResponse(clientHandshake.Payload)
+		cc.capabilities = handshake.CapabilityFlags
+		logger.WithFields(logrus.Fields{
+			"requested_database": databaseName,
+			"database":           database,
+		}).Info("Selected the database of the listener's port")
+		databaseName = database
+	}
+
+	// The rest of the connection sees the database by its name on MySQL,
+	// which is also what the client's SELECT DATABASE() returns
+	if mapped, err := cc.namer.backendName(databaseName); err != nil {
+		p.rejectConnection(clientConn, logger.WithError(err).WithField("database", databaseName), "invalid_database",
+			sequence.next(), errorCategoryOf(err), err.Error())
+		return
+	} else if mapped != databaseName {
+		clientHandshake = newPacket(clientHandshake.SequenceID,
+			withDatabase(clientHandshake.Payload, handshake.databaseOffset, handshake.databaseEnd, mapped))
+		logger.WithFields(logrus.Fields{
+			"database":         databaseName,
+			"backend_database": mapped,
+		}).Info("Mapped the handshake's database to its name on MySQL, which SELECT DATABASE() returns")
+		databaseName = mapped
+	}
+
+	// Move the connection to the backend its connection attributes select,
+	// or dial MySQL now if the proxy greeted the client itself
+	clientSeq, backendHandshake := clientHandshake.SequenceID, clientHandshake
+	if clientSeq != 1 {
+		// MySQL numbers the handshake response 1, even when the client's
+		// followed an SSLRequest to the proxy
+		backendHandshake = newPacket(1, clientHandshake.Payload)
+	}
+	addr, rule := p.routeFor(cc.Attributes, databaseName)
+	cc.routedByAttribute = rule == "connection attribute"
+	if mysqlConn == nil || addr != mysqlAddr {
+		reason, message := "routing", "cannot relay the connection to its routed MySQL server"
+		if mysqlConn == nil {
+			reason, message = "backend_unavailable", "cannot connect to MySQL server"
+		}
+		routedConn, greeting, rewritten, seq, err := p.reroute(clientConn, addr, clientHandshake, sequence, logger)
+		if err != nil {
+			p.rejectConnection(clientConn, logger.WithError(err).WithField("mysql_addr", addr), reason,
+				sequence.next(), errCategoryBackendUnavailable, message)
+			return
+		}
+		defer routedConn.Close()
+		p.backendConns.add(routedConn)
+		defer p.backendConns.remove(routedConn)
+		if mysqlConn != nil {
+			mysqlConn.Close()
+		}
+		if addr != p.backendAddr() {
+			logger.WithFields(logrus.Fields{
+				"mysql_addr": addr,
+				"rule":       rule,
+			}).Info("Routed connection to another backend")
+		}
+		routedConn.SetDeadline(time.Now().Add(config.HandshakeTimeout))
+
+		mysqlConn, mysqlAddr, serverGreeting = routedConn, addr, greeting
+		clientSeq, backendHandshake = seq, rewritten
+		cc.Backend = addr
+	}
+
+	// If database name found in handshake, create it immediately
+	databaseReady := false
+	if databaseName != "" {
+		logger.WithField("database", databaseName).Info("Client requested database in handshake")
+		err := p.ensurer.EnsureExists(withCreateTrigger(ctx, "handshake"), databaseName)
+		switch category := errorCategoryOf(err); {
+		case err == nil:
+			logger.WithField("database", databaseName).Info("Database is ready")
+			databaseReady = true
+		case errors.Is(err, errNameNotAllowed):
+			// MySQL reports the database as unknown, unless it already exists
+			logger.WithField("database", databaseName).Info("Passing handshake through without creating the database")
+		case (category == errCategoryReserved || category == errCategoryValidation) && config.DeniedHandshakeAction == "passthrough":
+			// Let MySQL decide whether the client may use the database, which
+			// it may accept as a quoted name the proxy would not create
+			logger.WithError(err).WithField("database", databaseName).Warn("Database may not be created, passing handshake through")
+		case category == errCategoryReserved:
+			p.rejectConnection(clientConn, logger.WithError(err).WithField("database", databaseName), "denied_database",
+				sequence.next(), category, fmt.Sprintf("access denied for database '%s'", databaseName))
+			return
+		case config.CreateFailureMode == "strip" && handshakeErr == nil:
+			// The client can still select a database once connected
+			logger.WithError(err).WithField("database", databaseName).Warn("Cannot create the handshake's database, connecting without one")
+			handshakeDatabasesStripped.Inc()
+			backendHandshake = withoutHandshakeDatabase(backendHandshake)
+			clientHandshake = withoutHandshakeDatabase(clientHandshake)
+			databaseName = ""
+		default:
+			// Closing without an ERR leaves the client to report a lost connection
+			if config.CreateFailureMode == "close" {
+				category = ""
+			}
+			p.rejectConnection(clientConn, logger.WithField("database", databaseName), creationRejectionReason(errorCategoryOf(err)),
+				sequence.next(), category, fmt.Sprintf("cannot create database '%s': %v", databaseName, err))
+			return
+		}
+	} else {
+		logger.Debug("No database specified in handshake - will handle USE commands later")
+	}
+
+	// An ERR 1049 answering the handshake of a database the proxy believed
+	// exists means it was dropped behind the proxy's back. It is created
+	// again and the handshake replayed on a new connection, once.
+	retryUnknownDatabase := config.AutoCreateOn1049 && !config.DryRun && databaseReady && handshakeErr == nil &&
+		handshake.CapabilityFlags&clientPluginAuth != 0
+	var serverResponse *MySQLPacket
+	for {
+		// seqOffset is how far MySQL's numbering is ahead of the client's
+		seqOffset := backendHandshake.SequenceID - clientSeq
+
+		// Speak TLS to MySQL on behalf of clients that do not use it themselves
+		if p.backendConfig(mysqlAddr).BackendTLS != "off" && handshakeErr == nil && handshake.CapabilityFlags&clientSSL == 0 {
+			tlsConn, rewritten, err := p.upgradeBackendTLS(mysqlConn, mysqlAddr, serverGreeting, backendHandshake)
+			if err != nil {
+				p.rejectConnection(clientConn, logger.WithError(err), "backend_tls", sequence.next(),
+					errCategoryBackendUnavailable, "cannot establish TLS with MySQL server")
+				return
+			}
+			if tlsConn != nil {
+				logger.Debug("Upgraded MySQL connection to TLS")
+				mysqlConn, backendHandshake = tlsConn, rewritten
+				seqOffset++
+			}
+		}
+
+		// Forward the client handshake to MySQL server
+		if err := writePacket(mysqlConn, backendHandshake); err != nil {
+			logger.WithError(err).Error("Failed to forward client handshake to MySQL")
+			return
+		}
+
+		// Relay the rest of the authentication exchange
+		var err error
+		serverResponse, err = p.relayAuth(clientConn, mysqlConn, sequence, seqOffset, retryUnknownDatabase, logger)
+		if errors.Is(err, errUnknownDatabaseHeld) {
+			retryUnknownDatabase = false
+			p.forgetDatabase(cc.Backend, databaseName)
+			replayConn, greeting, rewritten, seq, replayErr := p.replayHandshake(ctx, clientConn, mysqlAddr, databaseName,
+				newPacket(clientSeq, clientHandshake.Payload), sequence, logger)
+			if replayErr == nil {
+				defer replayConn.Close()
+				p.backendConns.add(replayConn)
+				defer p.backendConns.remove(replayConn)
+				mysqlConn.Close()
+				mysqlConn, serverGreeting = replayConn, greeting
+				clientSeq, backendHandshake = seq, rewritten
+				continue
+			}
+			logger.WithError(replayErr).Warn("Cannot replay the handshake, passing MySQL's unknown database error on")
+			if err := sequence.write(clientConn, serverResponse); err != nil {
+				logger.WithError(err).Error("Failed to forward MySQL authentication response")
+				return
+			}
+			err = nil
+		}
+
+		var pe *proxyError
+		switch {
+		case errors.As(err, &pe):
+			p.rejectConnection(clientConn, logger, "auth_plugin", sequence.next(), pe.category, pe.message)
+			return
+		case err != nil:
+			logger.WithError(err).Error("Authentication did not complete, closing connection")
+			return
+		case serverResponse.Payload[0] == 0xff:
+			if databaseName != "" && errPacketCode(serverResponse.Payload) == erBadDBError {
+				p.forgetDatabase(cc.Backend, databaseName)
+			}
+			logger.WithField("message", errPacketMessage(serverResponse.Payload)).Info("MySQL refused the client's authentication")
+			return
+		}
+		break
+	}
+
+	logger.Info("Handshake completed successfully")
+	handshakeCompleted = true
+	p.selectDatabase(cc, databaseName)
+	defer p.ephemeral.release(cc.ID)
+
+	// MySQL compresses the session if the client asked and it supports it;
+	// the proxy cannot read compressed packets, so it relays them untouched
+	if requestsCompression(clientHandshake.Payload) {
+		if capabilities, _ := parseGreetingCapabilities(serverGreeting.Payload); capabilities&clientCompress != 0 {
+			logger.Warn("Client uses the compressed protocol, relaying it untouched: databases are not created automatically after the handshake")
+			compressedPassthroughConnections.Inc()
+			p.relayUntouched(clientConn, mysqlConn, mysqlAddr, cc, logger)
+			return
+		}
+	}
+
+	// Run the proxy's own session statements now that authentication has succeeded
+	for _, statement := range p.sessionInitStatements(cc) {
+		if usable, err := runSessionStatement(mysqlConn, statement); err != nil {
+			if !usable {
+				logger.WithError(err).Error("Failed to run session init statement")
+				return
+			}
+			logger.WithError(err).Warn("Session init statement failed")
+		}
+	}
+
+	// Handle the rest of the connection by intercepting USE commands
+	done := make(chan struct{})
+	state := newRelayState(config.WriteTimeout)
+	state.queryLog = newQueryLog(config)
+	// Mirror the session to the shadow backend; clients using TLS end to end
+	// cannot be mirrored
+	if config.ShadowBackend != "" && handshakeErr == nil && handshake.CapabilityFlags&clientSSL == 0 {
+		state.shadow = p.startShadow(newPacket(1, clientHandshake.Payload), logger)
+	}
+
+	// The handshake deadline does not apply to the session itself, however
+	// long it runs or waits on a query
+	clientConn.SetDeadline(time.Time{})
+	mysqlConn.SetDeadline(time.Time{})
+
+	active := &activeConn{cc: cc, clientConn: clientConn, mysqlConn: mysqlConn, backend: mysqlAddr, state: state}
+	p.conns.add(active)
+	defer p.conns.remove(active)
+
+	// Forward from client to MySQL with USE command interception. Whichever
+	// direction stops first stops the other, so that neither is left blocked
+	// reading from a peer that is still connected.
+	go func() {
+		defer close(done)
+		state.end(p.forwardWithUseInterception(ctx, clientConn, mysqlConn, state, logger))
+		// A client that went away without COM_QUIT leaves MySQL waiting
+		closeRelayed(mysqlConn)
+	}()
+
+	// Close connections that stay idle for too long
+	if config.IdleTimeout > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go p.idleTimeout(clientConn, mysqlConn, state, stop, logger)
+	}
+
+	// Keep the backend connection alive while the client is idle
+	if config.IdleKeepalivePing > 0 {
+		stop := make(chan struct{})
+		defer close(stop)
+		go p.keepalive(clientConn, mysqlConn, state, stop, logger)
+	}
+
+	// Forward from MySQL to client; once MySQL has gone, the client is told
+	state.end(p.forwardFromServer(ctx, clientConn, mysqlConn, state, logger))
+	closeRelayed(clientConn)
+
+	// Wait for the other goroutine to finish
+	<-done
+	logger.WithFields(logrus.Fields{
+		"reason":            state.reason(),
+		"bytes_from_client": state.clientBytes.Load(),
+		"bytes_from_server": state.serverBytes.Load(),
+	}).Info("Connection closed")
+}
+
+// ListenAndServe starts the admin, metrics and health probe servers that are
+// configured, waits for MySQL if STARTUP_WAIT is set, then serves clients on
+// PROXY_PORT and/or PROXY_SOCKET. PROXY_PORT=0 without PROXY_SOCKET listens
+// on a free port, which Addr reports. It returns once Shutdown was called, or
+// shuts the proxy down within SHUTDOWN_TIMEOUT when ctx is done and returns
+// what Shutdown returned.
+func (p *Proxy) ListenAndServe(ctx context.Context) error {
+	config := p.config
+
+	if config.AdminPort != 0 {
+		go p.serveAdmin(net.JoinHostPort(config.MetricsListenAddress, strconv.Itoa(config.AdminPort)))
+	}
+	if config.MetricsPort != 0 {
+		go p.serveMetrics(net.JoinHostPort(config.MetricsListenAddress, strconv.Itoa(config.MetricsPort)))
+	}
+	if config.HealthPort != 0 {
+		go p.serveProbes(net.JoinHostPort(config.HealthListenAddress, strconv.Itoa(config.HealthPort)))
+	}
+	if config.DebugPort != 0 {
+		go p.serveDebug(net.JoinHostPort(config.DebugListenAddress, strconv.Itoa(config.DebugPort)))
+	}
+
+	// Wait for MySQL, so that early clients are not refused for it
+	if config.StartupWait > 0 {
+		if err := p.waitForBackend(p.backendAddr(), config.StartupWait); err != nil {
+			return fmt.Errorf("MySQL is not reachable: %w", err)
+		}
+	}
+
+	// Forget the restored databases that were dropped while the proxy was
+	// not running
+	if (p.audit != nil || p.state != nil) && !config.DryRun {
+		go p.reconcileRestored(p.runCtx)
+	}
+
+	// Listen on TCP and/or a Unix socket
+	var listeners []net.Listener
+	if config.ProxyPort != 0 || config.ProxySocket == "" {
+		listener, err := net.Listen("tcp", net.JoinHostPort(config.ListenAddress, strconv.Itoa(config.ProxyPort)))
+		if err != nil {
+			return fmt.Errorf("failed to start proxy server: %w", err)
+		}
+		p.listenersMu.Lock()
+		p.tcpAddr = listener.Addr()
+		p.listenersMu.Unlock()
+		listeners = append(listeners, listener)
+	}
+	if config.ProxySocket != "" {
+		listener, err := listenSocket(config.ProxySocket, config.ProxySocketMode)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return fmt.Errorf("failed to listen on proxy socket %s: %w", config.ProxySocket, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	for i := range p.portListeners {
+		mapping := &p.portListeners[i]
+		listener, err := net.Listen("tcp", net.JoinHostPort(config.ListenAddress, strconv.Itoa(mapping.port)))
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return fmt.Errorf("failed to listen on LISTENERS port %d: %w", mapping.port, err)
+		}
+		listeners = append(listeners, &databaseListener{Listener: listener, mapping: mapping})
+		p.log.WithFields(logrus.Fields{
+			"port":     mapping.port,
+			"database": mapping.database,
+			"prefix":   mapping.prefix,
+		}).Info("Listening on a database port")
+	}
+
+	fields := logrus.Fields{
+		"proxy_port":   config.ProxyPort,
+		"proxy_socket": config.ProxySocket,
+		"mysql_addr":   p.backendAddr(),
+	}
+	if addr := p.Addr(); addr != nil {
+		fields["proxy_addr"] = addr.String()
+	}
+	p.log.WithFields(fields).Info("MySQL Auto DB Proxy started")
+	if config.StatsInterval > 0 {
+		go p.logStats(config.StatsInterval)
+	}
+
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			if err := p.Serve(listener); err != nil {
+				p.log.WithError(err).Error("Stopped accepting connections")
+			}
+		}(listener)
+	}
+	go p.signalReady()
+
+	select {
+	case <-p.stopped:
+		return nil
+	case <-ctx.Done():
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+		defer cancel()
+		return p.Shutdown(shutdownCtx)
+	}
+}
+
+// Addr returns the address the proxy listens on for TCP clients, or nil
+// before ListenAndServe has bound it
+func (p *Proxy) Addr() net.Addr {
+	p.listenersMu.Lock()
+	defer p.listenersMu.Unlock()
+	return p.tcpAddr
+}
+
+// Serve accepts and handles connections on the listener until Shutdown
+// closes it. It returns nil once the proxy is shutting down, or the error
+// that broke the listener otherwise. Temporary accept errors, such as running
+// out of file descriptors, are retried after a pause that doubles with each
+// consecutive one, from 5ms up to a second, as net/http does.
+func (p *Proxy) Serve(listener net.Listener) error {
+	if !p.trackListener(listener) {
+		listener.Close()
+		return nil
+	}
+	mapping := listenerMapping(listener)
+	var backoff time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if p.closing.Load() {
+				return nil
+			}
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Temporary() { //nolint:staticcheck // what net/http checks too
+				return err
+			}
+			if backoff *= 2; backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff > time.Second {
+				backoff = time.Second
+			}
+			acceptBackoffs.Inc()
+			p.log.WithError(err).WithField("retry_in", backoff.String()).Error("Failed to accept connection")
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		p.connStarted()
+		connectionsAccepted.Inc()
+		go func() {
+			defer p.connDone()
+			if !p.connLimit.acquire() {
+				logger := p.log.WithFields(logrus.Fields{
+					"client_addr": conn.RemoteAddr().String(),
+					"active":      connectionsActive.Value(),
+					"peak":        connectionsPeak.Value(),
+				})
+				p.rejectConnection(conn, logger, "too_many_connections", 0, errCategoryTooManyConnections, "too many connections")
+				return
+			}
+			defer p.connLimit.release()
+			defer trackActive()()
+			p.handleConnection(conn, mapping)
+		}()
+	}
+}
@@ -0,0 +1,1046 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// testClientCapabilities are those of a MySQL 8.0 client connecting without
+// TLS or compression
+const testClientCapabilities = clientMySQL | clientConnectWithDB | clientProtocol41 | clientSecureConnection |
+	clientPluginAuth | clientConnectAttrs | clientPluginAuthLenencClientData | 0x0000a000
+
+// testConfig returns the default configuration, pointed at backend
+func testConfig(backend *fakeMySQL) Config {
+	config := DefaultConfig()
+	host, port, _ := net.SplitHostPort(backend.addr())
+	config.MySQLHost = host
+	config.MySQLPort, _ = strconv.Atoi(port)
+	config.HandshakeTimeout = 5 * time.Second
+	config.StatsInterval = 0
+	return config
+}
+
+// testLogger returns a logger whose entries the hook records
+func testLogger() (*logrus.Logger, *test.Hook) {
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	return logger, hook
+}
+
+// startProxy creates a proxy for config and serves it on a loopback port
+// until the test ends, returning the proxy and its address
+func startProxy(t testing.TB, config Config, opts ...Option) (*Proxy, string) {
+	t.Helper()
+	logger, _ := testLogger()
+	p, err := New(config, append([]Option{WithLogger(logger)}, opts...)...)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return p, serveProxy(t, p)
+}
+
+// serveProxy serves p on a loopback port until the test ends
+func serveProxy(t testing.TB, p *Proxy) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go p.Serve(listener)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		p.Shutdown(ctx)
+	})
+	return listener.Addr().String()
+}
+
+// testHandshake describes the HandshakeResponse41 a test client sends
+type testHandshake struct {
+	capabilities uint32
+	mariaDBCaps  uint32
+	user         string
+	auth         []byte
+	database     string
+	plugin       string
+	attrs        [][2]string
+}
+
+// payload encodes the handshake response according to its capabilities
+func (h testHandshake) payload() []byte {
+	caps := h.capabilities
+	if caps == 0 {
+		caps = testClientCapabilities
+	}
+	payload := binary32(caps)
+	payload = append(payload, 0, 0, 0, 1, 45)
+	payload = append(payload, make([]byte, 19)...)
+	payload = append(payload, binary32(h.mariaDBCaps)...)
+	payload = append(payload, h.user...)
+	payload = append(payload, 0)
+	switch {
+	case caps&clientPluginAuthLenencClientData != 0:
+		payload = appendLengthEncodedInt(payload, uint64(len(h.auth)))
+		payload = append(payload, h.auth...)
+	case caps&clientSecureConnection != 0:
+		payload = append(payload, byte(len(h.auth)))
+		payload = append(payload, h.auth...)
+	default:
+		payload = append(payload, h.auth...)
+		payload = append(payload, 0)
+	}
+	if caps&clientConnectWithDB != 0 {
+		payload = append(payload, h.database...)
+		payload = append(payload, 0)
+	}
+	if caps&clientPluginAuth != 0 {
+		plugin := h.plugin
+		if plugin == "" {
+			plugin = "mysql_native_password"
+		}
+		payload = append(payload, plugin...)
+		payload = append(payload, 0)
+	}
+	if caps&clientConnectAttrs != 0 {
+		var attrs []byte
+		for _, attr := range h.attrs {
+			attrs = appendLengthEncodedString(attrs, attr[0])
+			attrs = appendLengthEncodedString(attrs, attr[1])
+		}
+		payload = appendLengthEncodedInt(payload, uint64(len(attrs)))
+		payload = append(payload, attrs...)
+	}
+	return payload
+}
+
+// binary32 encodes a little-endian 32-bit integer
+func binary32(value uint32) []byte {
+	return []byte{byte(value), byte(value >> 8), byte(value >> 16), byte(value >> 24)}
+}
+
+// testClient is a MySQL client speaking the raw protocol to the proxy
+type testClient struct {
+	t        testing.TB
+	conn     net.Conn
+	greeting *MySQLPacket
+}
+
+// dialTestClient connects to addr and reads the greeting
+func dialTestClient(t testing.TB, addr string) *testClient {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	c := &testClient{t: t, conn: conn}
+	if c.greeting, err = readPacket(conn); err != nil {
+		t.Fatalf("read greeting: %v", err)
+	}
+	return c
+}
+
+// connect connects to addr with the handshake and returns the client with
+// the proxy's answer to it
+func connect(t testing.TB, addr string, handshake testHandshake) (*testClient, *MySQLPacket) {
+	t.Helper()
+	c := dialTestClient(t, addr)
+	return c, c.send(1, handshake.payload())
+}
+
+// mustConnect connects to addr with the handshake and fails the test unless
+// the proxy answers it with an OK
+func mustConnect(t testing.TB, addr string, handshake testHandshake) *testClient {
+	t.Helper()
+	c, response := connect(t, addr, handshake)
+	if response == nil || response.Payload[0] != 0x00 {
+		t.Fatalf("handshake answered with %s", describePacket(response))
+	}
+	return c
+}
+
+// send writes a packet and returns the first packet of the answer, or nil
+// if the connection was closed
+func (c *testClient) send(seq int, payload []byte) *MySQLPacket {
+	c.t.Helper()
+	if err := writePacket(c.conn, newPacket(seq, payload)); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+	return c.read()
+}
+
+// read returns the next packet, or nil if the connection was closed
+func (c *testClient) read() *MySQLPacket {
+	c.t.Helper()
+	packet, err := readPacket(c.conn)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) || isConnReset(err) {
+			return nil
+		}
+		c.t.Fatalf("read: %v", err)
+	}
+	return packet
+}
+
+// command sends a command and returns the packets of its answer: an OK or
+// ERR, or a whole result set
+func (c *testClient) command(payload []byte) []*MySQLPacket {
+	c.t.Helper()
+	first := c.send(0, payload)
+	if first == nil {
+		return nil
+	}
+	packets := []*MySQLPacket{first}
+	if isOKOrErr(first.Payload) || first.Payload[0] == 0xfb || payload[0] == comStmtPrepare {
+		return packets
+	}
+	for eofs := 0; eofs < 2; {
+		packet := c.read()
+		if packet == nil {
+			return packets
+		}
+		packets = append(packets, packet)
+		if packet.Payload[0] == 0xfe && len(packet.Payload) < 9 {
+			eofs++
+		}
+	}
+	return packets
+}
+
+// query runs a statement and returns the first packet of its answer
+func (c *testClient) query(query string) *MySQLPacket {
+	c.t.Helper()
+	packets := c.command(append([]byte{comQuery}, query...))
+	if len(packets) == 0 {
+		return nil
+	}
+	return packets[0]
+}
+
+// mustQuery runs a statement and fails the test unless it is answered OK
+func (c *testClient) mustQuery(query string) {
+	c.t.Helper()
+	if response := c.query(query); response == nil || response.Payload[0] == 0xff {
+		c.t.Fatalf("%s answered with %s", query, describePacket(response))
+	}
+}
+
+// isConnReset reports whether err is a connection reset by the peer
+func isConnReset(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && !opErr.Timeout()
+}
+
+// describePacket describes a packet in a test failure
+func describePacket(packet *MySQLPacket) string {
+	switch {
+	case packet == nil:
+		return "a closed connection"
+	case len(packet.Payload) > 0 && packet.Payload[0] == 0xff:
+		return "ERR " + strconv.Itoa(errPacketCode(packet.Payload)) + " " + errPacketMessage(packet.Payload)
+	case len(packet.Payload) > 0 && packet.Payload[0] == 0x00:
+		return "OK"
+	}
+	return "a packet of " + strconv.Itoa(len(packet.Payload)) + " bytes"
+}
+
+// expectErr fails the test unless packet is an ERR with the code
+func expectErr(t *testing.T, packet *MySQLPacket, code int) {
+	t.Helper()
+	if packet == nil || packet.Payload[0] != 0xff || errPacketCode(packet.Payload) != code {
+		t.Fatalf("got %s, want ERR %d", describePacket(packet), code)
+	}
+}
+
+// recordingEnsurer records the databases it is asked for and creates them on
+// the fake backend, unless it fails with err
+type recordingEnsurer struct {
+	backend *fakeMySQL
+
+	mu    sync.Mutex
+	names []string
+	ctxs  []context.Context
+	err   error
+}
+
+func (e *recordingEnsurer) EnsureExists(ctx context.Context, name string) error {
+	e.mu.Lock()
+	e.names = append(e.names, name)
+	e.ctxs = append(e.ctxs, ctx)
+	err := e.err
+	e.mu.Unlock()
+	if err == nil && e.backend != nil {
+		e.backend.create(name)
+	}
+	return err
+}
+
+// requested returns the databases asked for so far
+func (e *recordingEnsurer) requested() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]string(nil), e.names...)
+}
+
+// eventually polls cond until it holds, failing the test after a few seconds
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// lastCommand returns the last command the backend received
+func lastCommand(backend *fakeMySQL) []byte {
+	commands := backend.receivedCommands()
+	if len(commands) == 0 {
+		return nil
+	}
+	return commands[len(commands)-1]
+}
+
+func TestNewRejectsInvalidConfiguration(t *testing.T) {
+	backend := startFakeMySQL(t)
+	for name, mutate := range map[string]func(*Config){
+		"allowed clients": func(c *Config) { c.AllowedClients = []string{"not-an-address"} },
+		"debug port":      func(c *Config) { c.DebugPort = c.ProxyPort },
+		"dry run check":   func(c *Config) { c.DryRunCheck = true },
+		"proxy loop":      func(c *Config) { c.MySQLHost, c.MySQLPort = "127.0.0.1", c.ProxyPort },
+	} {
+		t.Run(name, func(t *testing.T) {
+			config := testConfig(backend)
+			mutate(&config)
+			logger, _ := testLogger()
+			if p, err := New(config, WithLogger(logger)); err == nil {
+				t.Fatalf("New succeeded with %+v", p.config)
+			}
+		})
+	}
+}
+
+func TestServeRelaysToBackend(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.create("app")
+	_, addr := startProxy(t, testConfig(backend))
+
+	c := mustConnect(t, addr, testHandshake{user: "root", database: "app"})
+	c.mustQuery("SELECT 1")
+	if got := string(lastCommand(backend)); got != "\x03SELECT 1" {
+		t.Fatalf("backend received %q", got)
+	}
+	if c.greeting.Payload[0] != 10 {
+		t.Fatalf("greeting is not a HandshakeV10: %x", c.greeting.Payload)
+	}
+}
+
+func TestHandleConnectionOverPipe(t *testing.T) {
+	backend := startFakeMySQL(t)
+	ensurer := &recordingEnsurer{backend: backend}
+	logger, _ := testLogger()
+	p, err := New(testConfig(backend), WithLogger(logger), WithEnsurer(ensurer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.handleConnection(server, nil)
+	}()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &testClient{t: t, conn: client}
+	if c.greeting, err = readPacket(client); err != nil {
+		t.Fatal(err)
+	}
+	if response := c.send(1, testHandshake{user: "root", database: "piped"}.payload()); response.Payload[0] != 0x00 {
+		t.Fatalf("handshake answered with %s", describePacket(response))
+	}
+	c.mustQuery("USE other")
+	if got := ensurer.requested(); !equalStrings(got, []string{"piped", "other"}) {
+		t.Fatalf("created %q", got)
+	}
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handleConnection did not return once the client closed")
+	}
+}
+
+// pipeClient serves one connection of p over a net.Pipe, returning the
+// client end once it has read the greeting
+func pipeClient(t *testing.T, p *Proxy) *testClient {
+	t.Helper()
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.handleConnection(server, nil)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &testClient{t: t, conn: client}
+	var err error
+	if c.greeting, err = readPacket(client); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCreationFailuresAnswerWithErr(t *testing.T) {
+	backend := startFakeMySQL(t)
+	ensurer := &recordingEnsurer{}
+	logger, _ := testLogger()
+	p, err := New(testConfig(backend), WithLogger(logger), WithEnsurer(ensurer))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		err     error
+		code    int
+		message string
+	}{
+		{newProxyError(errCategoryValidation, "invalid name"), 1102, "mysql-auto-db-proxy: cannot create database 'orders': invalid name"},
+		{newProxyError(errCategoryAccessDenied, "permission denied"), 1045, "mysql-auto-db-proxy: cannot create database 'orders': permission denied"},
+		{fmt.Errorf("dial tcp: connection refused"), 1053, "mysql-auto-db-proxy: cannot create database 'orders': dial tcp: connection refused"},
+	} {
+		ensurer.mu.Lock()
+		ensurer.err = tc.err
+		ensurer.mu.Unlock()
+
+		// The handshake is answered with an ERR following the client's packet
+		c := pipeClient(t, p)
+		response := c.send(1, testHandshake{user: "root", database: "orders"}.payload())
+		expectErr(t, response, tc.code)
+		if response.SequenceID != 2 || errPacketMessage(response.Payload) != tc.message {
+			t.Fatalf("handshake answered with seq %d %q", response.SequenceID, errPacketMessage(response.Payload))
+		}
+		if c.read() != nil {
+			t.Fatal("the connection stayed open after the ERR")
+		}
+	}
+
+	// A USE or COM_INIT_DB that cannot create its database fails with an ERR
+	// naming it, and the connection stays usable
+	ensurer.mu.Lock()
+	ensurer.err = nil
+	ensurer.mu.Unlock()
+	c := pipeClient(t, p)
+	if response := c.send(1, testHandshake{user: "root"}.payload()); response.Payload[0] != 0x00 {
+		t.Fatalf("handshake answered with %s", describePacket(response))
+	}
+	ensurer.mu.Lock()
+	ensurer.err = fmt.Errorf("dial tcp: connection refused")
+	ensurer.mu.Unlock()
+	for _, command := range [][]byte{append([]byte{comQuery}, "USE billing"...), append([]byte{comInitDB}, "billing"...)} {
+		response := c.send(0, command)
+		expectErr(t, response, 1053)
+		if response.SequenceID != 1 || !strings.Contains(errPacketMessage(response.Payload), "'billing'") {
+			t.Fatalf("command answered with seq %d %q", response.SequenceID, errPacketMessage(response.Payload))
+		}
+	}
+	ensurer.mu.Lock()
+	ensurer.err = nil
+	ensurer.mu.Unlock()
+	c.mustQuery("SELECT 1")
+}
+
+func TestShutdownDrainsConnections(t *testing.T) {
+	backend := startFakeMySQL(t)
+	logger, hook := testLogger()
+	p, err := New(testConfig(backend), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveProxy(t, p)
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- p.Shutdown(context.Background()) }()
+
+	// New connections are refused while the open one is drained
+	eventually(t, "the listener to close", func() bool {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	})
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a connection open", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.mustQuery("SELECT 1")
+	writePacket(c.conn, newPacket(0, []byte{comQuit}))
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	entry := findEntry(hook, "Connections drained")
+	if entry == nil || entry.Data["drained"] != int64(1) || entry.Data["force_closed"] != int64(0) {
+		t.Fatalf("drain reported as %v", entry)
+	}
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("second Shutdown: %v", err)
+	}
+}
+
+func TestShutdownForceClosesOnTimeout(t *testing.T) {
+	backend := startFakeMySQL(t)
+	logger, hook := testLogger()
+	p, err := New(testConfig(backend), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveProxy(t, p)
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if packet := c.read(); packet != nil && packet.Payload[0] != 0xff {
+		t.Fatalf("client read %s after a forced shutdown", describePacket(packet))
+	}
+	entry := findEntry(hook, "Connections drained")
+	if entry == nil || entry.Data["drained"] != int64(0) || entry.Data["force_closed"] != int64(1) {
+		t.Fatalf("drain reported as %v", entry)
+	}
+}
+
+func TestServeAfterShutdown(t *testing.T) {
+	backend := startFakeMySQL(t)
+	p, _ := startProxy(t, testConfig(backend))
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Serve(listener); err != nil {
+		t.Fatalf("Serve after Shutdown: %v", err)
+	}
+	if _, err := listener.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("listener still open after Serve returned: %v", err)
+	}
+}
+
+func TestListenAndServeStopsWithContext(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.ProxyPort = 0
+	config.ListenAddress = "127.0.0.1"
+	config.StartupWait = 0
+	config.ShutdownTimeout = time.Second
+	logger, _ := testLogger()
+	p, err := New(config, WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.ListenAndServe(ctx) }()
+	eventually(t, "the proxy to listen", func() bool { return p.Addr() != nil })
+
+	mustConnect(t, p.Addr().String(), testHandshake{user: "root"}).mustQuery("SELECT 1")
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ListenAndServe: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe did not return once its context was done")
+	}
+	if p.runCtx.Err() == nil {
+		t.Fatal("background work still running after shutdown")
+	}
+}
+
+func TestUseCreatesDatabase(t *testing.T) {
+	backend := startFakeMySQL(t)
+	ensurer := &recordingEnsurer{backend: backend}
+	_, addr := startProxy(t, testConfig(backend), WithEnsurer(ensurer))
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	for _, query := range []string{"USE orders", "use `billing` ;", "USE inventory -- pick\n"} {
+		c.mustQuery(query)
+	}
+	if got, want := ensurer.requested(), []string{"orders", "billing", "inventory"}; !equalStrings(got, want) {
+		t.Fatalf("created %q, want %q", got, want)
+	}
+
+	// Statements that merely start like USE are forwarded untouched
+	c.mustQuery("SELECT * FROM users")
+	expectErr(t, c.query("USE a b"), 1064)
+	if got := ensurer.requested(); len(got) != 3 {
+		t.Fatalf("created %q for statements that are not a USE", got)
+	}
+}
+
+func TestInitDBCreatesDatabase(t *testing.T) {
+	backend := startFakeMySQL(t)
+	ensurer := &recordingEnsurer{backend: backend}
+	_, addr := startProxy(t, testConfig(backend), WithEnsurer(ensurer))
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	if response := c.command(append([]byte{comInitDB}, "reports"...)); response[0].Payload[0] != 0x00 {
+		t.Fatalf("COM_INIT_DB answered with %s", describePacket(response[0]))
+	}
+	if got := ensurer.requested(); !equalStrings(got, []string{"reports"}) {
+		t.Fatalf("created %q", got)
+	}
+	if got := string(lastCommand(backend)); got != "\x02reports" {
+		t.Fatalf("backend received %q", got)
+	}
+}
+
+func TestSelectingDatabasesCreatesThemOnMySQL(t *testing.T) {
+	backend := startFakeMySQL(t)
+	_, addr := startProxy(t, testConfig(backend))
+
+	// Drivers select databases with COM_INIT_DB, interactive clients with USE
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	if response := c.command(append([]byte{comInitDB}, "from_driver"...)); response[0].Payload[0] != 0x00 {
+		t.Fatalf("COM_INIT_DB answered with %s", describePacket(response[0]))
+	}
+	c.mustQuery("  use \t\n from_client ;")
+	for _, name := range []string{"from_driver", "from_client"} {
+		if !backend.hasDatabase(name) {
+			t.Fatalf("%s was not created", name)
+		}
+	}
+
+	for payload, want := range map[string]bool{"\x02orders": true, "\x02": false, "\x03USE orders": false, "": false} {
+		if got := isInitDBCommand([]byte(payload)); got != want {
+			t.Errorf("isInitDBCommand(%q) = %v", payload, got)
+		}
+	}
+}
+
+func TestHandshakeDatabaseIsCreated(t *testing.T) {
+	backend := startFakeMySQL(t)
+	_, addr := startProxy(t, testConfig(backend))
+
+	mustConnect(t, addr, testHandshake{user: "root", database: "fresh"})
+	if !backend.hasDatabase("fresh") {
+		t.Fatal("the handshake's database was not created on MySQL")
+	}
+	if !containsString(backend.receivedQueries(), "CREATE DATABASE `fresh`") {
+		t.Fatalf("queries were %q", backend.receivedQueries())
+	}
+}
+
+func TestInvalidUseIsRefused(t *testing.T) {
+	backend := startFakeMySQL(t)
+	_, addr := startProxy(t, testConfig(backend))
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	response := c.query("USE `bad;name`")
+	if response.Payload[0] != 0xff {
+		t.Fatalf("invalid USE answered with %s", describePacket(response))
+	}
+	if backend.hasDatabase("bad;name") {
+		t.Fatal("created a database with an invalid name")
+	}
+
+	// The connection stays usable
+	c.mustQuery("SELECT 1")
+}
+
+func TestValidateDatabaseName(t *testing.T) {
+	long := strings.Repeat("a", 64)
+	for _, tc := range []struct {
+		name            string
+		strict, relaxed bool
+	}{
+		{"orders", true, true},
+		{"orders-eu_2", true, true},
+		// Names merely containing a system schema's name are fine
+		{"mysql_exporter_test", true, true},
+		{"system_config", true, true},
+		{"analysys", true, true},
+		{"my_information_schema", true, true},
+		// The system schemas themselves are not, in any case
+		{"mysql", false, false},
+		{"SYS", false, false},
+		{"Information_Schema", false, false},
+		{"performance_schema", false, false},
+		{long, true, true},
+		{long + "a", false, false},
+		{strings.Repeat("é", 64), false, true},
+		{strings.Repeat("é", 65), false, false},
+		{"", false, false},
+		{"price$list", false, true},
+		{"back`tick", false, true},
+		{"bad;name", false, true},
+		{"trailing ", false, false},
+		{"nul\x00byte", false, false},
+		{"emoji\U0001F600", false, false},
+		{"invalid\xff", false, false},
+	} {
+		if err := validateDatabaseName(tc.name, true); (err == nil) != tc.strict {
+			t.Errorf("strict validateDatabaseName(%q) = %v", tc.name, err)
+		}
+		if err := validateDatabaseName(tc.name, false); (err == nil) != tc.relaxed {
+			t.Errorf("validateDatabaseName(%q) = %v", tc.name, err)
+		}
+	}
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	for name, want := range map[string]string{
+		"orders":     "`orders`",
+		"back`tick":  "`back``tick`",
+		"``":         "``````",
+		"price$list": "`price$list`",
+	} {
+		if got := quoteIdentifier(name); got != want {
+			t.Errorf("quoteIdentifier(%q) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestRelaxedNamesAreCreated(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.StrictDBNames = false
+	_, addr := startProxy(t, config)
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	for _, name := range []string{"price$list", "back`tick", "café"} {
+		c.mustQuery("USE " + quoteIdentifier(name))
+		if !backend.hasDatabase(name) {
+			t.Fatalf("%q was not created", name)
+		}
+	}
+	if !containsString(backend.receivedQueries(), "CREATE DATABASE `back``tick`") {
+		t.Fatal("the backtick was not escaped in CREATE DATABASE")
+	}
+}
+
+func TestChangeUserCreatesDatabase(t *testing.T) {
+	backend := startFakeMySQL(t)
+	ensurer := &recordingEnsurer{backend: backend}
+	_, addr := startProxy(t, testConfig(backend), WithEnsurer(ensurer))
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	response := c.command(changeUserPayload("app", []byte("scrambled"), "tenant"))
+	if response[0].Payload[0] != 0x00 {
+		t.Fatalf("COM_CHANGE_USER answered with %s", describePacket(response[0]))
+	}
+	if got := ensurer.requested(); !equalStrings(got, []string{"tenant"}) {
+		t.Fatalf("created %q", got)
+	}
+
+	// The session carries on with commands once the exchange is over
+	c.mustQuery("USE next")
+	if got := ensurer.requested(); !equalStrings(got, []string{"tenant", "next"}) {
+		t.Fatalf("created %q", got)
+	}
+}
+
+func TestChangeUserWithoutDatabase(t *testing.T) {
+	backend := startFakeMySQL(t)
+	ensurer := &recordingEnsurer{backend: backend}
+	p, addr := startProxy(t, testConfig(backend), WithEnsurer(ensurer))
+
+	c := mustConnect(t, addr, testHandshake{user: "root", database: "orders"})
+	response := c.command(changeUserPayload("app", []byte("scrambled"), ""))
+	if response[0].Payload[0] != 0x00 {
+		t.Fatalf("COM_CHANGE_USER answered with %s", describePacket(response[0]))
+	}
+	if got := ensurer.requested(); !equalStrings(got, []string{"orders"}) {
+		t.Fatalf("created %q", got)
+	}
+	if current := p.conns.all()[0].cc.CurrentDB(); current != "" {
+		t.Fatalf("the session still has %q selected", current)
+	}
+}
+
+// changeUserPayload builds a COM_CHANGE_USER with a length-prefixed auth
+// response
+func changeUserPayload(user string, auth []byte, database string) []byte {
+	payload := append([]byte{comChangeUser}, user...)
+	payload = append(payload, 0, byte(len(auth)))
+	payload = append(payload, auth...)
+	payload = append(payload, database...)
+	payload = append(payload, 0, 45, 0)
+	payload = append(payload, "mysql_native_password"...)
+	return append(payload, 0)
+}
+
+// findEntry returns the last log entry with the message, or nil
+func findEntry(hook *test.Hook, message string) *logrus.Entry {
+	entries := hook.AllEntries()
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Message == message {
+			return entries[i]
+		}
+	}
+	return nil
+}
+
+// equalStrings reports whether two slices hold the same strings in order
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// containsString reports whether list holds value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// containsBytes reports whether list holds value
+func containsBytes(list [][]byte, value []byte) bool {
+	for _, item := range list {
+		if bytes.Equal(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestExtractDatabaseFromUseCommand(t *testing.T) {
+	for query, want := range map[string]string{
+		"USE foo":                 "foo",
+		"use foo;":                "foo",
+		"USE foo ;":               "foo",
+		"USE foo;-- x":            "foo",
+		"USE foo /* c */":         "foo",
+		"USE foo/* c */;":         "foo",
+		"USE foo -- x\n":          "foo",
+		"USE foo # x":             "foo",
+		"  \tUSE\n`foo`  ;  ":     "foo",
+		"USE `my db`":             "my db",
+		"USE `a``b`":              "a`b",
+		"USE`foo`":                "foo",
+		"USE foo; SELECT 1":       "foo",
+		"USE foo\x00":             "foo",
+		"USE foo bar":             "",
+		"USE foo /* unterminated": "",
+		"USE `unterminated":       "",
+		"USE ;":                   "",
+		"USE":                     "",
+		"USEFUL":                  "",
+		"SELECT 'USE foo'":        "",
+	} {
+		if got := extractDatabaseFromUseCommand(append([]byte{comQuery}, query...)); got != want {
+			t.Errorf("%q gave %q, want %q", query, got, want)
+		}
+	}
+	if got := extractDatabaseFromUseCommand(append([]byte{comInitDB}, "USE foo"...)); got != "" {
+		t.Errorf("a COM_INIT_DB gave %q", got)
+	}
+}
+
+func TestRequiredConnectionAttrs(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.RequiredConnectionAttrs = []string{"_service_name", "_client_name"}
+	_, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	mustConnect(t, addr, testHandshake{user: "root", attrs: [][2]string{
+		{"_client_name", "libmysql"}, {"_service_name", "billing"}, {"_pid", "42"},
+	}})
+	before := len(backend.receivedHandshakes())
+
+	for name, handshake := range map[string]testHandshake{
+		"missing attribute": {user: "root", attrs: [][2]string{{"_client_name", "libmysql"}}},
+		"no attributes":     {user: "root"},
+		"without CLIENT_CONNECT_ATTRS": {
+			user: "root", capabilities: testClientCapabilities &^ clientConnectAttrs,
+		},
+	} {
+		_, response := connect(t, addr, handshake)
+		expectErr(t, response, 1045)
+		if message := errPacketMessage(response.Payload); !strings.Contains(message, "connection attribute '_service_name' is required") {
+			t.Fatalf("%s: refused with %q", name, message)
+		}
+	}
+	if got := len(backend.receivedHandshakes()); got != before {
+		t.Fatal("a handshake missing required attributes was forwarded to MySQL")
+	}
+}
+
+func TestDeniedHandshakeDatabase(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.create("mysql")
+	_, addr := startProxy(t, testConfig(backend))
+
+	for database, code := range map[string]int{"mysql": 1044, "Performance_Schema": 1044, "bad;name": 1102} {
+		before := len(backend.receivedHandshakes())
+		_, response := connect(t, addr, testHandshake{user: "root", database: database})
+		expectErr(t, response, code)
+		// The ERR follows the client's handshake response, numbered 1
+		if response.SequenceID != 2 {
+			t.Fatalf("ERR numbered %d, want 2", response.SequenceID)
+		}
+		if message := errPacketMessage(response.Payload); !strings.Contains(message, "'"+database+"'") {
+			t.Fatalf("refused with %q, which does not name the database", message)
+		}
+		if len(backend.receivedHandshakes()) != before {
+			t.Fatalf("the handshake for %q was forwarded to MySQL", database)
+		}
+	}
+
+	config := testConfig(backend)
+	config.DeniedHandshakeAction = "passthrough"
+	_, addr = startProxy(t, config)
+	mustConnect(t, addr, testHandshake{user: "root", database: "mysql"})
+}
+
+func TestInvalidHandshakeDatabasePassthrough(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.create("my db")
+
+	_, addr := startProxy(t, testConfig(backend))
+	_, response := connect(t, addr, testHandshake{user: "root", database: "my db"})
+	expectErr(t, response, 1102)
+
+	// MySQL accepts the name it has quoted, so the handshake reaches it as sent
+	config := testConfig(backend)
+	config.DeniedHandshakeAction = "passthrough"
+	_, addr = startProxy(t, config)
+	mustConnect(t, addr, testHandshake{user: "root", database: "my db"})
+
+	handshakes := backend.receivedHandshakes()
+	hr, err := parseHandshakeResponse(handshakes[len(handshakes)-1])
+	if err != nil {
+		t.Fatalf("parse forwarded handshake: %v", err)
+	}
+	if hr.Database != "my db" {
+		t.Fatalf("MySQL received database %q", hr.Database)
+	}
+	for _, query := range backend.receivedQueries() {
+		if strings.HasPrefix(query, "CREATE DATABASE") {
+			t.Fatalf("the proxy created a database with %q", query)
+		}
+	}
+}
+
+func TestMaxUsernameLength(t *testing.T) {
+	backend := startFakeMySQL(t)
+	p, addr := startProxy(t, testConfig(backend), WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	// MySQL's limit is 32 characters, not bytes
+	mustConnect(t, addr, testHandshake{user: strings.Repeat("é", 32)})
+
+	before := len(backend.receivedHandshakes())
+	_, response := connect(t, addr, testHandshake{user: strings.Repeat("u", 33)})
+	expectErr(t, response, 1045)
+	if message := errPacketMessage(response.Payload); message != "mysql-auto-db-proxy: username is longer than 32 characters" {
+		t.Fatalf("refused with %q", message)
+	}
+	if len(backend.receivedHandshakes()) != before {
+		t.Fatal("the handshake was forwarded to MySQL")
+	}
+	if recent := p.rejections.recent(); len(recent) == 0 || recent[0].Reason != "username_too_long" {
+		t.Fatalf("/status reports %+v", recent)
+	}
+
+	config := testConfig(backend)
+	config.MaxUsernameLength = 0
+	_, addr = startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+	mustConnect(t, addr, testHandshake{user: strings.Repeat("u", 100)})
+}
+
+func TestConnectionIDsInLogs(t *testing.T) {
+	backend := startFakeMySQL(t)
+	logger, hook := testLogger()
+	p, addr := startProxy(t, testConfig(backend), WithLogger(logger))
+
+	// Two connections at once each log under their own conn_id, down to the
+	// creation of their database
+	var wg sync.WaitGroup
+	for _, name := range []string{"left", "right"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			c, response := connect(t, addr, testHandshake{user: "root"})
+			if response == nil || response.Payload[0] != 0x00 {
+				t.Errorf("handshake answered with %s", describePacket(response))
+				return
+			}
+			if response := c.query("USE " + name); response == nil || response.Payload[0] != 0x00 {
+				t.Errorf("USE answered with %s", describePacket(response))
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	ids := make(map[string]interface{})
+	for _, entry := range hook.AllEntries() {
+		database, _ := entry.Data["database"].(string)
+		if entry.Message != "Created database" || (database != "left" && database != "right") {
+			continue
+		}
+		if entry.Data["conn_id"] == nil {
+			t.Fatalf("%q logged without a conn_id", entry.Message)
+		}
+		ids[database] = entry.Data["conn_id"]
+	}
+	if len(ids) != 2 || ids["left"] == ids["right"] {
+		t.Fatalf("databases created under conn_ids %v", ids)
+	}
+
+	// Every line of a connection carries its ID, as does its created database
+	for database, id := range ids {
+		intercepted := 0
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "Intercepted USE command" && entry.Data["database"] == database {
+				intercepted++
+				if entry.Data["conn_id"] != id {
+					t.Errorf("USE of %s logged under conn_id %v, not %v", database, entry.Data["conn_id"], id)
+				}
+			}
+		}
+		if intercepted != 1 {
+			t.Errorf("USE of %s logged %d times", database, intercepted)
+		}
+		if created, _ := p.created.get(database); created.ConnID != id {
+			t.Errorf("%s registered for conn_id %d, not %v", database, created.ConnID, id)
+		}
+	}
+}
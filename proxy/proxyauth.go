@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// proxyAuthenticator checks the token clients present in a connection
+// attribute against an allowlist, independently of MySQL's own
+// authentication. The proxy only sees the scrambled auth response, never the
+// password, so clients prove themselves with a token instead.
+type proxyAuthenticator struct {
+	attribute string
+
+	// tokens maps usernames, or "*" for any user, to their accepted tokens
+	tokens map[string][]string
+}
+
+// newProxyAuthenticator loads the configured static tokens and token file.
+// Entries have the form "username:token"; a username of "*" accepts the
+// token for any user.
+func newProxyAuthenticator(config Config) (*proxyAuthenticator, error) {
+	a := &proxyAuthenticator{attribute: config.ProxyAuthAttribute, tokens: make(map[string][]string)}
+
+	for _, entry := range config.ProxyAuthTokens {
+		if err := a.add(entry); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.ProxyAuthTokenFile != "" {
+		file, err := os.Open(config.ProxyAuthTokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open proxy auth token file: %w", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		for line := 1; scanner.Scan(); line++ {
+			entry := strings.TrimSpace(scanner.Text())
+			if entry == "" || strings.HasPrefix(entry, "#") {
+				continue
+			}
+			if err := a.add(entry); err != nil {
+				return nil, fmt.Errorf("%s:%d: %w", config.ProxyAuthTokenFile, line, err)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read proxy auth token file: %w", err)
+		}
+	}
+
+	if len(a.tokens) == 0 {
+		return nil, fmt.Errorf("no proxy auth tokens configured")
+	}
+	return a, nil
+}
+
+// add parses and adds a "username:token" entry
+func (a *proxyAuthenticator) add(entry string) error {
+	username, token, ok := strings.Cut(entry, ":")
+	if !ok || username == "" || token == "" {
+		return fmt.Errorf("invalid proxy auth entry, expected username:token")
+	}
+	a.tokens[username] = append(a.tokens[username], token)
+	return nil
+}
+
+// authenticate reports whether the attributes carry a token accepted for the user
+func (a *proxyAuthenticator) authenticate(username string, attrs map[string]string) bool {
+	presented, ok := attrs[a.attribute]
+	if !ok {
+		return false
+	}
+
+	// Compare against every candidate so that timing does not reveal which matched
+	matched := 0
+	for _, candidates := range [][]string{a.tokens[username], a.tokens["*"]} {
+		for _, token := range candidates {
+			matched |= subtle.ConstantTimeCompare([]byte(presented), []byte(token))
+		}
+	}
+	return matched == 1
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProxyAuthenticator(t *testing.T) {
+	config := DefaultConfig()
+	config.ProxyAuthTokens = []string{"app:s3cret", "*:shared"}
+	config.ProxyAuthTokenFile = filepath.Join(t.TempDir(), "tokens")
+	if err := os.WriteFile(config.ProxyAuthTokenFile, []byte("# rotated monthly\n\napp:next\nops:from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := newProxyAuthenticator(config)
+	if err != nil {
+		t.Fatalf("newProxyAuthenticator: %v", err)
+	}
+
+	for _, tc := range []struct {
+		username string
+		attrs    map[string]string
+		want     bool
+	}{
+		{"app", map[string]string{"proxy_auth_token": "s3cret"}, true},
+		{"app", map[string]string{"proxy_auth_token": "next"}, true},
+		{"ops", map[string]string{"proxy_auth_token": "from-file"}, true},
+		{"anyone", map[string]string{"proxy_auth_token": "shared"}, true},
+		{"app", map[string]string{"proxy_auth_token": "wrong"}, false},
+		{"app", map[string]string{"proxy_auth_token": ""}, false},
+		{"anyone", map[string]string{"proxy_auth_token": "s3cret"}, false},
+		{"app", map[string]string{"other": "s3cret"}, false},
+		{"app", nil, false},
+	} {
+		if got := auth.authenticate(tc.username, tc.attrs); got != tc.want {
+			t.Errorf("authenticate(%s, %v) = %v", tc.username, tc.attrs, got)
+		}
+	}
+
+	for name, tc := range map[string]struct {
+		tokens []string
+		file   string
+		want   string
+	}{
+		"no tokens":      {want: "no proxy auth tokens"},
+		"no separator":   {tokens: []string{"app"}, want: "expected username:token"},
+		"empty token":    {tokens: []string{"app:"}, want: "expected username:token"},
+		"bad file entry": {file: "app:s3cret\n:token\n", want: "tokens:2"},
+		"missing file":   {tokens: []string{"app:s3cret"}, file: "-", want: "failed to open"},
+	} {
+		config := DefaultConfig()
+		config.ProxyAuthTokens = tc.tokens
+		if tc.file != "" {
+			config.ProxyAuthTokenFile = filepath.Join(t.TempDir(), "tokens")
+			if tc.file != "-" {
+				os.WriteFile(config.ProxyAuthTokenFile, []byte(tc.file), 0o600)
+			}
+		}
+		if _, err := newProxyAuthenticator(config); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: newProxyAuthenticator: %v", name, err)
+		}
+	}
+}
+
+func TestProxyAuth(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.ProxyAuth = "token"
+	config.ProxyAuthTokens = []string{"app:s3cret", "*:shared"}
+	_, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	// Clients with an accepted token reach MySQL, without the token
+	for _, handshake := range []testHandshake{
+		{user: "app", attrs: [][2]string{{"_client_name", "libmysql"}, {"proxy_auth_token", "s3cret"}}},
+		{user: "reporting", attrs: [][2]string{{"proxy_auth_token", "shared"}}},
+	} {
+		mustConnect(t, addr, handshake).mustQuery("SELECT 1")
+		handshakes := backend.receivedHandshakes()
+		received := handshakes[len(handshakes)-1]
+		hr, err := parseHandshakeResponse(received)
+		if err != nil || hr.Username != handshake.user {
+			t.Fatalf("MySQL received %+v, %v", hr, err)
+		}
+		if _, ok := hr.Attributes["proxy_auth_token"]; ok || bytes.Contains(received, []byte("s3cret")) || bytes.Contains(received, []byte("shared")) {
+			t.Fatalf("the token was forwarded to MySQL in %q", received)
+		}
+		if len(handshake.attrs) > 1 && hr.Attributes["_client_name"] != "libmysql" {
+			t.Fatalf("the other attributes were not forwarded: %v", hr.Attributes)
+		}
+	}
+
+	// Others are refused by the proxy
+	handshakes := len(backend.receivedHandshakes())
+	for name, attrs := range map[string][][2]string{
+		"wrong token":   {{"proxy_auth_token", "guess"}},
+		"other's token": {{"proxy_auth_token", "s3cret"}},
+		"no token":      nil,
+	} {
+		_, response := connect(t, addr, testHandshake{user: "intruder", attrs: attrs})
+		expectErr(t, response, 1045)
+		if message := errPacketMessage(response.Payload); !strings.Contains(message, "access denied for user 'intruder' by proxy authentication") {
+			t.Fatalf("%s: refused with %q", name, message)
+		}
+	}
+	if len(backend.receivedHandshakes()) != handshakes {
+		t.Fatal("a refused handshake reached MySQL")
+	}
+}
+
+func TestProxyAuthDialsMySQL(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.ProxyAuth = "token"
+	config.ProxyAuthTokens = []string{"app:s3cret"}
+	_, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	// The client answers MySQL's greeting, so MySQL is dialed before the
+	// token is checked, and hung up on once it is refused
+	sessions := backend.sessionCount()
+	_, response := connect(t, addr, testHandshake{user: "app"})
+	expectErr(t, response, 1045)
+	if backend.sessionCount() != sessions+1 {
+		t.Fatal("MySQL was not dialed for the refused client")
+	}
+	eventually(t, "the MySQL connection to close", func() bool { return backend.openSessions() == 0 })
+
+	// With TERMINATE_HANDSHAKE the proxy greets clients itself, and refused
+	// ones never reach MySQL
+	config.TerminateHandshake = true
+	_, addr = startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+	sessions = backend.sessionCount()
+	_, response = connect(t, addr, testHandshake{user: "app", attrs: [][2]string{{"proxy_auth_token", "guess"}}})
+	expectErr(t, response, 1045)
+	if backend.sessionCount() != sessions {
+		t.Fatal("MySQL was dialed for a refused client")
+	}
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyV1MaxLength is the longest v1 header line, CRLF included
+const proxyV1MaxLength = 107
+
+// errNoProxyHeader reports a connection that does not start with a PROXY
+// protocol header although PROXY_PROTOCOL is on
+var errNoProxyHeader = errors.New("connection does not start with a PROXY protocol header")
+
+// proxiedConn is a client connection received through a load balancer that
+// speaks the PROXY protocol. Reads continue after the header, and RemoteAddr
+// is the client's address conveyed by the header.
+type proxiedConn struct {
+	net.Conn
+	reader *bufio.Reader
+	source net.Addr
+}
+
+// Read reads the connection's bytes following the PROXY protocol header
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address conveyed by the header
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.source
+}
+
+// readProxyHeader reads the PROXY protocol v1 or v2 header a load balancer
+// sends at the start of conn, and returns the connection that continues
+// after it. The returned connection's RemoteAddr is the conveyed source
+// address; it is conn's own peer when the header carries none, as for the
+// v1 UNKNOWN family and v2 LOCAL connections such as health checks.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	reader := bufio.NewReaderSize(conn, 256)
+	start, err := reader.Peek(len(proxyV2Signature))
+	switch {
+	case err == nil && bytes.Equal(start, proxyV2Signature):
+		source, err := readProxyV2(reader)
+		if err != nil {
+			return nil, err
+		}
+		return newProxiedConn(conn, reader, source), nil
+	case len(start) >= 6 && string(start[:6]) == "PROXY ":
+		source, err := readProxyV1(reader)
+		if err != nil {
+			return nil, err
+		}
+		return newProxiedConn(conn, reader, source), nil
+	case err != nil && !errors.Is(err, io.EOF):
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %w", err)
+	default:
+		return nil, errNoProxyHeader
+	}
+}
+
+// newProxiedConn wraps conn, falling back to its own peer without a source
+func newProxiedConn(conn net.Conn, reader *bufio.Reader, source net.Addr) net.Conn {
+	if source == nil {
+		source = conn.RemoteAddr()
+	}
+	return &proxiedConn{Conn: conn, reader: reader, source: source}
+}
+
+// readProxyV1 reads a text header, "PROXY TCP4 <src> <dst> <sport> <dport>\r\n",
+// returning its source address, or nil for the UNKNOWN family
+func readProxyV1(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyV1MaxLength {
+			return nil, fmt.Errorf("PROXY protocol v1 header is longer than %d bytes", proxyV1MaxLength)
+		}
+		c, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read PROXY protocol v1 header: %w", err)
+		}
+		line = append(line, c)
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed PROXY protocol v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	if ip == nil || (ip.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, fmt.Errorf("invalid source address %q in PROXY protocol v1 header", fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source port %q in PROXY protocol v1 header", fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads a binary header, returning its source address, or nil
+// for LOCAL connections and for families other than TCP over IPv4 and IPv6
+func readProxyV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol v2 header: %w", err)
+	}
+	if version := header[12] >> 4; version != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", version)
+	}
+	command := header[12] & 0x0f
+	if command > 1 {
+		return nil, fmt.Errorf("unsupported PROXY protocol v2 command %d", command)
+	}
+	family, transport := header[13]>>4, header[13]&0x0f
+
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol v2 addresses: %w", err)
+	}
+
+	// LOCAL connections come from the load balancer itself and are skipped,
+	// as are the addresses of UNSPEC, UNIX and datagram connections
+	const commandProxy, familyInet, familyInet6, transportStream = 1, 1, 2, 1
+	if command != commandProxy || transport != transportStream {
+		return nil, nil
+	}
+	switch family {
+	case familyInet:
+		if len(body) < 12 {
+			return nil, fmt.Errorf("truncated PROXY protocol v2 IPv4 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case familyInet6:
+		if len(body) < 36 {
+			return nil, fmt.Errorf("truncated PROXY protocol v2 IPv6 addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,166 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a PROXY protocol v2 header from a command, a family
+// and transport byte and the address block
+func proxyV2Header(command, familyTransport byte, addresses []byte) []byte {
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x20|command, familyTransport)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+// proxyV2Inet4 is the address block of a TCP over IPv4 connection
+func proxyV2Inet4(src, dst string, srcPort, dstPort uint16) []byte {
+	block := append(net.ParseIP(src).To4(), net.ParseIP(dst).To4()...)
+	block = binary.BigEndian.AppendUint16(block, srcPort)
+	return binary.BigEndian.AppendUint16(block, dstPort)
+}
+
+// proxyV2Inet6 is the address block of a TCP over IPv6 connection
+func proxyV2Inet6(src, dst string, srcPort, dstPort uint16) []byte {
+	block := append(net.ParseIP(src).To16(), net.ParseIP(dst).To16()...)
+	block = binary.BigEndian.AppendUint16(block, srcPort)
+	return binary.BigEndian.AppendUint16(block, dstPort)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header []byte
+		source string
+		err    string
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 4242 3306\r\n"), "203.0.113.7:4242", ""},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::7 2001:db8::1 4242 3306\r\n"), "[2001:db8::7]:4242", ""},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), "peer", ""},
+		{"v2 IPv4", proxyV2Header(1, 0x11, proxyV2Inet4("203.0.113.7", "10.0.0.1", 4242, 3306)), "203.0.113.7:4242", ""},
+		{"v2 IPv6", proxyV2Header(1, 0x21, proxyV2Inet6("2001:db8::7", "2001:db8::1", 4242, 3306)), "[2001:db8::7]:4242", ""},
+		{"v2 IPv4 with TLVs", proxyV2Header(1, 0x11, append(proxyV2Inet4("203.0.113.7", "10.0.0.1", 4242, 3306), 0x04, 0x00, 0x01, 0x00)), "203.0.113.7:4242", ""},
+		{"v2 LOCAL", proxyV2Header(0, 0x00, nil), "peer", ""},
+		{"v2 UNSPEC", proxyV2Header(1, 0x00, nil), "peer", ""},
+		{"v1 malformed", []byte("PROXY TCP4 203.0.113.7 4242\r\n"), "", "malformed PROXY protocol v1 header"},
+		{"v1 mismatched family", []byte("PROXY TCP4 2001:db8::7 10.0.0.1 4242 3306\r\n"), "", "invalid source address"},
+		{"v1 too long", []byte("PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n"), "", "longer than 107 bytes"},
+		{"v2 truncated", proxyV2Header(1, 0x11, []byte{203, 0, 113, 7}), "", "truncated PROXY protocol v2 IPv4 addresses"},
+		{"v2 bad command", proxyV2Header(2, 0x11, proxyV2Inet4("203.0.113.7", "10.0.0.1", 4242, 3306)), "", "unsupported PROXY protocol v2 command 2"},
+		{"no header", testHandshake{user: "root"}.payload(), "", errNoProxyHeader.Error()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			server.SetDeadline(time.Now().Add(5 * time.Second))
+
+			// The header arrives a byte at a time, followed by the handshake
+			header := tc.header
+			go func() {
+				for i := range header {
+					if _, err := client.Write(header[i : i+1]); err != nil {
+						return
+					}
+				}
+				client.Write([]byte("after"))
+			}()
+
+			conn, err := readProxyHeader(server)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("readProxyHeader: %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProxyHeader: %v", err)
+			}
+			want := tc.source
+			if want == "peer" {
+				want = server.RemoteAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != want {
+				t.Fatalf("source %s, want %s", got, want)
+			}
+			rest := make([]byte, 5)
+			if _, err := io.ReadFull(conn, rest); err != nil || string(rest) != "after" {
+				t.Fatalf("read %q after the header, %v", rest, err)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolConnections(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.ProxyProtocol = true
+	config.AllowedClients = []string{"203.0.113.0/24"}
+	logger, hook := testLogger()
+	p, err := New(config, WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(header []byte) *testClient {
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			p.handleConnection(server, nil)
+		}()
+		t.Cleanup(func() {
+			client.Close()
+			<-done
+		})
+		client.SetDeadline(time.Now().Add(5 * time.Second))
+		c := &testClient{t: t, conn: client}
+		if _, err := client.Write(header); err != nil {
+			t.Fatalf("write header: %v", err)
+		}
+		c.greeting, _ = readPacket(client)
+		return c
+	}
+
+	// The conveyed address is the one logged, checked and recorded
+	for _, tc := range []struct {
+		header   []byte
+		database string
+	}{
+		{[]byte("PROXY TCP4 203.0.113.7 10.0.0.1 4242 3306\r\n"), "orders_v1"},
+		{proxyV2Header(1, 0x11, proxyV2Inet4("203.0.113.8", "10.0.0.1", 4343, 3306)), "orders_v2"},
+	} {
+		c := serve(tc.header)
+		if c.greeting == nil {
+			t.Fatal("no greeting after the PROXY protocol header")
+		}
+		if response := c.send(1, testHandshake{user: "root", database: tc.database}.payload()); response == nil || response.Payload[0] != 0x00 {
+			t.Fatalf("handshake answered with %s", describePacket(response))
+		}
+	}
+	for database, client := range map[string]string{"orders_v1": "203.0.113.7:4242", "orders_v2": "203.0.113.8:4343"} {
+		if created, ok := p.created.get(database); !ok || created.Client != client {
+			t.Errorf("%s recorded for %q", database, created.Client)
+		}
+	}
+	if entry := findEntry(hook, "New connection"); entry == nil || entry.Data["client_addr"] != "203.0.113.8:4343" || entry.Data["proxied_by"] == nil {
+		t.Fatalf("logged %v", entry)
+	}
+
+	// Connections without a header, and conveyed clients outside
+	// ALLOWED_CLIENTS, are refused
+	rejected := connectionsRejected.Value("proxy_protocol")
+	if c := serve(testHandshake{user: "root"}.payload()); c.greeting != nil {
+		t.Fatal("greeted a connection without a PROXY protocol header")
+	}
+	if connectionsRejected.Value("proxy_protocol") != rejected+1 {
+		t.Fatal("the connection without a header was not counted")
+	}
+	c := serve([]byte("PROXY TCP4 198.51.100.1 10.0.0.1 4242 3306\r\n"))
+	expectErr(t, c.greeting, 1130)
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+// queryLogCommands names the commands QUERY_LOG logs. COM_QUERY and
+// COM_STMT_PREPARE are logged with their statement, the other prepared
+// statement commands with the ID of the statement, since their parameters are
+// not decoded.
+var queryLogCommands = map[byte]string{
+	comQuery:            "COM_QUERY",
+	comStmtPrepare:      "COM_STMT_PREPARE",
+	comStmtExecute:      "COM_STMT_EXECUTE",
+	comStmtSendLongData: "COM_STMT_SEND_LONG_DATA",
+	comStmtClose:        "COM_STMT_CLOSE",
+	comStmtReset:        "COM_STMT_RESET",
+	comStmtFetch:        "COM_STMT_FETCH",
+}
+
+// pendingQuery is a command awaiting the first packet of its response, to
+// tell whether it was slow
+type pendingQuery struct {
+	logger *logrus.Entry
+	sentAt time.Time
+}
+
+// queryLog logs the statements a connection sends to MySQL. With a slow
+// threshold only the commands MySQL took longer than it to start answering
+// are logged.
+type queryLog struct {
+	maxLength int
+	slow      time.Duration
+	pending   atomic.Pointer[pendingQuery]
+}
+
+// newQueryLog creates the query log of a connection, or nil when QUERY_LOG
+// is off
+func newQueryLog(config Config) *queryLog {
+	if !config.QueryLog {
+		return nil
+	}
+	return &queryLog{
+		maxLength: config.QueryLogMaxLength,
+		slow:      time.Duration(config.QueryLogSlowMs) * time.Millisecond,
+	}
+}
+
+// sent records a command forwarded to MySQL, logging it right away unless
+// only slow queries are logged
+func (q *queryLog) sent(cc *ConnContext, payload []byte, logger *logrus.Entry) {
+	if q == nil || len(payload) == 0 {
+		return
+	}
+	command, ok := queryLogCommands[payload[0]]
+	if !ok {
+		return
+	}
+
+	fields := logrus.Fields{"command": command, "direction": "client_to_server"}
+	if database := cc.CurrentDB(); database != "" {
+		fields["database"] = database
+	}
+	switch payload[0] {
+	case comQuery, comStmtPrepare:
+		statement, truncated := truncateStatement(payload[1:], q.maxLength)
+		fields["statement"] = statement
+		if truncated {
+			fields["statement_length"] = len(payload) - 1
+		}
+	default:
+		if len(payload) >= 5 {
+			fields["statement_id"] = binary.LittleEndian.Uint32(payload[1:5])
+		}
+	}
+	entry := logger.WithFields(fields)
+
+	if q.slow <= 0 {
+		entry.Info("Query")
+		return
+	}
+	// MySQL does not answer these, so they cannot be timed
+	if payload[0] == comStmtSendLongData || payload[0] == comStmtClose {
+		return
+	}
+	q.pending.Store(&pendingQuery{logger: entry, sentAt: time.Now()})
+}
+
+// answered records a packet relayed from MySQL. The first one after a command
+// starts its response, and logs the command if it took at least the slow
+// threshold.
+func (q *queryLog) answered() {
+	if q == nil {
+		return
+	}
+	query := q.pending.Swap(nil)
+	if query == nil {
+		return
+	}
+	if elapsed := time.Since(query.sentAt); elapsed >= q.slow {
+		query.logger.WithField("duration_ms", elapsed.Milliseconds()).Info("Slow query")
+	}
+}
+
+// truncateStatement returns at most maxLength bytes of a statement, cut at a
+// character boundary, and whether it was cut
+func truncateStatement(statement []byte, maxLength int) (string, bool) {
+	if maxLength <= 0 || len(statement) <= maxLength {
+		return string(statement), false
+	}
+	end := maxLength
+	for end > 0 && !utf8.RuneStart(statement[end]) {
+		end--
+	}
+	return string(statement[:end]), true
+}
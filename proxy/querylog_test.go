@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestTruncateStatement(t *testing.T) {
+	for _, tc := range []struct {
+		statement string
+		maxLength int
+		want      string
+		truncated bool
+	}{
+		{"SELECT 1", 1024, "SELECT 1", false},
+		{"SELECT 1", 8, "SELECT 1", false},
+		{"SELECT 12", 8, "SELECT 1", true},
+		// Multi-byte characters are not cut in half
+		{"SELECT 'é'", 9, "SELECT '", true},
+		{"SELECT 'é'", 10, "SELECT 'é", true},
+		{"SELECT 1", 0, "SELECT 1", false},
+	} {
+		got, truncated := truncateStatement([]byte(tc.statement), tc.maxLength)
+		if got != tc.want || truncated != tc.truncated {
+			t.Errorf("truncateStatement(%q, %d) = %q, %v", tc.statement, tc.maxLength, got, truncated)
+		}
+	}
+}
+
+// queryEntries returns the entries logged with message
+func queryEntries(hook *test.Hook, message string) []*logrus.Entry {
+	var entries []*logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == message {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func TestQueryLog(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.create("orders")
+	config := testConfig(backend)
+	config.QueryLog = true
+	config.QueryLogMaxLength = 16
+	logger, hook := testLogger()
+	_, addr := startProxy(t, config, WithLogger(logger), WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("SELECT 1")
+	c.mustQuery("USE orders")
+	c.mustQuery("SELECT 'a long statement'")
+	prepared := c.send(0, append([]byte{comStmtPrepare}, "SELECT 2"...))
+	execute := append([]byte{comStmtExecute}, prepared.Payload[1:5]...)
+	c.command(append(execute, 0, 1, 0, 0, 0))
+
+	entries := queryEntries(hook, "Query")
+	if len(entries) != 5 {
+		t.Fatalf("logged %d statements, want 5", len(entries))
+	}
+	for i, want := range []logrus.Fields{
+		{"command": "COM_QUERY", "statement": "SELECT 1"},
+		{"command": "COM_QUERY", "statement": "USE orders"},
+		{"command": "COM_QUERY", "statement": "SELECT 'a long s", "statement_length": 25, "database": "orders"},
+		{"command": "COM_STMT_PREPARE", "statement": "SELECT 2", "database": "orders"},
+		{"command": "COM_STMT_EXECUTE", "statement_id": binary.LittleEndian.Uint32(prepared.Payload[1:5]), "database": "orders"},
+	} {
+		for key, value := range want {
+			if entries[i].Data[key] != value {
+				t.Errorf("statement %d logged %s=%v, want %v", i+1, key, entries[i].Data[key], value)
+			}
+		}
+		if entries[i].Data["conn_id"] == nil || entries[i].Data["direction"] != "client_to_server" {
+			t.Errorf("statement %d logged without its connection or direction", i+1)
+		}
+	}
+	if _, ok := entries[0].Data["database"]; ok {
+		t.Error("a statement without a database selected logged one")
+	}
+}
+
+func TestQueryLogIsOptIn(t *testing.T) {
+	backend := startFakeMySQL(t)
+	logger, hook := testLogger()
+	_, addr := startProxy(t, testConfig(backend), WithLogger(logger))
+	mustConnect(t, addr, testHandshake{user: "root"}).mustQuery("CREATE USER 'app'@'%' IDENTIFIED BY 'secret'")
+	if entries := queryEntries(hook, "Query"); len(entries) != 0 {
+		t.Fatalf("logged %d statements without QUERY_LOG", len(entries))
+	}
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.handleCommands(func(s *fakeSession, payload []byte) bool {
+		if payload[0] == comQuery && string(payload[1:]) == "SELECT SLEEP(0.2)" {
+			time.Sleep(200 * time.Millisecond)
+		}
+		return false
+	})
+	config := testConfig(backend)
+	config.QueryLog = true
+	config.QueryLogSlowMs = 100
+	logger, hook := testLogger()
+	_, addr := startProxy(t, config, WithLogger(logger), WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("SELECT 1")
+	c.mustQuery("SELECT SLEEP(0.2)")
+	c.mustQuery("SELECT 2")
+
+	if entries := queryEntries(hook, "Query"); len(entries) != 0 {
+		t.Fatalf("logged %d statements as they were sent", len(entries))
+	}
+	entries := queryEntries(hook, "Slow query")
+	if len(entries) != 1 || entries[0].Data["statement"] != "SELECT SLEEP(0.2)" {
+		t.Fatalf("logged %d slow statements", len(entries))
+	}
+	if duration := entries[0].Data["duration_ms"].(int64); duration < 100 {
+		t.Fatalf("slow statement took %dms", duration)
+	}
+}
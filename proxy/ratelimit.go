@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var createRateLimited = newCounterVec("mysql_autodb_create_rate_limited_total",
+	"Database creations refused by CREATE_RATE_LIMIT or CREATE_RATE_LIMIT_PER_CLIENT, by scope", "scope")
+
+// maxRateLimitedClients bounds the per-client buckets kept; beyond it the
+// buckets of clients that have not created anything lately are dropped
+const maxRateLimitedClients = 10000
+
+// tokenBucket allows perMinute events a minute, in bursts of up to perMinute
+type tokenBucket struct {
+	perMinute float64
+	tokens    float64
+	updated   time.Time
+}
+
+// newTokenBucket creates a full bucket
+func newTokenBucket(perMinute int, now time.Time) *tokenBucket {
+	return &tokenBucket{perMinute: float64(perMinute), tokens: float64(perMinute), updated: now}
+}
+
+// refill adds the tokens earned since the last update
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.updated); elapsed > 0 {
+		b.tokens = math.Min(b.perMinute, b.tokens+elapsed.Minutes()*b.perMinute)
+	}
+	b.updated = now
+}
+
+// take consumes a token, or returns how long until one is available
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.perMinute * float64(time.Minute))
+}
+
+// full reports whether the bucket has earned back every token
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.perMinute
+}
+
+// createRateLimiter limits database creations globally and per client IP,
+// each as a token bucket refilled at its limit per minute
+type createRateLimiter struct {
+	global    int
+	perClient int
+	now       func() time.Time
+
+	mu      sync.Mutex
+	all     *tokenBucket
+	clients map[string]*tokenBucket
+}
+
+// newCreateRateLimiter creates a limiter, or nil when both limits are 0
+func newCreateRateLimiter(global, perClient int) *createRateLimiter {
+	if global <= 0 && perClient <= 0 {
+		return nil
+	}
+	return &createRateLimiter{
+		global:    global,
+		perClient: perClient,
+		now:       time.Now,
+		clients:   make(map[string]*tokenBucket),
+	}
+}
+
+// allow consumes a creation for the client, returning a rate-limited error
+// when the client or the proxy as a whole is over its limit. The error is
+// logged with the limit reached and when the next creation will be allowed.
+func (l *createRateLimiter) allow(clientAddr string, logger *logrus.Entry) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+
+	var client *tokenBucket
+	if l.perClient > 0 {
+		host := clientHost(clientAddr)
+		client = l.clients[host]
+		if client == nil {
+			if len(l.clients) >= maxRateLimitedClients {
+				l.sweep(now)
+			}
+			client = newTokenBucket(l.perClient, now)
+			l.clients[host] = client
+		}
+		if ok, wait := client.take(now); !ok {
+			createRateLimited.Inc("client")
+			logger.WithFields(logrus.Fields{
+				"limit_per_minute": l.perClient,
+				"retry_after":      wait.Round(time.Second).String(),
+			}).Warn("Client reached CREATE_RATE_LIMIT_PER_CLIENT, not creating database")
+			return newProxyError(errCategoryRateLimited, "database creation rate limit of %d per minute reached for this client", l.perClient)
+		}
+	}
+
+	if l.global > 0 {
+		if l.all == nil {
+			l.all = newTokenBucket(l.global, now)
+		}
+		if ok, wait := l.all.take(now); !ok {
+			if client != nil {
+				// The client's token was not used after all
+				client.tokens++
+			}
+			createRateLimited.Inc("global")
+			logger.WithFields(logrus.Fields{
+				"limit_per_minute": l.global,
+				"retry_after":      wait.Round(time.Second).String(),
+			}).Warn("Proxy reached CREATE_RATE_LIMIT, not creating database")
+			return newProxyError(errCategoryRateLimited, "database creation rate limit of %d per minute reached", l.global)
+		}
+	}
+	return nil
+}
+
+// sweep drops the buckets of clients that are back to their full allowance,
+// which are the same as new ones
+func (l *createRateLimiter) sweep(now time.Time) {
+	for host, bucket := range l.clients {
+		if bucket.full(now) {
+			delete(l.clients, host)
+		}
+	}
+}
+
+// clientHost returns the host of a client address: the IP of a TCP client,
+// or the socket path of a Unix socket client
+func clientHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	host, _, _ := strings.Cut(addr, "#")
+	return host
+}
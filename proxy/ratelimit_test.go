@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(3, now)
+	for i := 0; i < 3; i++ {
+		if ok, _ := bucket.take(now); !ok {
+			t.Fatalf("creation %d refused", i+1)
+		}
+	}
+	ok, wait := bucket.take(now)
+	if ok || wait != 20*time.Second {
+		t.Fatalf("take = %v, %v; want a refusal for 20s", ok, wait)
+	}
+
+	// Tokens are earned back over time, up to the limit
+	if ok, _ := bucket.take(now.Add(20 * time.Second)); !ok {
+		t.Fatal("no token earned back after 20s")
+	}
+	if bucket.full(now.Add(time.Minute)) {
+		t.Fatal("bucket full before all its tokens were earned back")
+	}
+	if !bucket.full(now.Add(time.Hour)) || bucket.tokens != 3 {
+		t.Fatalf("bucket refilled to %v tokens", bucket.tokens)
+	}
+}
+
+func TestCreateRateLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := newCreateRateLimiter(5, 2)
+	limiter.now = func() time.Time { return now }
+	logger, _ := testLogger()
+	entry := logger.WithField("database", "x")
+	allow := func(client string) bool { return limiter.allow(client, entry) == nil }
+
+	// Each client may create two databases a minute
+	if !allow("10.0.0.1:5000") || !allow("10.0.0.1:5001") {
+		t.Fatal("client refused under its limit")
+	}
+	clientLimited := createRateLimited.Value("client")
+	if err := limiter.allow("10.0.0.1:5002", entry); errorCategoryOf(err) != errCategoryRateLimited {
+		t.Fatalf("third creation: %v", err)
+	}
+	if createRateLimited.Value("client") != clientLimited+1 {
+		t.Fatal("the client's refusal was not counted")
+	}
+
+	// and the proxy five
+	if !allow("10.0.0.2:5000") || !allow("10.0.0.2:5001") || !allow("10.0.0.3:5000") {
+		t.Fatal("client refused under its limit")
+	}
+	globalLimited := createRateLimited.Value("global")
+	if allow("10.0.0.3:5001") {
+		t.Fatal("creation allowed over the global limit")
+	}
+	if createRateLimited.Value("global") != globalLimited+1 {
+		t.Fatal("the global refusal was not counted")
+	}
+
+	// A refusal by the global limit does not use the client's allowance
+	now = now.Add(12 * time.Second)
+	if !allow("10.0.0.3:5002") {
+		t.Fatal("creation refused once a global token was earned back")
+	}
+	if limiter.clients["10.0.0.3"].tokens >= 1 {
+		t.Fatal("the client kept a token it used")
+	}
+
+	// A minute later every allowance is back
+	now = now.Add(time.Minute)
+	if !allow("10.0.0.1:5003") || !allow("10.0.0.1:5004") {
+		t.Fatal("allowance not earned back after a minute")
+	}
+
+	if newCreateRateLimiter(0, 0) != nil {
+		t.Fatal("a limiter without limits was created")
+	}
+}
+
+func TestClientHost(t *testing.T) {
+	for addr, want := range map[string]string{
+		"10.0.0.1:5000":      "10.0.0.1",
+		"[2001:db8::1]:5000": "2001:db8::1",
+		"/tmp/proxy.sock#12": "/tmp/proxy.sock",
+		"unparsable":         "unparsable",
+	} {
+		if got := clientHost(addr); got != want {
+			t.Errorf("clientHost(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
+
+func TestCreateRateLimit(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.create("existing")
+	config := testConfig(backend)
+	config.CreateRateLimit = 2
+	_, addr := startProxy(t, config)
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("USE first")
+	c.mustQuery("USE second")
+
+	// Selecting databases that exist uses no allowance
+	c.mustQuery("USE existing")
+	c.mustQuery("USE first")
+
+	expectErr(t, c.query("USE third"), 1226)
+	if backend.hasDatabase("third") {
+		t.Fatal("a database was created over the rate limit")
+	}
+	_, response := connect(t, addr, testHandshake{user: "root", database: "fourth"})
+	expectErr(t, response, 1226)
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// signalReady tells the environment that the proxy is accepting connections,
+// through the configured ready file and/or systemd notification. When
+// ReadyWaitForBackend is set it first waits until MySQL accepts connections.
+func (p *Proxy) signalReady() {
+	config := p.config
+	if config.ReadyFile == "" && !config.SystemdNotify {
+		return
+	}
+
+	if config.ReadyWaitForBackend {
+		for {
+			conn, err := net.DialTimeout("tcp", p.backendAddr(), 5*time.Second)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			p.log.WithError(err).Info("Waiting for MySQL before signalling readiness")
+			time.Sleep(time.Second)
+		}
+	}
+
+	if config.ReadyFile != "" {
+		content := fmt.Sprintf("%d\n", os.Getpid())
+		if err := os.WriteFile(config.ReadyFile, []byte(content), 0o644); err != nil {
+			p.log.WithError(err).WithField("ready_file", config.ReadyFile).Error("Failed to write ready file")
+		} else {
+			p.log.WithField("ready_file", config.ReadyFile).Info("Wrote ready file")
+		}
+	}
+
+	if config.SystemdNotify {
+		if err := sdNotify("READY=1"); err != nil {
+			p.log.WithError(err).Error("Failed to notify systemd")
+		} else {
+			p.log.Info("Notified systemd of readiness")
+		}
+	}
+}
+
+// sdNotify sends a state string to the systemd notification socket named by
+// $NOTIFY_SOCKET, as sd_notify(3) does
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return fmt.Errorf("NOTIFY_SOCKET is not set")
+	}
+	// A leading @ names a socket in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to notify socket: %w", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignalReady(t *testing.T) {
+	dir := t.TempDir()
+	notify, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "notify"), Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer notify.Close()
+	t.Setenv("NOTIFY_SOCKET", notify.LocalAddr().String())
+
+	backend := startFakeMySQL(t)
+	backend.stop()
+	config := testConfig(backend)
+	config.ListenAddress = "127.0.0.1"
+	config.ProxyPort = 0
+	config.StartupWait = 0
+	config.ShutdownTimeout = time.Second
+	config.ReadyFile = filepath.Join(dir, "ready")
+	config.SystemdNotify = true
+	config.ReadyWaitForBackend = true
+	logger, hook := testLogger()
+	p, err := New(config, WithLogger(logger), WithEnsurer(&recordingEnsurer{backend: backend}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	listenAndServe(t, p)
+
+	// Listening is not enough while MySQL is down
+	eventually(t, "the proxy to wait for MySQL", func() bool {
+		return findEntry(hook, "Waiting for MySQL before signalling readiness") != nil
+	})
+	if _, err := os.Stat(config.ReadyFile); !os.IsNotExist(err) {
+		t.Fatalf("the ready file was written with MySQL down: %v", err)
+	}
+	notify.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := notify.Read(make([]byte, 64)); err == nil {
+		t.Fatal("systemd was notified with MySQL down")
+	}
+
+	// Once it is up, the file holds the proxy's PID and systemd is told
+	backend.restart()
+	notify.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := notify.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Fatalf("systemd was sent %q, %v", buf[:n], err)
+	}
+	content, err := os.ReadFile(config.ReadyFile)
+	if err != nil || string(content) != strconv.Itoa(os.Getpid())+"\n" {
+		t.Fatalf("ready file holds %q, %v", content, err)
+	}
+	if conn, err := net.Dial("tcp", p.Addr().String()); err != nil {
+		t.Fatalf("ready, but not accepting connections: %v", err)
+	} else {
+		conn.Close()
+	}
+}
+
+func TestSignalReadyWithoutBackendWait(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.stop()
+	config := testConfig(backend)
+	config.ListenAddress = "127.0.0.1"
+	config.ProxyPort = 0
+	config.StartupWait = 0
+	config.ShutdownTimeout = time.Second
+	config.ReadyFile = filepath.Join(t.TempDir(), "ready")
+	logger, _ := testLogger()
+	p, err := New(config, WithLogger(logger), WithEnsurer(&recordingEnsurer{backend: backend}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	// The file only appears once the proxy listens, whether or not MySQL is up
+	if _, err := os.Stat(config.ReadyFile); !os.IsNotExist(err) {
+		t.Fatalf("the ready file was written before the proxy started: %v", err)
+	}
+	listenAndServe(t, p)
+	eventually(t, "the ready file to be written", func() bool {
+		_, err := os.Stat(config.ReadyFile)
+		return err == nil
+	})
+}
+
+func TestSDNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if err := sdNotify("READY=1"); err == nil {
+		t.Fatal("notified without NOTIFY_SOCKET")
+	}
+
+	// A leading @ names an abstract socket
+	name := "mysql-auto-db-proxy-test-" + strconv.Itoa(os.Getpid())
+	notify, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: "@" + name, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("abstract sockets unavailable: %v", err)
+	}
+	defer notify.Close()
+	t.Setenv("NOTIFY_SOCKET", "@"+name)
+	if err := sdNotify("STOPPING=1"); err != nil {
+		t.Fatalf("sdNotify: %v", err)
+	}
+	notify.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	if n, err := notify.Read(buf); err != nil || string(buf[:n]) != "STOPPING=1" {
+		t.Fatalf("received %q, %v", buf[:n], err)
+	}
+}
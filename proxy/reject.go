@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var connectionsRejected = newCounterVec("mysql_autodb_connections_rejected_total",
+	"Connections refused by the proxy, by reason", "reason")
+
+// maxRecentRejections is how many rejections /status reports
+const maxRecentRejections = 20
+
+// rejectionRecord is a rejected connection as reported by /status
+type rejectionRecord struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Reason  string    `json:"reason"`
+	Message string    `json:"message"`
+}
+
+// rejectionLog keeps the most recent rejections
+type rejectionLog struct {
+	mu      sync.Mutex
+	records []rejectionRecord
+}
+
+// add records a rejection, evicting the oldest beyond maxRecentRejections
+func (l *rejectionLog) add(record rejectionRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.records = append(l.records, record)
+	if len(l.records) > maxRecentRejections {
+		l.records = l.records[len(l.records)-maxRecentRejections:]
+	}
+}
+
+// recent returns the recorded rejections, newest first
+func (l *rejectionLog) recent() []rejectionRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	records := make([]rejectionRecord, len(l.records))
+	for i, record := range l.records {
+		records[len(records)-1-i] = record
+	}
+	return records
+}
+
+// rejectConnection refuses a client connection: it logs and counts the
+// rejection under reason, sends the client an ERR of the given category and
+// sequence ID unless the category is empty, and closes the connection
+func (p *Proxy) rejectConnection(conn net.Conn, logger *logrus.Entry, reason string, sequenceID int, category errorCategory, message string) {
+	logger.WithField("reason", reason).Warnf("Rejected connection: %s", message)
+	connectionsRejected.Inc(reason)
+	p.rejections.add(rejectionRecord{
+		Time:    time.Now().UTC(),
+		Client:  conn.RemoteAddr().String(),
+		Reason:  reason,
+		Message: message,
+	})
+
+	if category != "" {
+		p.writeErrPacket(conn, sequenceID, category, message)
+	}
+	conn.Close()
+}
+
+// creationRejectionReason returns the rejection reason for a handshake whose
+// database could not be created
+func creationRejectionReason(category errorCategory) string {
+	switch category {
+	case errCategoryValidation:
+		return "invalid_database"
+	case errCategoryRateLimited:
+		return "rate_limited"
+	default:
+		return "create_failed"
+	}
+}
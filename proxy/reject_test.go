@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRejectionLog(t *testing.T) {
+	var log rejectionLog
+	for i := 0; i < maxRecentRejections+5; i++ {
+		log.add(rejectionRecord{Reason: fmt.Sprint(i)})
+	}
+	recent := log.recent()
+	if len(recent) != maxRecentRejections {
+		t.Fatalf("%d rejections kept, want %d", len(recent), maxRecentRejections)
+	}
+	if recent[0].Reason != fmt.Sprint(maxRecentRejections+4) || recent[len(recent)-1].Reason != "5" {
+		t.Fatalf("kept rejections %s to %s", recent[0].Reason, recent[len(recent)-1].Reason)
+	}
+}
+
+// expectRejection checks that connect gets the connection rejected under
+// reason, counted once and reported first by /status
+func expectRejection(t *testing.T, p *Proxy, reason string, connect func()) {
+	t.Helper()
+	before := connectionsRejected.Value(reason)
+	connect()
+	eventually(t, "the rejection to be counted", func() bool { return connectionsRejected.Value(reason) == before+1 })
+	if recent := p.rejections.recent(); len(recent) == 0 || recent[0].Reason != reason || recent[0].Client == "" {
+		t.Fatalf("/status reports %+v", recent)
+	}
+}
+
+// readRejection dials addr and reads the ERR the proxy sends in place of a
+// greeting, or nil if it closes the connection without one
+func readRejection(t *testing.T, addr string) *MySQLPacket {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	packet, err := readPacket(conn)
+	if err != nil {
+		return nil
+	}
+	return packet
+}
+
+func TestRejectionReasons(t *testing.T) {
+	backend := startFakeMySQL(t)
+
+	t.Run("client_not_allowed", func(t *testing.T) {
+		config := testConfig(backend)
+		config.AllowedClients = []string{"10.0.0.0/8"}
+		p, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{}))
+		expectRejection(t, p, "client_not_allowed", func() { expectErr(t, readRejection(t, addr), 1130) })
+	})
+
+	t.Run("too_many_connections", func(t *testing.T) {
+		config := testConfig(backend)
+		config.MaxConnections = 1
+		p, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{}))
+		mustConnect(t, addr, testHandshake{user: "root"})
+		expectRejection(t, p, "too_many_connections", func() { expectErr(t, readRejection(t, addr), 1040) })
+	})
+
+	t.Run("paused", func(t *testing.T) {
+		config := testConfig(backend)
+		config.PauseTimeout = 10 * time.Millisecond
+		p, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{}))
+		p.pause.Pause()
+		defer p.pause.Resume()
+		expectRejection(t, p, "paused", func() {
+			if packet := readRejection(t, addr); packet != nil {
+				t.Fatalf("paused connection got %s", describePacket(packet))
+			}
+		})
+	})
+
+	t.Run("backend_unavailable", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := testConfig(backend)
+		config.MySQLPort = listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+		p, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{}))
+		expectRejection(t, p, "backend_unavailable", func() { expectErr(t, readRejection(t, addr), 1053) })
+	})
+
+	t.Run("denied_database", func(t *testing.T) {
+		p, addr := startProxy(t, testConfig(backend))
+		expectRejection(t, p, "denied_database", func() {
+			_, response := connect(t, addr, testHandshake{user: "root", database: "mysql"})
+			expectErr(t, response, 1044)
+		})
+	})
+
+	t.Run("invalid_database", func(t *testing.T) {
+		p, addr := startProxy(t, testConfig(backend))
+		expectRejection(t, p, "invalid_database", func() {
+			_, response := connect(t, addr, testHandshake{user: "root", database: "bad;name"})
+			expectErr(t, response, 1102)
+		})
+	})
+
+	t.Run("rate_limited", func(t *testing.T) {
+		ensurer := &recordingEnsurer{err: newProxyError(errCategoryRateLimited, "too many creations")}
+		p, addr := startProxy(t, testConfig(backend), WithEnsurer(ensurer))
+		expectRejection(t, p, "rate_limited", func() {
+			_, response := connect(t, addr, testHandshake{user: "root", database: "limited"})
+			expectErr(t, response, 1226)
+		})
+	})
+
+	t.Run("create_failed", func(t *testing.T) {
+		ensurer := &recordingEnsurer{err: ErrBackendUnreachable}
+		p, addr := startProxy(t, testConfig(backend), WithEnsurer(ensurer))
+		expectRejection(t, p, "create_failed", func() {
+			_, response := connect(t, addr, testHandshake{user: "root", database: "unreachable"})
+			expectErr(t, response, 1053)
+		})
+	})
+}
@@ -0,0 +1,519 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var databaseSelections = newCounterVec("mysql_autodb_database_selections_total",
+	"Commands selecting a database seen by the proxy, by command", "command")
+
+var sequenceAnomalies = newCounterVec("mysql_autodb_sequence_id_anomalies_total",
+	"Packets relayed or written with an unexpected sequence ID, by the side that sent them (proxy for its own)", "direction")
+
+// comPing is a COM_PING command packet as injected by the keepalive prober
+var comPing = []byte{0x01, 0x00, 0x00, 0x00, 0x0e}
+
+// relayState is the state shared by the two forwarding directions of a connection
+type relayState struct {
+	// serverWriteMu serializes writes to MySQL between the client forwarding
+	// loop and packets injected by the proxy itself
+	serverWriteMu sync.Mutex
+
+	// clientWriteMu serializes writes to the client between the server
+	// forwarding loop and packets injected by the proxy itself
+	clientWriteMu sync.Mutex
+
+	// lastActivity is the time of the last packet in either direction (unix nanos)
+	lastActivity atomic.Int64
+
+	// serverSpokeLast is true when the most recent traffic came from MySQL,
+	// meaning the client is not waiting on an outstanding command
+	serverSpokeLast atomic.Bool
+
+	// pingSentAt is the time an injected COM_PING was sent (unix nanos),
+	// or zero when no ping is outstanding
+	pingSentAt atomic.Int64
+
+	// lastRelayed is the time the proxy last relayed a packet in either
+	// direction (unix nanos); unlike lastActivity it ignores keepalive pings
+	lastRelayed atomic.Int64
+
+	// clientSpoke is set once the client has sent its first command
+	clientSpoke atomic.Bool
+
+	// nextSeq is the sequence ID expected on the next relayed packet. A client
+	// may always start a new command at 0.
+	nextSeq atomic.Uint32
+
+	// authenticating is set while the authentication exchange started by a
+	// COM_CHANGE_USER is relayed, until MySQL answers it with OK or ERR.
+	// Client packets are not commands meanwhile.
+	authenticating atomic.Bool
+
+	// writeTimeout bounds each relayed write (0 means no limit)
+	writeTimeout time.Duration
+
+	// pendingDB is the database selected by an in-flight command, applied to
+	// the connection's current database once MySQL answers it with OK
+	pendingDB atomic.Pointer[string]
+
+	// pendingSchema is the CREATE or DROP DATABASE statement in flight,
+	// applied to the known databases once MySQL answers it with OK
+	pendingSchema atomic.Pointer[schemaChange]
+
+	// pendingRetry is the in-flight USE or COM_INIT_DB command, replayed
+	// once the database has been created if MySQL answers it with ERR 1049
+	pendingRetry atomic.Pointer[[]byte]
+
+	// pendingPrepare is the followed statement of an in-flight
+	// COM_STMT_PREPARE, added to prepared once MySQL numbers it
+	pendingPrepare atomic.Pointer[preparedStatement]
+	prepared       preparedStatements
+
+	// queryInFlight is set while a COM_QUERY awaits the first packet of its
+	// answer, which alone may be a LOCAL INFILE request; swallowAnswer is
+	// set while MySQL's answer to the empty file the proxy sent in the
+	// client's place is still to come
+	queryInFlight atomic.Bool
+	swallowAnswer atomic.Bool
+
+	// shadow mirrors client packets to the shadow backend, if one is configured
+	shadow *shadowConn
+
+	// queryLog logs the client's statements when QUERY_LOG is on
+	queryLog *queryLog
+
+	// clientBytes and serverBytes count the bytes relayed from the client
+	// and from MySQL
+	clientBytes atomic.Uint64
+	serverBytes atomic.Uint64
+
+	// endReason is why the session ended, as first reported by either
+	// direction or by whatever closed the connection
+	endReason atomic.Pointer[string]
+}
+
+// newRelayState creates the relay state for a connection that just completed its handshake
+func newRelayState(writeTimeout time.Duration) *relayState {
+	state := &relayState{writeTimeout: writeTimeout}
+	now := time.Now().UnixNano()
+	state.lastActivity.Store(now)
+	state.lastRelayed.Store(now)
+	state.serverSpokeLast.Store(true)
+	return state
+}
+
+// end records why the session ended, unless a reason was recorded already:
+// once one direction stops the other is stopped too, and the first reason is
+// the one that explains both
+func (s *relayState) end(reason string) {
+	s.endReason.CompareAndSwap(nil, &reason)
+}
+
+// reason returns why the session ended
+func (s *relayState) reason() string {
+	if reason := s.endReason.Load(); reason != nil {
+		return *reason
+	}
+	return "unknown"
+}
+
+// closeRelayed stops relaying to and from conn once the other direction of
+// the session has finished. TCP and Unix connections are half-closed, which
+// lets the peer read what was already relayed before its EOF and returns a
+// read of conn blocked in the other direction with io.EOF; others, such as
+// TLS connections, are closed.
+func closeRelayed(conn net.Conn) {
+	if halves, ok := conn.(interface {
+		CloseRead() error
+		CloseWrite() error
+	}); ok {
+		halves.CloseWrite()
+		halves.CloseRead()
+		return
+	}
+	conn.Close()
+}
+
+// isOKOrErr reports whether a payload is an OK or ERR packet
+func isOKOrErr(payload []byte) bool {
+	return len(payload) > 0 && (payload[0] == 0x00 || payload[0] == 0xff)
+}
+
+// checkSequence records a packet, received in the given number of physical
+// packets, relayed from direction ("client" or
+// "server") and reports sequence IDs that do not follow on from the previous
+// packet, a sign of a framing bug or a misbehaving peer. It never alters what
+// is forwarded.
+func (s *relayState) checkSequence(direction string, sequenceID, packets int, logger *logrus.Entry) {
+	expected := s.nextSeq.Swap(uint32(sequenceID+packets) & 0xff)
+	if uint32(sequenceID) == expected || (direction == "client" && sequenceID == 0) {
+		return
+	}
+	sequenceAnomalies.Inc(direction)
+	logger.WithFields(logrus.Fields{
+		"direction":   direction,
+		"expected":    expected,
+		"sequence_id": sequenceID,
+	}).Warn("Unexpected packet sequence ID")
+}
+
+// writeToServer forwards a client packet to MySQL
+func (s *relayState) writeToServer(mysqlConn net.Conn, packet *MySQLPacket) error {
+	s.serverWriteMu.Lock()
+	defer s.serverWriteMu.Unlock()
+
+	now := time.Now().UnixNano()
+	s.serverSpokeLast.Store(false)
+	s.clientSpoke.Store(true)
+	s.lastActivity.Store(now)
+	s.lastRelayed.Store(now)
+	if err := writePacketWithTimeout(mysqlConn, packet, s.writeTimeout); err != nil {
+		return err
+	}
+	bytesForwarded.Add(uint64(packet.wireLength()), "client_to_server")
+	packetsForwarded.Inc("client_to_server")
+	s.clientBytes.Add(uint64(packet.wireLength()))
+	return nil
+}
+
+// streamToServer forwards a client packet to MySQL as it arrives: the header,
+// then the payload copied from the client without holding it all in memory
+func (s *relayState) streamToServer(mysqlConn, clientConn net.Conn, header []byte, length int) error {
+	s.serverWriteMu.Lock()
+	defer s.serverWriteMu.Unlock()
+
+	now := time.Now().UnixNano()
+	s.serverSpokeLast.Store(false)
+	s.clientSpoke.Store(true)
+	s.lastActivity.Store(now)
+	s.lastRelayed.Store(now)
+
+	w := &timeoutWriter{conn: mysqlConn, timeout: s.writeTimeout}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	n, err := io.CopyN(w, clientConn, int64(length))
+	bytesForwarded.Add(uint64(len(header))+uint64(n), "client_to_server")
+	packetsForwarded.Inc("client_to_server")
+	s.clientBytes.Add(uint64(len(header)) + uint64(n))
+	if err != nil {
+		return fmt.Errorf("failed to relay packet payload: %w", err)
+	}
+	return nil
+}
+
+// timeoutWriter applies writeWithTimeout to each write
+type timeoutWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w *timeoutWriter) Write(data []byte) (int, error) {
+	if err := writeWithTimeout(w.conn, data, w.timeout); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// writeToClient forwards a MySQL packet to the client
+func (s *relayState) writeToClient(clientConn net.Conn, packet *MySQLPacket) error {
+	s.clientWriteMu.Lock()
+	defer s.clientWriteMu.Unlock()
+
+	s.lastRelayed.Store(time.Now().UnixNano())
+	if err := writePacketWithTimeout(clientConn, packet, s.writeTimeout); err != nil {
+		return err
+	}
+	bytesForwarded.Add(uint64(packet.wireLength()), "server_to_client")
+	packetsForwarded.Inc("server_to_client")
+	s.serverBytes.Add(uint64(packet.wireLength()))
+	return nil
+}
+
+// writeWithTimeout writes data, failing if the peer does not accept it within
+// timeout (0 means no limit)
+func writeWithTimeout(conn net.Conn, data []byte, timeout time.Duration) error {
+	if timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+
+	_, err := conn.Write(data)
+	return writeTimeoutError(err, timeout)
+}
+
+// writePacketWithTimeout writes a packet within timeout, as writeWithTimeout
+func writePacketWithTimeout(conn net.Conn, packet *MySQLPacket, timeout time.Duration) error {
+	if timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(timeout))
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+
+	return writeTimeoutError(packet.writeTo(conn), timeout)
+}
+
+// writeTimeoutError reports a write that failed on its deadline as a timeout
+func writeTimeoutError(err error, timeout time.Duration) error {
+	if err == nil {
+		return nil
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("write timeout after %s: %w", timeout, err)
+	}
+	return err
+}
+
+// trackDatabaseChange records the database a client command will select, or
+// create or drop, if it succeeds. It must be called before the command is
+// forwarded to MySQL.
+func (s *relayState) trackDatabaseChange(cc *ConnContext, payload []byte, logger *logrus.Entry) {
+	if len(payload) == 0 {
+		return
+	}
+
+	var database string
+	switch payload[0] {
+	case comQuery:
+		if change, ok := parseSchemaStatement(string(payload[1:])); ok {
+			s.pendingSchema.Store(&change)
+			return
+		}
+		if !isUseCommand(payload) {
+			return
+		}
+		if database = extractDatabaseFromUseCommand(payload); database == "" {
+			return
+		}
+		databaseSelections.Inc("USE")
+	case comInitDB:
+		database = string(payload[1:])
+		databaseSelections.Inc("COM_INIT_DB")
+	case comChangeUser:
+		// With no database in the request the session has none selected afterwards
+		request, err := parseChangeUser(payload, cc.capabilities)
+		if err != nil {
+			logger.WithError(err).Debug("Failed to parse COM_CHANGE_USER")
+			return
+		}
+		database = request.Database
+	default:
+		// COM_RESET_CONNECTION resets session state but keeps the selected database
+		return
+	}
+	s.pendingDB.Store(&database)
+}
+
+// forwardFromServer relays packets from MySQL to the client, swallowing the
+// responses to keepalive pings injected by the proxy
+func (p *Proxy) forwardFromServer(ctx context.Context, clientConn, mysqlConn net.Conn, state *relayState, logger *logrus.Entry) string {
+	cc := connContextFrom(ctx)
+	// continued is set while the packets read are the continuation of a
+	// payload longer than maxPacketPayload, whose bytes must not be mistaken
+	// for the start of a response
+	continued := false
+	reader := p.newPacketReader(mysqlConn)
+	defer reader.release()
+	for {
+		packet, err := reader.readPacket()
+		if err != nil {
+			switch {
+			case errors.Is(err, io.EOF):
+				logger.Debug("MySQL closed connection (EOF)")
+				return "mysql_closed"
+			case errors.Is(err, net.ErrClosed):
+				logger.Debug("Stopped reading from the closed MySQL connection")
+				return "closed"
+			default:
+				logger.WithError(err).Debug("Stopped reading from MySQL")
+				return "mysql_read_failed"
+			}
+		}
+
+		state.lastActivity.Store(time.Now().UnixNano())
+		state.serverSpokeLast.Store(true)
+
+		continuation := continued
+		continued = packet.Length == maxPacketPayload
+		if continuation {
+			state.checkSequence("server", packet.SequenceID, 1, logger)
+			if err := state.writeToClient(clientConn, packet); err != nil {
+				logger.WithError(err).Warn("Failed to forward MySQL packet to client, closing connection")
+				clientConn.Close()
+				return "client_write_failed"
+			}
+			continue
+		}
+
+		// The first packet after an injected ping is its response
+		if state.pingSentAt.Swap(0) != 0 {
+			if len(packet.Payload) > 0 && packet.Payload[0] == 0x00 {
+				logger.Debug("Keepalive ping acknowledged by MySQL")
+				continue
+			}
+			logger.WithField("response_hex", fmt.Sprintf("%x", packet.Payload)).Warn("Keepalive ping failed, closing connection")
+			clientConn.Close()
+			return "keepalive_failed"
+		}
+
+		state.checkSequence("server", packet.SequenceID, 1, logger)
+
+		// The client already has an ERR for the LOCAL INFILE request this
+		// answers
+		if state.swallowAnswer.Swap(false) {
+			logger.WithField("response_length", len(packet.Payload)).Debug("Swallowed MySQL's answer to the refused local file")
+			continue
+		}
+		if state.queryInFlight.Swap(false) && p.config.BlockLocalInfile && isLocalInfileRequest(packet.Payload) {
+			if err := p.refuseLocalInfile(clientConn, mysqlConn, state, packet, logger); err != nil {
+				logger.WithError(err).Warn("Failed to refuse LOAD DATA LOCAL INFILE, closing connection")
+				clientConn.Close()
+				return "client_write_failed"
+			}
+			continue
+		}
+
+		if state.authenticating.Load() && isOKOrErr(packet.Payload) {
+			state.authenticating.Store(false)
+			logger.Debug("Authentication exchange completed")
+		}
+
+		// A followed COM_STMT_PREPARE is answered with a COM_STMT_PREPARE_OK,
+		// which starts like an OK, or an ERR
+		if statement := state.pendingPrepare.Swap(nil); statement != nil {
+			state.preparedAnswer(statement, packet.Payload, logger)
+			state.queryLog.answered()
+			if err := state.writeToClient(clientConn, packet); err != nil {
+				logger.WithError(err).Warn("Failed to forward MySQL packet to client, closing connection")
+				clientConn.Close()
+				return "client_write_failed"
+			}
+			continue
+		}
+
+		// A command that selects a database is answered with OK or ERR
+		if isOKOrErr(packet.Payload) {
+			if change := state.pendingSchema.Swap(nil); change != nil && packet.Payload[0] == 0x00 {
+				p.applySchemaChange(cc, *change, packet.Payload, logger)
+			}
+			retry := state.pendingRetry.Swap(nil)
+			switch database := state.pendingDB.Swap(nil); {
+			case database == nil:
+			case packet.Payload[0] == 0x00:
+				p.selectDatabase(cc, *database)
+				logger.WithField("database", *database).Debug("Current database changed")
+			case errPacketCode(packet.Payload) == erBadDBError:
+				p.forgetDatabase(cc.Backend, *database)
+				if retry != nil && p.retrySelection(ctx, mysqlConn, state, *database, *retry, logger) {
+					continue
+				}
+			}
+		}
+
+		state.queryLog.answered()
+		p.chaosDelay(ctx, chaosPointResponse, logger)
+		if err := state.writeToClient(clientConn, packet); err != nil {
+			logger.WithError(err).Warn("Failed to forward MySQL packet to client, closing connection")
+			clientConn.Close()
+			return "client_write_failed"
+		}
+	}
+}
+
+// keepalive injects a COM_PING to MySQL whenever the connection has been idle
+// for the configured interval, and closes the connection if the ping goes
+// unanswered.
+//
+// Pings are only sent when MySQL was the last to speak, since the client may
+// otherwise be waiting on a response, and never during an authentication
+// exchange. A server that pauses mid-way through a
+// result set for longer than the interval will still see a ping interleaved
+// with its response, so the interval should comfortably exceed the longest
+// expected pause in a streaming query.
+func (p *Proxy) keepalive(clientConn, mysqlConn net.Conn, state *relayState, stop <-chan struct{}, logger *logrus.Entry) {
+	interval := p.config.IdleKeepalivePing
+	check := interval / 2
+	if check <= 0 {
+		check = time.Second
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if sentAt := state.pingSentAt.Load(); sentAt != 0 {
+				if now.Sub(time.Unix(0, sentAt)) > interval {
+					logger.Warn("Keepalive ping timed out, closing connection")
+					state.end("keepalive_timeout")
+					mysqlConn.Close()
+					clientConn.Close()
+					return
+				}
+				continue
+			}
+
+			state.serverWriteMu.Lock()
+			idle := now.Sub(time.Unix(0, state.lastActivity.Load()))
+			if idle >= interval && state.serverSpokeLast.Load() && !state.authenticating.Load() {
+				state.pingSentAt.Store(now.UnixNano())
+				if err := writeWithTimeout(mysqlConn, comPing, state.writeTimeout); err != nil {
+					state.serverWriteMu.Unlock()
+					logger.WithError(err).Warn("Failed to send keepalive ping, closing connection")
+					state.end("keepalive_failed")
+					clientConn.Close()
+					return
+				}
+				logger.WithField("idle", idle.String()).Debug("Sent keepalive ping to MySQL")
+			}
+			state.serverWriteMu.Unlock()
+		}
+	}
+}
+
+// idleTimeout closes the connection once it has been idle for the configured
+// timeout. A connection is idle while MySQL spoke last, so a client waiting on
+// a slow query is never closed. Until the client sends its first command the
+// allowance is InitialIdleGrace, if that is longer.
+func (p *Proxy) idleTimeout(clientConn, mysqlConn net.Conn, state *relayState, stop <-chan struct{}, logger *logrus.Entry) {
+	timeout := p.config.IdleTimeout
+	check := timeout / 4
+	if check > time.Second || check <= 0 {
+		check = time.Second
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			allowance := timeout
+			if !state.clientSpoke.Load() && p.config.InitialIdleGrace > allowance {
+				allowance = p.config.InitialIdleGrace
+			}
+
+			idle := now.Sub(time.Unix(0, state.lastRelayed.Load()))
+			if idle >= allowance && state.serverSpokeLast.Load() {
+				logger.WithField("idle", idle.String()).Info("Closing idle connection")
+				state.end("idle_timeout")
+				clientConn.Close()
+				mysqlConn.Close()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,714 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// streamConn is a net.Conn that reads the same packets over and over and
+// discards what is written to it
+type streamConn struct {
+	net.Conn
+	stream []byte
+	pos    int
+}
+
+// newStreamConn returns a streamConn repeating the packets
+func newStreamConn(packets ...*MySQLPacket) *streamConn {
+	var stream []byte
+	for _, packet := range packets {
+		stream = append(stream, packetBytes(packet)...)
+	}
+	return &streamConn{stream: stream}
+}
+
+// packetBytes returns a packet as sent on the wire
+func packetBytes(packet *MySQLPacket) []byte {
+	var wire bytes.Buffer
+	frames := packet.frames()
+	frames.WriteTo(&wire)
+	return wire.Bytes()
+}
+
+func (c *streamConn) Read(p []byte) (int, error) {
+	n := copy(p, c.stream[c.pos:])
+	c.pos = (c.pos + n) % len(c.stream)
+	return n, nil
+}
+
+func (c *streamConn) Write(p []byte) (int, error)      { return len(p), nil }
+func (c *streamConn) SetWriteDeadline(time.Time) error { return nil }
+
+func TestPacketReaderReusesBuffer(t *testing.T) {
+	p := &Proxy{forwardBuffers: newBufferPool(16 << 10)}
+	query := newPacket(0, append([]byte{comQuery}, "SELECT * FROM orders WHERE id = 42"...))
+	large := newPacket(0, bytes.Repeat([]byte{comQuery}, 32<<10))
+	conn := newStreamConn(query, large)
+	reader := p.newPacketReader(conn)
+	defer reader.release()
+
+	for i := 0; i < 3; i++ {
+		packet, err := reader.readPacket()
+		if err != nil || !bytes.Equal(packet.Payload, query.Payload) {
+			t.Fatalf("read %v, %v", packet, err)
+		}
+		// A packet larger than the buffer is read into one of its own
+		if packet, err = reader.readPacket(); err != nil || packet.Length != large.Length {
+			t.Fatalf("read %v, %v", packet, err)
+		}
+		if &packet.FullPacket[0] == &(*reader.buf)[0] {
+			t.Fatal("a packet larger than the buffer was read into it")
+		}
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		conn.pos = 0
+		if _, err := reader.readPacket(); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("reading a packet that fits the buffer allocated %v times", allocs)
+	}
+}
+
+func TestWriteFramesWithoutCopying(t *testing.T) {
+	payload := bytes.Repeat([]byte{0x7a}, maxPacketPayload+5)
+	packet := newPacket(3, payload)
+	frames := packet.frames()
+	if len(frames) != 4 || len(frames[1]) != maxPacketPayload || len(frames[3]) != 5 {
+		t.Fatalf("framed as %d buffers", len(frames))
+	}
+	if &frames[1][0] != &payload[0] || &frames[3][0] != &payload[maxPacketPayload] {
+		t.Fatal("the payload was copied into the frames")
+	}
+	if frames[0][3] != 3 || frames[2][3] != 4 || packet.wireLength() != len(payload)+8 {
+		t.Fatalf("headers %x %x, wire length %d", frames[0], frames[2], packet.wireLength())
+	}
+}
+
+// BenchmarkPacketReader measures reading relayed packets into the pooled
+// buffer
+func BenchmarkPacketReader(b *testing.B) {
+	p := &Proxy{forwardBuffers: newBufferPool(16 << 10)}
+	packet := newPacket(0, append([]byte{comQuery}, bytes.Repeat([]byte("x"), 512)...))
+	conn := newStreamConn(packet)
+	reader := p.newPacketReader(conn)
+	defer reader.release()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(packet.wireLength()))
+	for i := 0; i < b.N; i++ {
+		if _, err := reader.readPacket(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkForwardFromServer measures relaying a result set from MySQL to
+// the client, packet by packet
+func BenchmarkForwardFromServer(b *testing.B) {
+	logger, _ := testLogger()
+	logger.SetLevel(logrus.InfoLevel)
+	p := &Proxy{forwardBuffers: newBufferPool(16 << 10), log: logger}
+	row := newPacket(2, appendLengthEncodedString(nil, string(bytes.Repeat([]byte("r"), 200))))
+	mysqlConn := newStreamConn(row)
+	clientConn := newStreamConn(row)
+	state := newRelayState(0)
+	entry := logrus.NewEntry(logger)
+
+	reader := p.newPacketReader(mysqlConn)
+	defer reader.release()
+	b.ReportAllocs()
+	b.SetBytes(int64(row.wireLength()))
+	for i := 0; i < b.N; i++ {
+		packet, err := reader.readPacket()
+		if err != nil {
+			b.Fatal(err)
+		}
+		state.checkSequence("server", packet.SequenceID, 1, entry)
+		if err := state.writeToClient(clientConn, packet); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkRelayQuery measures a query and its OK relayed through the proxy
+// to a backend, over loopback TCP
+func BenchmarkRelayQuery(b *testing.B) {
+	backend := startFakeMySQL(b)
+	_, addr := startProxy(b, testConfig(backend), WithEnsurer(&recordingEnsurer{backend: backend}))
+	c := mustConnect(b, addr, testHandshake{user: "root"})
+	c.conn.SetDeadline(time.Time{})
+	payload := append([]byte{comQuery}, "SELECT 1"...)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if response := c.send(0, payload); response == nil || response.Payload[0] != 0x00 {
+			b.Fatalf("query answered with %s", describePacket(response))
+		}
+	}
+}
+
+func TestCurrentDatabaseTracking(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.create("first", "second")
+	ensurer := &recordingEnsurer{backend: backend}
+	p, addr := startProxy(t, testConfig(backend), WithEnsurer(ensurer))
+
+	c := mustConnect(t, addr, testHandshake{user: "root", database: "first"})
+	var conn *activeConn
+	eventually(t, "the connection to be tracked", func() bool {
+		if conns := p.conns.all(); len(conns) == 1 {
+			conn = conns[0]
+		}
+		return conn != nil
+	})
+	expect := func(step, want string) {
+		t.Helper()
+		if got := conn.cc.CurrentDB(); got != want {
+			t.Fatalf("after %s the current database is %q, want %q", step, got, want)
+		}
+	}
+	expect("the handshake", "first")
+
+	c.mustQuery("USE second")
+	expect("USE", "second")
+	// The ensurer is handed the connection's context
+	ensurer.mu.Lock()
+	ctx := ensurer.ctxs[len(ensurer.ctxs)-1]
+	ensurer.mu.Unlock()
+	if connContextFrom(ctx) != conn.cc {
+		t.Fatal("the ensurer was not handed the connection's context")
+	}
+
+	ensurer.mu.Lock()
+	ensurer.err = newProxyError(errCategoryValidation, "refused")
+	ensurer.mu.Unlock()
+	expectErr(t, c.query("USE refused"), 1102)
+	expect("a refused USE", "second")
+	ensurer.mu.Lock()
+	ensurer.err = nil
+	ensurer.mu.Unlock()
+
+	if response := c.command(append([]byte{comInitDB}, "third"...)); response[0].Payload[0] != 0x00 {
+		t.Fatalf("COM_INIT_DB answered with %s", describePacket(response[0]))
+	}
+	expect("COM_INIT_DB", "third")
+
+	if response := c.command([]byte{comResetConnection}); response[0].Payload[0] != 0x00 {
+		t.Fatalf("COM_RESET_CONNECTION answered with %s", describePacket(response[0]))
+	}
+	expect("COM_RESET_CONNECTION", "third")
+	if response := c.command(append([]byte{comInitDB}, "fourth"...)); response[0].Payload[0] != 0x00 {
+		t.Fatalf("COM_INIT_DB answered with %s", describePacket(response[0]))
+	}
+	expect("COM_INIT_DB after COM_RESET_CONNECTION", "fourth")
+
+	if response := c.command(changeUserPayload("app", nil, "")); response[0].Payload[0] != 0x00 {
+		t.Fatalf("COM_CHANGE_USER answered with %s", describePacket(response[0]))
+	}
+	expect("COM_CHANGE_USER without a database", "")
+	if response := c.command(changeUserPayload("app", nil, "second")); response[0].Payload[0] != 0x00 {
+		t.Fatalf("COM_CHANGE_USER answered with %s", describePacket(response[0]))
+	}
+	expect("COM_CHANGE_USER", "second")
+}
+
+// closedWithin reports whether the proxy closes the client's connection
+// within d, without sending it anything
+func closedWithin(t *testing.T, c *testClient, d time.Duration) bool {
+	t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(d))
+	defer c.conn.SetReadDeadline(time.Time{})
+	_, err := c.conn.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return false
+	}
+	return true
+}
+
+func TestInitialIdleGrace(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.IdleTimeout = 100 * time.Millisecond
+	config.InitialIdleGrace = 800 * time.Millisecond
+	_, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	// Idle past the timeout, but within the grace, before the first command
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	if closedWithin(t, c, 400*time.Millisecond) {
+		t.Fatal("the connection was closed within its initial grace")
+	}
+	c.mustQuery("SELECT 1")
+
+	// Once the client has spoken the normal timeout applies
+	if !closedWithin(t, c, 600*time.Millisecond) {
+		t.Fatal("the connection outlived the idle timeout after its first command")
+	}
+
+	// The grace never shortens the timeout
+	config.InitialIdleGrace = 10 * time.Millisecond
+	_, addr = startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+	c = mustConnect(t, addr, testHandshake{user: "root"})
+	if closedWithin(t, c, 50*time.Millisecond) {
+		t.Fatal("a grace below the idle timeout closed the connection early")
+	}
+	if !closedWithin(t, c, 600*time.Millisecond) {
+		t.Fatal("the connection outlived the idle timeout")
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	state := newRelayState(50 * time.Millisecond)
+	packet := newPacket(1, []byte("stuck"))
+	for name, write := range map[string]func(net.Conn) error{
+		"client": func(conn net.Conn) error { return state.writeToClient(conn, packet) },
+		"server": func(conn net.Conn) error { return state.writeToServer(conn, packet) },
+	} {
+		// Nothing reads the other end of the pipe
+		conn, peer := net.Pipe()
+		start := time.Now()
+		err := write(conn)
+		if err == nil || !strings.Contains(err.Error(), "write timeout after 50ms") {
+			t.Fatalf("writing to a stuck %s: %v", name, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("writing to a stuck %s took %s", name, elapsed)
+		}
+		conn.Close()
+		peer.Close()
+	}
+}
+
+func TestStuckClientIsClosed(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.handleCommands(func(s *fakeSession, payload []byte) bool {
+		if string(payload) != "\x03SELECT big" {
+			return false
+		}
+		s.write([]byte{1})
+		s.write(append(appendLengthEncodedString(nil, "def"), 0, 0, 0, 1, 'b', 1, 'b', 0x0c, 33, 0, 0, 0, 1, 0xfd, 0, 0, 0, 0, 0))
+		s.eof()
+		row := appendLengthEncodedString(nil, strings.Repeat("x", 60000))
+		for s.write(row) == nil {
+		}
+		return true
+	})
+	config := testConfig(backend)
+	config.WriteTimeout = 200 * time.Millisecond
+	logger, hook := testLogger()
+	_, addr := startProxy(t, config, WithLogger(logger), WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	// The client sends a query and stops reading the rows
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	if err := writePacket(c.conn, newPacket(0, []byte("\x03SELECT big"))); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	eventually(t, "the proxy to give up on the client", func() bool {
+		entry := findEntry(hook, "Failed to forward MySQL packet to client, closing connection")
+		return entry != nil && strings.Contains(entry.Data["error"].(error).Error(), "write timeout after 200ms")
+	})
+}
+
+func TestEndlessContinuationsAreCapped(t *testing.T) {
+	// MySQL packets of the maximum length, continued forever
+	conn := &streamConn{stream: maxLengthFrame()}
+	header := make([]byte, 4)
+	conn.Read(header)
+	_, err := readLogicalPacket(conn, header, 3*maxPacketPayload)
+	if !errors.Is(err, errPacketTooLarge) {
+		t.Fatalf("reading endless continuations: %v", err)
+	}
+}
+
+func TestOversizedCommandClosesConnection(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.MaxReassembledPacketBytes = 1 << 20
+	_, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	// The client keeps sending continuation packets, which the proxy stops
+	// reading once it has given up
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	frame := maxLengthFrame()
+	go func() {
+		for seq := 0; ; seq++ {
+			frame[3] = byte(seq)
+			if _, err := c.conn.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+	expectErr(t, c.read(), 1153)
+	if packet := c.read(); packet != nil {
+		t.Fatalf("the connection stayed open, sending %s", describePacket(packet))
+	}
+	if got := len(backend.receivedCommands()); got != 0 {
+		t.Fatalf("MySQL received %d commands", got)
+	}
+}
+
+// maxLengthFrame returns a COM_QUERY packet of the maximum length, which a
+// continuation packet must follow
+func maxLengthFrame() []byte {
+	return append([]byte{0xff, 0xff, 0xff, 0, comQuery}, bytes.Repeat([]byte{'x'}, maxPacketPayload-1)...)
+}
+
+func TestEmptyClientPacket(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.handleCommands(func(s *fakeSession, payload []byte) bool {
+		if len(payload) == 0 {
+			s.ok()
+			return true
+		}
+		return false
+	})
+	ensurer := &recordingEnsurer{backend: backend}
+	_, addr := startProxy(t, testConfig(backend), WithEnsurer(ensurer))
+
+	// The empty packet reaches MySQL without being taken for a command, and
+	// the connection carries on
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	if response := c.send(0, nil); response == nil || response.Payload[0] != 0x00 {
+		t.Fatalf("empty packet answered with %s", describePacket(response))
+	}
+	c.mustQuery("USE afterwards")
+
+	commands := backend.receivedCommands()
+	if len(commands) < 2 || len(commands[len(commands)-2]) != 0 {
+		t.Fatalf("MySQL received %q", commands)
+	}
+	if !equalStrings(ensurer.requested(), []string{"afterwards"}) {
+		t.Fatalf("ensurer asked for %q", ensurer.requested())
+	}
+}
+
+func TestChangeUserAuthSwitch(t *testing.T) {
+	backend := startFakeMySQL(t)
+	var mu sync.Mutex
+	var replies [][]byte
+	backend.handleCommands(func(s *fakeSession, payload []byte) bool {
+		if len(payload) == 0 || payload[0] != comChangeUser {
+			return false
+		}
+		if s.write([]byte("\xfemysql_clear_password\x00")) != nil {
+			return true
+		}
+		reply, err := s.read()
+		if err != nil {
+			return true
+		}
+		mu.Lock()
+		replies = append(replies, reply)
+		mu.Unlock()
+		s.ok()
+		return true
+	})
+	ensurer := &recordingEnsurer{backend: backend}
+	_, addr := startProxy(t, testConfig(backend), WithEnsurer(ensurer))
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+
+	authSwitch := c.send(0, changeUserPayload("app", []byte("scrambled"), ""))
+	if authSwitch == nil || authSwitch.Payload[0] != 0xfe {
+		t.Fatalf("COM_CHANGE_USER answered with %s", describePacket(authSwitch))
+	}
+
+	// The password happens to read as a USE, which must reach MySQL as the
+	// auth switch response it is rather than be intercepted
+	password := []byte("\x03USE hijacked")
+	if response := c.send(authSwitch.SequenceID+1, password); response == nil || response.Payload[0] != 0x00 {
+		t.Fatalf("auth switch response answered with %s", describePacket(response))
+	}
+	mu.Lock()
+	if len(replies) != 1 || !bytes.Equal(replies[0], password) {
+		t.Fatalf("MySQL received auth switch responses %q", replies)
+	}
+	mu.Unlock()
+
+	// Interception resumes once the authentication is over
+	c.mustQuery("USE afterwards")
+	if !equalStrings(ensurer.requested(), []string{"afterwards"}) {
+		t.Fatalf("ensurer asked for %q", ensurer.requested())
+	}
+}
+
+func TestUseSplitAcrossWrites(t *testing.T) {
+	backend := startFakeMySQL(t)
+	ensurer := &recordingEnsurer{backend: backend}
+	_, addr := startProxy(t, testConfig(backend), WithEnsurer(ensurer))
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+
+	// The header and the start of the statement arrive apart from its end
+	data := packetBytes(newPacket(0, []byte("\x03USE split_db")))
+	for _, part := range [][]byte{data[:2], data[2:7], data[7:]} {
+		if _, err := c.conn.Write(part); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if response := c.read(); response == nil || response.Payload[0] != 0x00 {
+		t.Fatalf("USE answered with %s", describePacket(response))
+	}
+	if !equalStrings(ensurer.requested(), []string{"split_db"}) {
+		t.Fatalf("ensurer asked for %q", ensurer.requested())
+	}
+}
+
+func TestLargeQueryIsForwardedWhole(t *testing.T) {
+	backend := startFakeMySQL(t)
+	ensurer := &recordingEnsurer{backend: backend}
+	_, addr := startProxy(t, testConfig(backend), WithEnsurer(ensurer))
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+
+	// A 1 MB statement whose data happens to contain a USE and packet-like
+	// bytes is one command
+	query := "INSERT INTO blobs VALUES ('" + strings.Repeat("\x05\x00\x00\x00\x03USE bogus;", 1<<20/15) + "')"
+	c.mustQuery(query)
+	queries := backend.receivedQueries()
+	if len(queries) != 1 || queries[0] != query {
+		t.Fatalf("MySQL received %d queries", len(queries))
+	}
+	c.mustQuery("USE after_blob")
+	if !equalStrings(ensurer.requested(), []string{"after_blob"}) {
+		t.Fatalf("ensurer asked for %q", ensurer.requested())
+	}
+}
+
+func TestContinuationPackets(t *testing.T) {
+	backend := startFakeMySQL(t)
+	// The continuation of the row starts with bytes that would read as an
+	// ERR at the start of a response
+	row := appendLengthEncodedString(nil, strings.Repeat("r", maxPacketPayload))
+	row = append(row[:maxPacketPayload], append([]byte{0xff, 0x15, 0x04, '#'}, row[maxPacketPayload:]...)...)
+	backend.handleCommands(func(s *fakeSession, payload []byte) bool {
+		if string(payload) != "\x03SELECT big" {
+			return false
+		}
+		s.write([]byte{1})
+		s.write(append(appendLengthEncodedString(nil, "def"), 0, 0, 0, 1, 'b', 1, 'b', 0x0c, 33, 0, 0, 1, 0, 0xfc, 0, 0, 0, 0, 0))
+		s.eof()
+		s.write(row)
+		s.eof()
+		return true
+	})
+	ensurer := &recordingEnsurer{backend: backend}
+	_, addr := startProxy(t, testConfig(backend), WithEnsurer(ensurer))
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+
+	// A 17 MB statement reaches MySQL whole
+	query := "INSERT INTO blobs VALUES ('" + strings.Repeat("x", maxPacketPayload+1<<20) + "')"
+	c.mustQuery(query)
+	if queries := backend.receivedQueries(); len(queries) != 1 || queries[0] != query {
+		t.Fatalf("MySQL received %d queries", len(queries))
+	}
+
+	// A row longer than a packet reaches the client in its packets, untouched
+	if err := writePacket(c.conn, newPacket(0, []byte("\x03SELECT big"))); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	var received []byte
+	for i := 0; i < 6; i++ {
+		packet := c.read()
+		if packet == nil {
+			t.Fatal("connection closed while reading the result set")
+		}
+		if i >= 3 && i < 5 {
+			received = append(received, packet.Payload...)
+		}
+	}
+	if !bytes.Equal(received, row) {
+		t.Fatalf("client received a row of %d bytes, want %d", len(received), len(row))
+	}
+
+	// The relay is still in step with both sides
+	c.mustQuery("USE after_continuation")
+	if !equalStrings(ensurer.requested(), []string{"after_continuation"}) {
+		t.Fatalf("ensurer asked for %q", ensurer.requested())
+	}
+}
+
+func TestSessionsOutliveHandshakeTimeout(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.handleCommands(func(s *fakeSession, payload []byte) bool {
+		if string(payload) == "\x03ALTER TABLE big ADD COLUMN c INT" {
+			time.Sleep(600 * time.Millisecond)
+			s.ok()
+			return true
+		}
+		return false
+	})
+	config := testConfig(backend)
+	// The handshake timeout stands in for the 30 seconds sessions used to be
+	// cut at, whatever they were doing
+	config.HandshakeTimeout = 200 * time.Millisecond
+	_, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		c.mustQuery("SELECT 1")
+		time.Sleep(100 * time.Millisecond)
+	}
+	// Without IDLE_TIMEOUT a statement that keeps MySQL silent is not cut either
+	c.mustQuery("ALTER TABLE big ADD COLUMN c INT")
+
+	// Traffic keeps pushing IDLE_TIMEOUT back, until the client goes quiet
+	config.IdleTimeout = 300 * time.Millisecond
+	_, addr = startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+	c = mustConnect(t, addr, testHandshake{user: "root"})
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); {
+		c.mustQuery("SELECT 1")
+		time.Sleep(100 * time.Millisecond)
+	}
+	if !closedWithin(t, c, time.Second) {
+		t.Fatal("the idle connection outlived IDLE_TIMEOUT")
+	}
+}
+
+func TestCopyEndReason(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{nil, "client_closed"},
+		{net.ErrClosed, "closed"},
+		{&net.OpError{Op: "read", Err: net.ErrClosed}, "closed"},
+		{errors.New("connection reset by peer"), "relay_failed"},
+	} {
+		if got := copyEndReason("client", tc.err); got != tc.want {
+			t.Errorf("copyEndReason(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+
+	// The first reason explains the end of both directions
+	state := newRelayState(0)
+	if state.reason() != "unknown" {
+		t.Fatalf("reason before the end: %q", state.reason())
+	}
+	state.end("mysql_closed")
+	state.end("closed")
+	if state.reason() != "mysql_closed" {
+		t.Fatalf("reason %q, want mysql_closed", state.reason())
+	}
+}
+
+func TestMySQLClosingEndsTheSession(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.handleCommands(func(s *fakeSession, payload []byte) bool {
+		if payload[0] == comQuery && string(payload[1:]) == "SELECT 'goodbye'" {
+			s.conn.Close()
+			return true
+		}
+		return false
+	})
+	logger, hook := testLogger()
+	p, addr := startProxy(t, testConfig(backend), WithLogger(logger), WithEnsurer(&recordingEnsurer{}))
+
+	// Goroutines the runtime or earlier tests are still winding down may end
+	// meanwhile, so only the count being no higher than before is checked
+	goroutines := runtime.NumGoroutine()
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("SELECT 1")
+
+	// The client sees its connection end as soon as MySQL's does, while it is
+	// still connected itself
+	c.send(0, append([]byte{comQuery}, "SELECT 'goodbye'"...))
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("client read %v after MySQL closed, want EOF", err)
+	}
+	eventually(t, "the session to end", func() bool { return p.connsOpen.Load() == 0 })
+	eventually(t, "the relay goroutines to exit", func() bool { return runtime.NumGoroutine() <= goroutines })
+
+	entry := findEntry(hook, "Connection closed")
+	if entry == nil || entry.Data["reason"] != "mysql_closed" {
+		t.Fatalf("session ended with %v", entry)
+	}
+	if entry.Data["bytes_from_client"].(uint64) == 0 || entry.Data["bytes_from_server"].(uint64) == 0 {
+		t.Fatalf("session relayed %v bytes from the client and %v from MySQL", entry.Data["bytes_from_client"], entry.Data["bytes_from_server"])
+	}
+	for _, entry := range hook.AllEntries() {
+		if entry.Level <= logrus.ErrorLevel {
+			t.Errorf("logged %q at %s", entry.Message, entry.Level)
+		}
+	}
+}
+
+func TestClientClosingEndsTheSession(t *testing.T) {
+	backend := startFakeMySQL(t)
+	logger, hook := testLogger()
+	p, addr := startProxy(t, testConfig(backend), WithLogger(logger), WithEnsurer(&recordingEnsurer{}))
+
+	goroutines := runtime.NumGoroutine()
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("SELECT 1")
+	c.conn.Close()
+	eventually(t, "the session to end", func() bool { return p.connsOpen.Load() == 0 })
+	eventually(t, "the relay goroutines to exit", func() bool { return runtime.NumGoroutine() <= goroutines })
+	if entry := findEntry(hook, "Connection closed"); entry == nil || entry.Data["reason"] != "client_closed" {
+		t.Fatalf("session ended with %v", entry)
+	}
+}
+
+func TestIdleKeepalivePing(t *testing.T) {
+	backend := startFakeMySQL(t)
+	release := make(chan struct{})
+	backend.handleCommands(func(s *fakeSession, payload []byte) bool {
+		if string(payload) == "\x03SELECT SLEEP(1)" {
+			<-release
+		}
+		return false
+	})
+	config := testConfig(backend)
+	config.IdleKeepalivePing = 100 * time.Millisecond
+	_, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+	pings := func() (n int) {
+		for _, command := range backend.receivedCommands() {
+			if bytes.Equal(command, comPing[4:]) {
+				n++
+			}
+		}
+		return n
+	}
+
+	// MySQL spoke last, so the idle connection is pinged, and the client
+	// never sees the OKs
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("SELECT 1")
+	eventually(t, "MySQL to be pinged", func() bool { return pings() >= 2 })
+	if closedWithin(t, c, 50*time.Millisecond) {
+		t.Fatal("the client was sent the answer to a keepalive ping")
+	}
+	// A stray OK would be taken for the answer to a query returning rows
+	if response := c.query("SELECT @@lower_case_table_names"); response == nil || response.Payload[0] != 0x01 {
+		t.Fatalf("SELECT @@lower_case_table_names answered with %s", describePacket(response))
+	}
+
+	// A client waiting on a slow query is not pinged for, however long it
+	// takes
+	done := make(chan *MySQLPacket)
+	go func() { done <- c.query("SELECT SLEEP(1)") }()
+	eventually(t, "the slow query to reach MySQL", func() bool {
+		commands := backend.receivedCommands()
+		return string(commands[len(commands)-1]) == "\x03SELECT SLEEP(1)"
+	})
+	before := pings()
+	time.Sleep(400 * time.Millisecond)
+	if after := pings(); after != before {
+		t.Fatalf("%d pings sent while the client waited on MySQL", after-before)
+	}
+	close(release)
+	if response := <-done; response == nil || response.Payload[0] == 0xff {
+		t.Fatalf("the slow query answered with %s", describePacket(response))
+	}
+}
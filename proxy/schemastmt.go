@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var clientDatabaseStatements = newCounterVec("mysql_autodb_client_database_statements_total",
+	"CREATE DATABASE and DROP DATABASE statements clients ran successfully, by statement", "statement")
+
+// schemaChange is a CREATE DATABASE or DROP DATABASE statement sent by a
+// client, applied to the proxy's view of the backend once MySQL answers OK
+type schemaChange struct {
+	create bool
+	name   string
+}
+
+// parseSchemaStatement recognizes a statement starting with CREATE or DROP
+// DATABASE (or SCHEMA), with an optional IF [NOT] EXISTS and a possibly
+// backtick-quoted name. Only the start of the query is parsed, so the options
+// of a CREATE and any statements after the first are ignored.
+func parseSchemaStatement(query string) (schemaChange, bool) {
+	var change schemaChange
+	rest, ok := cutKeyword(strings.TrimLeft(query, sqlWhitespace), "CREATE")
+	if ok {
+		change.create = true
+	} else if rest, ok = cutKeyword(rest, "DROP"); !ok {
+		return change, false
+	}
+	if rest, ok = cutKeyword(rest, "DATABASE"); !ok {
+		if rest, ok = cutKeyword(rest, "SCHEMA"); !ok {
+			return change, false
+		}
+	}
+	if next, ok := cutKeyword(rest, "IF"); ok {
+		if change.create {
+			if next, ok = cutKeyword(next, "NOT"); !ok {
+				return change, false
+			}
+		}
+		if next, ok = cutKeyword(next, "EXISTS"); !ok {
+			return change, false
+		}
+		rest = next
+	}
+
+	change.name, rest = parseIdentifier(rest)
+	if change.name == "" || (!change.create && !isStatementEnd(rest)) {
+		return change, false
+	}
+	return change, true
+}
+
+// cutKeyword removes a keyword and the whitespace after it from the start of
+// rest, matching case-insensitively. The keyword must be followed by
+// whitespace or a quoted identifier.
+func cutKeyword(rest, keyword string) (string, bool) {
+	if len(rest) <= len(keyword) || !strings.EqualFold(rest[:len(keyword)], keyword) {
+		return rest, false
+	}
+	if next := rest[len(keyword)]; next != '`' && strings.IndexByte(sqlWhitespace, next) < 0 {
+		return rest, false
+	}
+	return strings.TrimLeft(rest[len(keyword):], sqlWhitespace), true
+}
+
+// applySchemaChange updates the known database cache and the registry of
+// created databases after MySQL answered a client's CREATE or DROP DATABASE
+// with the given OK packet
+func (p *Proxy) applySchemaChange(cc *ConnContext, change schemaChange, ok []byte, logger *logrus.Entry) {
+	backend := cc.Backend
+	if backend == "" {
+		backend = p.backendAddr()
+	}
+	logger = logger.WithField("database", change.name)
+
+	if !change.create {
+		clientDatabaseStatements.Inc("drop")
+		p.forgetDatabase(backend, change.name)
+		if database, found := p.created.get(change.name); found && database.Backend == backend {
+			p.created.remove(change.name)
+			if p.audit != nil && !database.DryRun {
+				p.audit.RecordDrop(dropAuditEvent{
+					Database:   change.name,
+					Backend:    backend,
+					Reason:     "client",
+					Timestamp:  time.Now().UTC(),
+					LastUsedAt: database.LastUsedAt.UTC(),
+				})
+			}
+		}
+		// MySQL leaves a session that dropped its database with none selected
+		if cc.CurrentDB() == change.name {
+			p.selectDatabase(cc, "")
+		}
+		logger.Info("Client dropped database")
+		return
+	}
+
+	// CREATE DATABASE IF NOT EXISTS succeeds without creating anything when
+	// the database exists, which MySQL reports as no rows affected
+	if affected, _, err := readLengthEncodedInt(ok[1:]); err != nil || affected == 0 {
+		return
+	}
+	clientDatabaseStatements.Inc("create")
+	if ensurer, found := p.backendEnsurers[backend]; found {
+		ensurer.Remember(change.name)
+	}
+	database := createdDatabase{
+		Name:          change.name,
+		CreatedAt:     time.Now().UTC(),
+		Client:        cc.ClientAddr,
+		ConnID:        cc.ID,
+		Username:      cc.Username,
+		Backend:       backend,
+		Trigger:       "create_database",
+		ClientCreated: true,
+	}
+	p.created.record(database)
+	if p.audit != nil {
+		p.audit.Record(database.creationEvent(p.instance))
+	}
+	logger.Info("Client created database")
+}
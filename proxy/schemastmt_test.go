@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSchemaStatement(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  *schemaChange
+	}{
+		{"CREATE DATABASE orders", &schemaChange{create: true, name: "orders"}},
+		{"  create Schema Orders;", &schemaChange{create: true, name: "Orders"}},
+		{"CREATE DATABASE IF NOT EXISTS `my-orders`", &schemaChange{create: true, name: "my-orders"}},
+		{"create database if not exists`orders`", &schemaChange{create: true, name: "orders"}},
+		{"CREATE DATABASE orders CHARACTER SET utf8mb4", &schemaChange{create: true, name: "orders"}},
+		{"CREATE DATABASE orders; DROP DATABASE billing", &schemaChange{create: true, name: "orders"}},
+		{"DROP DATABASE orders", &schemaChange{name: "orders"}},
+		{"Drop Schema If Exists `a``b`;", &schemaChange{name: "a`b"}},
+		{"drop database `orders` ; SELECT 1", &schemaChange{name: "orders"}},
+		{"DROP DATABASE orders extra", nil},
+		{"DROP DATABASE IF NOT EXISTS orders", nil},
+		{"CREATE DATABASE IF EXISTS orders", nil},
+		{"CREATE TABLE orders (id INT)", nil},
+		{"DROP DATABASES", nil},
+		{"CREATEDATABASE orders", nil},
+		{"SELECT 'CREATE DATABASE orders'", nil},
+		{"CREATE DATABASE", nil},
+	} {
+		change, ok := parseSchemaStatement(tc.query)
+		switch {
+		case tc.want == nil && ok:
+			t.Errorf("parseSchemaStatement(%q) = %+v", tc.query, change)
+		case tc.want != nil && (!ok || change != *tc.want):
+			t.Errorf("parseSchemaStatement(%q) = %+v, %v, want %+v", tc.query, change, ok, *tc.want)
+		}
+	}
+}
+
+// createQueries counts the CREATE DATABASE statements MySQL received for name
+func createQueries(backend *fakeMySQL, name string) int {
+	count := 0
+	for _, query := range backend.receivedQueries() {
+		if query == "CREATE DATABASE "+quoteIdentifier(name) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestClientDatabaseStatements(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.AutoCreateOn1049 = false
+	p, addr := startProxy(t, config)
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+
+	// A database the proxy created and the client dropped is forgotten, and
+	// created again when selected
+	c.mustQuery("USE orders")
+	drops := clientDatabaseStatements.Value("drop")
+	c.mustQuery("drop Database IF EXISTS `orders`")
+	if _, ok := p.created.get("orders"); ok {
+		t.Fatal("the dropped database is still registered")
+	}
+	if clientDatabaseStatements.Value("drop") != drops+1 {
+		t.Fatal("the drop was not counted")
+	}
+	if current := p.conns.all()[0].cc.CurrentDB(); current != "" {
+		t.Fatalf("the connection still has %q selected", current)
+	}
+	c.mustQuery("USE orders")
+	if got := createQueries(backend, "orders"); got != 2 {
+		t.Fatalf("orders created %d times, want 2", got)
+	}
+
+	// A database the client created is known to exist, and registered as
+	// created by the client
+	creates := clientDatabaseStatements.Value("create")
+	c.mustQuery("Create Database If Not Exists `Billing`")
+	database, ok := p.created.get("Billing")
+	if !ok || !database.ClientCreated || database.Trigger != "create_database" {
+		t.Fatalf("registered %+v, %v", database, ok)
+	}
+	checks := schemataQueries(backend)
+	c.mustQuery("USE Billing")
+	if schemataQueries(backend) != checks || createQueries(backend, "Billing") != 0 {
+		t.Fatal("the proxy checked for or created the client's database")
+	}
+
+	// Statements that create nothing, or that MySQL refuses, change nothing
+	backend.create("inventory")
+	c.mustQuery("CREATE DATABASE IF NOT EXISTS inventory")
+	expectErr(t, c.query("CREATE DATABASE inventory"), 1007)
+	if _, ok := p.created.get("inventory"); ok {
+		t.Fatal("an existing database was registered")
+	}
+	if clientDatabaseStatements.Value("create") != creates+1 {
+		t.Fatal("creations were miscounted")
+	}
+}
+
+func TestExpirySweepClientCreated(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	p, addr := startProxy(t, config)
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("CREATE DATABASE client_made")
+
+	now := func() time.Time { return time.Now().Add(2 * time.Hour) }
+	sweeper := newExpirySweeper(p, time.Hour, time.Minute)
+	sweeper.now = now
+	sweeper.sweep()
+	if !backend.hasDatabase("client_made") {
+		t.Fatal("a database the client created was dropped without DB_TTL_CLIENT_CREATED")
+	}
+
+	p.config.DBTTLClientCreated = true
+	sweeper.sweep()
+	if backend.hasDatabase("client_made") {
+		t.Fatal("a database the client created was kept with DB_TTL_CLIENT_CREATED")
+	}
+	if !strings.Contains(strings.Join(backend.receivedQueries(), "\n"), "DROP DATABASE IF EXISTS `client_made`") {
+		t.Fatal("the database was not dropped by the sweeper")
+	}
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// seedTimeout bounds running all seed files against a new database
+const seedTimeout = time.Minute
+
+var seedFailures = newCounter("mysql_autodb_seed_failures_total",
+	"Newly created databases whose seed SQL failed")
+
+// seedPlaceholder is replaced in seed files with the created database's name
+const seedPlaceholder = "${DATABASE}"
+
+// seedFiles returns the .sql files of the seed directory, in lexical order
+func seedFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seed directory: %w", err)
+	}
+	var files []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.EqualFold(filepath.Ext(entry.Name()), ".sql") {
+			files = append(files, filepath.Join(dir, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// seed runs the seed files against a database the proxy has just created.
+// Each file runs in its own transaction on one connection from db with the
+// database selected; statements MySQL commits implicitly, such as CREATE
+// TABLE, cannot be rolled back. Seeding stops at the first failing statement,
+// which is logged, and the database is left in place for the client.
+func (e *sqlEnsurer) seed(ctx context.Context, db *sql.DB, dbName string, logger *logrus.Entry) {
+	if e.config.SeedSQLDir == "" {
+		return
+	}
+	logger = logger.WithField("seed_dir", e.config.SeedSQLDir)
+	files, err := seedFiles(e.config.SeedSQLDir)
+	if err != nil {
+		seedFailures.Inc()
+		logger.WithError(err).Error("Failed to seed database")
+		return
+	}
+
+	// The seed runs to completion even if the create's own deadline is near
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), seedTimeout)
+	defer cancel()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		seedFailures.Inc()
+		logger.WithError(err).Error("Failed to connect to MySQL to seed database")
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, "USE "+quoteIdentifier(dbName)); err != nil {
+		seedFailures.Inc()
+		logger.WithError(err).Error("Failed to select database to seed")
+		return
+	}
+
+	for _, file := range files {
+		fileLogger := logger.WithField("file", filepath.Base(file))
+		script, err := os.ReadFile(file)
+		if err != nil {
+			seedFailures.Inc()
+			fileLogger.WithError(err).Error("Failed to read seed file")
+			return
+		}
+		statements := splitStatements(strings.ReplaceAll(string(script), seedPlaceholder, dbName))
+
+		tx, err := conn.BeginTx(ctx, nil)
+		if err != nil {
+			seedFailures.Inc()
+			fileLogger.WithError(err).Error("Failed to start seed transaction")
+			return
+		}
+		for i, statement := range statements {
+			if _, err := tx.ExecContext(ctx, statement); err != nil {
+				tx.Rollback()
+				seedFailures.Inc()
+				fileLogger.WithError(err).WithField("statement", i+1).Error("Seed statement failed")
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			seedFailures.Inc()
+			fileLogger.WithError(err).Error("Failed to commit seed file")
+			return
+		}
+		fileLogger.WithField("statements", len(statements)).Debug("Ran seed file")
+	}
+	logger.WithField("files", len(files)).Info("Seeded database")
+}
+
+// splitStatements splits a SQL script into statements at semicolons outside
+// quoted strings, quoted identifiers and comments. DELIMITER is not supported.
+func splitStatements(script string) []string {
+	var statements []string
+	var current strings.Builder
+	flush := func() {
+		if statement := strings.TrimSpace(current.String()); statement != "" {
+			statements = append(statements, statement)
+		}
+		current.Reset()
+	}
+
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`':
+			// Copy the quoted text up to its closing quote; backslashes escape
+			// in strings and doubled quotes escape in all three
+			end := i + 1
+			for end < len(script) {
+				if script[end] == '\\' && c != '`' {
+					end += 2
+					continue
+				}
+				if script[end] == c {
+					if end+1 < len(script) && script[end+1] == c {
+						end += 2
+						continue
+					}
+					break
+				}
+				end++
+			}
+			end = min(end, len(script)-1)
+			current.WriteString(script[i : end+1])
+			i = end
+		case c == '#' || isDashComment(script[i:]):
+			// Line comments are dropped
+			if end := strings.IndexByte(script[i:], '\n'); end >= 0 {
+				i += end
+				current.WriteByte('\n')
+			} else {
+				i = len(script)
+			}
+		case c == '/' && strings.HasPrefix(script[i:], "/*"):
+			if end := strings.Index(script[i+2:], "*/"); end >= 0 {
+				i += end + 3
+			} else {
+				i = len(script)
+			}
+			current.WriteByte(' ')
+		case c == ';':
+			flush()
+		default:
+			current.WriteByte(c)
+		}
+	}
+	flush()
+	return statements
+}
+
+// isDashComment reports whether text starts with a "-- " comment, which MySQL
+// only recognizes when the dashes are followed by whitespace
+func isDashComment(text string) bool {
+	return strings.HasPrefix(text, "--") && (len(text) == 2 || strings.ContainsRune(" \t\r\n", rune(text[2])))
+}
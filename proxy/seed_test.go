@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	for _, tc := range []struct {
+		script string
+		want   []string
+	}{
+		{"CREATE TABLE a (id INT); CREATE TABLE b (id INT);", []string{"CREATE TABLE a (id INT)", "CREATE TABLE b (id INT)"}},
+		{"INSERT INTO a VALUES ('x;y')", []string{"INSERT INTO a VALUES ('x;y')"}},
+		{`INSERT INTO a VALUES ('it''s; \'here\';')`, []string{`INSERT INTO a VALUES ('it''s; \'here\';')`}},
+		{"CREATE TABLE `semi;colon` (id INT)", []string{"CREATE TABLE `semi;colon` (id INT)"}},
+		{"-- a comment; here\nSELECT 1; # another; one\nSELECT 2", []string{"SELECT 1", "SELECT 2"}},
+		{"SELECT 1 /* block; comment */; SELECT 2", []string{"SELECT 1", "SELECT 2"}},
+		{"SELECT 3--1;", []string{"SELECT 3--1"}},
+		{" ;\n; ", nil},
+	} {
+		if got := splitStatements(tc.script); !equalStrings(got, tc.want) {
+			t.Errorf("splitStatements(%q) = %q, want %q", tc.script, got, tc.want)
+		}
+	}
+}
+
+// writeSeedFiles writes files, by name, to a new seed directory
+func writeSeedFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// queriesAfter returns the queries received after the first one equal to
+// query
+func queriesAfter(queries []string, query string) []string {
+	for i, received := range queries {
+		if received == query {
+			return queries[i+1:]
+		}
+	}
+	return nil
+}
+
+func TestSeedNewDatabases(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.create("existing")
+	config := testConfig(backend)
+	config.SeedSQLDir = writeSeedFiles(t, map[string]string{
+		"02_data.sql":   "INSERT INTO `${DATABASE}`.settings VALUES ('name', '${DATABASE}');",
+		"01_schema.sql": "CREATE TABLE settings (k TEXT, v TEXT);\nCREATE TABLE schema_migrations (version INT);",
+		"README.txt":    "not SQL",
+	})
+	e := newTestEnsurer(t, config)
+
+	if err := e.EnsureExists(context.Background(), "orders"); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	want := []string{
+		"START TRANSACTION",
+		"CREATE TABLE settings (k TEXT, v TEXT)",
+		"CREATE TABLE schema_migrations (version INT)",
+		"COMMIT",
+		"START TRANSACTION",
+		"INSERT INTO `orders`.settings VALUES ('name', 'orders')",
+		"COMMIT",
+	}
+	if got := queriesAfter(backend.receivedQueries(), "USE `orders`"); !equalStrings(got, want) {
+		t.Fatalf("seeded with %q, want %q", got, want)
+	}
+
+	// Databases that already existed are not seeded
+	seeded := len(backend.receivedQueries())
+	if err := e.EnsureExists(context.Background(), "existing"); err != nil {
+		t.Fatalf("check: %v", err)
+	}
+	for _, query := range backend.receivedQueries()[seeded:] {
+		if strings.HasPrefix(query, "CREATE TABLE") {
+			t.Fatalf("an existing database was seeded with %q", query)
+		}
+	}
+}
+
+func TestSeedFailureKeepsDatabase(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.handleCommands(func(s *fakeSession, payload []byte) bool {
+		if payload[0] == comQuery && strings.HasPrefix(string(payload[1:]), "INSERT INTO broken") {
+			s.err(1146, "42S02", "Table 'broken' doesn't exist")
+			return true
+		}
+		return false
+	})
+	config := testConfig(backend)
+	config.SeedSQLDir = writeSeedFiles(t, map[string]string{
+		"01_broken.sql": "CREATE TABLE ok (id INT);\nINSERT INTO broken VALUES (1);",
+		"02_later.sql":  "CREATE TABLE later (id INT);",
+	})
+	logger, hook := testLogger()
+	_, addr := startProxy(t, config, WithLogger(logger))
+
+	failures := seedFailures.Value()
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("USE orders")
+	if !backend.hasDatabase("orders") {
+		t.Fatal("the database was not created")
+	}
+	if got := seedFailures.Value() - failures; got != 1 {
+		t.Fatalf("counted %d seed failures", got)
+	}
+
+	// The failure is logged with the file and statement, and seeding stops
+	entry := findEntry(hook, "Seed statement failed")
+	if entry == nil || entry.Data["file"] != "01_broken.sql" || entry.Data["statement"] != 2 {
+		t.Fatalf("logged %v", entry)
+	}
+	if containsString(backend.receivedQueries(), "CREATE TABLE later (id INT)") {
+		t.Fatal("seeding went on after a failed file")
+	}
+	if !containsString(backend.receivedQueries(), "ROLLBACK") {
+		t.Fatal("the failed file was not rolled back")
+	}
+}
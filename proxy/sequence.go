@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/sirupsen/logrus"
+)
+
+// nextSequenceID returns the sequence ID that follows sequenceID, wrapping
+// after 0xff as MySQL does
+func nextSequenceID(sequenceID int) int {
+	return (sequenceID + 1) & 0xff
+}
+
+// lastSequenceID returns the sequence ID of the last physical packet of a
+// packet, which the next packet of the exchange follows on from
+func (p *MySQLPacket) lastSequenceID() int {
+	packets := p.Packets
+	if packets < 1 {
+		packets = 1
+	}
+	return (p.SequenceID + packets - 1) & 0xff
+}
+
+// exchangeSequence follows the sequence IDs the client sees during its
+// handshake: the last one it sent and the last one written to it, relayed
+// from MySQL or written by the proxy itself. Packets the proxy sends the
+// client on its own, such as an auth switch or an ERR refusing it, must carry
+// the next one, or strict clients report the connection out of sync.
+type exchangeSequence struct {
+	// read and written are the last sequence IDs read from and written to
+	// the client, -1 before any; last is the later of the two
+	read, written, last int
+
+	logger *logrus.Entry
+}
+
+// newExchangeSequence creates the sequence of an exchange that has not started
+func newExchangeSequence(logger *logrus.Entry) *exchangeSequence {
+	return &exchangeSequence{read: -1, written: -1, last: -1, logger: logger}
+}
+
+// readFrom records a packet read from the client
+func (s *exchangeSequence) readFrom(packet *MySQLPacket) {
+	s.read = packet.lastSequenceID()
+	s.last = s.read
+}
+
+// next returns the sequence ID of the next packet of the exchange
+func (s *exchangeSequence) next() int {
+	return nextSequenceID(s.last)
+}
+
+// packet frames a payload as the next packet of the exchange
+func (s *exchangeSequence) packet(payload []byte) *MySQLPacket {
+	return newPacket(s.next(), payload)
+}
+
+// write writes a packet to the client and records it. A packet that does not
+// follow on from the exchange is still written, but logged and counted as a
+// sequence ID anomaly of the proxy's.
+func (s *exchangeSequence) write(conn net.Conn, packet *MySQLPacket) error {
+	if expected := s.next(); packet.SequenceID&0xff != expected {
+		sequenceAnomalies.Inc("proxy")
+		s.logger.WithFields(logrus.Fields{
+			"expected":     expected,
+			"sequence_id":  packet.SequenceID & 0xff,
+			"last_read":    s.read,
+			"last_written": s.written,
+		}).Warn("Writing a packet out of sequence to the client")
+	}
+	if err := writePacket(conn, packet); err != nil {
+		return err
+	}
+	s.written = packet.lastSequenceID()
+	s.last = s.written
+	return nil
+}
@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestNextSequenceID(t *testing.T) {
+	for _, tc := range []struct{ id, want int }{{0, 1}, {1, 2}, {254, 255}, {255, 0}} {
+		if got := nextSequenceID(tc.id); got != tc.want {
+			t.Errorf("nextSequenceID(%d) = %d, want %d", tc.id, got, tc.want)
+		}
+	}
+	for _, tc := range []struct{ id, packets, want int }{
+		{3, 0, 3},
+		{3, 1, 3},
+		{3, 3, 5},
+		{254, 3, 0},
+	} {
+		packet := &MySQLPacket{SequenceID: tc.id, Packets: tc.packets}
+		if got := packet.lastSequenceID(); got != tc.want {
+			t.Errorf("lastSequenceID of %d packets from %d = %d, want %d", tc.packets, tc.id, got, tc.want)
+		}
+	}
+}
+
+// recordingConn is a net.Conn that keeps what is written to it
+type recordingConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	return c.written.Write(b)
+}
+
+func TestExchangeSequence(t *testing.T) {
+	logger, hook := testLogger()
+	sequence := newExchangeSequence(logger.WithField("test", "sequence"))
+	conn := &recordingConn{}
+	anomalies := sequenceAnomalies.Value("proxy")
+
+	// The greeting starts the exchange, and the proxy's own packets follow on
+	// from the last one the client sent
+	if sequence.next() != 0 {
+		t.Fatalf("exchange starts at %d", sequence.next())
+	}
+	if err := sequence.write(conn, sequence.packet([]byte("greeting"))); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	sequence.readFrom(&MySQLPacket{SequenceID: 1, Payload: []byte("handshake")})
+	ok := sequence.packet([]byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00})
+	if ok.SequenceID != 2 {
+		t.Fatalf("OK framed as packet %d, want 2", ok.SequenceID)
+	}
+	conn.written.Reset()
+	if err := sequence.write(conn, ok); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if want := []byte{7, 0, 0, 2, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}; !bytes.Equal(conn.written.Bytes(), want) {
+		t.Fatalf("OK written as % x, want % x", conn.written.Bytes(), want)
+	}
+	if sequenceAnomalies.Value("proxy") != anomalies || findEntry(hook, "Writing a packet out of sequence to the client") != nil {
+		t.Fatal("packets in sequence reported as anomalies")
+	}
+
+	// Sequence IDs wrap after 0xff, across the physical packets of a packet
+	sequence.readFrom(&MySQLPacket{SequenceID: 254, Packets: 2})
+	if err := sequence.write(conn, sequence.packet([]byte("next"))); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if sequence.written != 0 || sequence.next() != 1 {
+		t.Fatalf("wrote packet %d, next is %d", sequence.written, sequence.next())
+	}
+
+	// A packet out of sequence is still written, but reported
+	conn.written.Reset()
+	if err := sequence.write(conn, newPacket(5, []byte("late"))); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if conn.written.Len() != 8 || conn.written.Bytes()[3] != 5 {
+		t.Fatalf("wrote % x", conn.written.Bytes())
+	}
+	if got := sequenceAnomalies.Value("proxy") - anomalies; got != 1 {
+		t.Fatalf("%d anomalies counted, want 1", got)
+	}
+	entry := findEntry(hook, "Writing a packet out of sequence to the client")
+	if entry == nil || entry.Data["expected"] != 1 || entry.Data["sequence_id"] != 5 || entry.Data["last_read"] != 255 {
+		t.Fatalf("logged %v", entry)
+	}
+	if sequence.next() != 6 {
+		t.Fatalf("exchange continues at %d after the anomaly, want 6", sequence.next())
+	}
+}
+
+func TestHandshakeSequenceIDs(t *testing.T) {
+	backend, legacy := startFakeMySQL(t), startFakeMySQL(t)
+	config := testConfig(backend)
+	config.Backends = []string{"legacy=mysql://" + legacy.addr()}
+	config.DatabaseRoutes = []string{"legacy_=legacy"}
+	config.ChaosCreateFailurePatterns = []string{"legacy_flaky_*", "flaky_*"}
+	_, addr := startProxy(t, config)
+
+	// The packets the proxy writes after an auth switch of its own follow on
+	// from the client's answer to it
+	anomalies := sequenceAnomalies.Value("proxy")
+	for database, answer := range map[string]byte{"legacy_orders": 0x00, "legacy_flaky_orders": 0xff} {
+		handshake := testHandshake{user: "root", auth: []byte("scrambled"), database: database}
+		c, authSwitch := connect(t, addr, handshake)
+		if authSwitch == nil || authSwitch.Payload[0] != 0xfe || authSwitch.SequenceID != 2 {
+			t.Fatalf("%s: handshake answered with %s", database, describePacket(authSwitch))
+		}
+		if response := c.send(3, handshake.auth); response == nil || response.Payload[0] != answer || response.SequenceID != 4 {
+			t.Fatalf("%s: auth switch answered with %s", database, describePacket(response))
+		}
+	}
+
+	// as do those refusing a handshake outright
+	_, response := connect(t, addr, testHandshake{user: "root", database: "flaky_orders"})
+	expectErr(t, response, 1053)
+	if response.SequenceID != 2 {
+		t.Fatalf("refused with packet %d, want 2", response.SequenceID)
+	}
+	if got := sequenceAnomalies.Value("proxy") - anomalies; got != 0 {
+		t.Fatalf("%d packets written out of sequence", got)
+	}
+}
@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// sessionInitStatements returns the statements the proxy runs on a backend
+// session after the handshake, before relaying the client's commands
+func (p *Proxy) sessionInitStatements(cc *ConnContext) []string {
+	var statements []string
+	if p.config.TagConnections {
+		statements = append(statements, connectionTag(cc))
+	}
+	return statements
+}
+
+// connectionTag builds the statement that labels a backend session with the
+// proxy's connection ID and the client address, as user variables and as a
+// comment visible in the processlist and general log
+func connectionTag(cc *ConnContext) string {
+	return fmt.Sprintf("/* mysql-auto-db-proxy conn_id=%d client=%s */ SET @proxy_conn_id = '%d', @proxy_client_addr = '%s'",
+		cc.ID, escapeComment(cc.ClientAddr), cc.ID, escapeString(cc.ClientAddr))
+}
+
+// escapeString escapes a value for use inside a single-quoted SQL string literal
+func escapeString(value string) string {
+	var b strings.Builder
+	for _, r := range value {
+		switch r {
+		case '\'', '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case 0:
+			b.WriteString(`\0`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// escapeComment makes a value safe to embed in a /* */ comment
+func escapeComment(value string) string {
+	return strings.ReplaceAll(value, "*/", "* /")
+}
+
+// runSessionStatement runs a statement on the backend session on behalf of
+// the proxy. The statement must produce an OK or ERR packet, not a result set.
+// An ERR response is returned as an error with the session still usable; any
+// other error leaves the session in an unknown state.
+func runSessionStatement(mysqlConn net.Conn, statement string) (usable bool, err error) {
+	payload := append([]byte{comQuery}, statement...)
+	if err := writePacket(mysqlConn, newPacket(0, payload)); err != nil {
+		return false, err
+	}
+
+	response, err := readPacketWithTimeout(mysqlConn, 10*time.Second)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case len(response.Payload) > 0 && response.Payload[0] == 0x00:
+		return true, nil
+	case len(response.Payload) > 0 && response.Payload[0] == 0xff:
+		return true, fmt.Errorf("MySQL error: %s", errPacketMessage(response.Payload))
+	default:
+		return false, fmt.Errorf("unexpected response 0x%x to session statement", response.Payload)
+	}
+}
+
+// errPacketCode returns the error code of an ERR packet payload
+func errPacketCode(payload []byte) int {
+	if len(payload) < 3 {
+		return 0
+	}
+	return int(payload[1]) | int(payload[2])<<8
+}
+
+// errPacketMessage returns the message of an ERR packet payload
+func errPacketMessage(payload []byte) string {
+	if len(payload) < 3 {
+		return ""
+	}
+	message := payload[3:]
+	if len(message) >= 6 && message[0] == '#' {
+		message = message[6:]
+	}
+	return string(message)
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestEscapeString(t *testing.T) {
+	for value, want := range map[string]string{
+		"10.0.0.1:5123": "10.0.0.1:5123",
+		`it's`:          `it\'s`,
+		`back\slash`:    `back\\slash`,
+		"nul\x00":       `nul\0`,
+		"line\r\nbreak": `line\r\nbreak`,
+		"héllo":         "héllo",
+	} {
+		if got := escapeString(value); got != want {
+			t.Errorf("escaped %q as %q, want %q", value, got, want)
+		}
+	}
+	if got := escapeComment("a */ DROP DATABASE x; /* b"); strings.Contains(got, "*/") {
+		t.Errorf("escaped comment %q still closes the comment", got)
+	}
+}
+
+func TestConnectionTag(t *testing.T) {
+	cc := &ConnContext{ID: 42, ClientAddr: "10.0.0.1:5123"}
+	want := "/* mysql-auto-db-proxy conn_id=42 client=10.0.0.1:5123 */ SET @proxy_conn_id = '42', @proxy_client_addr = '10.0.0.1:5123'"
+	if got := connectionTag(cc); got != want {
+		t.Fatalf("tagged with %q, want %q", got, want)
+	}
+
+	cc.ClientAddr = "x'*/; DROP DATABASE y; --"
+	tag := connectionTag(cc)
+	// The comment ends where the proxy ends it, and the string literal keeps
+	// the address with its quote escaped
+	comment, statement, _ := strings.Cut(tag, "*/")
+	if !strings.HasSuffix(comment, "client=x'* /; DROP DATABASE y; -- ") ||
+		!strings.HasSuffix(statement, `@proxy_client_addr = 'x\'*/; DROP DATABASE y; --'`) {
+		t.Fatalf("tagged with %q", tag)
+	}
+}
+
+func TestTagConnections(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.TagConnections = true
+	p, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("SELECT 1")
+
+	queries := backend.receivedQueries()
+	if len(queries) != 2 || queries[1] != "SELECT 1" {
+		t.Fatalf("MySQL received %q", queries)
+	}
+	conns := p.conns.all()
+	if len(conns) != 1 {
+		t.Fatalf("%d connections tracked", len(conns))
+	}
+	cc := conns[0].cc
+	prefix := fmt.Sprintf("/* mysql-auto-db-proxy conn_id=%d client=%s */ SET @proxy_conn_id = '%d'", cc.ID, cc.ClientAddr, cc.ID)
+	if !strings.HasPrefix(queries[0], prefix) {
+		t.Fatalf("session tagged with %q, want it to start with %q", queries[0], prefix)
+	}
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	shadowErrors = newCounterVec("mysql_autodb_shadow_errors_total",
+		"Failures on mirrored shadow backend connections, by stage", "stage")
+	shadowResponses = newCounter("mysql_autodb_shadow_responses_total",
+		"Commands answered by the shadow backend")
+	shadowResponseMicroseconds = newCounter("mysql_autodb_shadow_response_microseconds_total",
+		"Time the shadow backend took to start answering commands")
+)
+
+// shadowQueueSize is how many client packets may wait for the shadow backend
+// before the mirror gives up on it
+const shadowQueueSize = 256
+
+// shadowConn mirrors a client connection to the shadow backend. The client's
+// packets are queued without blocking and replayed on a separate connection
+// whose responses are discarded, so the shadow can neither delay nor change
+// what the client sees and its failures only end the mirroring.
+type shadowConn struct {
+	addr   string
+	queue  chan *MySQLPacket
+	logger *logrus.Entry
+
+	// conns records the shadow connection, so that a shadow backend pointing
+	// at the proxy is recognised as a loop
+	conns *backendConnSet
+
+	// failed is set once the shadow connection is unusable; packets are no
+	// longer queued
+	failed atomic.Bool
+
+	// closing is set once the client side is done, so that the shadow
+	// connection closing is not counted as a failure
+	closing atomic.Bool
+
+	// commandsStarted is set once the first command has been mirrored; only
+	// touched by the client forwarding loop
+	commandsStarted bool
+}
+
+// startShadow opens a mirror of the connection on the shadow backend, which
+// authenticates with the client's handshake response
+func (p *Proxy) startShadow(handshake *MySQLPacket, logger *logrus.Entry) *shadowConn {
+	s := &shadowConn{
+		addr:   p.config.ShadowBackend,
+		queue:  make(chan *MySQLPacket, shadowQueueSize),
+		logger: logger.WithField("shadow_addr", p.config.ShadowBackend),
+		conns:  &p.backendConns,
+	}
+	go s.run(handshake)
+	return s
+}
+
+// mirror queues a client packet for the shadow backend. Packets are skipped
+// until the client sends its first command, so that the rest of the primary's
+// authentication exchange is not replayed.
+func (s *shadowConn) mirror(packet *MySQLPacket) {
+	if s.failed.Load() {
+		return
+	}
+	if !s.commandsStarted {
+		if packet.SequenceID != 0 {
+			return
+		}
+		s.commandsStarted = true
+	}
+
+	select {
+	case s.queue <- packet:
+	default:
+		// A dropped packet leaves the shadow session out of step
+		s.fail("dropped", nil)
+	}
+}
+
+// close ends the mirror once the client is done with the connection
+func (s *shadowConn) close() {
+	s.closing.Store(true)
+	close(s.queue)
+}
+
+// fail records a shadow failure and stops mirroring
+func (s *shadowConn) fail(stage string, err error) {
+	if s.closing.Load() || s.failed.Swap(true) {
+		return
+	}
+	shadowErrors.Inc(stage)
+	s.logger.WithError(err).WithField("stage", stage).Warn("Shadow backend failed, no longer mirroring connection")
+}
+
+// run connects to the shadow backend, authenticates and replays the queued
+// packets until the queue is closed
+func (s *shadowConn) run(handshake *MySQLPacket) {
+	conn, err := net.DialTimeout("tcp", s.addr, 5*time.Second)
+	if err != nil {
+		s.fail("connect", err)
+		return
+	}
+	defer conn.Close()
+	s.conns.add(conn)
+	defer s.conns.remove(conn)
+
+	if _, err := readPacketWithTimeout(conn, 10*time.Second); err != nil {
+		s.fail("handshake", err)
+		return
+	}
+	if err := writePacket(conn, handshake); err != nil {
+		s.fail("handshake", err)
+		return
+	}
+	response, err := readPacketWithTimeout(conn, 10*time.Second)
+	if err != nil {
+		s.fail("handshake", err)
+		return
+	}
+	if len(response.Payload) == 0 || response.Payload[0] != 0x00 {
+		s.logger.WithField("message", errPacketMessage(response.Payload)).Debug("Shadow backend did not accept the handshake")
+		s.fail("handshake", nil)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	s.logger.Debug("Mirroring connection to shadow backend")
+
+	sent := make(chan time.Time, shadowQueueSize)
+	go s.discardResponses(conn, sent)
+
+	for packet := range s.queue {
+		if s.failed.Load() {
+			continue
+		}
+		if packet.SequenceID == 0 && expectsResponse(packet.Payload) {
+			select {
+			case sent <- time.Now():
+			default:
+			}
+		}
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if err := writePacket(conn, packet); err != nil {
+			s.fail("write", err)
+		}
+	}
+}
+
+// discardResponses reads and drops the shadow backend's responses, metering
+// how long each command took to be answered and how many were errors
+func (s *shadowConn) discardResponses(conn net.Conn, sent <-chan time.Time) {
+	for {
+		packet, err := readPacket(conn)
+		if err != nil {
+			s.fail("read", err)
+			return
+		}
+		// The first packet of each response carries sequence ID 1
+		if packet.SequenceID != 1 {
+			continue
+		}
+		select {
+		case at := <-sent:
+			shadowResponses.Inc()
+			shadowResponseMicroseconds.Add(uint64(time.Since(at).Microseconds()))
+		default:
+		}
+		if len(packet.Payload) > 0 && packet.Payload[0] == 0xff {
+			shadowErrors.Inc("error_response")
+		}
+	}
+}
+
+// expectsResponse reports whether MySQL answers a command payload
+func expectsResponse(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	switch payload[0] {
+	case comQuit, comStmtSendLongData, comStmtClose:
+		return false
+	default:
+		return true
+	}
+}
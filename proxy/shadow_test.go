@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShadowMirrorsSession(t *testing.T) {
+	backend, shadow := startFakeMySQL(t), startFakeMySQL(t)
+	// The shadow refuses every query, which the client must never see
+	shadow.handleCommands(func(s *fakeSession, payload []byte) bool {
+		if payload[0] != comQuery {
+			return false
+		}
+		s.err(1146, "42S02", "Table 'shadow.t' doesn't exist")
+		return true
+	})
+	config := testConfig(backend)
+	config.ShadowBackend = shadow.addr()
+	p, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	responses, errorResponses := shadowResponses.Value(), shadowErrors.Value("error_response")
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("SELECT 1")
+	c.mustQuery("USE orders")
+	c.mustQuery("SELECT 2")
+
+	// The shadow authenticates with the client's handshake and is sent the
+	// same commands
+	commands := func(f *fakeMySQL) (queries []string) {
+		for _, command := range f.receivedCommands() {
+			queries = append(queries, string(command))
+		}
+		return queries
+	}
+	eventually(t, "the shadow to receive the session", func() bool { return len(shadow.receivedCommands()) == 3 })
+	if mirrored, relayed := commands(shadow), commands(backend); !equalStrings(mirrored, relayed) {
+		t.Fatalf("shadow received %q, MySQL %q", mirrored, relayed)
+	}
+	if handshakes := shadow.receivedHandshakes(); len(handshakes) != 1 || parseUsername(newPacket(1, handshakes[0])) != "root" {
+		t.Fatalf("shadow received handshakes %q", handshakes)
+	}
+
+	// Its answers are only metered
+	eventually(t, "the shadow's answers to be metered", func() bool {
+		return shadowResponses.Value()-responses == 3 && shadowErrors.Value("error_response")-errorResponses == 3
+	})
+	if current := p.conns.all()[0].cc.CurrentDB(); current != "orders" {
+		t.Fatalf("the connection has %q selected", current)
+	}
+}
+
+func TestSlowShadowDoesNotStallPrimary(t *testing.T) {
+	backend, shadow := startFakeMySQL(t), startFakeMySQL(t)
+	stalled := make(chan struct{})
+	defer close(stalled)
+	shadow.handleCommands(func(s *fakeSession, payload []byte) bool {
+		<-stalled
+		return false
+	})
+	config := testConfig(backend)
+	config.ShadowBackend = shadow.addr()
+	_, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	// The shadow stops reading, so once the socket buffers are full its
+	// queue fills and mirroring is given up, while the client goes on at the
+	// primary's pace
+	dropped := shadowErrors.Value("dropped")
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	query := "SELECT '" + strings.Repeat("x", 32*1024) + "'"
+	start := time.Now()
+	for i := 0; i < 2*shadowQueueSize; i++ {
+		c.mustQuery(query)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("%d queries took %v with a stalled shadow", 2*shadowQueueSize, elapsed)
+	}
+	eventually(t, "the mirror to be given up", func() bool { return shadowErrors.Value("dropped") == dropped+1 })
+}
+
+func TestDeadShadowDoesNotStallPrimary(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	deadAddr := listener.Addr().String()
+	listener.Close()
+
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.ShadowBackend = deadAddr
+	_, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	failures := shadowErrors.Value("connect")
+	c := mustConnect(t, addr, testHandshake{user: "root", database: "orders"})
+	c.mustQuery("SELECT 1")
+	eventually(t, "the shadow to fail", func() bool { return shadowErrors.Value("connect") == failures+1 })
+	c.mustQuery("SELECT 2")
+	if !backend.hasDatabase("orders") {
+		t.Fatal("the primary session did not go on without the shadow")
+	}
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// flushTimeout bounds how long asynchronous sinks may take to flush on shutdown
+const flushTimeout = 10 * time.Second
+
+// readHeaderTimeout bounds how long the proxy's HTTP servers wait for the
+// headers of a request
+const readHeaderTimeout = 10 * time.Second
+
+// asyncSink is a component that buffers data and delivers it in the background
+type asyncSink interface {
+	// Close stops accepting data, delivers what is still buffered until ctx
+	// expires, and releases the sink's resources
+	Close(ctx context.Context) error
+}
+
+// trackListener registers a listener so that Shutdown can close it. It
+// reports false if the proxy is already shutting down.
+func (p *Proxy) trackListener(listener net.Listener) bool {
+	p.listenersMu.Lock()
+	defer p.listenersMu.Unlock()
+	if p.closing.Load() {
+		return false
+	}
+	p.listeners = append(p.listeners, listener)
+	return true
+}
+
+// connStarted tracks a connection Serve accepted until connDone
+func (p *Proxy) connStarted() {
+	p.connWG.Add(1)
+	p.connsOpen.Add(1)
+}
+
+// connDone stops tracking a connection once its handler has returned
+func (p *Proxy) connDone() {
+	p.connsOpen.Add(-1)
+	p.connWG.Done()
+}
+
+// newHTTPServer returns an HTTP server for handler on addr
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: readHeaderTimeout}
+}
+
+// trackServer registers an HTTP server so that Shutdown can stop it. It
+// reports false if the proxy is already shutting down.
+func (p *Proxy) trackServer(server *http.Server) bool {
+	p.listenersMu.Lock()
+	defer p.listenersMu.Unlock()
+	if p.closing.Load() {
+		return false
+	}
+	p.servers = append(p.servers, server)
+	return true
+}
+
+// stopServers shuts the HTTP servers down, letting requests in progress, such
+// as a CPU profile, finish until ctx expires
+func (p *Proxy) stopServers(ctx context.Context) {
+	p.listenersMu.Lock()
+	servers := p.servers
+	p.servers = nil
+	p.listenersMu.Unlock()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			server.Close()
+		}
+	}
+}
+
+// closePools closes the connection pools the proxy keeps to its backends for
+// creating databases and checking their health
+func (p *Proxy) closePools() {
+	for _, ensurer := range p.backendEnsurers {
+		ensurer.db.Close()
+	}
+	if p.readiness != nil {
+		p.readiness.db.Close()
+	}
+	if p.health != nil {
+		p.health.db.Close()
+	}
+}
+
+// Shutdown stops the proxy in order: it stops accepting connections, waits for
+// open connections to finish, then flushes and closes the asynchronous sinks.
+// Connections still open when ctx expires are closed; the sinks are then given
+// a fresh flushTimeout to deliver what they have buffered. Only the first call
+// does this; later calls return nil.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.listenersMu.Lock()
+	if !p.closing.CompareAndSwap(false, true) {
+		p.listenersMu.Unlock()
+		return nil
+	}
+	for _, listener := range p.listeners {
+		listener.Close()
+	}
+	p.listeners = nil
+	p.listenersMu.Unlock()
+	close(p.stopped)
+	p.cancelRun()
+	open := p.connsOpen.Load()
+	p.log.WithField("connections", open).Info("Stopped accepting connections")
+
+	drained := make(chan struct{})
+	go func() {
+		p.connWG.Wait()
+		close(drained)
+	}()
+
+	var forced int64
+	select {
+	case <-drained:
+		p.log.Info("All connections closed")
+	case <-ctx.Done():
+		p.cancelConns()
+		forced = p.connsOpen.Load()
+		p.log.WithField("connections", forced).Warn("Shutdown timeout reached, closing remaining connections")
+		for _, conn := range p.conns.all() {
+			conn.state.end("shutdown")
+			conn.clientConn.Close()
+			conn.mysqlConn.Close()
+		}
+	}
+	p.log.WithFields(logrus.Fields{
+		"drained":      open - forced,
+		"force_closed": forced,
+	}).Info("Connections drained")
+
+	flushCtx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	p.stopServers(flushCtx)
+
+	var firstErr error
+	for _, sink := range p.sinks {
+		if err := sink.Close(flushCtx); err != nil {
+			p.log.WithError(err).Warn("Failed to flush on shutdown")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	p.closePools()
+	return firstErr
+}
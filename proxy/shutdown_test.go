@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// orderSink records how many connections were still open when it was closed
+type orderSink struct {
+	p           *Proxy
+	openAtClose int64
+	deadline    bool
+	closed      atomic.Bool
+}
+
+func (s *orderSink) Close(ctx context.Context) error {
+	s.openAtClose = s.p.connsOpen.Load()
+	_, s.deadline = ctx.Deadline()
+	s.closed.Store(true)
+	return nil
+}
+
+func TestShutdownClosesSinksAfterDraining(t *testing.T) {
+	backend := startFakeMySQL(t)
+	logger, _ := testLogger()
+	p, err := New(testConfig(backend), WithLogger(logger), WithEnsurer(&recordingEnsurer{backend: backend}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	sink := &orderSink{p: p}
+	p.sinks = append(p.sinks, sink)
+	addr := serveProxy(t, p)
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- p.Shutdown(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	if sink.closed.Load() {
+		t.Fatal("the sink was closed while a connection was open")
+	}
+
+	c.conn.Close()
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if !sink.closed.Load() || sink.openAtClose != 0 || !sink.deadline {
+		t.Fatalf("sink closed %v with %d connections open, deadline %v", sink.closed.Load(), sink.openAtClose, sink.deadline)
+	}
+}
+
+func TestShutdownFlushesBufferedEvents(t *testing.T) {
+	var (
+		mu        sync.Mutex
+		delivered []string
+	)
+	release := make(chan struct{})
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		var event CreationEvent
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &event)
+		mu.Lock()
+		delivered = append(delivered, event.Database)
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.WebhookURL = webhook.URL
+	config.AuditLogPath = filepath.Join(t.TempDir(), "audit.log")
+	p, addr := startProxy(t, config)
+
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	for _, name := range []string{"first", "second", "third"} {
+		c.mustQuery("USE " + name)
+	}
+	c.conn.Close()
+
+	// The webhook only answers once the proxy is shutting down, so the
+	// events are still buffered when Shutdown starts
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- p.Shutdown(context.Background()) }()
+	eventually(t, "shutdown to start", func() bool { return p.closing.Load() })
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"first", "second", "third"}; !equalStrings(delivered, want) {
+		t.Fatalf("webhook received %q, want %q", delivered, want)
+	}
+	audit, err := os.ReadFile(config.AuditLogPath)
+	if err != nil {
+		t.Fatalf("read audit log: %v", err)
+	}
+	if lines := strings.Count(string(audit), "\n"); lines != 3 {
+		t.Fatalf("audit log has %d lines:\n%s", lines, audit)
+	}
+	if p.audit.file != nil {
+		t.Fatal("the audit log was left open")
+	}
+}
+
+func TestShutdownDrainsOpenConnections(t *testing.T) {
+	backend := startFakeMySQL(t)
+	logger, hook := testLogger()
+	p, addr := startProxy(t, testConfig(backend), WithLogger(logger), WithEnsurer(&recordingEnsurer{backend: backend}))
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+
+	// A connection opened before the signal keeps working while the proxy drains
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- p.Shutdown(context.Background()) }()
+	eventually(t, "shutdown to start", func() bool { return p.closing.Load() })
+	c.mustQuery("USE during_drain")
+	c.mustQuery("SELECT 1")
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		conn.Close()
+		t.Fatal("a new connection was accepted while draining")
+	}
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown finished with a connection open")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	c.conn.Close()
+	if err := <-shutdown; err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	entry := findEntry(hook, "Connections drained")
+	if entry == nil || entry.Data["drained"] != int64(1) || entry.Data["force_closed"] != int64(0) {
+		t.Fatalf("logged %v", entry)
+	}
+}
+
+func TestShutdownTimeoutClosesConnections(t *testing.T) {
+	backend := startFakeMySQL(t)
+	logger, hook := testLogger()
+	p, addr := startProxy(t, testConfig(backend), WithLogger(logger), WithEnsurer(&recordingEnsurer{backend: backend}))
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if c.read() != nil {
+		t.Fatal("the connection was left open after the drain timeout")
+	}
+	entry := findEntry(hook, "Connections drained")
+	if entry == nil || entry.Data["drained"] != int64(0) || entry.Data["force_closed"] != int64(1) {
+		t.Fatalf("logged %v", entry)
+	}
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// listenSocket listens on the Unix socket at path with the given octal file
+// mode. A socket file left behind by a proxy that did not shut down cleanly
+// is removed first; one a process is still listening on is an error. The
+// socket file is removed when the listener is closed.
+func listenSocket(path, mode string) (net.Listener, error) {
+	perm, err := strconv.ParseUint(mode, 8, 9)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket mode %q: %w", mode, err)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, fs.FileMode(perm)); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set mode of %s: %w", path, err)
+	}
+	return &socketListener{Listener: listener, path: path}, nil
+}
+
+// removeStaleSocket removes the socket file at path unless a process still
+// accepts connections on it. Files other than sockets are left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+	}
+	return nil
+}
+
+// socketListener numbers the connections accepted on a Unix socket. Their
+// peers are unnamed, so each connection's RemoteAddr is the socket path and
+// its number, which is what connections are logged and recorded under.
+type socketListener struct {
+	net.Listener
+	path string
+	next atomic.Uint64
+}
+
+// Accept waits for the next connection and names its peer
+func (l *socketListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	addr := socketPeer(l.path + "#" + strconv.FormatUint(l.next.Add(1), 10))
+	return &socketConn{Conn: conn, peer: addr}, nil
+}
+
+// socketConn is a connection accepted on a Unix socket, with a named peer
+type socketConn struct {
+	net.Conn
+	peer socketPeer
+}
+
+// RemoteAddr returns the socket path and the connection's number
+func (c *socketConn) RemoteAddr() net.Addr {
+	return c.peer
+}
+
+// socketPeer is the address of a client connected to a Unix socket
+type socketPeer string
+
+// Network returns "unix"
+func (a socketPeer) Network() string { return "unix" }
+
+// String returns the socket path and the connection's number
+func (a socketPeer) String() string { return string(a) }
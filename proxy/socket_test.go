@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestListenSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+
+	// A socket left behind by a proxy that did not shut down is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	listener, err := listenSocket(path, "0600")
+	if err != nil {
+		t.Fatalf("listenSocket over a stale socket: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("socket mode %v, %v", info.Mode().Perm(), err)
+	}
+
+	// One still in use is not
+	if _, err := listenSocket(path, "0600"); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("listenSocket over a live socket: %v", err)
+	}
+
+	// Connections are named after the socket
+	go func() {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr := conn.RemoteAddr(); addr.Network() != "unix" || addr.String() != path+"#1" {
+		t.Fatalf("peer named %s %s", addr.Network(), addr)
+	}
+	conn.Close()
+
+	// The socket file is removed on close
+	listener.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatalf("socket file left behind: %v", err)
+	}
+
+	// Other files are left alone
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenSocket(path, "0600"); err == nil || !strings.Contains(err.Error(), "is not a socket") {
+		t.Fatalf("listenSocket over a file: %v", err)
+	}
+	if _, err := listenSocket(filepath.Join(t.TempDir(), "other.sock"), "999"); err == nil {
+		t.Fatal("accepted an invalid mode")
+	}
+}
+
+func TestProxySocket(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.ProxyPort = 0
+	config.ProxySocket = filepath.Join(t.TempDir(), "proxy.sock")
+	config.StartupWait = 0
+	logger, hook := testLogger()
+	p, err := New(config, WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.ListenAndServe(ctx) }()
+	eventually(t, "the proxy to listen on the socket", func() bool {
+		_, err := os.Stat(config.ProxySocket)
+		return err == nil
+	})
+	if p.Addr() != nil {
+		t.Fatal("listening on TCP with PROXY_PORT 0 and a socket")
+	}
+
+	db, err := sql.Open("mysql", "root@unix("+config.ProxySocket+")/orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Ping(); err != nil {
+		t.Fatalf("ping over the socket: %v", err)
+	}
+	db.Close()
+	if !backend.hasDatabase("orders") {
+		t.Fatal("the database was not created")
+	}
+	if entry := findEntry(hook, "Database is ready"); entry == nil || !strings.HasPrefix(entry.Data["client_addr"].(string), config.ProxySocket+"#") {
+		t.Fatalf("logged %v", entry)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ListenAndServe: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe did not return once its context was done")
+	}
+	if _, err := os.Lstat(config.ProxySocket); !os.IsNotExist(err) {
+		t.Fatalf("socket file left behind: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxStartupBackoff caps the delay between attempts to reach MySQL at startup,
+// and the time each attempt may take
+const maxStartupBackoff = 5 * time.Second
+
+// waitForBackend waits for the MySQL server at addr to greet a connection,
+// retrying with exponential backoff for at most wait. Each failed attempt is
+// logged. It returns the last error once wait has passed.
+func (p *Proxy) waitForBackend(addr string, wait time.Duration) error {
+	logger := p.log.WithField("mysql_addr", addr)
+	deadline := time.Now().Add(wait)
+	backoff := 250 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		err := pingBackend(addr, maxStartupBackoff)
+		if err == nil {
+			if attempt > 1 {
+				logger.WithField("attempts", attempt).Info("MySQL is reachable")
+			}
+			return nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("MySQL at %s was not reachable within STARTUP_WAIT (%s): %w", addr, wait, err)
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		logger.WithError(err).WithFields(logrus.Fields{
+			"attempt":  attempt,
+			"retry_in": backoff.Round(time.Millisecond).String(),
+		}).Info("Waiting for MySQL to accept connections")
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxStartupBackoff {
+			backoff = maxStartupBackoff
+		}
+	}
+}
+
+// pingBackend connects to MySQL and checks that it sends a usable greeting,
+// which it does not while it is still starting or refusing connections
+func pingBackend(addr string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	greeting, err := readPacketWithTimeout(conn, timeout)
+	if err != nil {
+		return fmt.Errorf("failed to read greeting: %w", err)
+	}
+	return checkGreeting(greeting.Payload)
+}
+
+// dialBackend connects to a MySQL backend for a client. Failed dials are
+// retried BACKEND_DIAL_ATTEMPTS times in all, BACKEND_DIAL_BACKOFF apart, so
+// that a MySQL restart does not fail every client connecting meanwhile.
+func (p *Proxy) dialBackend(addr string, logger *logrus.Entry) (net.Conn, error) {
+	attempts := max(p.config.BackendDialAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+		if err == nil {
+			return conn, nil
+		}
+		backendDialFailures.Inc()
+		if attempt >= attempts {
+			return nil, err
+		}
+		logger.WithError(err).WithFields(logrus.Fields{
+			"mysql_addr": addr,
+			"attempt":    attempt,
+		}).Warn("Failed to connect to MySQL, retrying")
+		time.Sleep(p.config.BackendDialBackoff)
+	}
+}
@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitForBackend(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.stop()
+	logger, hook := testLogger()
+	p, err := New(testConfig(backend), WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// MySQL that is still down when the wait ends is an error
+	if err := p.waitForBackend(backend.addr(), 300*time.Millisecond); err == nil || !strings.Contains(err.Error(), "not reachable within STARTUP_WAIT") {
+		t.Fatalf("waitForBackend: %v", err)
+	}
+
+	// MySQL that comes up in time ends the wait
+	restarted := make(chan struct{})
+	time.AfterFunc(400*time.Millisecond, func() {
+		backend.restart()
+		close(restarted)
+	})
+	if err := p.waitForBackend(backend.addr(), 10*time.Second); err != nil {
+		t.Fatalf("waitForBackend: %v", err)
+	}
+	<-restarted
+	if entry := findEntry(hook, "MySQL is reachable"); entry == nil || entry.Data["attempts"].(int) < 2 {
+		t.Fatalf("logged %v", entry)
+	}
+	if entry := findEntry(hook, "Waiting for MySQL to accept connections"); entry == nil || entry.Data["attempt"] == nil {
+		t.Fatalf("logged %v", entry)
+	}
+}
+
+func TestPingBackend(t *testing.T) {
+	backend := startFakeMySQL(t)
+	if err := pingBackend(backend.addr(), time.Second); err != nil {
+		t.Fatalf("pingBackend: %v", err)
+	}
+
+	// Servers that accept connections without greeting them are not ready
+	for _, response := range [][]byte{nil, packetBytes(newPacket(0, []byte{5, 'x', 0}))} {
+		config := startRawBackend(t, response)
+		if err := pingBackend(net.JoinHostPort(config.MySQLHost, strconv.Itoa(config.MySQLPort)), time.Second); err == nil {
+			t.Fatalf("a server answering %q was taken as ready", response)
+		}
+	}
+}
+
+func TestListenAndServeWithoutBackend(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.stop()
+	config := testConfig(backend)
+	config.ProxyPort = 0
+	config.ListenAddress = "127.0.0.1"
+	config.StartupWait = 300 * time.Millisecond
+	logger, _ := testLogger()
+	p, err := New(config, WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.ListenAndServe(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "MySQL is not reachable") {
+		t.Fatalf("ListenAndServe: %v", err)
+	}
+	if p.Addr() != nil {
+		t.Fatal("listened before MySQL was reachable")
+	}
+}
+
+func TestBackendDialRetries(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.BackendDialAttempts = 10
+	config.BackendDialBackoff = 100 * time.Millisecond
+	_, addr := startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+
+	// A client connecting while MySQL restarts is served once it is back
+	backend.stop()
+	failures := backendDialFailures.Value()
+	restarted := make(chan struct{})
+	time.AfterFunc(300*time.Millisecond, func() {
+		backend.restart()
+		close(restarted)
+	})
+	mustConnect(t, addr, testHandshake{user: "root"}).mustQuery("SELECT 1")
+	<-restarted
+	if backendDialFailures.Value() == failures {
+		t.Fatal("no failed dial was retried")
+	}
+
+	// Without retries the client is refused at once
+	config.BackendDialAttempts = 1
+	_, addr = startProxy(t, config, WithEnsurer(&recordingEnsurer{backend: backend}))
+	backend.stop()
+	failures = backendDialFailures.Value()
+	if c := dialTestClient(t, addr); c.greeting.Payload[0] != 0xff {
+		t.Fatalf("greeted with %s", describePacket(c.greeting))
+	}
+	if got := backendDialFailures.Value() - failures; got != 1 {
+		t.Fatalf("%d dials failed, want 1", got)
+	}
+}
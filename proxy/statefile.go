@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// stateFileVersion is the format of the state file the proxy writes
+const stateFileVersion = 1
+
+var stateFileSaveFailures = newCounter("mysql_autodb_state_file_save_failures_total",
+	"Failed attempts to save the registry of created databases to STATE_FILE")
+
+// stateFileContents is the JSON document of the state file
+type stateFileContents struct {
+	Version   int               `json:"version"`
+	SavedAt   time.Time         `json:"saved_at"`
+	Databases []createdDatabase `json:"databases"`
+}
+
+// stateFile saves the registry of created databases to STATE_FILE, with their
+// last use, so that a restarted proxy knows them again as they were. It saves
+// as soon as a database is recorded or removed, every interval when only
+// their last use changed, and when it is closed. Each save writes a new file
+// next to the old one and renames it over it, so that a crash never leaves a
+// partly written state behind.
+type stateFile struct {
+	path     string
+	registry *createdRegistry
+	interval time.Duration
+	log      logrus.FieldLogger
+
+	// saved is the version of the registry last saved; only the run loop and
+	// Close, once it has stopped, save
+	saved uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newStateFile creates a state file for the registry; run starts saving it
+func newStateFile(path string, registry *createdRegistry, interval time.Duration, log logrus.FieldLogger) *stateFile {
+	return &stateFile{
+		path:     path,
+		registry: registry,
+		interval: interval,
+		log:      log,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// loadStateFile returns the databases saved in the state file at path, none
+// if it does not exist
+func loadStateFile(path string) ([]createdDatabase, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %w", err)
+	}
+
+	var contents stateFileContents
+	if err := json.Unmarshal(data, &contents); err != nil {
+		return nil, fmt.Errorf("malformed state file: %w", err)
+	}
+	if contents.Version != stateFileVersion {
+		return nil, fmt.Errorf("unsupported state file version %d", contents.Version)
+	}
+	for _, database := range contents.Databases {
+		if database.Name == "" || database.CreatedAt.IsZero() {
+			return nil, errors.New("malformed state file: database without a name or creation time")
+		}
+	}
+	return contents.Databases, nil
+}
+
+// run saves the registry whenever it changes, and every interval, until the
+// state file is closed
+func (s *stateFile) run() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.registry.changed:
+		case <-ticker.C:
+		}
+		if err := s.save(); err != nil {
+			stateFileSaveFailures.Inc()
+			s.log.WithError(err).WithField("state_file", s.path).Error("Failed to save state file, retrying on the next change or flush")
+		}
+	}
+}
+
+// save writes the registry to the state file, unless it has not changed since
+// it was last saved. Dry run databases, which do not exist, are left out.
+func (s *stateFile) save() error {
+	databases, version := s.registry.snapshot()
+	if version == s.saved {
+		return nil
+	}
+	contents := stateFileContents{
+		Version:   stateFileVersion,
+		SavedAt:   time.Now().UTC(),
+		Databases: make([]createdDatabase, 0, len(databases)),
+	}
+	for _, database := range databases {
+		if !database.DryRun {
+			contents.Databases = append(contents.Databases, database)
+		}
+	}
+	data, err := json.MarshalIndent(contents, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), 0o640)
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), s.path)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	s.saved = version
+	return nil
+}
+
+// Close stops saving and saves the registry one last time
+func (s *stateFile) Close(ctx context.Context) error {
+	close(s.stop)
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return s.save()
+}
+
+// restoreState records the databases saved in STATE_FILE in the registry. A
+// state file that cannot be read does not stop the proxy: it is moved aside
+// as STATE_FILE.corrupt and the proxy starts without it.
+func (p *Proxy) restoreState(path string) {
+	logger := p.log.WithField("state_file", path)
+	databases, err := loadStateFile(path)
+	if err != nil {
+		if renameErr := os.Rename(path, path+".corrupt"); renameErr == nil {
+			logger = logger.WithField("moved_to", path+".corrupt")
+		}
+		logger.WithError(err).Error("Cannot load state file, starting without the databases it records")
+		return
+	}
+	for _, database := range databases {
+		database.Restored = true
+		p.created.record(database)
+	}
+	logger.WithField("databases", len(databases)).Info("Restored created databases from the state file")
+}
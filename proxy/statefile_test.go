@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// stateDatabases returns the databases saved in the state file at path, by
+// name
+func stateDatabases(t *testing.T, path string) map[string]createdDatabase {
+	t.Helper()
+	databases, err := loadStateFile(path)
+	if err != nil {
+		t.Fatalf("loadStateFile: %v", err)
+	}
+	byName := make(map[string]createdDatabase, len(databases))
+	for _, database := range databases {
+		byName[database.Name] = database
+	}
+	return byName
+}
+
+func TestStateFileRoundTrip(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.create("unmanaged")
+	config := testConfig(backend)
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+
+	p, addr := startProxy(t, config)
+	c := mustConnect(t, addr, testHandshake{user: "app", database: "orders"})
+	c.mustQuery("USE billing")
+	c.mustQuery("USE unmanaged")
+	created := make(map[string]createdDatabase)
+	for _, database := range p.created.list() {
+		created[database.Name] = database
+	}
+	c.conn.Close()
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if saved := stateDatabases(t, config.StateFile); len(saved) != 2 {
+		t.Fatalf("state file holds %v, want orders and billing", saved)
+	}
+
+	// billing is dropped while the proxy is not running
+	backend.mu.Lock()
+	delete(backend.databases, "billing")
+	backend.mu.Unlock()
+
+	// A second proxy on the same state file knows the databases as they were
+	p, _ = startProxy(t, config)
+	for name, trigger := range map[string]string{"orders": "handshake", "billing": "use"} {
+		database, ok := p.created.get(name)
+		want := created[name]
+		if !ok || !database.Restored || database.Trigger != trigger || database.Username != "app" || database.Backend != backend.addr() ||
+			!database.CreatedAt.Equal(want.CreatedAt) || !database.LastUsedAt.Equal(want.LastUsedAt) {
+			t.Fatalf("restored %s as %+v, %v", name, database, ok)
+		}
+	}
+
+	// Checked against MySQL, the dropped database is pruned, and one the proxy
+	// did not create is never adopted
+	p.reconcileRestored(context.Background())
+	if _, ok := p.created.get("billing"); ok {
+		t.Fatal("the dropped database is still registered")
+	}
+	if _, ok := p.created.get("orders"); !ok {
+		t.Fatal("an existing database was forgotten")
+	}
+	if _, ok := p.created.get("unmanaged"); ok {
+		t.Fatal("a database the proxy did not create was adopted")
+	}
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if saved := stateDatabases(t, config.StateFile); len(saved) != 1 || !saved["orders"].Restored {
+		t.Fatalf("state file holds %v after pruning, want orders", saved)
+	}
+}
+
+func TestStateFileSaves(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+	config.StateFlushInterval = 50 * time.Millisecond
+	p, addr := startProxy(t, config)
+
+	// A created database is saved at once
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("USE orders")
+	eventually(t, "orders to be saved", func() bool {
+		_, ok := stateDatabases(t, config.StateFile)["orders"]
+		return ok
+	})
+
+	// and its last use on the next flush
+	used := stateDatabases(t, config.StateFile)["orders"].LastUsedAt
+	time.Sleep(10 * time.Millisecond)
+	c.mustQuery("USE orders")
+	eventually(t, "the last use to be saved", func() bool {
+		return stateDatabases(t, config.StateFile)["orders"].LastUsedAt.After(used)
+	})
+	database, _ := p.created.get("orders")
+	if saved := stateDatabases(t, config.StateFile)["orders"]; !saved.LastUsedAt.Equal(database.LastUsedAt) {
+		t.Fatalf("saved last use %v, want %v", saved.LastUsedAt, database.LastUsedAt)
+	}
+
+	// Saves replace the file, leaving no temporary files behind
+	entries, err := os.ReadDir(filepath.Dir(config.StateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("state directory holds %d files, want 1", len(entries))
+	}
+}
+
+func TestCorruptStateFile(t *testing.T) {
+	for name, contents := range map[string]string{
+		"partly written":      `{"version":1,"databases":[{"name":"orders","created_at":"2024-`,
+		"unsupported version": `{"version":2,"databases":[]}`,
+		"unnamed database":    `{"version":1,"databases":[{"created_at":"2024-05-01T00:00:00Z"}]}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			backend := startFakeMySQL(t)
+			config := testConfig(backend)
+			config.StateFile = filepath.Join(t.TempDir(), "state.json")
+			if err := os.WriteFile(config.StateFile, []byte(contents), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			logger, hook := testLogger()
+
+			// The proxy starts without the state, which is moved aside
+			p, addr := startProxy(t, config, WithLogger(logger))
+			if entry := findEntry(hook, "Cannot load state file, starting without the databases it records"); entry == nil {
+				t.Fatal("the unreadable state file was not logged")
+			}
+			if len(p.created.list()) != 0 {
+				t.Fatalf("registry holds %v", p.created.list())
+			}
+			if kept, err := os.ReadFile(config.StateFile + ".corrupt"); err != nil || string(kept) != contents {
+				t.Fatalf("state file moved aside as %q, %v", kept, err)
+			}
+
+			// and a fresh one is saved
+			mustConnect(t, addr, testHandshake{user: "root"}).mustQuery("USE billing")
+			eventually(t, "a fresh state file", func() bool {
+				_, err := os.Stat(config.StateFile)
+				return err == nil
+			})
+			if saved := stateDatabases(t, config.StateFile); len(saved) != 1 {
+				t.Fatalf("fresh state file holds %v, want billing", saved)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// statsSnapshot is the proxy's activity since it started, read from the
+// metrics counters, for setups without Prometheus. It is logged every
+// STATS_INTERVAL and on SIGUSR2, and served by GET /stats.
+type statsSnapshot struct {
+	Uptime              string `json:"uptime"`
+	ActiveConnections   int64  `json:"active_connections"`
+	ConnectionsAccepted uint64 `json:"connections_accepted"`
+	HandshakeTimeouts   uint64 `json:"handshake_timeouts"`
+	AcceptBackoffs      uint64 `json:"accept_backoffs"`
+	DatabasesCreated    uint64 `json:"databases_created"`
+	UseCommands         uint64 `json:"use_commands"`
+	InitDBCommands      uint64 `json:"init_db_commands"`
+	BytesFromClients    uint64 `json:"bytes_from_clients"`
+	BytesFromMySQL      uint64 `json:"bytes_from_mysql"`
+	Goroutines          int    `json:"goroutines"`
+}
+
+// connStats is a connected client, as GET /stats and SIGUSR2 list it
+type connStats struct {
+	ID          uint64    `json:"conn_id"`
+	ClientAddr  string    `json:"client_addr"`
+	Username    string    `json:"username"`
+	Database    string    `json:"database"`
+	Backend     string    `json:"backend"`
+	ConnectedAt time.Time `json:"connected_at"`
+}
+
+// stats returns a snapshot of the proxy's activity
+func (p *Proxy) stats() statsSnapshot {
+	return statsSnapshot{
+		Uptime:              time.Since(p.startedAt).Round(time.Second).String(),
+		ActiveConnections:   connectionsActive.Value(),
+		ConnectionsAccepted: connectionsAccepted.Value(),
+		HandshakeTimeouts:   handshakeTimeouts.Value(),
+		AcceptBackoffs:      acceptBackoffs.Value(),
+		DatabasesCreated:    databasesCreated.Total(),
+		UseCommands:         databaseSelections.Value("USE"),
+		InitDBCommands:      databaseSelections.Value("COM_INIT_DB"),
+		BytesFromClients:    bytesForwarded.Value("client_to_server"),
+		BytesFromMySQL:      bytesForwarded.Value("server_to_client"),
+		Goroutines:          runtime.NumGoroutine(),
+	}
+}
+
+// fields returns the snapshot as the fields of a log line
+func (s statsSnapshot) fields() logrus.Fields {
+	return logrus.Fields{
+		"uptime":               s.Uptime,
+		"active_connections":   s.ActiveConnections,
+		"connections_accepted": s.ConnectionsAccepted,
+		"handshake_timeouts":   s.HandshakeTimeouts,
+		"accept_backoffs":      s.AcceptBackoffs,
+		"databases_created":    s.DatabasesCreated,
+		"use_commands":         s.UseCommands,
+		"init_db_commands":     s.InitDBCommands,
+		"bytes_from_clients":   s.BytesFromClients,
+		"bytes_from_mysql":     s.BytesFromMySQL,
+		"goroutines":           s.Goroutines,
+	}
+}
+
+// connectionStats lists the connections relaying data, oldest first
+func (p *Proxy) connectionStats() []connStats {
+	conns := p.conns.all()
+	list := make([]connStats, 0, len(conns))
+	for _, conn := range conns {
+		list = append(list, connStats{
+			ID:          conn.cc.ID,
+			ClientAddr:  conn.cc.ClientAddr,
+			Username:    conn.cc.Username,
+			Database:    conn.cc.CurrentDB(),
+			Backend:     conn.backend,
+			ConnectedAt: conn.cc.ConnectedAt.UTC(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// logStats logs a snapshot every interval until the proxy shuts down
+func (p *Proxy) logStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.runCtx.Done():
+			return
+		case <-ticker.C:
+			p.log.WithFields(p.stats().fields()).Info("Stats")
+		}
+	}
+}
+
+// DumpStats logs a snapshot of the proxy's activity followed by a line for
+// each connected client with the database it has selected
+func (p *Proxy) DumpStats() {
+	p.log.WithFields(p.stats().fields()).Info("Stats")
+	for _, conn := range p.connectionStats() {
+		p.log.WithFields(logrus.Fields{
+			"conn_id":      conn.ID,
+			"client_addr":  conn.ClientAddr,
+			"username":     conn.Username,
+			"database":     conn.Database,
+			"backend":      conn.Backend,
+			"connected_at": conn.ConnectedAt.Format(time.RFC3339),
+		}).Info("Connected client")
+	}
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStats(t *testing.T) {
+	backend := startFakeMySQL(t)
+	logger, hook := testLogger()
+	p, addr := startProxy(t, testConfig(backend), WithLogger(logger))
+
+	before := p.stats()
+	orders := mustConnect(t, addr, testHandshake{user: "root", database: "orders"})
+	orders.mustQuery("USE billing")
+	inventory := mustConnect(t, addr, testHandshake{user: "app"})
+	if response := inventory.command(append([]byte{comInitDB}, "inventory"...)); response[0].Payload[0] != 0x00 {
+		t.Fatalf("COM_INIT_DB answered with %s", describePacket(response[0]))
+	}
+	inventory.mustQuery("SELECT 1")
+
+	after := p.stats()
+	for _, tc := range []struct {
+		name      string
+		got, want uint64
+	}{
+		{"connections accepted", after.ConnectionsAccepted - before.ConnectionsAccepted, 2},
+		{"databases created", after.DatabasesCreated - before.DatabasesCreated, 3},
+		{"USE commands", after.UseCommands - before.UseCommands, 1},
+		{"COM_INIT_DB commands", after.InitDBCommands - before.InitDBCommands, 1},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%d %s counted, want %d", tc.got, tc.name, tc.want)
+		}
+	}
+	if after.BytesFromClients <= before.BytesFromClients || after.BytesFromMySQL <= before.BytesFromMySQL {
+		t.Error("relayed bytes were not counted in both directions")
+	}
+	if after.ActiveConnections < 2 || after.Goroutines == 0 {
+		t.Errorf("%d active connections and %d goroutines reported", after.ActiveConnections, after.Goroutines)
+	}
+
+	// The connected clients are listed, oldest first, with the database each
+	// has selected
+	conns := p.connectionStats()
+	if len(conns) != 2 {
+		t.Fatalf("%d connections listed, want 2", len(conns))
+	}
+	for i, want := range []struct {
+		client             *testClient
+		username, database string
+	}{
+		{orders, "root", "billing"},
+		{inventory, "app", "inventory"},
+	} {
+		if conn := conns[i]; conn.ClientAddr != want.client.conn.LocalAddr().String() || conn.Username != want.username || conn.Database != want.database || conn.Backend != backend.addr() {
+			t.Errorf("connection %d listed as %+v", i, conn)
+		}
+	}
+
+	// GET /stats serves the same snapshot
+	recorder := httptest.NewRecorder()
+	p.adminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var body struct {
+		Stats       statsSnapshot `json:"stats"`
+		Connections []connStats   `json:"connections"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil || recorder.Code != http.StatusOK {
+		t.Fatalf("GET /stats: %d %s", recorder.Code, recorder.Body)
+	}
+	if body.Stats.ConnectionsAccepted != after.ConnectionsAccepted || len(body.Connections) != 2 || body.Connections[1].Database != "inventory" {
+		t.Fatalf("GET /stats served %+v", body)
+	}
+	recorder = httptest.NewRecorder()
+	p.adminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/stats", nil))
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST /stats: %d", recorder.Code)
+	}
+
+	// and DumpStats logs it with a line per client
+	p.DumpStats()
+	if entry := findEntry(hook, "Stats"); entry == nil || entry.Data["connections_accepted"] != after.ConnectionsAccepted {
+		t.Fatalf("stats logged as %v", entry)
+	}
+	clients := queryEntries(hook, "Connected client")
+	if len(clients) != 2 || clients[0].Data["database"] != "billing" || clients[1].Data["username"] != "app" {
+		t.Fatalf("%d connected clients logged", len(clients))
+	}
+}
+
+// listenAndServe runs p.ListenAndServe on a loopback port until the test
+// ends
+func listenAndServe(t *testing.T, p *Proxy) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- p.ListenAndServe(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	eventually(t, "the proxy to listen", func() bool { return p.Addr() != nil })
+}
+
+func TestStatsInterval(t *testing.T) {
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.ListenAddress = "127.0.0.1"
+	config.ProxyPort = 0
+	config.StartupWait = 0
+	config.ShutdownTimeout = time.Second
+	config.StatsInterval = 50 * time.Millisecond
+	logger, hook := testLogger()
+	p, err := New(config, WithLogger(logger), WithEnsurer(&recordingEnsurer{backend: backend}))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	listenAndServe(t, p)
+	mustConnect(t, p.Addr().String(), testHandshake{user: "root"}).mustQuery("SELECT 1")
+	eventually(t, "stats to be logged", func() bool { return len(queryEntries(hook, "Stats")) >= 2 })
+
+	// without listing the connected clients
+	if findEntry(hook, "Connected client") != nil {
+		t.Fatal("the periodic stats listed the connected clients")
+	}
+
+	config.StatsInterval = 0
+	logger, hook = testLogger()
+	if p, err = New(config, WithLogger(logger), WithEnsurer(&recordingEnsurer{backend: backend})); err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	listenAndServe(t, p)
+	time.Sleep(200 * time.Millisecond)
+	if findEntry(hook, "Stats") != nil {
+		t.Fatal("stats logged with STATS_INTERVAL=0")
+	}
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var unknownDatabaseRetries = newCounterVec("mysql_autodb_unknown_database_retries_total",
+	"Handshakes and commands MySQL refused with an unknown database, replayed after creating it, by stage", "stage")
+
+// replayHandshake creates the database MySQL refused a handshake for as
+// unknown, then authenticates the client again on a new connection to the
+// backend at addr, as for a rerouted connection. clientHandshake is numbered
+// as the client's last packet.
+func (p *Proxy) replayHandshake(ctx context.Context, clientConn net.Conn, addr, dbName string, clientHandshake *MySQLPacket, sequence *exchangeSequence, logger *logrus.Entry) (net.Conn, *MySQLPacket, *MySQLPacket, int, error) {
+	if err := p.ensurer.EnsureExists(withCreateTrigger(ctx, "handshake"), dbName); err != nil {
+		return nil, nil, nil, 0, fmt.Errorf("cannot create database: %w", err)
+	}
+	unknownDatabaseRetries.Inc("handshake")
+	logger.WithField("database", dbName).Info("MySQL reported the handshake's database unknown, replaying the handshake after creating it")
+
+	mysqlConn, greeting, rewritten, seq, err := p.reroute(clientConn, addr, clientHandshake, sequence, logger)
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+	mysqlConn.SetDeadline(time.Now().Add(p.config.HandshakeTimeout))
+	return mysqlConn, greeting, rewritten, seq, nil
+}
+
+// retrySelection creates the database a USE or COM_INIT_DB command selected
+// after MySQL refused it as unknown, and sends MySQL the command again, whose
+// answer then goes to the client in place of the error. It returns false,
+// leaving the error for the client, when the database may not or cannot be
+// created.
+func (p *Proxy) retrySelection(ctx context.Context, mysqlConn net.Conn, state *relayState, dbName string, command []byte, logger *logrus.Entry) bool {
+	logger = logger.WithField("database", dbName)
+	if usePassthrough(p.config.UsePassthroughPatterns, dbName) {
+		return false
+	}
+	if err := p.ensurer.EnsureExists(withCreateTrigger(ctx, commandTrigger(command)), dbName); err != nil {
+		logger.WithError(err).Warn("Cannot create the database MySQL reported unknown")
+		return false
+	}
+
+	// The command's answer is numbered as the error it replaces
+	state.pendingDB.Store(&dbName)
+	state.nextSeq.Store(1)
+	if err := state.writeToServer(mysqlConn, newPacket(0, command)); err != nil {
+		logger.WithError(err).Warn("Failed to send the command again to MySQL")
+		return false
+	}
+	unknownDatabaseRetries.Inc("command")
+	logger.Info("MySQL reported the selected database unknown, sent the command again after creating it")
+	return true
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"sync"
+	"testing"
+)
+
+// dropBehindProxy drops a database on the fake without the proxy knowing
+func dropBehindProxy(backend *fakeMySQL, name string) {
+	backend.mu.Lock()
+	delete(backend.databases, name)
+	backend.mu.Unlock()
+}
+
+func TestUnknownDatabaseHandshakeIsReplayed(t *testing.T) {
+	backend := startFakeMySQL(t)
+	_, addr := startProxy(t, testConfig(backend))
+	mustConnect(t, addr, testHandshake{user: "root", database: "orders"})
+
+	// The cached database was dropped, so MySQL refuses the next handshake
+	// and the proxy creates it and has the client authenticate again
+	dropBehindProxy(backend, "orders")
+	retries, handshakes := unknownDatabaseRetries.Value("handshake"), len(backend.receivedHandshakes())
+	c, response := connectRerouted(t, addr, testHandshake{user: "root", auth: []byte("scrambled"), database: "orders"})
+	if response == nil || response.Payload[0] != 0x00 {
+		t.Fatalf("handshake answered with %s", describePacket(response))
+	}
+	if !backend.hasDatabase("orders") {
+		t.Fatal("the database was not created again")
+	}
+	if got := unknownDatabaseRetries.Value("handshake") - retries; got != 1 {
+		t.Fatalf("%d handshakes replayed", got)
+	}
+	if got := len(backend.receivedHandshakes()) - handshakes; got < 2 {
+		t.Fatalf("MySQL received %d handshakes, want the refused one and its replay", got)
+	}
+	c.mustQuery("SELECT 1")
+
+	// Without AUTO_CREATE_ON_1049 the client gets MySQL's error
+	config := testConfig(backend)
+	config.AutoCreateOn1049 = false
+	_, addr = startProxy(t, config)
+	mustConnect(t, addr, testHandshake{user: "root", database: "billing"})
+	dropBehindProxy(backend, "billing")
+	_, response = connect(t, addr, testHandshake{user: "root", database: "billing"})
+	expectErr(t, response, 1049)
+}
+
+func TestUnknownDatabaseCommandIsRetried(t *testing.T) {
+	backend := startFakeMySQL(t)
+	// MySQL refuses the first selection of each database, as when it was
+	// dropped since the proxy created it
+	var (
+		mu      sync.Mutex
+		refused = make(map[string]bool)
+	)
+	backend.handleCommands(func(s *fakeSession, payload []byte) bool {
+		var name string
+		switch {
+		case payload[0] == comInitDB:
+			name = string(payload[1:])
+		case isUseCommand(payload):
+			name = parseUseStatement(string(payload[1:]))
+		default:
+			return false
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if refused[name] {
+			return false
+		}
+		refused[name] = true
+		s.err(1049, "42000", "Unknown database '"+name+"'")
+		return true
+	})
+	ensurer := &recordingEnsurer{backend: backend}
+	_, addr := startProxy(t, testConfig(backend), WithEnsurer(ensurer))
+
+	retries := unknownDatabaseRetries.Value("command")
+	c := mustConnect(t, addr, testHandshake{user: "root"})
+	c.mustQuery("USE orders")
+	if response := c.send(0, append([]byte{comInitDB}, "billing"...)); response.Payload[0] != 0x00 {
+		t.Fatalf("COM_INIT_DB answered with %s", describePacket(response))
+	}
+	if got := unknownDatabaseRetries.Value("command") - retries; got != 2 {
+		t.Fatalf("%d commands retried", got)
+	}
+	// Each database is ensured when intercepted and again before the retry
+	if want := []string{"orders", "orders", "billing", "billing"}; !equalStrings(ensurer.requested(), want) {
+		t.Fatalf("ensurer asked for %q, want %q", ensurer.requested(), want)
+	}
+	c.mustQuery("SELECT 1")
+
+	// Without AUTO_CREATE_ON_1049 the client gets MySQL's error
+	config := testConfig(backend)
+	config.AutoCreateOn1049 = false
+	_, addr = startProxy(t, config, WithEnsurer(ensurer))
+	c = mustConnect(t, addr, testHandshake{user: "root"})
+	expectErr(t, c.query("USE inventory"), 1049)
+	c.mustQuery("USE inventory")
+}
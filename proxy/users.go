@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxUserNameLength is the longest account name MySQL accepts, in characters
+const maxUserNameLength = 32
+
+// userPlaceholder is replaced in AUTO_USER_PASSWORD with the client's username
+const userPlaceholder = "${USERNAME}"
+
+var usersCreated = newCounter("mysql_autodb_users_created_total",
+	"MySQL users created by the proxy for the databases it created")
+
+// quoteString quotes a value as a SQL string literal
+func quoteString(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `''`).Replace(value) + "'"
+}
+
+// userAccount returns the quoted account of the user created for a database
+func userAccount(dbName string) string {
+	return quoteString(dbName) + "@'%'"
+}
+
+// autoUserPassword returns the password of the user created for a database
+// on behalf of the connection: AUTO_USER_PASSWORD with its placeholders
+// replaced, or else the client's own password when its credentials are
+// passed through. It returns "" when there is none.
+func (e *sqlEnsurer) autoUserPassword(dbName string, cc *ConnContext) string {
+	if e.config.AutoUserPassword != "" {
+		return strings.NewReplacer(seedPlaceholder, dbName, userPlaceholder, cc.Username).Replace(e.config.AutoUserPassword)
+	}
+	if cc.credentials != nil {
+		return cc.credentials.password
+	}
+	return ""
+}
+
+// createUser creates a user named after a database the proxy has just
+// created, with all privileges on it, and returns its name. A user that
+// already exists is left untouched and "" is returned, as it is when the
+// user cannot be created; the database is kept either way.
+func (e *sqlEnsurer) createUser(ctx context.Context, db *sql.DB, dbName string, logger *logrus.Entry) string {
+	if !e.config.CreateUsers {
+		return ""
+	}
+	cc := connContextFrom(ctx)
+	logger = logger.WithField("user", dbName)
+	if utf8.RuneCountInString(dbName) > maxUserNameLength {
+		logger.Warnf("Database name is longer than the %d characters of a MySQL user name, not creating its user", maxUserNameLength)
+		return ""
+	}
+	password := e.autoUserPassword(dbName, cc)
+	if password == "" {
+		logger.Warn("No password for the database's user, not creating it")
+		return ""
+	}
+
+	var existing int
+	if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM mysql.user WHERE User = ? AND Host = '%'", dbName).Scan(&existing); err != nil {
+		logger.WithError(err).Error("Failed to check whether the database's user exists")
+		return ""
+	}
+	if existing != 0 {
+		logger.Debug("User already exists, leaving it untouched")
+		return ""
+	}
+
+	account := userAccount(dbName)
+	if _, err := db.ExecContext(ctx, "CREATE USER "+account+" IDENTIFIED BY "+quoteString(password)); err != nil {
+		logger.WithError(err).Error("Failed to create the database's user")
+		return ""
+	}
+	if _, err := db.ExecContext(ctx, "GRANT ALL ON "+quoteIdentifier(dbName)+".* TO "+account); err != nil {
+		logger.WithError(err).Error("Failed to grant the database's user its privileges")
+	}
+	usersCreated.Inc()
+	logger.Info("Created user for database")
+	return dbName
+}
+
+// DropUser drops a user the proxy created for one of its databases
+func (e *sqlEnsurer) DropUser(ctx context.Context, user string) error {
+	if err := validateDatabaseName(user, e.config.StrictDBNames); err != nil {
+		return fmt.Errorf("invalid user name: %w", err)
+	}
+	if _, err := e.db.ExecContext(ctx, "DROP USER IF EXISTS "+userAccount(user)); err != nil {
+		return fmt.Errorf("failed to drop user %s: %w", user, err)
+	}
+	e.log.WithField("user", user).Info("Dropped user")
+	return nil
+}
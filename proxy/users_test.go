@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestQuoteString(t *testing.T) {
+	for value, want := range map[string]string{
+		"orders":     "'orders'",
+		"it's":       "'it''s'",
+		`back\slash`: `'back\\slash'`,
+	} {
+		if got := quoteString(value); got != want {
+			t.Errorf("quoteString(%q) = %s, want %s", value, got, want)
+		}
+	}
+	if got := userAccount("it's"); got != "'it''s'@'%'" {
+		t.Errorf("userAccount = %s", got)
+	}
+}
+
+// userQueries returns the queries MySQL received that manage users
+func userQueries(backend *fakeMySQL) []string {
+	var queries []string
+	for _, query := range backend.receivedQueries() {
+		if strings.HasPrefix(query, "CREATE USER") || strings.HasPrefix(query, "GRANT") || strings.HasPrefix(query, "DROP USER") {
+			queries = append(queries, query)
+		}
+	}
+	return queries
+}
+
+func TestCreateUsers(t *testing.T) {
+	backend := startFakeMySQL(t)
+	backend.mu.Lock()
+	backend.users["billing"] = true
+	backend.mu.Unlock()
+	config := testConfig(backend)
+	config.CreateUsers = true
+	config.StrictDBNames = false
+	config.AutoUserPassword = "pw-${DATABASE}-${USERNAME}"
+	p, addr := startProxy(t, config)
+
+	c := mustConnect(t, addr, testHandshake{user: "svc"})
+	c.mustQuery("USE orders")
+	c.mustQuery("USE `it's`")
+	want := []string{
+		"CREATE USER 'orders'@'%' IDENTIFIED BY 'pw-orders-svc'",
+		"GRANT ALL ON `orders`.* TO 'orders'@'%'",
+		"CREATE USER 'it''s'@'%' IDENTIFIED BY 'pw-it''s-svc'",
+		"GRANT ALL ON `it's`.* TO 'it''s'@'%'",
+	}
+	if got := userQueries(backend); !equalStrings(got, want) {
+		t.Fatalf("user statements %q, want %q", got, want)
+	}
+
+	// Existing users are left untouched
+	c.mustQuery("USE billing")
+	if got := userQueries(backend); len(got) != len(want) {
+		t.Fatalf("an existing user was changed with %q", got[len(want):])
+	}
+
+	// The created users are registered with their databases, and dropped
+	// with them
+	created, ok := p.created.get("orders")
+	if !ok || created.CreatedUser != "orders" {
+		t.Fatalf("registered %+v", created)
+	}
+	if billing, _ := p.created.get("billing"); billing.CreatedUser != "" {
+		t.Fatalf("registered user %q for an existing user", billing.CreatedUser)
+	}
+	if err := p.dropDatabase(context.Background(), created); err != nil {
+		t.Fatalf("dropDatabase: %v", err)
+	}
+	if !containsString(userQueries(backend), "DROP USER IF EXISTS 'orders'@'%'") {
+		t.Fatal("the created user was not dropped")
+	}
+}
+
+func TestCreateUsersNeedsPassword(t *testing.T) {
+	config := DefaultConfig()
+	config.CreateUsers = true
+	if _, err := New(config); err == nil || !strings.Contains(err.Error(), "CREATE_USERS needs AUTO_USER_PASSWORD") {
+		t.Fatalf("New: %v", err)
+	}
+}
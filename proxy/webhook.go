@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// webhookSignatureHeader carries the HMAC-SHA256 of the body, keyed with
+// WebhookSecret, as "sha256=<hex>"
+const webhookSignatureHeader = "X-Mysql-Autodb-Signature-256"
+
+// webhookAttemptTimeout bounds each delivery attempt
+const webhookAttemptTimeout = 3 * time.Second
+
+// webhookPublisher delivers creation events by POSTing them to a URL,
+// retrying failed deliveries with a doubling backoff
+type webhookPublisher struct {
+	url      string
+	secret   []byte
+	attempts int
+	backoff  time.Duration
+	client   *http.Client
+}
+
+// newWebhookPublisher creates the publisher for WebhookURL
+func newWebhookPublisher(config Config) *webhookPublisher {
+	return &webhookPublisher{
+		url:      config.WebhookURL,
+		secret:   []byte(config.WebhookSecret),
+		attempts: config.WebhookAttempts,
+		backoff:  500 * time.Millisecond,
+		client:   &http.Client{Timeout: webhookAttemptTimeout},
+	}
+}
+
+// webhookURL accepts empty values and http or https URLs
+func webhookURL(value interface{}) error {
+	raw := value.(string)
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("must be an http:// or https:// URL")
+	}
+	return nil
+}
+
+// Publish POSTs the payload, ignoring the topic, until the webhook accepts it,
+// the attempts are used up or ctx expires. Responses other than 5xx and 429
+// are not retried, since sending the same request again would not help.
+func (w *webhookPublisher) Publish(ctx context.Context, _ string, payload []byte) error {
+	backoff := w.backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		if retry, err = w.deliver(ctx, payload); err == nil {
+			return nil
+		}
+		if !retry || attempt >= w.attempts {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return fmt.Errorf("webhook delivery abandoned: %w", err)
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+// deliver makes one delivery attempt, reporting whether a failure may be
+// retried
+func (w *webhookPublisher) deliver(ctx context.Context, payload []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(payload))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mysql-auto-db-proxy/"+Version)
+	if len(w.secret) > 0 {
+		mac := hmac.New(sha256.New, w.secret)
+		mac.Write(payload)
+		req.Header.Set(webhookSignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("webhook request failed: %w", err)
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("webhook answered %s", resp.Status)
+}
+
+// Close releases idle connections to the webhook
+func (w *webhookPublisher) Close() error {
+	w.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,207 @@
+package proxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRecorder is a webhook answering with statuses in turn, then with 200,
+// that records the requests it receives
+type webhookRecorder struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   [][]byte
+	headers  []http.Header
+}
+
+func (w *webhookRecorder) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.bodies = append(w.bodies, body)
+	w.headers = append(w.headers, r.Header.Clone())
+	status := http.StatusOK
+	if len(w.statuses) > 0 {
+		status, w.statuses = w.statuses[0], w.statuses[1:]
+	}
+	rw.WriteHeader(status)
+}
+
+// requests returns the number of requests received
+func (w *webhookRecorder) requests() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.bodies)
+}
+
+// signature returns the signature header expected for body
+func signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	recorder := &webhookRecorder{statuses: []int{500, 503}}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	config := DefaultConfig()
+	config.WebhookURL = server.URL
+	config.WebhookSecret = "s3cret"
+	publisher := newWebhookPublisher(config)
+	publisher.backoff = time.Millisecond
+	defer publisher.Close()
+
+	// 5xx responses are retried until the webhook accepts the event
+	payload := []byte(`{"database":"orders"}`)
+	if err := publisher.Publish(context.Background(), "", payload); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if recorder.requests() != 3 {
+		t.Fatalf("%d requests, want 3", recorder.requests())
+	}
+	for i, header := range recorder.headers {
+		if header.Get("Content-Type") != "application/json" || header.Get(webhookSignatureHeader) != signature("s3cret", payload) {
+			t.Fatalf("request %d sent with %v", i+1, header)
+		}
+	}
+
+	// until the attempts are used up
+	recorder.statuses = []int{500, 500, 500, 500}
+	if err := publisher.Publish(context.Background(), "", payload); err == nil {
+		t.Fatal("Publish succeeded after three 500 responses")
+	}
+	if recorder.requests() != 6 {
+		t.Fatalf("%d requests, want 6", recorder.requests())
+	}
+
+	// and other failures are not retried
+	for _, status := range []int{400, 404} {
+		recorder.statuses = []int{status}
+		requests := recorder.requests()
+		if err := publisher.Publish(context.Background(), "", payload); err == nil {
+			t.Fatalf("Publish succeeded after a %d response", status)
+		}
+		if recorder.requests() != requests+1 {
+			t.Fatalf("a %d response was retried", status)
+		}
+	}
+	recorder.statuses = []int{429}
+	if err := publisher.Publish(context.Background(), "", payload); err != nil {
+		t.Fatalf("Publish after a 429 response: %v", err)
+	}
+
+	// Without a secret, requests are not signed
+	config.WebhookSecret = ""
+	if err := newWebhookPublisher(config).Publish(context.Background(), "", payload); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if header := recorder.headers[len(recorder.headers)-1]; header.Get(webhookSignatureHeader) != "" {
+		t.Fatal("an unsigned request carries a signature")
+	}
+}
+
+func TestWebhookURL(t *testing.T) {
+	for _, value := range []string{"", "http://bot:8080/hooks", "https://bot.example.com/hooks"} {
+		if err := webhookURL(value); err != nil {
+			t.Errorf("rejected %q: %v", value, err)
+		}
+	}
+	for _, value := range []string{"bot:8080", "ftp://bot/hooks", "http:///hooks", "://bot"} {
+		if err := webhookURL(value); err == nil {
+			t.Errorf("accepted %q", value)
+		}
+	}
+}
+
+func TestCreationWebhook(t *testing.T) {
+	recorder := &webhookRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	backend := startFakeMySQL(t)
+	backend.create("existing")
+	config := testConfig(backend)
+	config.WebhookURL = server.URL
+	config.WebhookSecret = "s3cret"
+	config.InstanceID = "proxy-1"
+	p, addr := startProxy(t, config)
+
+	c := mustConnect(t, addr, testHandshake{user: "app", database: "orders"})
+	c.mustQuery("USE existing")
+	eventually(t, "the creation event to be delivered", func() bool { return recorder.requests() == 1 })
+
+	recorder.mu.Lock()
+	body, header := recorder.bodies[0], recorder.headers[0]
+	recorder.mu.Unlock()
+	if header.Get(webhookSignatureHeader) != signature("s3cret", body) {
+		t.Fatal("the event was not signed with WEBHOOK_SECRET")
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatalf("decode event: %v", err)
+	}
+	for key, want := range map[string]interface{}{
+		"database": "orders",
+		"username": "app",
+		"instance": "proxy-1",
+		"backend":  backend.addr(),
+		"trigger":  "handshake",
+	} {
+		if event[key] != want {
+			t.Errorf("event has %s=%v, want %v", key, event[key], want)
+		}
+	}
+	if client, _ := event["client"].(string); client == "" {
+		t.Error("event has no client address")
+	}
+	if timestamp, _ := event["timestamp"].(string); timestamp == "" {
+		t.Error("event has no timestamp")
+	} else if _, err := time.Parse(time.RFC3339Nano, timestamp); err != nil {
+		t.Errorf("event timestamp %q: %v", timestamp, err)
+	}
+
+	// Events are delivered before the proxy finishes shutting down
+	c.mustQuery("USE billing")
+	c.conn.Close()
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+	if recorder.requests() != 2 {
+		t.Fatalf("%d events delivered, want 2", recorder.requests())
+	}
+}
+
+func TestWebhookFailuresDoNotAffectClients(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	backend := startFakeMySQL(t)
+	config := testConfig(backend)
+	config.WebhookURL = server.URL
+	config.WebhookAttempts = 1
+	_, addr := startProxy(t, config)
+
+	start := time.Now()
+	c := mustConnect(t, addr, testHandshake{user: "root", database: "orders"})
+	c.mustQuery("USE billing")
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Fatalf("clients waited %v for the webhook", elapsed)
+	}
+	if !backend.hasDatabase("orders") || !backend.hasDatabase("billing") {
+		t.Fatal("the databases were not created")
+	}
+}